@@ -2,6 +2,12 @@ package main
 
 import (
 	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/controller/bandwidth"
+	"ciccni/pkg/agent/controller/flowsync"
+	"ciccni/pkg/agent/controller/networkpolicy"
+	"ciccni/pkg/agent/controller/noderoute"
+	"ciccni/pkg/agent/controller/podgc"
+	"ciccni/pkg/agent/debugserver"
 	"ciccni/pkg/cniserver"
 	k8sclient "ciccni/pkg/k8s-client"
 	"ciccni/pkg/openflow"
@@ -9,6 +15,7 @@ import (
 	"fmt"
 	"time"
 
+	"k8s.io/client-go/informers"
 	"k8s.io/klog"
 )
 
@@ -34,15 +41,14 @@ func run(opts *Options) error {
 	stopCh := make(chan struct{})
 
 	clientset, err2 := k8sclient.CreateClient()
-	// _ = informers.NewSharedInformerFactory(clientset, informerDefaultResync)
-
 	if err2 != nil {
 		klog.Fatal("[agent.go]-[run]-创建clientset失败")
 	}
+	informerFactory := informers.NewSharedInformerFactory(clientset, informerDefaultResync)
 
 	ifaceStore := agent.NewInterfaceStore()
 
-	ofClient := openflow.NewClient(opts.config.OVSBridge)
+	ofClient := openflow.NewClient(opts.config.OVSBridge, opts.config.OpenFlowBackend == openFlowBackendNative)
 
 	agentInitialize := agent.NewInitializer(clientset, ovsBridgeClient, ifaceStore, ofClient, opts.config.HostGateway, opts.config.DefaultMTU)
 	err2 = agentInitialize.Initialize()
@@ -66,7 +72,53 @@ func run(opts *Options) error {
 		clientset,
 	)
 
+	// 对端node的隧道、arp流表随Node的加入/离开动态维护
+	nodeRouteController := noderoute.NewNodeRouteController(informerFactory.Core().V1().Nodes(), ofClient, nodeConfig)
+
+	// 根据NetworkPolicy为本node上的pod安装ingress/egress规则流表
+	networkPolicyController := networkpolicy.NewNetworkPolicyController(
+		informerFactory.Networking().V1().NetworkPolicies(),
+		informerFactory.Core().V1().Pods(),
+		informerFactory.Core().V1().Namespaces(),
+		ofClient,
+		ifaceStore,
+		nodeConfig,
+	)
+
+	// pod的限速annotation发生变化后，动态修改veth上的tc配置
+	bandwidthController := bandwidth.NewBandwidthController(informerFactory.Core().V1().Pods(), ifaceStore, nodeConfig)
+
+	podGCInterval, err3 := time.ParseDuration(opts.config.PodGCInterval)
+	if err3 != nil {
+		return fmt.Errorf("invalid podGCInterval %s: %v", opts.config.PodGCInterval, err3)
+	}
+	// 回收CNI DEL遗漏的ovs port、pod流表以及ipam分配记录
+	podGCController := podgc.NewPodGCController(clientset, ovsBridgeClient, ofClient, ifaceStore, nodeConfig, opts.config.IPAMType, defaultCNIPath, podGCInterval, opts.config.PodGCDryRun)
+
+	flowSyncInterval, err4 := time.ParseDuration(opts.config.FlowSyncInterval)
+	if err4 != nil {
+		return fmt.Errorf("invalid flowSyncInterval %s: %v", opts.config.FlowSyncInterval, err4)
+	}
+	if flowSyncInterval <= 0 {
+		return fmt.Errorf("invalid flowSyncInterval %s: must be positive", opts.config.FlowSyncInterval)
+	}
+	// 周期性地修复交换机上与缓存不一致的流表
+	flowSyncController := flowsync.NewFlowSyncController(ofClient, flowSyncInterval)
+
+	// 本地调试接口，提供流表状态、流表对账以及孤儿port回收的情况
+	debugServer := debugserver.NewServer(opts.config.DebugAddress, ofClient, flowSyncController, podGCController)
+
 	go cniRPCServer.Run(stopCh)
+	go debugServer.Run(stopCh)
+
+	informerFactory.Start(stopCh)
+	go nodeRouteController.Run(stopCh)
+	go networkPolicyController.Run(stopCh)
+	go bandwidthController.Run(stopCh)
+	go podGCController.Run(stopCh)
+	go flowSyncController.Run(stopCh)
+	// 各个controller按本次的round重新安装流表之后，删除上一次启动遗留的流表
+	go agentInitialize.DeleteStaleFlows(stopCh, nodeRouteController.HasSynced, networkPolicyController.HasSynced)
 
 	<-stopCh
 
@@ -1,6 +1,8 @@
 package main
 
 type AgentConfig struct {
+	// Unix domain socket the agent serves CNI requests on. The ciccni binary reads the same path
+	// from "cniSocket" in the CNI network configuration. Defaults to /var/run/ciccni/cni.sock.
 	CNISocket string `yaml:"cniSocket,omitempty"`
 	// clientConnection specifies the kubeconfig file and client connection settings for the agent
 	// to communicate with the apiserver.
@@ -44,5 +46,27 @@ type AgentConfig struct {
 	// Antrea Agent through an environment variable: ANTREA_IPSEC_PSK.
 	// Defaults to false.
 	EnableIPSecTunnel bool `yaml:"enableIPSecTunnel,omitempty"`
+	// Type of the IPAM used in the CNI network configuration, e.g. "host-local" or "ciccni-ipam".
+	// The agent refuses to start if the type is not registered, or if it delegates to an IPAM
+	// plugin binary that is missing from /opt/cni/bin. The garbage collector also uses it to
+	// release IPAM allocations. Defaults to host-local.
+	IPAMType string `yaml:"ipamType,omitempty"`
+	// Interval of the garbage collector that removes OVS ports, pod flows and IPAM allocations left
+	// behind by Pods that no longer exist on this Node, e.g. "2m". Defaults to 2m.
+	PodGCInterval string `yaml:"podGCInterval,omitempty"`
+	// When enabled, the garbage collector only logs what it would collect without removing anything.
+	// Defaults to false.
+	PodGCDryRun bool `yaml:"podGCDryRun,omitempty"`
+	// Interval of the flow reconciler that compares the flows on the OVS bridge with the flows the agent
+	// installed, re-adds the missing ones and removes the unknown ones, e.g. "5m". Defaults to 5m.
+	FlowSyncInterval string `yaml:"flowSyncInterval,omitempty"`
+	// Local address of the debug HTTP server, which serves the status of the flow tables on
+	// /debug/flowtables (add "?source=switch" to query the counts from OVS) and the status of the flow
+	// reconciler on /debug/flowsync. Defaults to 127.0.0.1:10350.
+	DebugAddress string `yaml:"debugAddress,omitempty"`
+	// How the agent programs OpenFlow flows, supported values:
+	// - command: run ovs-ofctl for every flow, which is slower but easier to debug (default)
+	// - native: keep an OpenFlow 1.3 connection to the bridge's management socket, opt-in
+	OpenFlowBackend string `yaml:"openflowBackend,omitempty"`
 }
 
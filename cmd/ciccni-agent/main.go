@@ -25,7 +25,10 @@ func newAgentCommand() (cmd *cobra.Command) {
 		Long: "The ciccni agent runs on each node.",
 		Run: func(cmd *cobra.Command, args []string) {
 			if err := opts.complete(args); err != nil {
-
+				klog.Fatalf("Failed to complete: %v", err)
+			}
+			if err := opts.validate(args); err != nil {
+				klog.Fatalf("Failed to validate: %v", err)
 			}
 
 			if err := run(opts); err != nil {
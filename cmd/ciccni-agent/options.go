@@ -2,6 +2,8 @@ package main
 
 import (
 	"ciccni/pkg/cni"
+	"ciccni/pkg/cniserver/ipam"
+	"fmt"
 	"os"
 
 	"github.com/spf13/pflag"
@@ -15,6 +17,15 @@ const (
 	defaultServiceCIDR        = "10.96.0.0/12"
 	defaultMTUVxlan           = 1450
 	defaultMTUGeneve          = 1450
+	defaultPodGCInterval      = "2m"
+	defaultFlowSyncInterval   = "5m"
+	defaultDebugAddress       = "127.0.0.1:10350"
+	defaultIPAMType           = ipam.IPAM_HOST_LOCAL
+	defaultCNIPath            = "/opt/cni/bin"
+
+	openFlowBackendNative  = "native"
+	openFlowBackendCommand = "command"
+	defaultOpenFlowBackend = openFlowBackendCommand
 )
 
 type Options struct {
@@ -47,6 +58,16 @@ func (o *Options) complete(args []string) error {
 }
 
 // validate validates all the required options. It must be called after complete.
+func (o *Options) validate(args []string) error {
+	if err := ipam.ValidateIPAMType(o.config.IPAMType, defaultCNIPath); err != nil {
+		return fmt.Errorf("invalid ipamType: %v, registered IPAM drivers: %+v", err, ipam.ListIPAMDrivers())
+	}
+	if o.config.OpenFlowBackend != openFlowBackendNative && o.config.OpenFlowBackend != openFlowBackendCommand {
+		return fmt.Errorf("invalid openflowBackend %s, supported values: %s, %s", o.config.OpenFlowBackend, openFlowBackendNative, openFlowBackendCommand)
+	}
+	return nil
+}
+
 //func (o *Options) validate(args []string) error {
 //	if len(args) != 0 {
 //		return fmt.Errorf("an empty argument list is not supported")
@@ -103,5 +124,20 @@ func (o *Options) setDefaults() {
 	if o.config.DefaultMTU == 0 {
 		o.config.DefaultMTU = defaultMTUVxlan
 	}
+	if o.config.PodGCInterval == "" {
+		o.config.PodGCInterval = defaultPodGCInterval
+	}
+	if o.config.FlowSyncInterval == "" {
+		o.config.FlowSyncInterval = defaultFlowSyncInterval
+	}
+	if o.config.DebugAddress == "" {
+		o.config.DebugAddress = defaultDebugAddress
+	}
+	if o.config.IPAMType == "" {
+		o.config.IPAMType = defaultIPAMType
+	}
+	if o.config.OpenFlowBackend == "" {
+		o.config.OpenFlowBackend = defaultOpenFlowBackend
+	}
 
 }
@@ -11,6 +11,6 @@ func main() {
 		cni.ActionAdd.Request,
 		cni.ActionCheck.Request,
 		cni.ActionDel.Request,
-		cniversion.PluginSupports("0.3.0"),
+		cniversion.PluginSupports(cni.SupportedCNIVersions...),
 		"cic-cni")
 }
@@ -5,20 +5,23 @@ import (
 	"ciccni/pkg/iptables"
 	"ciccni/pkg/link"
 	"ciccni/pkg/openflow"
+	"ciccni/pkg/openflow/cookie"
 	"ciccni/pkg/ovs"
 	"context"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/vishvananda/netlink"
 	"gopkg.in/yaml.v2"
-	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
@@ -30,6 +33,9 @@ const (
 	tunOFPort = 1
 	hostGatewayOFPort = 2
 	maxRetryForHostLink = 5
+	// roundNumKey 网桥external_ids中保存上一次启动的round的key
+	roundNumKey = "roundNum"
+	maxRetryForRoundNumSave = 5
 )
 
 type NodeConfig struct {
@@ -54,6 +60,7 @@ type Initializer struct {
 	ofClient openflow.Client
 	hostGateway string
 	MTU int
+	roundInfo types.RoundInfo
 } 
 
 func NewInitializer(k8sClient kubernetes.Interface, 
@@ -75,8 +82,7 @@ func NewInitializer(k8sClient kubernetes.Interface,
 /** Initialize 对agent进行初始化
   - 节点信息，包括node名、podcidr等信息
   - 安装对应的ovs网桥
-  - 写入基本flow，并缓存arp内容（arp内容会在后续加入节点node的时候进行修改） 
-  TODO：在最初版本中，没有添加新加入节点的时候修改arp流表项；后续我们希望增加这个功能
+  - 写入基本flow。对端node的arp以及隧道流表由noderoute controller负责，node加入或离开时会动态修改
 */
 func (i *Initializer) Initialize() error {
 	// 1. 初始化节点信息
@@ -168,7 +174,7 @@ func (i *Initializer) setUpOVSBridge() error {
 	// }
 
 	// 2. 构造ovs端口cache
-	if err := i.ifaceStore.Initialize(i.ovsBridgeClient, TunPortName); err != nil {
+	if err := i.ifaceStore.Initialize(i.ovsBridgeClient, i.hostGateway, TunPortName); err != nil {
 		klog.Errorf("[agentFunc.go]-[setUpOVSBridge]-无法初始化ifaceStore, err=%v", err)
 		return err
 	}
@@ -204,86 +210,153 @@ func (i *Initializer) setUpTunnelInterface(tunPortName string) error {
 	return nil
 }
 
+// initOpenFlow 安装本地node的ip流表。对端node的隧道以及arp流表由noderoute controller根据Node事件动态维护
 func (i *Initializer) initOpenFlow() error {
-	// 1. 写入发向每个node的arp包
-	nodeList, err := i.k8sClient.CoreV1().Nodes().List(context.TODO(), metaV1.ListOptions{})
-	if err != nil {
-		klog.Errorf("[agentFunc.go]-[initOpenFlow]-获取所有Node列表出错")
+	klog.Infof("[initOpenFlow]-本地node ip流表安装")
+	if err := i.ofClient.InstallLocalIPFlow(i.nodeConfig.NodeName, i.nodeConfig.PodCIDR.String()); err != nil {
+		klog.Errorf("[initOpenFlow]-本地node ip安装失败, podcidr = %s, err = %s", i.nodeConfig.PodCIDR.String(), err)
 		return err
 	}
-
-	i.constructArpOpenflow(nodeList)
-	
-	// 2. 在此处加入发向每个node的ip流表项
-	i.constructIPTunFlow(nodeList)
-	
-	return nil
-	
-}
-
-func (i *Initializer) constructArpOpenflow(nodeList *v1.NodeList) {
-	tunDsts := make([]string, 0)
-
-	// 遍历每一个Node，找到其IP，这个IP将会用作有关ARP的的流表项构建
-	for _, node := range nodeList.Items {
-		if node.Name == i.nodeConfig.NodeName {
+	// agent重启后，为InterfaceStore中恢复的容器接口重新安装pod流表，使得DEL时能够根据缓存删除这些流表。
+	// 这些流表必须在DeleteStaleFlows之前按本次的round重新安装，否则会被当作遗留的流表删除
+	var corednsServiceIP net.IP
+	for _, id := range i.ifaceStore.GetInterfaceIDs() {
+		config, found := i.ifaceStore.GetInterface(id)
+		if !found || config.Type != ContainerInterface {
 			continue
 		}
-
-		// 有没有可能，某个Node没有NodeInternalIP呢？
-		for _, address := range node.Status.Addresses {
-			if address.Type == v1.NodeInternalIP {
-				tunDsts = append(tunDsts, address.Address)
-				break
+		if err := i.ofClient.InstallPodFlows(config.ID, config.IP, config.MAC, i.nodeConfig.Gateway.MAC, uint32(config.OFPort)); err != nil {
+			klog.Errorf("[initOpenFlow]-恢复pod %s/%s 的流表失败, err = %s", config.PodNamespace, config.PodName, err)
+			return err
+		}
+		if !isCorednsPod(config.PodNamespace, config.PodName) {
+			continue
+		}
+		if corednsServiceIP == nil {
+			serviceIP, err := i.getCorednsServiceIP()
+			if err != nil {
+				return err
 			}
+			corednsServiceIP = serviceIP
+		}
+		if err := i.ofClient.InstallCorednsFlow(uint32(config.OFPort), config.ID, corednsServiceIP); err != nil {
+			klog.Errorf("[initOpenFlow]-恢复pod %s/%s 的coreDNS流表失败, err = %s", config.PodNamespace, config.PodName, err)
+			return err
 		}
 	}
-	if len(tunDsts) != 0 {
-		i.ofClient.InstallARPFlow(tunDsts)
-	}	
+	return nil
 }
 
-func (i *Initializer) constructIPTunFlow(nodeList *v1.NodeList) {
-	for _, node := range nodeList.Items {
-		if node.Name == i.nodeConfig.NodeName { // 本地node只需要为ip进行nromal操作即可
-			klog.Infof("[constructIPTunFlow]-本地node ip流表安装")
-			err := i.ofClient.InstallLocalIPFlow(node.Name, i.nodeConfig.PodCIDR.String())
-			if err != nil {
-				klog.Errorf("[constructIPTunFlow]-本地node ip安装失败, podcidr = %s, err = %s", i.nodeConfig.PodCIDR.String(), err)
-			}
-		} else {
-			var nodeAddress net.IP
-			for _, address := range node.Status.Addresses {
-				if address.Type == v1.NodeInternalIP {
-					nodeAddress = net.ParseIP(address.Address)
-					break
-				}
-			}
-			if nodeAddress != nil {
-				klog.Infof("[constructIPTunFlow]-node: %s ip流表安装", node.Name)
-				err := i.ofClient.InstallTunFlow(node.Spec.PodCIDR, 0, nodeAddress)
-				if err != nil {
-					klog.Errorf("[constructIPTunFlow]-node %s ip安装失败, err = %s", nodeAddress, err)
-				}
-			} else {
-				klog.Errorf("[agentFunc.go]-[constructIPTunFlow]-为node:%s安装ip流表规则出错", node.Name)
-			}
-		}
+// isCorednsPod 与cniserver中的判断保持一致，kube-system下名称以coredns开头的pod需要额外安装coreDNS流表
+func isCorednsPod(podNamespace, podName string) bool {
+	return podNamespace == "kube-system" && strings.HasPrefix(podName, "coredns")
+}
+
+// getCorednsServiceIP 获取kube-dns服务的ClusterIP
+func (i *Initializer) getCorednsServiceIP() (net.IP, error) {
+	kubedns, err := i.k8sClient.CoreV1().Services("kube-system").Get(context.TODO(), "kube-dns", metaV1.GetOptions{})
+	if err != nil {
+		klog.Errorf("[getCorednsServiceIP]-无法获取kube-dns服务, err = %s", err)
+		return nil, err
 	}
+	serviceIP := net.ParseIP(kubedns.Spec.ClusterIP)
+	if serviceIP == nil {
+		return nil, fmt.Errorf("[getCorednsServiceIP]-kube-dns服务的ClusterIP %q 不合法", kubedns.Spec.ClusterIP)
+	}
+	return serviceIP, nil
 }
 
 func (i *Initializer) setUpFlow() error {
+	roundInfo, err := getRoundInfo(i.ovsBridgeClient)
+	if err != nil {
+		return err
+	}
+	i.roundInfo = roundInfo
+	klog.Infof("[setUpFlow]-本次启动的round为%d", roundInfo.RoundNum)
 	// 写入基本的openflow流表项
-	if err := i.ofClient.Initialize(); err != nil {
+	if err := i.ofClient.Initialize(roundInfo); err != nil {
 		klog.Errorf("[Initialize]-ofClient.Initalize()失败， err = %s", err)
 		return err
 	}
+	// classifierTable默认丢弃未分类的流量，因此需要先为gateway以及tunnel端口安装classifier流表
+	gatewayIface, found := i.ifaceStore.GetInterface(i.hostGateway)
+	if !found {
+		return fmt.Errorf("gateway port %s not found in interface store", i.hostGateway)
+	}
+	if err := i.ofClient.InstallGatewayFlows(i.nodeConfig.Gateway.IP, i.nodeConfig.Gateway.MAC, uint32(gatewayIface.OFPort)); err != nil {
+		klog.Errorf("[setUpFlow]-安装gateway流表失败, err = %s", err)
+		return err
+	}
+	tunnelIface, found := i.ifaceStore.GetInterface(TunPortName)
+	if !found {
+		return fmt.Errorf("tunnel port %s not found in interface store", TunPortName)
+	}
+	if err := i.ofClient.InstallTunnelFlows(uint32(tunnelIface.OFPort)); err != nil {
+		klog.Errorf("[setUpFlow]-安装tunnel流表失败, err = %s", err)
+		return err
+	}
 	if err := i.initOpenFlow(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// getRoundInfo 从网桥的external_ids中读取上一次启动的round，并计算出本次的round。
+// 引入cookie之前安装的流表cookie均为0，因此没有记录时按上一个round为0处理，使这些流表同样能被清理
+func getRoundInfo(bridgeClient ovs.OVSBridgeClient) (types.RoundInfo, error) {
+	externalIDs, err := bridgeClient.GetExternalIDs()
+	if err != nil {
+		return types.RoundInfo{}, fmt.Errorf("[getRoundInfo]-获取网桥external_ids失败: %v", err)
+	}
+	var prevRoundNum uint64
+	if value, ok := externalIDs[roundNumKey]; ok {
+		num, parseErr := strconv.ParseUint(value, 10, 64)
+		if parseErr != nil {
+			return types.RoundInfo{}, fmt.Errorf("[getRoundInfo]-网桥external_ids中的%s=%s不合法: %v", roundNumKey, value, parseErr)
+		}
+		prevRoundNum = num
+	}
+	return types.RoundInfo{RoundNum: cookie.NextRound(prevRoundNum), PrevRoundNum: &prevRoundNum}, nil
+}
+
+// persistRoundNum 将round写入网桥的external_ids，SetExternalIDs会覆盖整个external_ids，因此需要保留其他的key
+func persistRoundNum(roundNum uint64, bridgeClient ovs.OVSBridgeClient) error {
+	var lastErr error
+	for retry := 0; retry < maxRetryForRoundNumSave; retry++ {
+		externalIDs, err := bridgeClient.GetExternalIDs()
+		if err == nil {
+			updated := make(map[string]interface{}, len(externalIDs)+1)
+			for k, v := range externalIDs {
+				updated[k] = v
+			}
+			updated[roundNumKey] = strconv.FormatUint(roundNum, 10)
+			if err = bridgeClient.SetExternalIDs(updated); err == nil {
+				return nil
+			}
+		}
+		lastErr = err
+		klog.Warningf("[persistRoundNum]-保存round失败, 重试中, err = %s", err)
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("[persistRoundNum]-保存round %d失败: %v", roundNum, lastErr)
+}
+
+// DeleteStaleFlows 等待synced全部返回true，即各个controller都按本次的round重新安装了流表之后，删除上一个round遗留的流表。
+// 遗留的流表删除成功之后才保存本次的round：agent在此之前退出时，下次启动仍然以上一个round为基准清理遗留的流表
+func (i *Initializer) DeleteStaleFlows(stopCh <-chan struct{}, synced ...cache.InformerSynced) {
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return
+	}
+	klog.Infof("[DeleteStaleFlows]-删除round %d遗留的流表", *i.roundInfo.PrevRoundNum)
+	if err := i.ofClient.DeleteStaleFlows(); err != nil {
+		klog.Errorf("[DeleteStaleFlows]-删除遗留的流表失败, err = %s", err)
+		return
+	}
+	if err := persistRoundNum(i.roundInfo.RoundNum, i.ovsBridgeClient); err != nil {
+		klog.Errorf("[DeleteStaleFlows]-%s", err)
+	}
+}
+
 // getNodeName 尝试通过环境变量获取nodeName。注意，这个环境变量应该通过yaml文件中进行配置
 func getNodeName() (string, error) {
 	nodeName := os.Getenv(NodeNameEnvKey)
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"ciccni/pkg/openflow"
+	"ciccni/pkg/ovs"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeOFClient 记录恢复的pod以及coreDNS流表，其余方法不会被测试调用
+type fakeOFClient struct {
+	openflow.Client
+	podFlows     []string
+	corednsFlows map[string]string
+	staleErr     error
+}
+
+func (f *fakeOFClient) InstallLocalIPFlow(nodeName string, podCIDR string) error {
+	return nil
+}
+
+func (f *fakeOFClient) InstallPodFlows(containerID string, podIP net.IP, podMAC, gatewayMAC net.HardwareAddr, ofPort uint32) error {
+	f.podFlows = append(f.podFlows, containerID)
+	return nil
+}
+
+func (f *fakeOFClient) InstallCorednsFlow(ofPortNum uint32, containerID string, serviceIP net.IP) error {
+	f.corednsFlows[containerID] = serviceIP.String()
+	return nil
+}
+
+func (f *fakeOFClient) DeleteStaleFlows() error {
+	return f.staleErr
+}
+
+// fakeOVSBridgeClient 只实现了读写网桥external_ids
+type fakeOVSBridgeClient struct {
+	ovs.OVSBridgeClient
+	externalIDs map[string]string
+}
+
+func (f *fakeOVSBridgeClient) GetExternalIDs() (map[string]string, ovs.Error) {
+	return f.externalIDs, nil
+}
+
+func (f *fakeOVSBridgeClient) SetExternalIDs(externalIDs map[string]interface{}) ovs.Error {
+	f.externalIDs = map[string]string{}
+	for k, v := range externalIDs {
+		f.externalIDs[k] = v.(string)
+	}
+	return nil
+}
+
+func TestInitOpenFlowRestoresCorednsFlows(t *testing.T) {
+	kubedns := &v1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "kube-system", Name: "kube-dns"},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10"},
+	}
+	ofClient := &fakeOFClient{corednsFlows: map[string]string{}}
+	ifaceStore := NewInterfaceStore()
+	addContainer := func(id, podName, podNamespace string, ofPort int32) {
+		config := NewContainerInterfaceConfig(id, podName, podNamespace, "", nil, net.ParseIP("10.244.1.2"))
+		config.OVSPortConfig = &OVSPortConfig{IfaceName: id, OFPort: ofPort}
+		ifaceStore.AddInterface(id, config)
+	}
+	addContainer("c-coredns", "coredns-5d78c9869d-abcde", "kube-system", 3)
+	addContainer("c-nginx", "nginx-7c5ddbdf54-abcde", "default", 4)
+	addContainer("c-fake", "coredns-fake", "default", 5)
+
+	_, podCIDR, _ := net.ParseCIDR("10.244.1.0/24")
+	i := &Initializer{
+		k8sClient:  fake.NewSimpleClientset(kubedns),
+		ifaceStore: ifaceStore,
+		ofClient:   ofClient,
+		nodeConfig: &NodeConfig{NodeName: "node1", PodCIDR: podCIDR, Gateway: &Gateway{}},
+	}
+	require.NoError(t, i.initOpenFlow())
+	require.ElementsMatch(t, []string{"c-coredns", "c-nginx", "c-fake"}, ofClient.podFlows)
+	// 只有kube-system下的coredns pod会恢复coreDNS流表，serviceIP为kube-dns的ClusterIP
+	require.Equal(t, map[string]string{"c-coredns": "10.96.0.10"}, ofClient.corednsFlows)
+}
+
+func TestDeleteStaleFlowsPersistsRound(t *testing.T) {
+	bridge := &fakeOVSBridgeClient{externalIDs: map[string]string{"foo": "bar"}}
+	roundInfo, err := getRoundInfo(bridge)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), *roundInfo.PrevRoundNum)
+
+	// 删除遗留流表失败时不保存round，下次启动仍然清理上一个round的流表
+	ofClient := &fakeOFClient{staleErr: errors.New("failed")}
+	i := &Initializer{ovsBridgeClient: bridge, ofClient: ofClient, roundInfo: roundInfo}
+	i.DeleteStaleFlows(nil)
+	require.Equal(t, map[string]string{"foo": "bar"}, bridge.externalIDs)
+
+	ofClient.staleErr = nil
+	i.DeleteStaleFlows(nil)
+	next, err := getRoundInfo(bridge)
+	require.NoError(t, err)
+	require.Equal(t, roundInfo.RoundNum, *next.PrevRoundNum)
+	require.Equal(t, "bar", bridge.externalIDs["foo"])
+}
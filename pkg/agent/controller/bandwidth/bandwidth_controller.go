@@ -0,0 +1,241 @@
+package bandwidth
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/tctools"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	controllerName = "BandwidthController"
+	// 处理失败的pod会以指数退避的方式重新入队
+	minRetryDelay = 2 * time.Second
+	maxRetryDelay = 120 * time.Second
+	// 同一个pod不会被多个worker同时处理
+	defaultWorkers = 2
+)
+
+// Controller 监听本node上pod的限速annotation，annotation被添加、修改或者删除后，
+// 进入pod的netns替换或删除容器端veth上的htb class与过滤器，并同步host端veth上的入方向限速。
+// pod创建时的限速由CNI ADD根据annotation配置，这里只负责之后的变化
+type Controller struct {
+	nodeConfig      *agent.NodeConfig
+	ifaceStore      agent.InterfaceStore
+	podLister       corelisters.PodLister
+	podListerSynced cache.InformerSynced
+	queue           workqueue.RateLimitingInterface
+	// applyIngressRateFunc、deleteRootFunc 配置host端veth上的入方向限速，默认为tctools中的实现
+	applyIngressRateFunc func(ifName string, rate uint64, burst uint64) error
+	deleteRootFunc       func(ifName string) error
+}
+
+// NewBandwidthController 创建Controller，并在podInformer上注册事件处理函数
+func NewBandwidthController(
+	podInformer coreinformers.PodInformer,
+	ifaceStore agent.InterfaceStore,
+	nodeConfig *agent.NodeConfig) *Controller {
+	controller := &Controller{
+		nodeConfig:      nodeConfig,
+		ifaceStore:      ifaceStore,
+		podLister:       podInformer.Lister(),
+		podListerSynced: podInformer.Informer().HasSynced,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(minRetryDelay, maxRetryDelay), "bandwidth"),
+
+		applyIngressRateFunc: tctools.ApplyIngressRate,
+		deleteRootFunc:       tctools.DeleteRootFromInterface,
+	}
+	podInformer.Informer().AddEventHandlerWithResyncPeriod(
+		cache.ResourceEventHandlerFuncs{
+			// agent重启期间annotation可能发生了变化，因此启动时会检查本node上的所有pod
+			AddFunc: func(cur interface{}) {
+				controller.enqueuePod(cur)
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldPod, ok1 := old.(*v1.Pod)
+				curPod, ok2 := cur.(*v1.Pod)
+				if ok1 && ok2 && !bandwidthAnnotationsChanged(oldPod, curPod) {
+					return
+				}
+				controller.enqueuePod(cur)
+			},
+		},
+		0,
+	)
+	return controller
+}
+
+// bandwidthAnnotationsChanged 判断两个版本的pod之间限速相关的annotation是否发生了变化
+func bandwidthAnnotationsChanged(oldPod, curPod *v1.Pod) bool {
+	for _, key := range tctools.BandwidthAnnotations {
+		oldValue, oldOK := oldPod.Annotations[key]
+		curValue, curOK := curPod.Annotations[key]
+		if oldOK != curOK || oldValue != curValue {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueuePod 将本node上非hostNetwork的pod加入工作队列
+func (c *Controller) enqueuePod(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	if pod.Spec.NodeName != c.nodeConfig.NodeName || pod.Spec.HostNetwork {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		klog.Errorf("[enqueuePod]-无法获取pod的key, pod=%s/%s, err=%s", pod.Namespace, pod.Name, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run 等待informer同步完成后启动worker，直到stopCh关闭
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("[bandwidth_controller.go]-[Run]-启动%s", controllerName)
+	defer klog.Infof("[bandwidth_controller.go]-[Run]-关闭%s", controllerName)
+
+	if !cache.WaitForNamedCacheSync(controllerName, stopCh, c.podListerSynced) {
+		return
+	}
+
+	for i := 0; i < defaultWorkers; i++ {
+		go wait.Until(c.worker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (c *Controller) worker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.queue.Forget(obj)
+		klog.Errorf("[processNextWorkItem]-工作队列中出现非string类型的key: %v", obj)
+		return true
+	}
+	if err := c.syncPodBandwidth(key); err != nil {
+		klog.Errorf("[processNextWorkItem]-同步pod %s的限速配置失败, 稍后重试, err=%s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// syncPodBandwidth 按照pod当前的annotation配置容器端以及host端veth上的限速，没有对应annotation时删除已有的配置
+func (c *Controller) syncPodBandwidth(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		// veth会随着CNI DEL一起删除，不需要处理
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	iface, ok := c.ifaceStore.GetContainerInterface(name, namespace)
+	if !ok || iface.OVSPortConfig == nil {
+		// CNI ADD还没有完成，CNI ADD会根据最新的annotation进行配置
+		klog.V(2).Infof("[syncPodBandwidth]-pod %s的接口尚未创建, 跳过", key)
+		return nil
+	}
+
+	tcArgs, err := tctools.ParseTcAnnotations(pod.Annotations)
+	if err != nil {
+		// annotation格式错误时重试也无法成功，等待用户修改annotation
+		klog.Errorf("[syncPodBandwidth]-解析pod %s的限速annotation失败, err=%s", key, err)
+		return nil
+	}
+	if tcArgs == nil {
+		tcArgs = &tctools.TCArgs{Scope: tctools.EgressScopeAll}
+	}
+
+	if tcArgs.IngressRate > 0 {
+		err = c.applyIngressRateFunc(iface.IfaceName, tcArgs.IngressRate, tcArgs.IngressBurst)
+	} else {
+		err = c.deleteRootFunc(iface.IfaceName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to configure ingress bandwidth on %s: %v", iface.IfaceName, err)
+	}
+
+	if iface.NetNS == "" {
+		// 旧版本创建的port没有记录容器的netns，无法进入容器修改出方向限速
+		klog.Warningf("[syncPodBandwidth]-pod %s 的接口没有记录netns, 跳过出方向限速", key)
+		return nil
+	}
+	hostLink, err := net.InterfaceByName(iface.IfaceName)
+	if err != nil {
+		return err
+	}
+	return ns.WithNetNSPath(iface.NetNS, func(_ ns.NetNS) error {
+		containerIfName, err := getPeerInterfaceName(hostLink.Index)
+		if err != nil {
+			return err
+		}
+		if tcArgs.Rate > 0 {
+			err = tctools.ApplyEgressRate(containerIfName, tcArgs, c.nodeConfig.ClusterPodCIDR)
+		} else {
+			err = tctools.DeleteRootFromInterface(containerIfName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to configure egress bandwidth on %s in netns %s: %v", containerIfName, iface.NetNS, err)
+		}
+		klog.Infof("[syncPodBandwidth]-已更新pod %s的限速配置, egress=%d, ingress=%d", key, tcArgs.Rate, tcArgs.IngressRate)
+		return nil
+	})
+}
+
+// getPeerInterfaceName 在当前netns中查找对端ifindex为peerIndex的veth，返回其名称
+func getPeerInterfaceName(peerIndex int) (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		veth, ok := link.(*netlink.Veth)
+		if !ok {
+			continue
+		}
+		index, err := netlink.VethPeerIndex(veth)
+		if err != nil {
+			continue
+		}
+		if index == peerIndex {
+			return veth.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no veth with peer index %d found", peerIndex)
+}
@@ -0,0 +1,97 @@
+package bandwidth
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/util"
+	"ciccni/pkg/tctools"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name string, nodeName string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+	}
+}
+
+func TestBandwidthAnnotationsChanged(t *testing.T) {
+	rate := map[string]string{tctools.EgressRateAnnotation: "10m"}
+	tests := []struct {
+		name    string
+		old     map[string]string
+		cur     map[string]string
+		changed bool
+	}{
+		{"added", nil, rate, true},
+		{"removed", rate, nil, true},
+		{"modified", rate, map[string]string{tctools.EgressRateAnnotation: "20m"}, true},
+		{"scope added", rate, map[string]string{tctools.EgressRateAnnotation: "10m", tctools.EgressScopeAnnotation: "cluster"}, true},
+		{"ingress added", rate, map[string]string{tctools.EgressRateAnnotation: "10m", tctools.IngressRateAnnotation: "1m"}, true},
+		{"kubernetes annotation added", rate, map[string]string{tctools.EgressRateAnnotation: "10m", tctools.KubernetesIngressBandwidthAnnotation: "1M"}, true},
+		{"unchanged", rate, map[string]string{tctools.EgressRateAnnotation: "10m"}, false},
+		{"unrelated", rate, map[string]string{tctools.EgressRateAnnotation: "10m", "foo": "bar"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.changed, bandwidthAnnotationsChanged(newPod("web", "node1", tt.old), newPod("web", "node1", tt.cur)))
+		})
+	}
+}
+
+func TestEnqueuePod(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	c := NewBandwidthController(informerFactory.Core().V1().Pods(), agent.NewInterfaceStore(), &agent.NodeConfig{NodeName: "node1"})
+
+	c.enqueuePod(newPod("remote", "node2", nil))
+	hostNetworkPod := newPod("host", "node1", nil)
+	hostNetworkPod.Spec.HostNetwork = true
+	c.enqueuePod(hostNetworkPod)
+	require.Equal(t, 0, c.queue.Len())
+
+	c.enqueuePod(newPod("web", "node1", nil))
+	require.Equal(t, 1, c.queue.Len())
+	key, _ := c.queue.Get()
+	require.Equal(t, "default/web", key)
+
+	// 接口尚未创建的pod直接跳过，等待CNI ADD根据annotation配置
+	require.NoError(t, informerFactory.Core().V1().Pods().Informer().GetIndexer().Add(newPod("web", "node1", map[string]string{tctools.EgressRateAnnotation: "10m"})))
+	require.NoError(t, c.syncPodBandwidth("default/web"))
+	// pod已经删除时不需要处理
+	require.NoError(t, c.syncPodBandwidth("default/gone"))
+}
+
+func TestSyncPodBandwidthWithoutNetNS(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	podInformer := informerFactory.Core().V1().Pods()
+	ifaceStore := agent.NewInterfaceStore()
+	c := NewBandwidthController(podInformer, ifaceStore, &agent.NodeConfig{NodeName: "node1"})
+	var applied, deleted []string
+	c.applyIngressRateFunc = func(ifName string, rate uint64, burst uint64) error {
+		applied = append(applied, fmt.Sprintf("%s/%d/%d", ifName, rate, burst))
+		return nil
+	}
+	c.deleteRootFunc = func(ifName string) error {
+		deleted = append(deleted, ifName)
+		return nil
+	}
+
+	// 旧版本创建的port没有记录netns，入方向限速仍然会被更新，只跳过出方向
+	iface := agent.NewContainerInterfaceConfig("c0ffee", "web", "default", "", nil, nil)
+	iface.OVSPortConfig = &agent.OVSPortConfig{IfaceName: "web-abcd", OFPort: 3}
+	ifaceStore.AddInterface(util.GenerateContainerInterfaceName("web", "default"), iface)
+	podStore := podInformer.Informer().GetIndexer()
+	require.NoError(t, podStore.Add(newPod("web", "node1", map[string]string{tctools.IngressRateAnnotation: "8kbit"})))
+	require.NoError(t, c.syncPodBandwidth("default/web"))
+	require.Equal(t, []string{"web-abcd/1000/100"}, applied)
+
+	require.NoError(t, podStore.Update(newPod("web", "node1", nil)))
+	require.NoError(t, c.syncPodBandwidth("default/web"))
+	require.Equal(t, []string{"web-abcd"}, deleted)
+}
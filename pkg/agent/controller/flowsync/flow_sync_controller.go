@@ -0,0 +1,91 @@
+package flowsync
+
+import (
+	"sync"
+	"time"
+
+	"ciccni/pkg/openflow"
+	binding "ciccni/pkg/ovs/openflow"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const controllerName = "FlowSyncController"
+
+// Status 记录流表对账的情况，Missing、Mismatched、Unknown为累计修复的流表数
+type Status struct {
+	Rounds     uint64 `json:"rounds"`
+	Failures   uint64 `json:"failures"`
+	Missing    uint64 `json:"missing"`
+	Mismatched uint64 `json:"mismatched"`
+	Unknown    uint64 `json:"unknown"`
+	// LastSyncTime 最近一次对账成功的时间
+	LastSyncTime time.Time `json:"lastSyncTime"`
+	// LastResult 最近一次成功的对账发现的差异
+	LastResult binding.FlowSyncResult `json:"lastResult"`
+	// LastError 最近一次对账失败的原因，对账成功后清空
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Controller 周期性地从网桥上dump出本次round的流表，与ofClient缓存中的流表对比，
+// 补装缺失的流表并删除缓存中没有的流表，修复ovs-vswitchd重启或者被手动修改造成的流表偏差
+type Controller struct {
+	ofClient openflow.Client
+	interval time.Duration
+
+	statusLock sync.Mutex
+	status     Status
+}
+
+func NewFlowSyncController(ofClient openflow.Client, interval time.Duration) *Controller {
+	return &Controller{
+		ofClient: ofClient,
+		interval: interval,
+	}
+}
+
+// Run 每隔interval对账一次，第一次对账在启动interval之后进行，此时各个controller已经完成了流表的安装
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	klog.Infof("[flow_sync_controller.go]-[Run]-启动%s, interval = %v", controllerName, c.interval)
+	defer klog.Infof("[flow_sync_controller.go]-[Run]-关闭%s", controllerName)
+	select {
+	case <-time.After(c.interval):
+	case <-stopCh:
+		return
+	}
+	wait.Until(c.sync, c.interval, stopCh)
+}
+
+// GetStatus 返回对账情况的快照
+func (c *Controller) GetStatus() Status {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.status
+}
+
+func (c *Controller) sync() {
+	result, err := c.ofClient.ReconcileFlows()
+
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.status.Rounds++
+	if err != nil {
+		klog.Errorf("[sync]-第%d轮流表对账失败, err=%s", c.status.Rounds, err)
+		c.status.Failures++
+		c.status.LastError = err.Error()
+		return
+	}
+	c.status.Missing += uint64(result.Missing)
+	c.status.Mismatched += uint64(result.Mismatched)
+	c.status.Unknown += uint64(result.Unknown)
+	c.status.LastSyncTime = time.Now()
+	c.status.LastResult = result
+	c.status.LastError = ""
+	if result.Missing+result.Mismatched+result.Unknown > 0 {
+		klog.Warningf("[sync]-第%d轮流表对账发现偏差并已修复, missing = %d, mismatched = %d, unknown = %d",
+			c.status.Rounds, result.Missing, result.Mismatched, result.Unknown)
+		return
+	}
+	klog.V(2).Infof("[sync]-第%d轮流表对账结束, 没有发现偏差", c.status.Rounds)
+}
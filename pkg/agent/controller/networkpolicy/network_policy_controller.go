@@ -0,0 +1,817 @@
+package networkpolicy
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/types"
+	"ciccni/pkg/openflow"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	networkinginformers "k8s.io/client-go/informers/networking/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	controllerName = "NetworkPolicyController"
+	// 处理失败的policy会以指数退避的方式重新入队
+	minRetryDelay = 2 * time.Second
+	maxRetryDelay = 120 * time.Second
+	// 同一个policy不会被多个worker同时处理；多个rule共用的conjunctive match流表由ofClient内部加锁保护
+	defaultWorkers = 4
+)
+
+// allIPNet 对应未配置from/to的rule，表示允许所有地址
+var allIPNet = net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+
+// Controller 监听NetworkPolicy、Pod以及Namespace的变化，为本node上被policy选中的pod计算出types.PolicyRule，
+// 并通过ofClient安装到ingressRule/egressRule等表中。
+// 被选中的本地pod使用OFPortAddress进行匹配；peer中的pod（无论是否在本node上）使用IPAddress进行匹配，
+// 因为egress表位于l2ForwardingCalc之前，此时还无法通过目的ofport进行匹配
+type Controller struct {
+	ofClient   openflow.Client
+	ifaceStore agent.InterfaceStore
+	nodeConfig *agent.NodeConfig
+
+	policyLister    networkinglisters.NetworkPolicyLister
+	podLister       corelisters.PodLister
+	namespaceLister corelisters.NamespaceLister
+	listersSynced   []cache.InformerSynced
+	queue           workqueue.RateLimitingInterface
+
+	// rulesLock 保护installedRules以及nextRuleID
+	rulesLock sync.Mutex
+	// installedRules 记录已经安装的rule，key为policy的namespace/name，value为rule名称到rule的映射
+	installedRules map[string]map[string]*types.PolicyRule
+	// nextRuleID 用于分配conjunction id，0不是合法的conjunction id
+	nextRuleID uint32
+	// initialLock 保护initialPolicies
+	initialLock sync.Mutex
+	// initialPolicies informer同步完成时尚未成功同步过的policy，为nil表示informer还未同步完成
+	initialPolicies map[string]struct{}
+}
+
+// NewNetworkPolicyController 创建Controller，并在各个informer上注册事件处理函数
+func NewNetworkPolicyController(
+	policyInformer networkinginformers.NetworkPolicyInformer,
+	podInformer coreinformers.PodInformer,
+	namespaceInformer coreinformers.NamespaceInformer,
+	ofClient openflow.Client,
+	ifaceStore agent.InterfaceStore,
+	nodeConfig *agent.NodeConfig) *Controller {
+	controller := &Controller{
+		ofClient:        ofClient,
+		ifaceStore:      ifaceStore,
+		nodeConfig:      nodeConfig,
+		policyLister:    policyInformer.Lister(),
+		podLister:       podInformer.Lister(),
+		namespaceLister: namespaceInformer.Lister(),
+		listersSynced: []cache.InformerSynced{
+			policyInformer.Informer().HasSynced,
+			podInformer.Informer().HasSynced,
+			namespaceInformer.Informer().HasSynced,
+		},
+		queue:          workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(minRetryDelay, maxRetryDelay), "networkpolicy"),
+		installedRules: map[string]map[string]*types.PolicyRule{},
+		nextRuleID:     1,
+	}
+	// policy的resync事件也会入队，用于补上pod的ovs port晚于pod事件创建的情况
+	policyInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: controller.enqueuePolicy,
+			UpdateFunc: func(old, cur interface{}) {
+				controller.enqueuePolicy(cur)
+			},
+			DeleteFunc: controller.enqueuePolicy,
+		},
+	)
+	podInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(cur interface{}) {
+				controller.enqueueAllPolicies()
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldPod, ok1 := old.(*v1.Pod)
+				curPod, ok2 := cur.(*v1.Pod)
+				// 只有label、ip或者所在node发生变化时，pod才会影响policy的计算结果
+				if ok1 && ok2 && oldPod.Status.PodIP == curPod.Status.PodIP && oldPod.Spec.NodeName == curPod.Spec.NodeName &&
+					labels.Equals(oldPod.Labels, curPod.Labels) {
+					return
+				}
+				controller.enqueueAllPolicies()
+			},
+			DeleteFunc: func(old interface{}) {
+				controller.enqueueAllPolicies()
+			},
+		},
+	)
+	namespaceInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(cur interface{}) {
+				controller.enqueueAllPolicies()
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldNS, ok1 := old.(*v1.Namespace)
+				curNS, ok2 := cur.(*v1.Namespace)
+				if ok1 && ok2 && labels.Equals(oldNS.Labels, curNS.Labels) {
+					return
+				}
+				controller.enqueueAllPolicies()
+			},
+			DeleteFunc: func(old interface{}) {
+				controller.enqueueAllPolicies()
+			},
+		},
+	)
+	return controller
+}
+
+func (c *Controller) enqueuePolicy(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("[enqueuePolicy]-无法获取policy的key, obj=%v, err=%s", obj, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueAllPolicies pod或namespace变化时，由于namespaceSelector可以跨namespace选择pod，所有policy都需要重新计算
+func (c *Controller) enqueueAllPolicies() {
+	policies, err := c.policyLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[enqueueAllPolicies]-获取policy列表失败, err=%s", err)
+		return
+	}
+	for _, policy := range policies {
+		c.enqueuePolicy(policy)
+	}
+}
+
+// Run 等待informer同步完成后启动worker，直到stopCh关闭
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("[network_policy_controller.go]-[Run]-启动%s", controllerName)
+	defer klog.Infof("[network_policy_controller.go]-[Run]-关闭%s", controllerName)
+
+	if !cache.WaitForNamedCacheSync(controllerName, stopCh, c.listersSynced...) {
+		return
+	}
+	if err := c.recordInitialPolicies(); err != nil {
+		klog.Errorf("[Run]-获取policy列表失败, err=%s", err)
+		return
+	}
+
+	for i := 0; i < defaultWorkers; i++ {
+		go wait.Until(c.worker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (c *Controller) worker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.queue.Forget(obj)
+		klog.Errorf("[processNextWorkItem]-工作队列中出现非string类型的key: %v", obj)
+		return true
+	}
+	if err := c.syncNetworkPolicy(key); err != nil {
+		klog.Errorf("[processNextWorkItem]-同步policy %s的流表失败, 稍后重试, err=%s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	c.initialLock.Lock()
+	delete(c.initialPolicies, key)
+	c.initialLock.Unlock()
+	return true
+}
+
+// recordInitialPolicies 记录informer同步完成时已经存在的policy
+func (c *Controller) recordInitialPolicies() error {
+	policies, err := c.policyLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	initialPolicies := make(map[string]struct{}, len(policies))
+	for _, policy := range policies {
+		key, err := cache.MetaNamespaceKeyFunc(policy)
+		if err != nil {
+			return err
+		}
+		initialPolicies[key] = struct{}{}
+	}
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	c.initialPolicies = initialPolicies
+	return nil
+}
+
+// HasSynced 启动时已经存在的policy的流表全部安装成功之后返回true
+func (c *Controller) HasSynced() bool {
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	return c.initialPolicies != nil && len(c.initialPolicies) == 0
+}
+
+// syncNetworkPolicy 根据informer缓存中policy的最新状态计算出期望的rule集合，与已安装的rule进行比较：
+// 多余的rule被卸载，新的rule被安装，只有from/to地址变化的rule通过增删地址的方式更新
+func (c *Controller) syncNetworkPolicy(key string) error {
+	startTime := time.Now()
+	defer func() {
+		klog.V(4).Infof("[syncNetworkPolicy]-同步policy %s 耗时 %v", key, time.Since(startTime))
+	}()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	desired := map[string]*types.PolicyRule{}
+	policy, err := c.policyLister.NetworkPolicies(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if desired, err = c.computeRules(policy); err != nil {
+			return err
+		}
+	}
+
+	installed := c.getInstalledRules(key)
+	for ruleName, rule := range installed {
+		if _, ok := desired[ruleName]; ok {
+			continue
+		}
+		klog.Infof("[syncNetworkPolicy]-卸载policy %s 的rule %s, id=%d", key, ruleName, rule.ID)
+		if err := c.ofClient.UninstallPolicyRuleFlows(rule.ID); err != nil {
+			return fmt.Errorf("failed to uninstall rule %s of NetworkPolicy %s: %v", ruleName, key, err)
+		}
+		c.setInstalledRule(key, ruleName, nil)
+	}
+
+	for ruleName, rule := range desired {
+		if old, ok := installed[ruleName]; ok {
+			if sameRuleShape(old, rule) {
+				rule.ID = old.ID
+				if err := c.updateRuleAddresses(old, rule); err != nil {
+					return fmt.Errorf("failed to update rule %s of NetworkPolicy %s: %v", ruleName, key, err)
+				}
+				c.setInstalledRule(key, ruleName, rule)
+				continue
+			}
+			if err := c.ofClient.UninstallPolicyRuleFlows(old.ID); err != nil {
+				return fmt.Errorf("failed to uninstall rule %s of NetworkPolicy %s: %v", ruleName, key, err)
+			}
+			c.setInstalledRule(key, ruleName, nil)
+		}
+		rule.ID = c.allocateRuleID()
+		klog.Infof("[syncNetworkPolicy]-安装policy %s 的rule %s, id=%d", key, ruleName, rule.ID)
+		if err := c.ofClient.InstallPolicyRuleFlows(rule); err != nil {
+			// 安装了一半的流表需要清理掉，下次重试时重新安装
+			if err2 := c.ofClient.UninstallPolicyRuleFlows(rule.ID); err2 != nil {
+				klog.Errorf("[syncNetworkPolicy]-清理rule %d 失败, err=%s", rule.ID, err2)
+			}
+			return fmt.Errorf("failed to install rule %s of NetworkPolicy %s: %v", ruleName, key, err)
+		}
+		c.setInstalledRule(key, ruleName, rule)
+	}
+	return nil
+}
+
+// updateRuleAddresses 比较新旧rule的from/to，只增删发生变化的地址
+func (c *Controller) updateRuleAddresses(old, cur *types.PolicyRule) error {
+	for _, dir := range []struct {
+		addrType types.AddressType
+		old, cur []types.Address
+	}{
+		{types.SrcAddress, old.From, cur.From},
+		{types.DstAddress, old.To, cur.To},
+	} {
+		added, removed := diffAddresses(dir.old, dir.cur, dir.addrType)
+		if len(added) > 0 {
+			if err := c.ofClient.AddPolicyRuleAddress(old.ID, dir.addrType, added); err != nil {
+				return err
+			}
+		}
+		if len(removed) > 0 {
+			if err := c.ofClient.DeletePolicyRuleAddress(old.ID, dir.addrType, removed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Controller) getInstalledRules(key string) map[string]*types.PolicyRule {
+	c.rulesLock.Lock()
+	defer c.rulesLock.Unlock()
+	rules := make(map[string]*types.PolicyRule, len(c.installedRules[key]))
+	for ruleName, rule := range c.installedRules[key] {
+		rules[ruleName] = rule
+	}
+	return rules
+}
+
+// setInstalledRule rule为nil时表示删除
+func (c *Controller) setInstalledRule(key, ruleName string, rule *types.PolicyRule) {
+	c.rulesLock.Lock()
+	defer c.rulesLock.Unlock()
+	if rule == nil {
+		delete(c.installedRules[key], ruleName)
+		if len(c.installedRules[key]) == 0 {
+			delete(c.installedRules, key)
+		}
+		return
+	}
+	if c.installedRules[key] == nil {
+		c.installedRules[key] = map[string]*types.PolicyRule{}
+	}
+	c.installedRules[key][ruleName] = rule
+}
+
+func (c *Controller) allocateRuleID() uint32 {
+	c.rulesLock.Lock()
+	defer c.rulesLock.Unlock()
+	id := c.nextRuleID
+	c.nextRuleID++
+	return id
+}
+
+// computeRules 计算policy在本node上需要安装的rule，key为rule名称，例如"ingress/0"、"egress/deny"。
+// 命名端口按照解析出的端口号拆分为独立的rule，例如"ingress/0/TCP/8080"，只匹配定义了该端口的pod。
+// policy没有选中本node上的任何pod时返回空集合。
+// 未配置from/to的rule允许所有地址；policy中某个方向生效但没有任何rule时，生成只包含本地pod的DENY-ALL rule
+func (c *Controller) computeRules(policy *networkingv1.NetworkPolicy) (map[string]*types.PolicyRule, error) {
+	rules := map[string]*types.PolicyRule{}
+	appliedTo, appliedToPods, err := c.localPodAddresses(policy.Namespace, &policy.Spec.PodSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(appliedTo) == 0 {
+		return rules, nil
+	}
+
+	ingressEnabled, egressEnabled := policyTypes(policy)
+	if ingressEnabled {
+		for i, ingress := range policy.Spec.Ingress {
+			from, exceptFrom, err := c.peerAddresses(policy.Namespace, ingress.From)
+			if err != nil {
+				return nil, err
+			}
+			services, namedPorts := servicePorts(ingress.Ports)
+			ruleName := fmt.Sprintf("ingress/%d", i)
+			rules[ruleName] = &types.PolicyRule{
+				Direction:  networkingv1.PolicyTypeIngress,
+				From:       from,
+				ExceptFrom: exceptFrom,
+				To:         appliedTo,
+				Service:    services,
+			}
+			// 命名端口只对定义了这个端口的本地pod放行
+			for _, target := range resolveNamedPorts(namedPorts, appliedToPods) {
+				rules[ruleName+"/"+target.name()] = &types.PolicyRule{
+					Direction:  networkingv1.PolicyTypeIngress,
+					From:       from,
+					ExceptFrom: exceptFrom,
+					To:         c.podOFPortAddresses(target.pods),
+					Service:    []*networkingv1.NetworkPolicyPort{target.port},
+				}
+			}
+		}
+		if len(policy.Spec.Ingress) == 0 {
+			rules["ingress/deny"] = &types.PolicyRule{Direction: networkingv1.PolicyTypeIngress, To: appliedTo}
+		}
+	}
+	if egressEnabled {
+		for i, egress := range policy.Spec.Egress {
+			to, exceptTo, err := c.peerAddresses(policy.Namespace, egress.To)
+			if err != nil {
+				return nil, err
+			}
+			services, namedPorts := servicePorts(egress.Ports)
+			ruleName := fmt.Sprintf("egress/%d", i)
+			rules[ruleName] = &types.PolicyRule{
+				Direction: networkingv1.PolicyTypeEgress,
+				From:      appliedTo,
+				To:        to,
+				ExceptTo:  exceptTo,
+				Service:   services,
+			}
+			if len(namedPorts) == 0 {
+				continue
+			}
+			// 命名端口只对peer覆盖的pod中定义了这个端口的pod放行
+			peerPods, err := c.peerPods(policy.Namespace, egress.To)
+			if err != nil {
+				return nil, err
+			}
+			for _, target := range resolveNamedPorts(namedPorts, peerPods) {
+				rules[ruleName+"/"+target.name()] = &types.PolicyRule{
+					Direction: networkingv1.PolicyTypeEgress,
+					From:      appliedTo,
+					To:        podIPAddresses(target.pods),
+					Service:   []*networkingv1.NetworkPolicyPort{target.port},
+				}
+			}
+		}
+		if len(policy.Spec.Egress) == 0 {
+			rules["egress/deny"] = &types.PolicyRule{Direction: networkingv1.PolicyTypeEgress, From: appliedTo}
+		}
+	}
+	return rules, nil
+}
+
+// policyTypes 未配置policyTypes时，ingress总是生效，egress只有在配置了egress rule时才生效
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress bool, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+// localPodAddresses 返回namespace中被selector选中、运行在本node上且已经创建了ovs port的pod，以及这些pod的ofport
+func (c *Controller) localPodAddresses(namespace string, selector *metav1.LabelSelector) ([]types.Address, []*v1.Pod, error) {
+	pods, err := c.selectPods(namespace, selector, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	addresses := []types.Address{}
+	var localPods []*v1.Pod
+	for _, pod := range pods {
+		if pod.Spec.NodeName != c.nodeConfig.NodeName {
+			continue
+		}
+		iface, ok := c.ifaceStore.GetContainerInterface(pod.Name, pod.Namespace)
+		if !ok || iface.OVSPortConfig == nil || iface.OFPort <= 0 {
+			// ovs port还没有创建，等待pod更新事件或policy的resync
+			klog.V(2).Infof("[localPodAddresses]-pod %s/%s 的ovs port不存在, 暂时跳过", pod.Namespace, pod.Name)
+			continue
+		}
+		addresses = append(addresses, openflow.NewOFPortAddress(iface.OFPort))
+		localPods = append(localPods, pod)
+	}
+	return dedupAddresses(addresses), localPods, nil
+}
+
+// peerAddresses 将rule中的peer转换为地址。peers为空时表示所有地址；ipBlock中的except作为rule的except地址返回。
+// 返回的地址列表不为nil，即使没有选中任何pod，以保证rule中对应的clause存在，从而拒绝所有流量
+func (c *Controller) peerAddresses(namespace string, peers []networkingv1.NetworkPolicyPeer) ([]types.Address, []types.Address, error) {
+	if len(peers) == 0 {
+		return []types.Address{openflow.NewIPNetAddress(allIPNet)}, nil, nil
+	}
+	addresses := []types.Address{}
+	var excepts []types.Address
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			_, ipNet, err := net.ParseCIDR(peer.IPBlock.CIDR)
+			if err != nil {
+				klog.Warningf("[peerAddresses]-ipBlock中的cidr %s 不合法, 忽略, err=%s", peer.IPBlock.CIDR, err)
+				continue
+			}
+			addresses = append(addresses, openflow.NewIPNetAddress(*ipNet))
+			for _, except := range peer.IPBlock.Except {
+				_, exceptNet, err := net.ParseCIDR(except)
+				if err != nil {
+					klog.Warningf("[peerAddresses]-ipBlock中的except %s 不合法, 忽略, err=%s", except, err)
+					continue
+				}
+				excepts = append(excepts, openflow.NewIPNetAddress(*exceptNet))
+			}
+			continue
+		}
+		pods, err := c.selectPods(namespace, peer.PodSelector, peer.NamespaceSelector)
+		if err != nil {
+			return nil, nil, err
+		}
+		addresses = append(addresses, podIPAddresses(pods)...)
+	}
+	return dedupAddresses(addresses), dedupAddresses(excepts), nil
+}
+
+// peerPods 返回peers覆盖的所有pod，用于解析egress rule中的命名端口：peers为空时为集群中所有的pod，
+// ipBlock覆盖ip在cidr中且不在except中的pod。hostNetwork以及还没有分配ip的pod被忽略
+func (c *Controller) peerPods(namespace string, peers []networkingv1.NetworkPolicyPeer) ([]*v1.Pod, error) {
+	var candidates []*v1.Pod
+	if len(peers) == 0 {
+		allPods, err := c.podLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		candidates = allPods
+	}
+	for _, peer := range peers {
+		if peer.IPBlock == nil {
+			pods, err := c.selectPods(namespace, peer.PodSelector, peer.NamespaceSelector)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, pods...)
+			continue
+		}
+		allPods, err := c.podLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range allPods {
+			if ipBlockContains(peer.IPBlock, net.ParseIP(pod.Status.PodIP)) {
+				candidates = append(candidates, pod)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	var pods []*v1.Pod
+	for _, pod := range candidates {
+		key := pod.Namespace + "/" + pod.Name
+		if seen[key] || pod.Spec.HostNetwork || net.ParseIP(pod.Status.PodIP) == nil ||
+			pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		seen[key] = true
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// ipBlockContains 判断ip是否在ipBlock的cidr中并且不在except中
+func ipBlockContains(ipBlock *networkingv1.IPBlock, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	_, ipNet, err := net.ParseCIDR(ipBlock.CIDR)
+	if err != nil || !ipNet.Contains(ip) {
+		return false
+	}
+	for _, except := range ipBlock.Except {
+		if _, exceptNet, err := net.ParseCIDR(except); err == nil && exceptNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// podIPAddresses 将pod转换为ip地址，hostNetwork以及还没有分配ip的pod被忽略
+func podIPAddresses(pods []*v1.Pod) []types.Address {
+	addresses := []types.Address{}
+	for _, pod := range pods {
+		podIP := net.ParseIP(pod.Status.PodIP)
+		if pod.Spec.HostNetwork || podIP == nil {
+			continue
+		}
+		addresses = append(addresses, openflow.NewIPAddress(podIP))
+	}
+	return dedupAddresses(addresses)
+}
+
+// podOFPortAddresses 将本地pod转换为ofport地址，pods应当来自localPodAddresses
+func (c *Controller) podOFPortAddresses(pods []*v1.Pod) []types.Address {
+	addresses := []types.Address{}
+	for _, pod := range pods {
+		iface, ok := c.ifaceStore.GetContainerInterface(pod.Name, pod.Namespace)
+		if !ok || iface.OVSPortConfig == nil || iface.OFPort <= 0 {
+			continue
+		}
+		addresses = append(addresses, openflow.NewOFPortAddress(iface.OFPort))
+	}
+	return dedupAddresses(addresses)
+}
+
+// selectPods 返回被podSelector以及namespaceSelector同时选中的pod。
+// namespaceSelector为nil时只在policy所在的namespace中选择，podSelector为nil时选中namespace中的所有pod
+func (c *Controller) selectPods(namespace string, podSelector, namespaceSelector *metav1.LabelSelector) ([]*v1.Pod, error) {
+	podLabels := labels.Everything()
+	if podSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(podSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid podSelector: %v", err)
+		}
+		podLabels = selector
+	}
+
+	namespaces := []string{namespace}
+	if namespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(namespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %v", err)
+		}
+		nsList, err := c.namespaceLister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = namespaces[:0]
+		for _, ns := range nsList {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	var pods []*v1.Pod
+	for _, ns := range namespaces {
+		nsPods, err := c.podLister.Pods(ns).List(podLabels)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range nsPods {
+			if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// servicePorts 将rule中的端口转换为service clause，ports为空时表示所有端口，返回nil。protocol为空时默认为TCP。
+// 命名端口不会出现在services中，而是单独返回，由resolveNamedPorts按照目的pod拆分为独立的rule。
+// 只有命名端口时services为空但不为nil，rule仍然会隔离被选中的pod
+func servicePorts(ports []networkingv1.NetworkPolicyPort) (services []*networkingv1.NetworkPolicyPort, namedPorts []*networkingv1.NetworkPolicyPort) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	services = []*networkingv1.NetworkPolicyPort{}
+	for i := range ports {
+		port := ports[i].DeepCopy()
+		if port.Protocol == nil {
+			protocol := v1.ProtocolTCP
+			port.Protocol = &protocol
+		}
+		if port.Port != nil && port.Port.Type == intstr.String {
+			namedPorts = append(namedPorts, port)
+			continue
+		}
+		services = append(services, port)
+	}
+	return services, namedPorts
+}
+
+// namedPortTarget 命名端口解析出的一个端口号，以及定义了这个端口号的目的pod
+type namedPortTarget struct {
+	port *networkingv1.NetworkPolicyPort
+	pods []*v1.Pod
+}
+
+// name 作为rule名称的后缀，例如"TCP/8080"
+func (t *namedPortTarget) name() string {
+	return fmt.Sprintf("%s/%d", *t.port.Protocol, t.port.Port.IntVal)
+}
+
+// resolveNamedPorts 根据目的pod的containerPort将命名端口解析为端口号，并按照协议和端口号对pod分组：
+// 同一个名字在不同pod上对应不同端口时，每个端口号只对定义了它的pod放行。
+// 结果按照协议和端口号排序，保证rule的计算结果稳定；无法解析的命名端口被忽略，即不放行对应的流量
+func resolveNamedPorts(namedPorts []*networkingv1.NetworkPolicyPort, pods []*v1.Pod) []*namedPortTarget {
+	targets := map[string]*namedPortTarget{}
+	for _, namedPort := range namedPorts {
+		resolved := false
+		for _, pod := range pods {
+			number, found := lookupContainerPort(pod, namedPort.Port.StrVal, *namedPort.Protocol)
+			if !found {
+				continue
+			}
+			resolved = true
+			portNumber := intstr.FromInt32(number)
+			target := &namedPortTarget{port: &networkingv1.NetworkPolicyPort{Protocol: namedPort.Protocol, Port: &portNumber}}
+			if existing, ok := targets[target.name()]; ok {
+				target = existing
+			} else {
+				targets[target.name()] = target
+			}
+			if !containsPod(target.pods, pod) {
+				target.pods = append(target.pods, pod)
+			}
+		}
+		if !resolved {
+			klog.Warningf("[resolveNamedPorts]-命名端口 %s/%s 在目的pod中不存在, 忽略", *namedPort.Protocol, namedPort.Port.StrVal)
+		}
+	}
+	result := make([]*namedPortTarget, 0, len(targets))
+	for _, target := range targets {
+		result = append(result, target)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if *result[i].port.Protocol != *result[j].port.Protocol {
+			return *result[i].port.Protocol < *result[j].port.Protocol
+		}
+		return result[i].port.Port.IntVal < result[j].port.Port.IntVal
+	})
+	return result
+}
+
+// lookupContainerPort 返回pod中名称和协议都匹配的containerPort
+func lookupContainerPort(pod *v1.Pod, name string, protocol v1.Protocol) (int32, bool) {
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			containerProtocol := containerPort.Protocol
+			if containerProtocol == "" {
+				containerProtocol = v1.ProtocolTCP
+			}
+			if containerPort.Name == name && containerProtocol == protocol {
+				return containerPort.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func containsPod(pods []*v1.Pod, pod *v1.Pod) bool {
+	for _, p := range pods {
+		if p == pod {
+			return true
+		}
+	}
+	return false
+}
+
+// sameRuleShape 判断两个rule是否只有from/to中的地址不同，此时可以通过增删地址更新rule，否则需要重新安装
+func sameRuleShape(old, cur *types.PolicyRule) bool {
+	return old.Direction == cur.Direction &&
+		(old.From == nil) == (cur.From == nil) &&
+		(old.To == nil) == (cur.To == nil) &&
+		reflect.DeepEqual(addressKeys(old.ExceptFrom, types.SrcAddress), addressKeys(cur.ExceptFrom, types.SrcAddress)) &&
+		reflect.DeepEqual(addressKeys(old.ExceptTo, types.DstAddress), addressKeys(cur.ExceptTo, types.DstAddress)) &&
+		reflect.DeepEqual(old.Service, cur.Service)
+}
+
+// diffAddresses 返回cur中新增的地址以及old中被删除的地址
+func diffAddresses(old, cur []types.Address, addrType types.AddressType) (added, removed []types.Address) {
+	oldSet := make(map[string]bool, len(old))
+	for _, addr := range old {
+		oldSet[addressKey(addr, addrType)] = true
+	}
+	curSet := make(map[string]bool, len(cur))
+	for _, addr := range cur {
+		key := addressKey(addr, addrType)
+		curSet[key] = true
+		if !oldSet[key] {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range old {
+		if !curSet[addressKey(addr, addrType)] {
+			removed = append(removed, addr)
+		}
+	}
+	return added, removed
+}
+
+func addressKey(addr types.Address, addrType types.AddressType) string {
+	return fmt.Sprintf("%d/%s", addr.GetMatchKey(addrType), addr.GetMatchValue())
+}
+
+func addressKeys(addresses []types.Address, addrType types.AddressType) []string {
+	keys := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		keys = append(keys, addressKey(addr, addrType))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func dedupAddresses(addresses []types.Address) []types.Address {
+	if addresses == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(addresses))
+	result := make([]types.Address, 0, len(addresses))
+	for _, addr := range addresses {
+		key := addressKey(addr, types.SrcAddress)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, addr)
+	}
+	return result
+}
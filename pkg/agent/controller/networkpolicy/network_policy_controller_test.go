@@ -0,0 +1,286 @@
+package networkpolicy
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/types"
+	"ciccni/pkg/agent/util"
+	"ciccni/pkg/openflow"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeOFClient 只记录policy相关的调用，其它方法不会被controller使用
+type fakeOFClient struct {
+	openflow.Client
+	rules map[uint32]*types.PolicyRule
+}
+
+func (f *fakeOFClient) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
+	f.rules[rule.ID] = &types.PolicyRule{ID: rule.ID, Direction: rule.Direction, From: rule.From, To: rule.To, Service: rule.Service}
+	return nil
+}
+
+func (f *fakeOFClient) UninstallPolicyRuleFlows(ruleID uint32) error {
+	delete(f.rules, ruleID)
+	return nil
+}
+
+func (f *fakeOFClient) AddPolicyRuleAddress(ruleID uint32, addrType types.AddressType, addresses []types.Address) error {
+	rule := f.rules[ruleID]
+	if addrType == types.SrcAddress {
+		rule.From = append(rule.From, addresses...)
+	} else {
+		rule.To = append(rule.To, addresses...)
+	}
+	return nil
+}
+
+func (f *fakeOFClient) DeletePolicyRuleAddress(ruleID uint32, addrType types.AddressType, addresses []types.Address) error {
+	rule := f.rules[ruleID]
+	remove := map[string]bool{}
+	for _, addr := range addresses {
+		remove[addressKey(addr, addrType)] = true
+	}
+	filter := func(in []types.Address) []types.Address {
+		out := []types.Address{}
+		for _, addr := range in {
+			if !remove[addressKey(addr, addrType)] {
+				out = append(out, addr)
+			}
+		}
+		return out
+	}
+	if addrType == types.SrcAddress {
+		rule.From = filter(rule.From)
+	} else {
+		rule.To = filter(rule.To)
+	}
+	return nil
+}
+
+func newPod(namespace, name, nodeName, ip string, podLabels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: podLabels},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status:     v1.PodStatus{PodIP: ip, Phase: v1.PodRunning},
+	}
+}
+
+func TestSyncNetworkPolicy(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	policyInformer := informerFactory.Networking().V1().NetworkPolicies()
+	podInformer := informerFactory.Core().V1().Pods()
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	ifaceStore := agent.NewInterfaceStore()
+	ofClient := &fakeOFClient{rules: map[uint32]*types.PolicyRule{}}
+	c := NewNetworkPolicyController(policyInformer, podInformer, namespaceInformer, ofClient, ifaceStore, &agent.NodeConfig{NodeName: "node1"})
+
+	podStore := podInformer.Informer().GetStore()
+	require.NoError(t, namespaceInformer.Informer().GetStore().Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1", Labels: map[string]string{"team": "a"}}}))
+	require.NoError(t, podStore.Add(newPod("ns1", "web", "node1", "10.244.1.2", map[string]string{"app": "web"})))
+	require.NoError(t, podStore.Add(newPod("ns1", "client-local", "node1", "10.244.1.3", map[string]string{"app": "client"})))
+	require.NoError(t, podStore.Add(newPod("ns1", "client-remote", "node2", "10.244.2.3", map[string]string{"app": "client"})))
+	webIface := agent.NewContainerInterfaceConfig("c-web", "web", "ns1", "", nil, net.ParseIP("10.244.1.2"))
+	webIface.OVSPortConfig = &agent.OVSPortConfig{OFPort: 5}
+	ifaceStore.AddInterface(util.GenerateContainerInterfaceName("web", "ns1"), webIface)
+
+	tcp := v1.ProtocolTCP
+	port := intstr.FromInt(80)
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "allow-client"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{
+					PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+				}},
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+			}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+	require.NoError(t, policyInformer.Informer().GetStore().Add(policy))
+	require.NoError(t, c.syncNetworkPolicy("ns1/allow-client"))
+
+	// ingress rule以ofport匹配本地pod，以ip匹配peer；egress没有rule，生成DENY-ALL rule
+	require.Len(t, ofClient.rules, 2)
+	installed := c.getInstalledRules("ns1/allow-client")
+	ingress := ofClient.rules[installed["ingress/0"].ID]
+	require.Equal(t, []string{"4/5"}, addressKeys(ingress.To, types.DstAddress))
+	require.Equal(t, []string{"1/10.244.1.3", "1/10.244.2.3"}, addressKeys(ingress.From, types.SrcAddress))
+	require.Len(t, ingress.Service, 1)
+	egressDeny := ofClient.rules[installed["egress/deny"].ID]
+	require.Equal(t, []string{"5/5"}, addressKeys(egressDeny.From, types.SrcAddress))
+	require.Nil(t, egressDeny.To)
+
+	// peer pod被删除后只删除对应的地址，rule id不变
+	ingressID := ingress.ID
+	require.NoError(t, podStore.Delete(newPod("ns1", "client-remote", "node2", "", nil)))
+	require.NoError(t, c.syncNetworkPolicy("ns1/allow-client"))
+	require.Equal(t, []string{"1/10.244.1.3"}, addressKeys(ofClient.rules[ingressID].From, types.SrcAddress))
+
+	// 被选中的本地pod不存在后，所有rule被卸载
+	ifaceStore.DeleteInterface(util.GenerateContainerInterfaceName("web", "ns1"))
+	require.NoError(t, c.syncNetworkPolicy("ns1/allow-client"))
+	require.Empty(t, ofClient.rules)
+
+	// policy被删除后不会残留任何rule
+	ifaceStore.AddInterface(util.GenerateContainerInterfaceName("web", "ns1"), webIface)
+	require.NoError(t, c.syncNetworkPolicy("ns1/allow-client"))
+	require.Len(t, ofClient.rules, 2)
+	require.NoError(t, policyInformer.Informer().GetStore().Delete(policy))
+	require.NoError(t, c.syncNetworkPolicy("ns1/allow-client"))
+	require.Empty(t, ofClient.rules)
+	require.Empty(t, c.getInstalledRules("ns1/allow-client"))
+}
+
+func TestServicePorts(t *testing.T) {
+	udp := v1.ProtocolUDP
+	http := intstr.FromString("http")
+	start := intstr.FromInt(8000)
+	end := int32(8080)
+
+	services, namedPorts := servicePorts(nil)
+	require.Nil(t, services)
+	require.Nil(t, namedPorts)
+
+	// 命名端口单独返回，其余端口的protocol默认为TCP
+	services, namedPorts = servicePorts([]networkingv1.NetworkPolicyPort{
+		{Port: &http},
+		{Port: &start, EndPort: &end},
+		{Protocol: &udp},
+	})
+	var actual []string
+	for _, s := range services {
+		port := "*"
+		if s.Port != nil {
+			port = s.Port.String()
+		}
+		if s.EndPort != nil {
+			port = fmt.Sprintf("%s-%d", port, *s.EndPort)
+		}
+		actual = append(actual, string(*s.Protocol)+"/"+port)
+	}
+	require.Equal(t, []string{"TCP/8000-8080", "UDP/*"}, actual)
+	require.Len(t, namedPorts, 1)
+	require.Equal(t, v1.ProtocolTCP, *namedPorts[0].Protocol)
+
+	// 只有命名端口时services不为nil，rule仍然隔离被选中的pod
+	services, _ = servicePorts([]networkingv1.NetworkPolicyPort{{Port: &http}})
+	require.NotNil(t, services)
+	require.Empty(t, services)
+}
+
+func TestResolveNamedPorts(t *testing.T) {
+	tcp := v1.ProtocolTCP
+	udp := v1.ProtocolUDP
+	http := intstr.FromString("http")
+	dns := intstr.FromString("dns")
+	missing := intstr.FromString("missing")
+	pods := []*v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{
+			{Name: "http", ContainerPort: 8080},
+			{Name: "dns", ContainerPort: 53, Protocol: v1.ProtocolUDP},
+		}}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 80}}}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c"}, Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}}},
+	}
+
+	targets := resolveNamedPorts([]*networkingv1.NetworkPolicyPort{
+		{Protocol: &tcp, Port: &http},
+		{Protocol: &udp, Port: &dns},
+		{Protocol: &tcp, Port: &missing},
+	}, pods)
+	// 每个端口号只包含定义了它的pod，无法解析的命名端口被忽略
+	actual := map[string][]string{}
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.name())
+		for _, pod := range target.pods {
+			actual[target.name()] = append(actual[target.name()], pod.Name)
+		}
+	}
+	require.Equal(t, []string{"TCP/80", "TCP/8080", "UDP/53"}, names)
+	require.Equal(t, map[string][]string{"TCP/80": {"b"}, "TCP/8080": {"a", "c"}, "UDP/53": {"a"}}, actual)
+}
+
+func TestComputeRulesNamedPorts(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	policyInformer := informerFactory.Networking().V1().NetworkPolicies()
+	podInformer := informerFactory.Core().V1().Pods()
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	ifaceStore := agent.NewInterfaceStore()
+	ofClient := &fakeOFClient{rules: map[uint32]*types.PolicyRule{}}
+	c := NewNetworkPolicyController(policyInformer, podInformer, namespaceInformer, ofClient, ifaceStore, &agent.NodeConfig{NodeName: "node1"})
+
+	podStore := podInformer.Informer().GetStore()
+	addPod := func(name, nodeName, ip string, ofPort int32, port v1.ContainerPort) {
+		pod := newPod("ns1", name, nodeName, ip, map[string]string{"app": name})
+		pod.Spec.Containers = []v1.Container{{Ports: []v1.ContainerPort{port}}}
+		require.NoError(t, podStore.Add(pod))
+		if ofPort > 0 {
+			iface := agent.NewContainerInterfaceConfig("c-"+name, name, "ns1", "", nil, net.ParseIP(ip))
+			iface.OVSPortConfig = &agent.OVSPortConfig{OFPort: ofPort}
+			ifaceStore.AddInterface(util.GenerateContainerInterfaceName(name, "ns1"), iface)
+		}
+	}
+	addPod("web", "node1", "10.244.1.2", 5, v1.ContainerPort{Name: "http", ContainerPort: 8080})
+	addPod("admin", "node1", "10.244.1.3", 6, v1.ContainerPort{Name: "http", ContainerPort: 80})
+	addPod("remote", "node2", "10.244.2.2", 0, v1.ContainerPort{Name: "http", ContainerPort: 9090})
+	addPod("outside", "node2", "10.245.0.2", 0, v1.ContainerPort{Name: "http", ContainerPort: 7070})
+
+	http := intstr.FromString("http")
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "named-ports"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "admin"}},
+			}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{Port: &http}},
+			}},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{Ports: []networkingv1.NetworkPolicyPort{{Port: &http}}},
+				{
+					To:    []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.244.0.0/16", Except: []string{"10.244.1.0/24"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{{Port: &http}},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+	rules, err := c.computeRules(policy)
+	require.NoError(t, err)
+
+	var names []string
+	for name := range rules {
+		names = append(names, name)
+	}
+	require.ElementsMatch(t, []string{
+		"ingress/0", "ingress/0/TCP/80", "ingress/0/TCP/8080",
+		"egress/0", "egress/0/TCP/80", "egress/0/TCP/7070", "egress/0/TCP/8080", "egress/0/TCP/9090",
+		"egress/1", "egress/1/TCP/9090",
+	}, names)
+
+	// 基础rule不放行命名端口，但仍然隔离被选中的pod
+	require.NotNil(t, rules["ingress/0"].Service)
+	require.Empty(t, rules["ingress/0"].Service)
+	// 每个端口号只放行到定义了它的pod，不会因为其它pod定义了同名端口而放行
+	require.Equal(t, []string{"4/5"}, addressKeys(rules["ingress/0/TCP/8080"].To, types.DstAddress))
+	require.Equal(t, []string{"4/6"}, addressKeys(rules["ingress/0/TCP/80"].To, types.DstAddress))
+	require.Equal(t, "8080", rules["ingress/0/TCP/8080"].Service[0].Port.String())
+	// to为空时按照集群中所有pod解析，ipBlock只覆盖cidr中且不在except中的pod
+	require.Equal(t, []string{"0/10.245.0.2"}, addressKeys(rules["egress/0/TCP/7070"].To, types.DstAddress))
+	require.Equal(t, []string{"0/10.244.2.2"}, addressKeys(rules["egress/1/TCP/9090"].To, types.DstAddress))
+	require.Equal(t, []string{"5/5", "5/6"}, addressKeys(rules["egress/1/TCP/9090"].From, types.SrcAddress))
+}
@@ -0,0 +1,252 @@
+package noderoute
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/openflow"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	controllerName = "NodeRouteController"
+	// 处理失败的node会以指数退避的方式重新入队
+	minRetryDelay = 2 * time.Second
+	maxRetryDelay = 120 * time.Second
+	// 同一个node不会被多个worker同时处理；共用的arp flow由ofClient内部加锁保护
+	defaultWorkers = 4
+)
+
+// nodeRouteInfo 记录为某个对端node安装流表时所使用的信息，用于判断node的InternalIP或PodCIDR是否发生了变化
+type nodeRouteInfo struct {
+	podCIDR string
+	nodeIP  net.IP
+}
+
+// Controller 监听集群中Node的变化，为每个对端node安装/更新/删除vxlan隧道以及ARP相关的流表项
+type Controller struct {
+	ofClient         openflow.Client
+	nodeConfig       *agent.NodeConfig
+	nodeInformer     coreinformers.NodeInformer
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	queue            workqueue.RateLimitingInterface
+	// installedNodes 记录已经安装了流表的对端node，key为node name，value为*nodeRouteInfo
+	installedNodes *sync.Map
+	// initialLock 保护initialNodes
+	initialLock sync.Mutex
+	// initialNodes informer同步完成时尚未成功同步过的node，为nil表示informer还未同步完成
+	initialNodes map[string]struct{}
+}
+
+// NewNodeRouteController 创建Controller，并在nodeInformer上注册事件处理函数
+func NewNodeRouteController(
+	nodeInformer coreinformers.NodeInformer,
+	ofClient openflow.Client,
+	nodeConfig *agent.NodeConfig) *Controller {
+	controller := &Controller{
+		ofClient:         ofClient,
+		nodeConfig:       nodeConfig,
+		nodeInformer:     nodeInformer,
+		nodeLister:       nodeInformer.Lister(),
+		nodeListerSynced: nodeInformer.Informer().HasSynced,
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(minRetryDelay, maxRetryDelay), "noderoute"),
+		installedNodes:   &sync.Map{},
+	}
+	nodeInformer.Informer().AddEventHandlerWithResyncPeriod(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(cur interface{}) {
+				controller.enqueueNode(cur)
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldNode, ok1 := old.(*v1.Node)
+				curNode, ok2 := cur.(*v1.Node)
+				// 只有InternalIP或者PodCIDR发生变化时，才需要重新安装流表
+				if ok1 && ok2 && getNodeInternalIP(oldNode).Equal(getNodeInternalIP(curNode)) && oldNode.Spec.PodCIDR == curNode.Spec.PodCIDR {
+					return
+				}
+				controller.enqueueNode(cur)
+			},
+			DeleteFunc: func(old interface{}) {
+				controller.enqueueNode(old)
+			},
+		},
+		0,
+	)
+	return controller
+}
+
+// enqueueNode 将node name加入工作队列，本地node不需要隧道流表，直接忽略
+func (c *Controller) enqueueNode(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("[enqueueNode]-无法获取node的key, obj=%v, err=%s", obj, err)
+		return
+	}
+	if key == c.nodeConfig.NodeName {
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run 等待informer同步完成后启动worker，直到stopCh关闭
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("[node_route_controller.go]-[Run]-启动%s", controllerName)
+	defer klog.Infof("[node_route_controller.go]-[Run]-关闭%s", controllerName)
+
+	if !cache.WaitForNamedCacheSync(controllerName, stopCh, c.nodeListerSynced) {
+		return
+	}
+	if err := c.recordInitialNodes(); err != nil {
+		klog.Errorf("[Run]-获取node列表失败, err=%s", err)
+		return
+	}
+
+	for i := 0; i < defaultWorkers; i++ {
+		go wait.Until(c.worker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (c *Controller) worker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.queue.Forget(obj)
+		klog.Errorf("[processNextWorkItem]-工作队列中出现非string类型的key: %v", obj)
+		return true
+	}
+	if err := c.syncNodeRoute(key); err != nil {
+		klog.Errorf("[processNextWorkItem]-同步node %s的流表失败, 稍后重试, err=%s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	c.initialLock.Lock()
+	delete(c.initialNodes, key)
+	c.initialLock.Unlock()
+	return true
+}
+
+// recordInitialNodes 记录informer同步完成时已经存在的对端node
+func (c *Controller) recordInitialNodes() error {
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	initialNodes := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		if node.Name != c.nodeConfig.NodeName {
+			initialNodes[node.Name] = struct{}{}
+		}
+	}
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	c.initialNodes = initialNodes
+	return nil
+}
+
+// HasSynced 启动时已经存在的对端node的流表全部安装成功之后返回true
+func (c *Controller) HasSynced() bool {
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	return c.initialNodes != nil && len(c.initialNodes) == 0
+}
+
+// syncNodeRoute 根据informer缓存中node的最新状态，安装、更新或删除该node对应的流表项
+func (c *Controller) syncNodeRoute(nodeName string) error {
+	startTime := time.Now()
+	defer func() {
+		klog.V(4).Infof("[syncNodeRoute]-同步node %s 耗时 %v", nodeName, time.Since(startTime))
+	}()
+
+	node, err := c.nodeLister.Get(nodeName)
+	if errors.IsNotFound(err) {
+		return c.deleteNodeRoute(nodeName)
+	} else if err != nil {
+		return err
+	}
+
+	nodeIP := getNodeInternalIP(node)
+	if nodeIP == nil || node.Spec.PodCIDR == "" {
+		// node信息还不完整，等待下一次update事件
+		klog.Infof("[syncNodeRoute]-node %s 的InternalIP或PodCIDR为空, 暂不安装流表", nodeName)
+		return c.deleteNodeRoute(nodeName)
+	}
+
+	if infoI, installed := c.installedNodes.Load(nodeName); installed {
+		info := infoI.(*nodeRouteInfo)
+		if info.podCIDR == node.Spec.PodCIDR && info.nodeIP.Equal(nodeIP) {
+			return nil
+		}
+		klog.Infof("[syncNodeRoute]-node %s 信息发生变化, podCIDR: %s -> %s, nodeIP: %s -> %s",
+			nodeName, info.podCIDR, node.Spec.PodCIDR, info.nodeIP, nodeIP)
+		if err := c.deleteNodeRoute(nodeName); err != nil {
+			return err
+		}
+	}
+	return c.addNodeRoute(nodeName, &nodeRouteInfo{podCIDR: node.Spec.PodCIDR, nodeIP: nodeIP})
+}
+
+func (c *Controller) addNodeRoute(nodeName string, info *nodeRouteInfo) error {
+	klog.Infof("[addNodeRoute]-为node %s 安装流表, podCIDR = %s, nodeIP = %s", nodeName, info.podCIDR, info.nodeIP)
+	if err := c.ofClient.InstallTunFlow(nodeName, info.podCIDR, 0, info.nodeIP); err != nil {
+		return fmt.Errorf("failed to install tunnel flow for node %s: %v", nodeName, err)
+	}
+	if err := c.ofClient.AddARPTunnelDst(info.nodeIP); err != nil {
+		return fmt.Errorf("failed to add node %s to arp flow: %v", nodeName, err)
+	}
+	c.installedNodes.Store(nodeName, info)
+	return nil
+}
+
+// deleteNodeRoute 删除node对应的隧道流表，并将其从arp流表的对端列表中移除
+func (c *Controller) deleteNodeRoute(nodeName string) error {
+	infoI, installed := c.installedNodes.Load(nodeName)
+	if !installed {
+		return nil
+	}
+	info := infoI.(*nodeRouteInfo)
+	klog.Infof("[deleteNodeRoute]-删除node %s 的流表", nodeName)
+	if err := c.ofClient.RemoveARPTunnelDst(info.nodeIP); err != nil {
+		return fmt.Errorf("failed to remove node %s from arp flow: %v", nodeName, err)
+	}
+	if err := c.ofClient.UninstallTunFlow(nodeName); err != nil {
+		return fmt.Errorf("failed to uninstall tunnel flow for node %s: %v", nodeName, err)
+	}
+	c.installedNodes.Delete(nodeName)
+	return nil
+}
+
+// getNodeInternalIP 返回node的InternalIP，不存在时返回nil
+func getNodeInternalIP(node *v1.Node) net.IP {
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP {
+			return net.ParseIP(address.Address)
+		}
+	}
+	return nil
+}
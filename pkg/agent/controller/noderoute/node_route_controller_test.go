@@ -0,0 +1,87 @@
+package noderoute
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/openflow"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeOFClient 按node记录隧道流表，并记录arp流表中的对端列表
+type fakeOFClient struct {
+	openflow.Client
+	tunFlows   map[string]string
+	arpTunDsts map[string]bool
+}
+
+func (f *fakeOFClient) InstallTunFlow(hostname string, dstIPNet string, inPort uint32, tunnelDstIP net.IP) error {
+	f.tunFlows[hostname] = dstIPNet + "->" + tunnelDstIP.String()
+	return nil
+}
+
+func (f *fakeOFClient) UninstallTunFlow(hostname string) error {
+	delete(f.tunFlows, hostname)
+	return nil
+}
+
+func (f *fakeOFClient) AddARPTunnelDst(tunDst net.IP) error {
+	f.arpTunDsts[tunDst.String()] = true
+	return nil
+}
+
+func (f *fakeOFClient) RemoveARPTunnelDst(tunDst net.IP) error {
+	delete(f.arpTunDsts, tunDst.String())
+	return nil
+}
+
+func newNode(name, podCIDR, internalIP string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{PodCIDR: podCIDR},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: internalIP},
+		}},
+	}
+}
+
+func TestSyncNodeRoute(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	ofClient := &fakeOFClient{tunFlows: map[string]string{}, arpTunDsts: map[string]bool{}}
+	c := NewNodeRouteController(nodeInformer, ofClient, &agent.NodeConfig{NodeName: "node1"})
+
+	nodeStore := nodeInformer.Informer().GetStore()
+	require.NoError(t, nodeStore.Add(newNode("node2", "10.244.2.0/24", "192.168.0.2")))
+	require.NoError(t, nodeStore.Add(newNode("node3", "10.244.3.0/24", "192.168.0.3")))
+	require.NoError(t, c.syncNodeRoute("node2"))
+	require.NoError(t, c.syncNodeRoute("node3"))
+	require.Equal(t, map[string]string{
+		"node2": "10.244.2.0/24->192.168.0.2",
+		"node3": "10.244.3.0/24->192.168.0.3",
+	}, ofClient.tunFlows)
+	require.Equal(t, map[string]bool{"192.168.0.2": true, "192.168.0.3": true}, ofClient.arpTunDsts)
+
+	// 删除一个node只删除该node的流表，其它node不受影响
+	require.NoError(t, nodeStore.Delete(newNode("node2", "", "")))
+	require.NoError(t, c.syncNodeRoute("node2"))
+	require.Equal(t, map[string]string{"node3": "10.244.3.0/24->192.168.0.3"}, ofClient.tunFlows)
+	require.Equal(t, map[string]bool{"192.168.0.3": true}, ofClient.arpTunDsts)
+	_, installed := c.installedNodes.Load("node2")
+	require.False(t, installed)
+
+	// 再次同步已经删除的node不会产生任何操作
+	require.NoError(t, c.syncNodeRoute("node2"))
+	require.Len(t, ofClient.tunFlows, 1)
+
+	// node的InternalIP变化后，流表按照node重新安装
+	require.NoError(t, nodeStore.Update(newNode("node3", "10.244.3.0/24", "192.168.0.30")))
+	require.NoError(t, c.syncNodeRoute("node3"))
+	require.Equal(t, map[string]string{"node3": "10.244.3.0/24->192.168.0.30"}, ofClient.tunFlows)
+	require.Equal(t, map[string]bool{"192.168.0.30": true}, ofClient.arpTunDsts)
+}
@@ -0,0 +1,268 @@
+package podgc
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/apis/cni/pb"
+	"ciccni/pkg/cni"
+	"ciccni/pkg/cniserver/ipam"
+	"ciccni/pkg/openflow"
+	"ciccni/pkg/ovs"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	controllerName = "PodGCController"
+
+	// cniNetworkName 需要与ciccni.conflist中的name保持一致，回收ipam记录时会用它构造DEL请求
+	cniNetworkName = "ciccni"
+	// defaultContainerIfName 旧版本创建的port没有记录容器内的接口名，此时使用kubelet默认的接口名
+	defaultContainerIfName = "eth0"
+)
+
+// Metrics 记录回收的情况，dry-run模式下只会增加WouldCollect。
+// Flows为删除了pod流表的容器数，IPs为释放了ip的容器数，只统计确实存在对应记录的容器
+type Metrics struct {
+	Rounds       uint64 `json:"rounds"`
+	WouldCollect uint64 `json:"wouldCollect"`
+	Ports        uint64 `json:"ports"`
+	Flows        uint64 `json:"flows"`
+	IPs          uint64 `json:"ips"`
+	Failures     uint64 `json:"failures"`
+}
+
+// orphan 描述一个已经没有对应pod的容器接口
+type orphan struct {
+	config *agent.InterfaceConfig
+	// onBridge 为false表示ovs上已经没有这个port，只需要清理缓存、流表和ipam
+	onBridge bool
+}
+
+// Controller 周期性地对比ovs port、InterfaceStore以及调度到本node上的pod，回收CNI DEL遗漏的port、
+// pod流表以及ipam分配记录
+type Controller struct {
+	kubeClient      kubernetes.Interface
+	ovsBridgeClient ovs.OVSBridgeClient
+	ofClient        openflow.Client
+	ifaceStore      agent.InterfaceStore
+	nodeConfig      *agent.NodeConfig
+	ipamType        string
+	cniPath         string
+	interval        time.Duration
+	dryRun          bool
+	// suspects 为上一轮被判定为孤儿的port名。port需要连续两轮都被判定为孤儿才会被回收，
+	// 避免和正在进行的CNI ADD/DEL相互影响
+	suspects map[string]bool
+	metrics  Metrics
+	// releaseIPAMFunc 释放容器的ipam分配记录，默认为releaseIPAM
+	releaseIPAMFunc func(config *agent.InterfaceConfig) error
+}
+
+func NewPodGCController(
+	kubeClient kubernetes.Interface,
+	ovsBridgeClient ovs.OVSBridgeClient,
+	ofClient openflow.Client,
+	ifaceStore agent.InterfaceStore,
+	nodeConfig *agent.NodeConfig,
+	ipamType string,
+	cniPath string,
+	interval time.Duration,
+	dryRun bool) *Controller {
+	c := &Controller{
+		kubeClient:      kubeClient,
+		ovsBridgeClient: ovsBridgeClient,
+		ofClient:        ofClient,
+		ifaceStore:      ifaceStore,
+		nodeConfig:      nodeConfig,
+		ipamType:        ipamType,
+		cniPath:         cniPath,
+		interval:        interval,
+		dryRun:          dryRun,
+		suspects:        map[string]bool{},
+	}
+	c.releaseIPAMFunc = c.releaseIPAM
+	return c
+}
+
+// Run 每隔interval执行一次回收，直到stopCh关闭
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	klog.Infof("[pod_gc_controller.go]-[Run]-启动%s, interval = %v, dryRun = %t", controllerName, c.interval, c.dryRun)
+	defer klog.Infof("[pod_gc_controller.go]-[Run]-关闭%s", controllerName)
+	wait.Until(c.collect, c.interval, stopCh)
+}
+
+// GetMetrics 返回当前回收计数的快照
+func (c *Controller) GetMetrics() Metrics {
+	return Metrics{
+		Rounds:       atomic.LoadUint64(&c.metrics.Rounds),
+		WouldCollect: atomic.LoadUint64(&c.metrics.WouldCollect),
+		Ports:        atomic.LoadUint64(&c.metrics.Ports),
+		Flows:        atomic.LoadUint64(&c.metrics.Flows),
+		IPs:          atomic.LoadUint64(&c.metrics.IPs),
+		Failures:     atomic.LoadUint64(&c.metrics.Failures),
+	}
+}
+
+func (c *Controller) collect() {
+	atomic.AddUint64(&c.metrics.Rounds, 1)
+	orphans, err := c.findOrphans()
+	if err != nil {
+		klog.Errorf("[collect]-查找孤儿port失败, err=%s", err)
+		atomic.AddUint64(&c.metrics.Failures, 1)
+		return
+	}
+
+	suspects := make(map[string]bool, len(orphans))
+	for name, o := range orphans {
+		if !c.suspects[name] {
+			klog.V(2).Infof("[collect]-port %s (pod %s/%s) 没有对应的pod, 下一轮确认后回收", name, o.config.PodNamespace, o.config.PodName)
+			suspects[name] = true
+			continue
+		}
+		if c.dryRun {
+			klog.Infof("[collect]-[dry-run]-将回收port %s, containerID = %s, pod = %s/%s, ip = %s",
+				name, o.config.ID, o.config.PodNamespace, o.config.PodName, o.config.IP)
+			atomic.AddUint64(&c.metrics.WouldCollect, 1)
+			// dry-run时不回收，下一轮仍然可以直接输出
+			suspects[name] = true
+			continue
+		}
+		if err := c.collectOrphan(name, o); err != nil {
+			klog.Errorf("[collect]-回收port %s 失败, 下一轮重试, err=%s", name, err)
+			atomic.AddUint64(&c.metrics.Failures, 1)
+			suspects[name] = true
+		}
+	}
+	c.suspects = suspects
+
+	m := c.GetMetrics()
+	klog.V(2).Infof("[collect]-第%d轮回收结束, ports = %d, flows = %d, ips = %d, wouldCollect = %d, failures = %d",
+		m.Rounds, m.Ports, m.Flows, m.IPs, m.WouldCollect, m.Failures)
+}
+
+// findOrphans 返回所有没有对应pod的容器接口，key为ovs port名
+func (c *Controller) findOrphans() (map[string]*orphan, error) {
+	pods, err := c.kubeClient.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", c.nodeConfig.NodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods on node %s: %v", c.nodeConfig.NodeName, err)
+	}
+	livePods := make(map[string]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		livePods[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	ports, err := c.ovsBridgeClient.GetPortList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list OVS ports: %v", err)
+	}
+
+	orphans := make(map[string]*orphan)
+	onBridge := make(map[string]bool, len(ports))
+	for _, port := range ports {
+		onBridge[port.Name] = true
+		config := agent.ParseContainerAttachInfo(port.ExternalIDs)
+		if config == nil || livePods[config.PodNamespace+"/"+config.PodName] {
+			continue
+		}
+		config.OVSPortConfig = &agent.OVSPortConfig{IfaceName: port.Name, PortUUID: port.UUID, OFPort: port.OFPort}
+		orphans[port.Name] = &orphan{config: config, onBridge: true}
+	}
+
+	// InterfaceStore中可能残留ovs上已经不存在的port
+	for _, id := range c.ifaceStore.GetInterfaceIDs() {
+		config, found := c.ifaceStore.GetInterface(id)
+		if !found || config.Type != agent.ContainerInterface || onBridge[id] {
+			continue
+		}
+		if livePods[config.PodNamespace+"/"+config.PodName] {
+			continue
+		}
+		orphans[id] = &orphan{config: config, onBridge: false}
+	}
+	return orphans, nil
+}
+
+// collectOrphan 回收一个孤儿接口：pod流表、ipam分配记录、ovs port、host端veth以及InterfaceStore缓存
+func (c *Controller) collectOrphan(portName string, o *orphan) error {
+	klog.Infof("[collectOrphan]-回收port %s, containerID = %s, pod = %s/%s, ip = %s",
+		portName, o.config.ID, o.config.PodNamespace, o.config.PodName, o.config.IP)
+
+	// 只有InterfaceStore中的接口安装过pod流表（CNI ADD以及agent重启后恢复缓存时都会安装），
+	// 不在缓存中的接口删除流表时不会删除任何内容，不计入Flows
+	_, hasFlows := c.ifaceStore.GetInterface(portName)
+	if err := c.ofClient.UninstallCorednsFlow(o.config.ID); err != nil {
+		return fmt.Errorf("failed to uninstall coreDNS flows of container %s: %v", o.config.ID, err)
+	}
+	if err := c.ofClient.UninstallPodFlows(o.config.ID); err != nil {
+		return fmt.Errorf("failed to uninstall flows of container %s: %v", o.config.ID, err)
+	}
+	if hasFlows {
+		atomic.AddUint64(&c.metrics.Flows, 1)
+	}
+
+	// ipam的DEL是幂等的，放在删除port之前，保证失败后下一轮还能找到这个port并重试
+	if err := c.releaseIPAMFunc(o.config); err != nil {
+		return fmt.Errorf("failed to release IPAM allocation of container %s: %v", o.config.ID, err)
+	}
+	// 没有记录ip的容器不会在ipam中留下分配记录
+	if o.config.IP != nil {
+		atomic.AddUint64(&c.metrics.IPs, 1)
+	}
+
+	if o.onBridge {
+		if err := c.ovsBridgeClient.DeletePort(o.config.PortUUID); err != nil {
+			return fmt.Errorf("failed to delete OVS port %s: %v", portName, err)
+		}
+		atomic.AddUint64(&c.metrics.Ports, 1)
+	}
+	// 删除host端veth，容器端会随之被删除
+	if err := ip.DelLinkByName(portName); err != nil && err != ip.ErrLinkNotFound {
+		klog.Warningf("[collectOrphan]-删除host端veth %s 失败, err=%s", portName, err)
+	}
+	c.ifaceStore.DeleteInterface(portName)
+
+	return nil
+}
+
+// releaseIPAM 构造一个CNI DEL请求，释放容器在ipam中的分配记录。
+// 接口名使用缓存中记录的容器内接口名，cniVersion使用agent支持的最新版本
+func (c *Controller) releaseIPAM(config *agent.InterfaceConfig) error {
+	networkConfig, err := json.Marshal(map[string]interface{}{
+		"cniVersion": cni.SupportedCNIVersions[len(cni.SupportedCNIVersions)-1],
+		"name":       cniNetworkName,
+		"ipam":       ipam.IPAMConfig{Type: c.ipamType, Subnet: c.nodeConfig.PodCIDR.String()},
+	})
+	if err != nil {
+		return err
+	}
+	args := &pb.CniCmdArgs{
+		ContainerId:          config.ID,
+		Ifname:               containerIfName(config),
+		Path:                 c.cniPath,
+		NetworkConfiguration: networkConfig,
+	}
+	return ipam.ExecIPAMDelete(args, c.ipamType)
+}
+
+// containerIfName 返回容器内的接口名，旧版本创建的port没有记录时返回defaultContainerIfName
+func containerIfName(config *agent.InterfaceConfig) string {
+	if config.ContainerIfName == "" {
+		return defaultContainerIfName
+	}
+	return config.ContainerIfName
+}
@@ -0,0 +1,170 @@
+package podgc
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/util"
+	"ciccni/pkg/openflow"
+	"ciccni/pkg/ovs"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeOVSBridgeClient 与InterfaceStore测试中的一样只实现了用到的方法，DeletePort会从port列表中删除对应的port
+type fakeOVSBridgeClient struct {
+	ovs.OVSBridgeClient
+	ports   []ovs.OVSPortData
+	deleted []string
+}
+
+func (f *fakeOVSBridgeClient) GetPortList() ([]ovs.OVSPortData, ovs.Error) {
+	return f.ports, nil
+}
+
+func (f *fakeOVSBridgeClient) DeletePort(portUUID string) ovs.Error {
+	f.deleted = append(f.deleted, portUUID)
+	ports := f.ports[:0]
+	for _, port := range f.ports {
+		if port.UUID != portUUID {
+			ports = append(ports, port)
+		}
+	}
+	f.ports = ports
+	return nil
+}
+
+// fakeOFClient 记录被删除流表的容器
+type fakeOFClient struct {
+	openflow.Client
+	uninstalled []string
+}
+
+func (f *fakeOFClient) UninstallCorednsFlow(containerID string) error {
+	return nil
+}
+
+func (f *fakeOFClient) UninstallPodFlows(containerID string) error {
+	f.uninstalled = append(f.uninstalled, containerID)
+	return nil
+}
+
+const nodeName = "node1"
+
+func newPod(name string, hostNetwork bool) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: nodeName, HostNetwork: hostNetwork},
+	}
+}
+
+// newContainerPort 构造一个由CNI ADD创建的容器port，同时写入InterfaceStore
+func newContainerPort(store agent.InterfaceStore, podName string, ofPort int32) ovs.OVSPortData {
+	portName := util.GenerateContainerInterfaceName(podName, "default")
+	config := agent.NewContainerInterfaceConfig("id-"+podName, podName, "default", "", nil, net.ParseIP("10.244.0.10"))
+	config.OVSPortConfig = &agent.OVSPortConfig{IfaceName: portName, PortUUID: "uuid-" + podName, OFPort: ofPort}
+	store.AddInterface(portName, config)
+
+	externalIDs := make(map[string]string)
+	for k, v := range agent.BuildOVSPortExternalIDs(config) {
+		externalIDs[k] = v.(string)
+	}
+	return ovs.OVSPortData{UUID: "uuid-" + podName, Name: portName, IFName: portName, OFPort: ofPort, ExternalIDs: externalIDs}
+}
+
+func newTestController(dryRun bool, pods ...*v1.Pod) (*Controller, *fakeOVSBridgeClient, *fakeOFClient, *[]string) {
+	objects := make([]runtime.Object, 0, len(pods))
+	for _, pod := range pods {
+		objects = append(objects, pod)
+	}
+	store := agent.NewInterfaceStore()
+	bridge := &fakeOVSBridgeClient{ports: []ovs.OVSPortData{
+		{UUID: "uuid-gw", Name: "gw0", IFName: "gw0", OFPort: 2},
+		newContainerPort(store, "web", 3),
+		newContainerPort(store, "gone", 4),
+		newContainerPort(store, "host", 5),
+	}}
+	// ovs上已经没有这个port，只残留在InterfaceStore中
+	newContainerPort(store, "stale", 6)
+
+	ofClient := &fakeOFClient{}
+	c := NewPodGCController(fake.NewSimpleClientset(objects...), bridge, ofClient, store, &agent.NodeConfig{NodeName: nodeName}, "", "/opt/cni/bin", time.Minute, dryRun)
+	released := &[]string{}
+	c.releaseIPAMFunc = func(config *agent.InterfaceConfig) error {
+		*released = append(*released, config.ID)
+		return nil
+	}
+	return c, bridge, ofClient, released
+}
+
+func TestFindOrphans(t *testing.T) {
+	// hostNetwork的pod不会有容器port，即使同名也视为孤儿
+	c, _, _, _ := newTestController(false, newPod("web", false), newPod("host", true))
+
+	orphans, err := c.findOrphans()
+	require.NoError(t, err)
+	require.Len(t, orphans, 3)
+
+	gone := orphans[util.GenerateContainerInterfaceName("gone", "default")]
+	require.NotNil(t, gone)
+	require.True(t, gone.onBridge)
+	require.Equal(t, "id-gone", gone.config.ID)
+	require.Equal(t, "uuid-gone", gone.config.PortUUID)
+
+	require.NotNil(t, orphans[util.GenerateContainerInterfaceName("host", "default")])
+
+	stale := orphans[util.GenerateContainerInterfaceName("stale", "default")]
+	require.NotNil(t, stale)
+	require.False(t, stale.onBridge)
+}
+
+func TestCollect(t *testing.T) {
+	c, bridge, ofClient, released := newTestController(false, newPod("web", false), newPod("host", false))
+	gonePort := util.GenerateContainerInterfaceName("gone", "default")
+
+	// 第一轮只记录为可疑port，不回收
+	c.collect()
+	require.Empty(t, bridge.deleted)
+	require.Empty(t, ofClient.uninstalled)
+	require.True(t, c.suspects[gonePort])
+
+	// 第二轮确认后回收
+	c.collect()
+	require.Equal(t, []string{"uuid-gone"}, bridge.deleted)
+	require.ElementsMatch(t, []string{"id-gone", "id-stale"}, ofClient.uninstalled)
+	require.ElementsMatch(t, []string{"id-gone", "id-stale"}, *released)
+	_, found := c.ifaceStore.GetInterface(gonePort)
+	require.False(t, found)
+	require.Empty(t, c.suspects)
+	require.Equal(t, Metrics{Rounds: 2, Ports: 1, Flows: 2, IPs: 2}, c.GetMetrics())
+
+	// 回收之后不会重复计数
+	c.collect()
+	require.Equal(t, Metrics{Rounds: 3, Ports: 1, Flows: 2, IPs: 2}, c.GetMetrics())
+}
+
+func TestCollectDryRun(t *testing.T) {
+	c, bridge, ofClient, released := newTestController(true, newPod("web", false), newPod("host", false))
+
+	for i := 0; i < 3; i++ {
+		c.collect()
+	}
+	require.Empty(t, bridge.deleted)
+	require.Empty(t, ofClient.uninstalled)
+	require.Empty(t, *released)
+	// 从第二轮开始每轮输出两个将被回收的port
+	require.Equal(t, Metrics{Rounds: 3, WouldCollect: 4}, c.GetMetrics())
+}
+
+func TestContainerIfName(t *testing.T) {
+	config := agent.NewContainerInterfaceConfig("c0ffee", "web", "default", "", nil, nil)
+	// 旧版本创建的port没有记录容器内的接口名
+	require.Equal(t, "eth0", containerIfName(config))
+	config.ContainerIfName = "net1"
+	require.Equal(t, "net1", containerIfName(config))
+}
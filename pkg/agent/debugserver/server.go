@@ -0,0 +1,92 @@
+package debugserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ciccni/pkg/agent/controller/flowsync"
+	"ciccni/pkg/agent/controller/podgc"
+	"ciccni/pkg/openflow"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// flowTablesPath 返回各个流表的状态，默认使用本地计数，?source=switch时从交换机查询流表数以及报文计数
+	flowTablesPath = "/debug/flowtables"
+	// flowSyncPath 返回流表对账的情况
+	flowSyncPath = "/debug/flowsync"
+	// podGCPath 返回孤儿port回收的计数
+	podGCPath = "/debug/podgc"
+
+	sourceSwitch = "switch"
+)
+
+// Server 在addr上以JSON的形式提供agent的调试信息，只应监听本地地址
+type Server struct {
+	addr               string
+	ofClient           openflow.Client
+	flowSyncController *flowsync.Controller
+	podGCController    *podgc.Controller
+}
+
+func NewServer(addr string, ofClient openflow.Client, flowSyncController *flowsync.Controller, podGCController *podgc.Controller) *Server {
+	return &Server{
+		addr:               addr,
+		ofClient:           ofClient,
+		flowSyncController: flowSyncController,
+		podGCController:    podGCController,
+	}
+}
+
+// Run 启动http服务，直到stopCh关闭
+func (s *Server) Run(stopCh <-chan struct{}) {
+	server := &http.Server{Addr: s.addr, Handler: s.Handler()}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	klog.Infof("[server.go]-[Run]-启动调试接口, addr = %s", s.addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("[server.go]-[Run]-调试接口退出, err = %s", err)
+	}
+}
+
+// Handler 返回调试接口的路由
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(flowTablesPath, s.handleFlowTables)
+	mux.HandleFunc(flowSyncPath, s.handleFlowSync)
+	mux.HandleFunc(podGCPath, s.handlePodGC)
+	return mux
+}
+
+func (s *Server) handleFlowTables(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("source") != sourceSwitch {
+		writeJSON(w, s.ofClient.GetFlowTableStatus())
+		return
+	}
+	status, err := s.ofClient.QueryFlowTableStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (s *Server) handleFlowSync(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.flowSyncController.GetStatus())
+}
+
+func (s *Server) handlePodGC(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.podGCController.GetMetrics())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		klog.Errorf("[server.go]-[writeJSON]-返回调试信息失败, err = %s", err)
+	}
+}
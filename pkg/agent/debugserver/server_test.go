@@ -0,0 +1,57 @@
+package debugserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/controller/flowsync"
+	"ciccni/pkg/agent/controller/podgc"
+	"ciccni/pkg/openflow"
+	binding "ciccni/pkg/ovs/openflow"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOFClient 只实现调试接口使用的方法
+type fakeOFClient struct {
+	openflow.Client
+}
+
+func (f *fakeOFClient) GetFlowTableStatus() []binding.TableStatus {
+	return []binding.TableStatus{{ID: 0, FlowCount: 3}}
+}
+
+func (f *fakeOFClient) QueryFlowTableStatus() ([]binding.TableStatus, error) {
+	return []binding.TableStatus{{ID: 0, FlowCount: 2, FromSwitch: true, PacketCount: 10}}, nil
+}
+
+func TestHandler(t *testing.T) {
+	ofClient := &fakeOFClient{}
+	podGCController := podgc.NewPodGCController(nil, nil, ofClient, agent.NewInterfaceStore(), &agent.NodeConfig{}, "", "/opt/cni/bin", time.Minute, false)
+	handler := NewServer("", ofClient, flowsync.NewFlowSyncController(ofClient, time.Minute), podGCController).Handler()
+
+	get := func(path string, v interface{}) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), v))
+	}
+
+	var status []binding.TableStatus
+	get(flowTablesPath, &status)
+	require.Equal(t, []binding.TableStatus{{ID: 0, FlowCount: 3}}, status)
+	get(flowTablesPath+"?source=switch", &status)
+	require.Equal(t, []binding.TableStatus{{ID: 0, FlowCount: 2, FromSwitch: true, PacketCount: 10}}, status)
+
+	var syncStatus flowsync.Status
+	get(flowSyncPath, &syncStatus)
+	require.Equal(t, uint64(0), syncStatus.Rounds)
+
+	var gcMetrics podgc.Metrics
+	get(podGCPath, &gcMetrics)
+	require.Equal(t, podgc.Metrics{}, gcMetrics)
+}
@@ -25,6 +25,10 @@ const (
 	OVSExternalIDContainerID  = "container-id"
 	OVSExternalIDPodName      = "pod-name"
 	OVSExternalIDPodNamespace = "pod-namespace"
+	// OVSExternalIDNetNS 容器的netns路径，agent重启后仍然可以进入容器的netns修改限速配置
+	OVSExternalIDNetNS = "container-netns"
+	// OVSExternalIDIfName 容器内的接口名，回收ipam分配记录时需要与CNI ADD时的接口名一致
+	OVSExternalIDIfName = "container-ifname"
 )
 
 type OVSPortConfig struct {
@@ -41,6 +45,8 @@ type InterfaceConfig struct {
 	PodName string
 	PodNamespace string
 	NetNS string
+	// ContainerIfName 容器内的接口名，旧版本创建的port为空
+	ContainerIfName string
 	*OVSPortConfig
 }
 
@@ -55,7 +61,7 @@ func NewGatewayInterface(gatewayName string) *InterfaceConfig {
 
 // InterfaceStore 缓存接口，支持add/delete/get操作
 type InterfaceStore interface {
-	Initialize(ovsBridgeClient ovs.OVSBridgeClient, tunnelPort string) error
+	Initialize(ovsBridgeClient ovs.OVSBridgeClient, gatewayPort string, tunnelPort string) error
 
 	// AddInterface 对应的key值一般选用{port.Name}
 	AddInterface(ifaceID string, interfaceConfig *InterfaceConfig)
@@ -73,31 +79,41 @@ type interfaceCache struct {
 	cache map[string]*InterfaceConfig
 }
 
-func (i *interfaceCache) Initialize(ovsBridgeClient ovs.OVSBridgeClient, tunnelPort string) error {
+// Initialize 根据ovs网桥上已有的port重建缓存，agent重启后可以通过它找回之前创建的port。
+// gatewayPort和tunnelPort通过port名识别，容器port则通过BuildOVSPortExternalIDs写入的external_ids识别
+func (i *interfaceCache) Initialize(ovsBridgeClient ovs.OVSBridgeClient, gatewayPort string, tunnelPort string) error {
 	ovsPorts, err := ovsBridgeClient.GetPortList()
 	if err != nil {
 		klog.Errorf("[interface_cache.go]-[Initialize]-无法list OVS ports, err=%v", err)
 		return err
 	}
 
+	i.Lock()
+	defer i.Unlock()
 	for _, port := range ovsPorts {
 		portcfg := &OVSPortConfig{IfaceName: port.Name, PortUUID: port.UUID, OFPort: port.OFPort}
 		var interfaceConfig *InterfaceConfig
 		switch {
 		case port.Name == tunnelPort:
 			interfaceConfig = &InterfaceConfig{Type: TunnelInterface, OVSPortConfig: portcfg, ID: tunnelPort}
+		case port.Name == gatewayPort:
+			interfaceConfig = &InterfaceConfig{Type: GatewayInterface, OVSPortConfig: portcfg, ID: gatewayPort}
 		default:
 			if port.ExternalIDs == nil {
 				klog.V(2).Infof("[interface_cache.go]-[Initialize]- OVSport %s 没有external_ids", port.Name)
 				continue
 			}
-			// ovs port中也许会有对应的容器内部的port。但是目前先不写这个逻辑，后续有机会再加入
+			interfaceConfig = ParseContainerAttachInfo(port.ExternalIDs)
+			if interfaceConfig == nil {
+				klog.V(2).Infof("[interface_cache.go]-[Initialize]- OVSport %s 不是容器port, 跳过", port.Name)
+				continue
+			}
+			interfaceConfig.OVSPortConfig = portcfg
 		}
 
 		// 对于每一个port都做一次缓存
-		if interfaceConfig != nil {
-			i.cache[interfaceConfig.IfaceName] = interfaceConfig
-		}
+		klog.V(2).Infof("[interface_cache.go]-[Initialize]-恢复OVSport %s 的缓存, type = %d", port.Name, interfaceConfig.Type)
+		i.cache[interfaceConfig.IfaceName] = interfaceConfig
 	}
 	return nil
 }
@@ -167,9 +183,30 @@ func BuildOVSPortExternalIDs(containerConfig *InterfaceConfig) map[string]interf
 	externalIDs[OVSExternalIDIP] = containerConfig.IP.String()
 	externalIDs[OVSExternalIDPodName] = containerConfig.PodName
 	externalIDs[OVSExternalIDPodNamespace] = containerConfig.PodNamespace
+	externalIDs[OVSExternalIDNetNS] = containerConfig.NetNS
+	externalIDs[OVSExternalIDIfName] = containerConfig.ContainerIfName
 	return externalIDs
 }
 
+// ParseContainerAttachInfo 根据BuildOVSPortExternalIDs写入的external_ids还原容器接口信息。
+// external_ids中没有container-id时返回nil，表示该port不是容器port
+func ParseContainerAttachInfo(externalIDs map[string]string) *InterfaceConfig {
+	containerID, ok := externalIDs[OVSExternalIDContainerID]
+	if !ok || containerID == "" {
+		return nil
+	}
+	containerMAC, err := net.ParseMAC(externalIDs[OVSExternalIDMAC])
+	if err != nil {
+		klog.Warningf("[ParseContainerAttachInfo]-解析容器 %s 的mac地址失败, err=%v", containerID, err)
+	}
+	containerIP := net.ParseIP(externalIDs[OVSExternalIDIP])
+	podName := externalIDs[OVSExternalIDPodName]
+	podNamespace := externalIDs[OVSExternalIDPodNamespace]
+	containerConfig := NewContainerInterfaceConfig(containerID, podName, podNamespace, externalIDs[OVSExternalIDNetNS], containerMAC, containerIP)
+	containerConfig.ContainerIfName = externalIDs[OVSExternalIDIfName]
+	return containerConfig
+}
+
 func (i *interfaceCache) GetContainerInterface(podName string, podNamespace string) (*InterfaceConfig, bool) {
 	ovsPortName := util.GenerateContainerInterfaceName(podName, podNamespace)
 	i.RLock()
@@ -0,0 +1,75 @@
+package agent_test
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/agent/util"
+	"ciccni/pkg/ovs"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOVSBridgeClient 只实现了GetPortList，其余方法不会在InterfaceStore.Initialize中被调用
+type fakeOVSBridgeClient struct {
+	ovs.OVSBridgeClient
+	ports []ovs.OVSPortData
+}
+
+func (f *fakeOVSBridgeClient) GetPortList() ([]ovs.OVSPortData, ovs.Error) {
+	return f.ports, nil
+}
+
+func TestInterfaceStoreInitialize(t *testing.T) {
+	podName, podNamespace := "nginx-7c5ddbdf54-abcde", "default"
+	containerPortName := util.GenerateContainerInterfaceName(podName, podNamespace)
+	containerMAC, _ := net.ParseMAC("aa:bb:cc:00:11:22")
+	containerIP := net.ParseIP("10.244.1.5")
+	containerConfig := agent.NewContainerInterfaceConfig("c0ffee", podName, podNamespace, "/var/run/netns/cni-1234", containerMAC, containerIP)
+	containerConfig.ContainerIfName = "eth0"
+
+	externalIDs := make(map[string]string)
+	for k, v := range agent.BuildOVSPortExternalIDs(containerConfig) {
+		externalIDs[k] = v.(string)
+	}
+	bridge := &fakeOVSBridgeClient{ports: []ovs.OVSPortData{
+		{UUID: "uuid-tun", Name: "tun0", IFName: "tun0", OFPort: 1},
+		{UUID: "uuid-gw", Name: "gw0", IFName: "gw0", OFPort: 2},
+		{UUID: "uuid-pod", Name: containerPortName, IFName: containerPortName, OFPort: 3, ExternalIDs: externalIDs},
+		{UUID: "uuid-other", Name: "other0", IFName: "other0", OFPort: 4, ExternalIDs: map[string]string{"foo": "bar"}},
+		{UUID: "uuid-noids", Name: "noids0", IFName: "noids0", OFPort: 5},
+	}}
+
+	store := agent.NewInterfaceStore()
+	require.NoError(t, store.Initialize(bridge, "gw0", "tun0"))
+	require.Equal(t, 3, store.Len())
+	require.Equal(t, 1, store.GetContainerInterfaceNum())
+
+	tunnel, found := store.GetInterface("tun0")
+	require.True(t, found)
+	require.Equal(t, agent.TunnelInterface, tunnel.Type)
+	require.Equal(t, int32(1), tunnel.OFPort)
+
+	gateway, found := store.GetInterface("gw0")
+	require.True(t, found)
+	require.Equal(t, agent.GatewayInterface, gateway.Type)
+	require.Equal(t, "uuid-gw", gateway.PortUUID)
+
+	container, found := store.GetContainerInterface(podName, podNamespace)
+	require.True(t, found)
+	require.Equal(t, agent.ContainerInterface, container.Type)
+	require.Equal(t, "c0ffee", container.ID)
+	require.Equal(t, podName, container.PodName)
+	require.Equal(t, podNamespace, container.PodNamespace)
+	require.Equal(t, "/var/run/netns/cni-1234", container.NetNS)
+	require.Equal(t, "eth0", container.ContainerIfName)
+	require.Equal(t, containerMAC, container.MAC)
+	require.True(t, containerIP.Equal(container.IP))
+	require.Equal(t, "uuid-pod", container.PortUUID)
+	require.Equal(t, int32(3), container.OFPort)
+
+	_, found = store.GetInterface("other0")
+	require.False(t, found)
+	_, found = store.GetInterface("noids0")
+	require.False(t, found)
+}
@@ -0,0 +1,8 @@
+package types
+
+// RoundInfo agent每次启动对应一个新的round，流表的cookie中带有round，用于识别之前的agent遗留的流表
+type RoundInfo struct {
+	RoundNum uint64
+	// PrevRoundNum 上一次启动的round，总是不为nil。网桥上没有记录时为0，即引入cookie之前安装的流表的round
+	PrevRoundNum *uint64
+}
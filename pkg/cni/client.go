@@ -4,9 +4,11 @@ import (
 	"ciccni/pkg/apis/cni/pb"
 	"ciccni/pkg/logUtils"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -19,6 +21,15 @@ import (
 // CICCNISocketAddr rpc类unix域套接字地址
 const CICCNISocketAddr = "/var/run/ciccni/cni.sock"
 
+const (
+	defaultAddTimeout   = 60 * time.Second
+	defaultDelTimeout   = 60 * time.Second
+	defaultCheckTimeout = 30 * time.Second
+	// agent不可用时以指数退避的方式重试，直到超时
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 2 * time.Second
+)
+
 type Action int
 
 const (
@@ -27,15 +38,66 @@ const (
 	ActionDel
 )
 
+func (a Action) String() string {
+	switch a {
+	case ActionAdd:
+		return "ADD"
+	case ActionCheck:
+		return "CHECK"
+	case ActionDel:
+		return "DEL"
+	}
+	return "UNKNOWN"
+}
+
+// ShimConfig 为cni二进制自身使用的配置，来自network configuration，未配置时使用默认值
+type ShimConfig struct {
+	// CNISocket agent监听的unix域套接字，需要与agent配置中的cniSocket一致
+	CNISocket string `json:"cniSocket,omitempty"`
+	// 各个命令的超时时间，格式与time.ParseDuration相同，例如"30s"
+	AddTimeout   string `json:"addTimeout,omitempty"`
+	DelTimeout   string `json:"delTimeout,omitempty"`
+	CheckTimeout string `json:"checkTimeout,omitempty"`
+}
+
+// loadShimConfig 从network configuration中解析socket地址以及action对应的超时时间
+func loadShimConfig(stdinData []byte, a Action) (string, time.Duration, error) {
+	conf := &ShimConfig{}
+	if err := json.Unmarshal(stdinData, conf); err != nil {
+		return "", 0, fmt.Errorf("failed to decode network config: %v", err)
+	}
+	socket := conf.CNISocket
+	if socket == "" {
+		socket = CICCNISocketAddr
+	}
+
+	timeout, timeoutStr := defaultAddTimeout, conf.AddTimeout
+	switch a {
+	case ActionDel:
+		timeout, timeoutStr = defaultDelTimeout, conf.DelTimeout
+	case ActionCheck:
+		timeout, timeoutStr = defaultCheckTimeout, conf.CheckTimeout
+	}
+	if timeoutStr != "" {
+		d, err := time.ParseDuration(timeoutStr)
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("invalid %s timeout %q", a, timeoutStr)
+		}
+		timeout = d
+	}
+	return socket, timeout, nil
+}
+
 var withClient = rpcClient
 
-func rpcClient(f func(client pb.CniClient) error) error {
+func rpcClient(socket string, f func(client pb.CniClient) error) error {
 	conn, err := grpc.Dial(
-		CICCNISocketAddr,
+		socket,
 		//grpc.WithInsecure(),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithContextDialer(func(ctx context.Context, addr string) (conn net.Conn, e error) {
-			return net.Dial("unix", addr)
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
 		}),
 	)
 	if err != nil {
@@ -47,65 +109,15 @@ func rpcClient(f func(client pb.CniClient) error) error {
 }
 
 func (a Action) Request(arg *skel.CmdArgs) error {
-	return withClient(func(client pb.CniClient) error {
-		request := &pb.CniCmdRequest{CniArgs: &pb.CniCmdArgs{
-			ContainerId:          arg.ContainerID,
-			Ifname:               arg.IfName,
-			Args:                 arg.Args,
-			Netns:                arg.Netns,
-			NetworkConfiguration: arg.StdinData,
-			Path:                 arg.Path,
-		}}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		var err error
-		var resp *pb.CniCmdResponse
-
-		switch a {
-		case ActionAdd:
-			resp, err = client.CmdAdd(ctx, request)
-		case ActionDel:
-			resp, err = client.CmdDel(ctx, request)
-		case ActionCheck:
-			resp, err = client.CmdCheck(ctx, request)
-		}
-
-		if status.Code(err) == codes.Unimplemented {
-			return &types.Error{
-				Code:    uint(pb.ErrorCode_INCOMPATIBLE_API_VERSION),
-				Msg:     "incompatible CNI API version between client (antrea-cni) and server (antrea-agent)",
-				Details: fmt.Sprintf("service or method unimplemented by gRPC server: %v", err.Error()),
-			}
-		} else if status.Code(err) == codes.Unavailable || status.Code(err) == codes.DeadlineExceeded {
-			// network errors, could be transient.
-			return &types.Error{
-				Code: uint(pb.ErrorCode_TRY_AGAIN_LATER),
-				Msg:  err.Error(),
-			}
-		} else if err != nil { // all other RPC errors.
-			return &types.Error{
-				Code: uint(pb.ErrorCode_UNKNOWN_RPC_ERROR),
-				Msg:  err.Error(),
-			}
-		}
-
-		// Handle errors during CNI execution.
-		if resp.Error != nil {
-			return &types.Error{
-				Code: uint(resp.Error.Code),
-				Msg:  resp.Error.Message,
-			}
+	socket, timeout, err := loadShimConfig(arg.StdinData, a)
+	if err != nil {
+		return &types.Error{
+			Code: uint(pb.ErrorCode_DECODING_FAILURE),
+			Msg:  err.Error(),
 		}
-		os.Stdout.Write(resp.CniResult) // cni处理返回结果必须要返回给stdout
-
-		return nil
-	})
-
-}
+	}
 
-func CmdAdd(arg *skel.CmdArgs) error {
-	return withClient(func(client pb.CniClient) error {
+	return withClient(socket, func(client pb.CniClient) error {
 		request := &pb.CniCmdRequest{CniArgs: &pb.CniCmdArgs{
 			ContainerId:          arg.ContainerID,
 			Ifname:               arg.IfName,
@@ -115,15 +127,9 @@ func CmdAdd(arg *skel.CmdArgs) error {
 			Path:                 arg.Path,
 		}}
 
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
-
-		resp, err := client.CmdAdd(ctx, request)
-		// if err != nil {
-
-		// 	logUtils.Log.Errorf("[client.go]-[CmdAdd]-调用rpc请求CmdAdd失败, err=%s", err)
-		// 	return err
-		// }
+		resp, err := a.requestWithRetry(ctx, client, request)
 
 		if status.Code(err) == codes.Unimplemented {
 			return &types.Error{
@@ -134,8 +140,9 @@ func CmdAdd(arg *skel.CmdArgs) error {
 		} else if status.Code(err) == codes.Unavailable || status.Code(err) == codes.DeadlineExceeded {
 			// network errors, could be transient.
 			return &types.Error{
-				Code: uint(pb.ErrorCode_TRY_AGAIN_LATER),
-				Msg:  err.Error(),
+				Code:    uint(pb.ErrorCode_TRY_AGAIN_LATER),
+				Msg:     err.Error(),
+				Details: fmt.Sprintf("CNI %s against %s did not finish within %v", a, socket, timeout),
 			}
 		} else if err != nil { // all other RPC errors.
 			return &types.Error{
@@ -155,9 +162,33 @@ func CmdAdd(arg *skel.CmdArgs) error {
 
 		return nil
 	})
-
 }
 
-func CmdDel(arg *skel.CmdArgs) error {
-	return nil
+// requestWithRetry 发送请求，agent不可用（例如正在重启）时以指数退避的方式重试，直到ctx超时
+func (a Action) requestWithRetry(ctx context.Context, client pb.CniClient, request *pb.CniCmdRequest) (*pb.CniCmdResponse, error) {
+	interval := minRetryInterval
+	for {
+		var resp *pb.CniCmdResponse
+		var err error
+		switch a {
+		case ActionAdd:
+			resp, err = client.CmdAdd(ctx, request)
+		case ActionDel:
+			resp, err = client.CmdDel(ctx, request)
+		case ActionCheck:
+			resp, err = client.CmdCheck(ctx, request)
+		}
+		if status.Code(err) != codes.Unavailable {
+			return resp, err
+		}
+		logUtils.Log.Warnf("[client.go]-[requestWithRetry]-agent不可用, %v后重试, err=%s", interval, err)
+		select {
+		case <-ctx.Done():
+			return nil, status.Error(codes.DeadlineExceeded, fmt.Sprintf("%v, last error: %v", ctx.Err(), err))
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
 }
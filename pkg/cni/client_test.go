@@ -0,0 +1,101 @@
+package cni_test
+
+import (
+	"ciccni/pkg/apis/cni/pb"
+	"ciccni/pkg/cni"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakeCniServer CmdAdd会一直阻塞到请求超时，CmdDel直接返回成功
+type fakeCniServer struct {
+	pb.UnimplementedCniServer
+}
+
+func (s *fakeCniServer) CmdAdd(ctx context.Context, request *pb.CniCmdRequest) (*pb.CniCmdResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *fakeCniServer) CmdDel(ctx context.Context, request *pb.CniCmdRequest) (*pb.CniCmdResponse, error) {
+	return &pb.CniCmdResponse{CniResult: []byte("")}, nil
+}
+
+func startFakeCniServer(t *testing.T, socket string) {
+	server, err := serveFakeCniServer(socket)
+	require.NoError(t, err)
+	t.Cleanup(server.Stop)
+}
+
+// serveFakeCniServer 在socket上启动fakeCniServer，不依赖testing.T，可以在其它goroutine中调用
+func serveFakeCniServer(socket string) (*grpc.Server, error) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer()
+	pb.RegisterCniServer(server, &fakeCniServer{})
+	go server.Serve(listener)
+	return server, nil
+}
+
+func cmdArgs(socket string, extra string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: "c1",
+		IfName:      "eth0",
+		StdinData:   []byte(fmt.Sprintf(`{"cniVersion":"0.4.0","name":"ciccni","type":"ciccni","cniSocket":%q%s}`, socket, extra)),
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	startFakeCniServer(t, socket)
+
+	start := time.Now()
+	err := cni.ActionAdd.Request(cmdArgs(socket, `,"addTimeout":"200ms"`))
+	require.Error(t, err)
+	require.Equal(t, uint(pb.ErrorCode_TRY_AGAIN_LATER), err.(*types.Error).Code)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRequestRetryUntilAgentAvailable(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	// socket在请求发出之后才创建，server启动的结果通过channel交给测试goroutine检查
+	type result struct {
+		server *grpc.Server
+		err    error
+	}
+	started := make(chan result, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server, err := serveFakeCniServer(socket)
+		started <- result{server, err}
+	}()
+	err := cni.ActionDel.Request(cmdArgs(socket, `,"delTimeout":"5s"`))
+	res := <-started
+	require.NoError(t, res.err)
+	defer res.server.Stop()
+	require.NoError(t, err)
+}
+
+func TestRequestAgentUnavailable(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	err := cni.ActionDel.Request(cmdArgs(socket, `,"delTimeout":"300ms"`))
+	require.Error(t, err)
+	require.Equal(t, uint(pb.ErrorCode_TRY_AGAIN_LATER), err.(*types.Error).Code)
+}
+
+func TestRequestInvalidTimeout(t *testing.T) {
+	err := cni.ActionAdd.Request(cmdArgs("/nonexistent.sock", `,"addTimeout":"soon"`))
+	require.Error(t, err)
+	require.Equal(t, uint(pb.ErrorCode_DECODING_FAILURE), err.(*types.Error).Code)
+}
@@ -0,0 +1,14 @@
+package cni
+
+// SupportedCNIVersions 为ciccni支持的CNI spec版本，cni二进制与agent使用同一份列表进行版本协商
+var SupportedCNIVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// IsCNIVersionSupported 判断cniVersion是否在SupportedCNIVersions中
+func IsCNIVersionSupported(cniVersion string) bool {
+	for _, v := range SupportedCNIVersions {
+		if v == cniVersion {
+			return true
+		}
+	}
+	return false
+}
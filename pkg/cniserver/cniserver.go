@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"ciccni/pkg/agent"
 	"ciccni/pkg/apis/cni/pb"
+	"ciccni/pkg/cni"
 	"ciccni/pkg/cniserver/ipam"
 	"ciccni/pkg/openflow"
 	"ciccni/pkg/ovs"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/types"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
+	cniversion "github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"google.golang.org/grpc"
@@ -119,6 +121,8 @@ func (cniServer *CniServer) CmdAdd(ctx context.Context, request *pb.CniCmdReques
 		cniServer.ofClient,
 		cniServer.ifaceStore,
 		cniServer.k8sClient,
+		cniServer.nodeConfig.Gateway.MAC,
+		cniServer.nodeConfig.ClusterPodCIDR,
 		podName, podNamespace,
 		cniConfig.ContainerId,
 		netNS,
@@ -134,20 +138,37 @@ func (cniServer *CniServer) CmdAdd(ctx context.Context, request *pb.CniCmdReques
 	result.DNS = cniConfig.DNS
 
 	// 封装result
-	var resultBytes bytes.Buffer
-	resultAsCurrent, _ := result.GetAsVersion(cniConfig.CNIVersion) // 不妨假设配置项中的version一定是正确的
-	resultAsCurrent.PrintTo(&resultBytes)
-	klog.Infof("[CmdAdd]-CmdAdd request success, resp=%s", resultBytes.String())
-	resp := &pb.CniCmdResponse{CniResult: resultBytes.Bytes()}
+	resp := cniServer.resultResponse(result, cniConfig.CNIVersion)
+	klog.Infof("[CmdAdd]-CmdAdd request finished, resp=%s", resp)
 	return resp, nil
 }
 
+// resultResponse 将result按照配置中的cniVersion编码为response，cniVersion已经在checkReuquestMessage中校验过
+func (cniServer *CniServer) resultResponse(result *types100.Result, cniVersion string) *pb.CniCmdResponse {
+	var resultBytes bytes.Buffer
+	resultAsVersion, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		klog.Errorf("[resultResponse]-无法将result转换为版本%s, err=%s", cniVersion, err)
+		return cniServer.incompatibleCNIVersionResponse(cniVersion)
+	}
+	if err := resultAsVersion.PrintTo(&resultBytes); err != nil {
+		return cniServer.generateCNIErrorResponse(pb.ErrorCode_IO_FAILURE, fmt.Sprintf("fail to encode result: %s", err))
+	}
+	return &pb.CniCmdResponse{CniResult: resultBytes.Bytes()}
+}
+
 func (cniServer *CniServer) CmdDel(ctx context.Context, request *pb.CniCmdRequest) (*pb.CniCmdResponse, error) {
 	klog.Infof("[CmdDel]-接收到CmdDel参数: %s", request)
 	cniConfig, response := cniServer.checkReuquestMessage(request)
 	if response != nil {
 		return response, nil
 	}
+	// 1.0.0起DEL也会带上prevResult，它只用于日志；解析失败不影响资源的释放
+	if prevResult, err := parsePrevResult(cniConfig.NetworkConfig); err != nil {
+		klog.Warningf("[CmdDel]-解析prevResult失败, 忽略, err=%s", err)
+	} else if prevResult != nil {
+		klog.Infof("[CmdDel]-container %s 的prevResult: ips=%v", cniConfig.ContainerId, prevResult.IPs)
+	}
 	if err := ipam.ExecIPAMDelete(cniConfig.CniCmdArgs, cniConfig.IPAM.Type); err != nil {
 		klog.Errorf("[CmdDel]-释放IPAM中ip地址失败, err=%s", err)
 		return cniServer.ipamFailureResponse(err), nil
@@ -174,12 +195,56 @@ func (cniServer *CniServer) CmdDel(ctx context.Context, request *pb.CniCmdReques
 	}, nil
 }
 
+// CmdCheck 检查pod的网络配置是否与ADD时一致：容器内veth的ip/mac/mtu、host端veth在ovs网桥上的external_ids、
+// InterfaceStore中的缓存以及ipam插件中的分配记录。任何一项不一致都会返回CHECK_INTERFACE_FAILURE
 func (cniServer *CniServer) CmdCheck(ctx context.Context, request *pb.CniCmdRequest) (*pb.CniCmdResponse, error) {
 	klog.Infof("[CmdCheck]-接收到CmdCheck参数: %s", request)
-	_, response := cniServer.checkReuquestMessage(request)
+	cniConfig, response := cniServer.checkReuquestMessage(request)
 	if response != nil {
 		return response, nil
 	}
+
+	// CHECK从0.4.0开始才被引入，并且要求必须带上prevResult
+	if gt, err := cniversion.GreaterThanOrEqualTo(cniConfig.CNIVersion, "0.4.0"); err != nil || !gt {
+		return cniServer.incompatibleCNIVersionResponse(cniConfig.CNIVersion), nil
+	}
+	prevResult, err := parsePrevResult(cniConfig.NetworkConfig)
+	if err != nil {
+		klog.Errorf("[CmdCheck]-解析prevResult失败, err=%s", err)
+		return cniServer.generateCNIErrorResponse(
+			pb.ErrorCode_DECODING_FAILURE,
+			fmt.Sprintf("fail to decode prevResult: %s", err),
+		), nil
+	}
+	if prevResult == nil {
+		return cniServer.generateCNIErrorResponse(
+			pb.ErrorCode_INVALID_NETWORK_CONFIG,
+			"prevResult is required for CHECK",
+		), nil
+	}
+
+	if err := ipam.ExecIPAMCheck(cniConfig.CniCmdArgs, cniConfig.IPAM.Type); err != nil {
+		klog.Errorf("[CmdCheck]-ipam检查失败, err=%s", err)
+		return cniServer.checkInterfaceFailureResponse(fmt.Errorf("IPAM check failed: %v", err)), nil
+	}
+
+	podName := string(cniConfig.K8S_POD_NAME)
+	podNamespace := string(cniConfig.K8S_POD_NAMESPACE)
+	netNS := cniServer.hostNetNSPath(cniConfig.Netns)
+	if err := checkInterfaces(
+		cniServer.ovsBridgeClient,
+		cniServer.ifaceStore,
+		podName,
+		podNamespace,
+		cniConfig.ContainerId,
+		netNS,
+		cniConfig.Ifname,
+		cniConfig.MTU,
+		prevResult,
+	); err != nil {
+		klog.Errorf("[CmdCheck]-检查pod %s/%s 的网络配置失败, err=%s", podNamespace, podName, err)
+		return cniServer.checkInterfaceFailureResponse(err), nil
+	}
 	return &pb.CniCmdResponse{
 		CniResult: []byte(""),
 	}, nil
@@ -196,9 +261,14 @@ func (cniServer *CniServer) checkReuquestMessage(request *pb.CniCmdRequest) (*CN
 	}
 	cniVersion := cniConfig.CNIVersion
 	if !cniServer.isCNIVersionSupported(cniVersion) {
+		klog.Errorf("[checkReuquestMessage]-不支持的cniVersion: %s", cniVersion)
+		return nil, cniServer.incompatibleCNIVersionResponse(cniVersion)
+	}
+	if !ipam.IsIPAMTypeValid(cniConfig.IPAM.Type) {
+		klog.Errorf("[checkReuquestMessage]-未注册的ipam类型: %s", cniConfig.IPAM.Type)
 		return nil, cniServer.generateCNIErrorResponse(
-			pb.ErrorCode_UNSUPPORTED_FIELD,
-			"unsupprted cniVersion provided: "+cniVersion,
+			pb.ErrorCode_INVALID_NETWORK_CONFIG,
+			"unsupported IPAM type provided: "+cniConfig.IPAM.Type,
 		)
 	}
 
@@ -235,9 +305,16 @@ func (cniServer *CniServer) generateCNIErrorResponse(cniErrorCode pb.ErrorCode,
 	}
 }
 
-// TODO: 目前仅支持0.3.0，日后可考虑兼容性问题？
+// isCNIVersionSupported 支持的版本见cni.SupportedCNIVersions，与cni二进制中PluginSupports的列表一致
 func (cniServer *CniServer) isCNIVersionSupported(cniVersion string) bool {
-	return true
+	return cni.IsCNIVersionSupported(cniVersion)
+}
+
+func (cniServer *CniServer) incompatibleCNIVersionResponse(cniVersion string) *pb.CniCmdResponse {
+	return cniServer.generateCNIErrorResponse(
+		pb.ErrorCode_INCOMPATIBLE_CNI_VERSION,
+		fmt.Sprintf("unsupported CNI version %q, supported versions: %s", cniVersion, strings.Join(cni.SupportedCNIVersions, ", ")),
+	)
 }
 
 func (cniServer *CniServer) hostNetNSPath(nsPath string) string {
@@ -262,11 +339,20 @@ func (cniServer *CniServer) configureInterfaceFailureResponse(err error) *pb.Cni
 	)
 }
 
+func (cniServer *CniServer) checkInterfaceFailureResponse(err error) *pb.CniCmdResponse {
+	return cniServer.generateCNIErrorResponse(
+		pb.ErrorCode_CHECK_INTERFACE_FAILURE,
+		fmt.Sprintf("网络配置检查失败, err=%s", err),
+	)
+}
+
 func configureInterface(
 	ovsBridge ovs.OVSBridgeClient, // 配置网桥端口
 	ofClient openflow.Client, // 为新加入的端口配置流表规则
 	ifaceStore agent.InterfaceStore, // 缓存新加入的接口
 	k8sClient kubernetes.Interface,
+	gatewayMAC net.HardwareAddr,
+	clusterCIDR *net.IPNet, // 集群的pod网段，用于区分出方向限速的范围
 	podName string,
 	podNamespace string,
 	containerID string,
@@ -298,7 +384,7 @@ func configureInterface(
 		klog.Errorf("[cniserver.go]-[configureInterface]-创建tc配置失败, err=%s", err)
 	}
 	// 注： tcArgs可能为空
-	hostIface, containerIface, err := setupVethPair(podName, podNamespace, ifname, netns, MTU, tcArgs)
+	hostIface, containerIface, err := setupVethPair(podName, podNamespace, ifname, netns, MTU, tcArgs, clusterCIDR)
 	if err != nil {
 		return err
 	}
@@ -325,14 +411,29 @@ func configureInterface(
 		}
 	}()
 
-	// 3.2 coreDNS的流表规则写入
+	ofPort, err := ovsBridge.GetOFPort(ovsPortName)
+	if err != nil {
+		klog.Errorf("Failed to get of_port of OVS interface %s: %v", ovsPortName, err)
+		return err
+	}
+
+	// 3.3 安装pod的classifier、spoofguard以及l2/l3转发流表，以containerID为key
+	klog.Infof("[configureInterface]-3.3 为container %s 安装pod流表, ofPort = %d", containerID, ofPort)
+	if err := ofClient.InstallPodFlows(containerID, containerConfig.IP, containerConfig.MAC, gatewayMAC, uint32(ofPort)); err != nil {
+		klog.Errorf("[configureInterface]-安装pod流表失败, err=%s", err)
+		return err
+	}
+	defer func() {
+		if !success {
+			if err := ofClient.UninstallPodFlows(containerID); err != nil {
+				klog.Errorf("[configureInterface]-回滚pod流表失败, containerID = %s, err = %s", containerID, err)
+			}
+		}
+	}()
+
+	// 3.4 coreDNS的流表规则写入
 	if strings.HasPrefix(podName, "coredns") && podNamespace == "kube-system" {
 		klog.Infof("[configureInterface]-coreDNS流表规则写入中...")
-		ofPortNum, err := ovsBridge.GetOFPort(ovsPortName)
-		if err != nil {
-			klog.Errorf("[configueInterface]-无法获取%s的ovs端口", ovsPortName)
-			return err
-		}
 
 		// 如果为coredns，还需要获取coreDNS对应的serviceIP
 
@@ -341,14 +442,15 @@ func configureInterface(
 			Get(context.TODO(), "kube-dns", metav1.GetOptions{})
 		if err2 != nil {
 			klog.Errorf("[configureInterface]-无法通过clientset获取kube-dns服务, err = %s", err2)
+			return err2
 		}
 		serviceIPString := kubedns.Spec.ClusterIP
 		serviceIP := net.ParseIP(serviceIPString)
 
-		err2 = ofClient.InstallCorednsFlow(uint32(ofPortNum), containerID, serviceIP)
+		err2 = ofClient.InstallCorednsFlow(uint32(ofPort), containerID, serviceIP)
 		if err2 != nil {
 			klog.Errorf("[configureInterface]-创建coreDns流表规则失败, err=%s", err2)
-			return err
+			return err2
 		}
 
 		defer func() {
@@ -369,18 +471,7 @@ func configureInterface(
 		return err
 	}
 
-	// 5. 配置该端口的流表规则。感觉不用配置流表规则了
-	// ofPort, err := ovsBridge.GetOFPort(ovsPortName)
-	// if err != nil {
-	// 	klog.Errorf("[cniserver.go]-[configureInterface]-5. GetOfPort %s error, err=%s",ovsPortName, err)
-	// }
-
-	// 6. 配置信息写入local cache中
-	ofPort, err := ovsBridge.GetOFPort(ovsPortName)
-	if err != nil {
-		klog.Errorf("Failed to get of_port of OVS interface %s: %v", ovsPortName, err)
-		return err
-	}
+	// 5. 配置信息写入local cache中
 	containerConfig.OVSPortConfig = &agent.OVSPortConfig{PortUUID: portUUID, IfaceName: ovsPortName, OFPort: ofPort}
 	klog.Infof("[configureInterface]-缓存接口信息, key = %s, value = %s", containerConfig.IfaceName, containerConfig.String())
 	ifaceStore.AddInterface(containerConfig.IfaceName, containerConfig)
@@ -405,6 +496,22 @@ func removeInterfaces(
 		klog.Infof("Target netns not specified, not removing veth pair")
 	}
 	interfaceConfig, found := ifaceStore.GetContainerInterface(podName, podNamepsace)
+	if found && interfaceConfig.ID != containerID {
+		// pod重建后，旧sandbox的DEL可能晚于新sandbox的ADD到达，此时不能删除新container的port以及流表
+		klog.Infof("[removeInterfaces]-pod %s/%s 的port属于container %s, 跳过container %s", podNamepsace, podName, interfaceConfig.ID, containerID)
+		return nil
+	}
+
+	// 流表以containerID为key，即使local cache中没有对应的port也需要删除
+	if err := ofCient.UninstallCorednsFlow(containerID); err != nil {
+		klog.Errorf("[removeInterfaces]-删除coreDNS流表失败, containerID = %s, err = %s", containerID, err)
+		return err
+	}
+	if err := ofCient.UninstallPodFlows(containerID); err != nil {
+		klog.Errorf("[removeInterfaces]-删除pod流表失败, containerID = %s, err = %s", containerID, err)
+		return err
+	}
+
 	if !found {
 		klog.Errorf("[removeInterfaces]-无法在local cache中找到port, containerID = %s", containerID)
 		return nil
@@ -422,6 +529,42 @@ func removeInterfaces(
 	return nil
 }
 
+// checkInterfaces 以InterfaceStore中缓存的接口信息为准，检查容器内veth、ovs port以及prevResult是否与之一致
+func checkInterfaces(
+	ovsBridgeClient ovs.OVSBridgeClient,
+	ifaceStore agent.InterfaceStore,
+	podName string,
+	podNamespace string,
+	containerID string,
+	containerNetns string,
+	ifname string,
+	MTU int,
+	prevResult *types100.Result,
+) error {
+	containerConfig, found := ifaceStore.GetContainerInterface(podName, podNamespace)
+	if !found {
+		return fmt.Errorf("interface of pod %s/%s not found in interface store", podNamespace, podName)
+	}
+	if containerConfig.ID != containerID {
+		return fmt.Errorf("interface of pod %s/%s belongs to container %s, not %s", podNamespace, podName, containerConfig.ID, containerID)
+	}
+
+	if prevResult != nil {
+		if err := checkPrevResult(containerConfig, ifname, prevResult); err != nil {
+			return err
+		}
+	}
+
+	peerIndex, err := checkContainerInterface(containerNetns, ifname, containerConfig, MTU)
+	if err != nil {
+		return err
+	}
+	if err := checkHostInterface(ovsBridgeClient, containerConfig, peerIndex); err != nil {
+		return err
+	}
+	return nil
+}
+
 // buildContainerConfig 返回interfaceConfig，返回值用于构造网桥端口，同时写入local cache中
 func buildContainerConfig(containerID, podName, podNamespace string, containerIface *types100.Interface, IPs []*types100.IPConfig) *agent.InterfaceConfig {
 	containerIP, err := parseContainerIP(IPs)
@@ -430,7 +573,25 @@ func buildContainerConfig(containerID, podName, podNamespace string, containerIf
 		return nil
 	}
 	containerMAC, _ := net.ParseMAC(containerIface.Mac)
-	return agent.NewContainerInterfaceConfig(containerID, podName, podNamespace, containerIface.Sandbox, containerMAC, containerIP)
+	containerConfig := agent.NewContainerInterfaceConfig(containerID, podName, podNamespace, containerIface.Sandbox, containerMAC, containerIP)
+	containerConfig.ContainerIfName = containerIface.Name
+	return containerConfig
+}
+
+// parsePrevResult 将NetworkConfig中的prevResult解析为当前版本的result，没有prevResult时返回nil
+func parsePrevResult(networkConfig *NetworkConfig) (*types100.Result, error) {
+	if networkConfig.RawPrevResult == nil {
+		return nil, nil
+	}
+	resultBytes, err := json.Marshal(networkConfig.RawPrevResult)
+	if err != nil {
+		return nil, err
+	}
+	prevResult, err := cniversion.NewResult(networkConfig.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, err
+	}
+	return types100.NewResultFromResult(prevResult)
 }
 
 func parseContainerIP(IPs []*types100.IPConfig) (net.IP, error) {
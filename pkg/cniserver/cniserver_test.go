@@ -0,0 +1,161 @@
+package cniserver
+
+import (
+	"ciccni/pkg/agent"
+	"ciccni/pkg/apis/cni/pb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer() *CniServer {
+	_, podCIDR, _ := net.ParseCIDR("10.244.1.0/24")
+	return New("", &agent.NodeConfig{NodeName: "node1", PodCIDR: podCIDR}, 1450, "", nil, nil, agent.NewInterfaceStore(), nil)
+}
+
+// newRequest 构造CNI请求，prevResult为空时不携带prevResult
+func newRequest(cniVersion string, prevResult string) *pb.CniCmdRequest {
+	networkConfig := fmt.Sprintf(`{"cniVersion":%q,"name":"ciccni","type":"ciccni","ipam":{"type":"host-local"}`, cniVersion)
+	if prevResult != "" {
+		networkConfig += `,"prevResult":` + prevResult
+	}
+	networkConfig += "}"
+	return &pb.CniCmdRequest{CniArgs: &pb.CniCmdArgs{
+		ContainerId:          "c0ffee",
+		Netns:                "/var/run/netns/test",
+		Ifname:               "eth0",
+		Args:                 "K8S_POD_NAME=web;K8S_POD_NAMESPACE=default",
+		Path:                 "/opt/cni/bin",
+		NetworkConfiguration: []byte(networkConfig),
+	}}
+}
+
+func TestCheckRequestMessageVersion(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		cniVersion string
+		supported  bool
+	}{
+		{"0.3.0", true},
+		{"0.3.1", true},
+		{"0.4.0", true},
+		{"1.0.0", true},
+		{"", false},
+		{"0.2.0", false},
+		{"1.1.0", false},
+		{"2.0.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cniVersion, func(t *testing.T) {
+			cniConfig, response := server.checkReuquestMessage(newRequest(tt.cniVersion, ""))
+			if tt.supported {
+				require.Nil(t, response)
+				require.Equal(t, tt.cniVersion, cniConfig.CNIVersion)
+				require.Equal(t, "web", string(cniConfig.K8S_POD_NAME))
+				require.Equal(t, "10.244.1.0/24", cniConfig.IPAM.Subnet)
+				require.Equal(t, 1450, cniConfig.MTU)
+				return
+			}
+			require.Nil(t, cniConfig)
+			require.Equal(t, pb.ErrorCode_INCOMPATIBLE_CNI_VERSION, response.Error.Code)
+		})
+	}
+
+	_, response := server.checkReuquestMessage(&pb.CniCmdRequest{CniArgs: &pb.CniCmdArgs{NetworkConfiguration: []byte("{")}})
+	require.Equal(t, pb.ErrorCode_DECODING_FAILURE, response.Error.Code)
+}
+
+func TestCmdCheckRequest(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		name       string
+		cniVersion string
+		prevResult string
+		code       pb.ErrorCode
+	}{
+		// CHECK从0.4.0开始才被引入
+		{"0.3.1 rejected", "0.3.1", `{"cniVersion":"0.3.1"}`, pb.ErrorCode_INCOMPATIBLE_CNI_VERSION},
+		{"0.3.0 rejected", "0.3.0", "", pb.ErrorCode_INCOMPATIBLE_CNI_VERSION},
+		{"unsupported version", "9.9.9", "", pb.ErrorCode_INCOMPATIBLE_CNI_VERSION},
+		{"0.4.0 without prevResult", "0.4.0", "", pb.ErrorCode_INVALID_NETWORK_CONFIG},
+		{"1.0.0 without prevResult", "1.0.0", "", pb.ErrorCode_INVALID_NETWORK_CONFIG},
+		{"malformed prevResult", "1.0.0", `{"cniVersion":"1.0.0","ips":"bad"}`, pb.ErrorCode_DECODING_FAILURE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := server.CmdCheck(context.TODO(), newRequest(tt.cniVersion, tt.prevResult))
+			require.NoError(t, err)
+			require.NotNil(t, response.Error)
+			require.Equal(t, tt.code, response.Error.Code)
+		})
+	}
+}
+
+func TestResultResponse(t *testing.T) {
+	server := newTestServer()
+	_, address, _ := net.ParseCIDR("10.244.1.5/24")
+	address.IP = net.ParseIP("10.244.1.5")
+	interfaceIndex := 1
+	result := &types100.Result{
+		CNIVersion: types100.ImplementedSpecVersion,
+		Interfaces: []*types100.Interface{{Name: "veth0"}, {Name: "eth0", Sandbox: "/var/run/netns/test"}},
+		IPs:        []*types100.IPConfig{{Interface: &interfaceIndex, Address: *address, Gateway: net.ParseIP("10.244.1.1")}},
+	}
+
+	tests := []struct {
+		cniVersion string
+		// 0.3.x以及0.4.0的result中ip带有version字段，1.0.0中去掉了
+		ipVersion interface{}
+	}{
+		{"0.3.0", "4"},
+		{"0.3.1", "4"},
+		{"0.4.0", "4"},
+		{"1.0.0", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cniVersion, func(t *testing.T) {
+			response := server.resultResponse(result, tt.cniVersion)
+			require.Nil(t, response.Error)
+
+			var decoded struct {
+				CNIVersion string                   `json:"cniVersion"`
+				Interfaces []map[string]interface{} `json:"interfaces"`
+				IPs        []map[string]interface{} `json:"ips"`
+			}
+			require.NoError(t, json.Unmarshal(response.CniResult, &decoded))
+			require.Equal(t, tt.cniVersion, decoded.CNIVersion)
+			require.Len(t, decoded.Interfaces, 2)
+			require.Len(t, decoded.IPs, 1)
+			require.Equal(t, "10.244.1.5/24", decoded.IPs[0]["address"])
+			require.Equal(t, float64(1), decoded.IPs[0]["interface"])
+			require.Equal(t, tt.ipVersion, decoded.IPs[0]["version"])
+		})
+	}
+
+	response := server.resultResponse(result, "9.9.9")
+	require.Equal(t, pb.ErrorCode_INCOMPATIBLE_CNI_VERSION, response.Error.Code)
+}
+
+func TestCheckOVSPortExternalIDs(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:00:11:22")
+	containerConfig := agent.NewContainerInterfaceConfig("c0ffee", "nginx", "default", "/var/run/netns/cni-1234", mac, net.ParseIP("10.244.1.5"))
+	containerConfig.ContainerIfName = "eth0"
+	externalIDs := map[string]string{}
+	for k, v := range agent.BuildOVSPortExternalIDs(containerConfig) {
+		externalIDs[k] = v.(string)
+	}
+	require.NoError(t, checkOVSPortExternalIDs("nginx-abcd", containerConfig, externalIDs))
+
+	// 旧版本创建的port没有container-netns以及container-ifname，CHECK仍然通过
+	delete(externalIDs, agent.OVSExternalIDNetNS)
+	delete(externalIDs, agent.OVSExternalIDIfName)
+	require.NoError(t, checkOVSPortExternalIDs("nginx-abcd", containerConfig, externalIDs))
+
+	externalIDs[agent.OVSExternalIDNetNS] = "/var/run/netns/other"
+	require.Error(t, checkOVSPortExternalIDs("nginx-abcd", containerConfig, externalIDs))
+}
@@ -72,6 +72,10 @@ func (d *IPAMDelegator) Check(args *invoke.Args, networkConfig []byte) error {
 	return nil
 }
 
+func (d *IPAMDelegator) Capabilities() IPAMCapabilities {
+	return IPAMCapabilities{InProcess: false, Persistent: true, Check: true}
+}
+
 var defaultExec = &invoke.DefaultExec{
 	RawExec: &invoke.RawExec{Stderr: os.Stderr},
 }
@@ -94,8 +98,11 @@ func delegateWithResult(delegatePlugin string, networkConfig []byte, args *invok
 	}
 
 	res, err := invoke.ExecPluginWithResult(ctx, pluginPath, networkConfig, args, realExec)
-	res040, err := current.NewResultFromResult(res)
-	return res040, err
+	if err != nil {
+		return nil, err
+	}
+	// ipam插件按照配置中的cniVersion返回结果，这里统一转换为当前版本
+	return current.NewResultFromResult(res)
 }
 
 func delegateNoResult(delegatePlugin string, networkConfig []byte, args *invoke.Args) error {
@@ -0,0 +1,251 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"k8s.io/klog"
+)
+
+const (
+	// IPAM_NATIVE 在agent进程内直接从node的PodCIDR中分配地址，不需要额外的ipam二进制
+	IPAM_NATIVE = "ciccni-ipam"
+
+	defaultNativeIPAMDataDir = "/var/lib/cni/ciccni"
+	nativeIPAMDataFile       = "allocations.json"
+)
+
+// nativeIPAMStore 是持久化到本地文件中的分配记录
+type nativeIPAMStore struct {
+	Subnet string `json:"subnet"`
+	// Allocations key为containerID，value为分配的ip
+	Allocations map[string]string `json:"allocations"`
+	// LastReserved 上一次分配的ip，下一次从它之后开始查找，避免刚释放的地址马上被复用
+	LastReserved string `json:"lastReserved,omitempty"`
+}
+
+// NativeIPAMDriver 在进程内从ipam配置中的subnet（即node的PodCIDR）分配地址，网关地址会被预留。
+// 分配记录保存在本地文件中，agent重启后不会丢失；对同一个containerID重复执行ADD/DEL是幂等的
+type NativeIPAMDriver struct {
+	sync.Mutex
+	dataDir string
+	store   *nativeIPAMStore
+}
+
+func NewNativeIPAMDriver(dataDir string) *NativeIPAMDriver {
+	return &NativeIPAMDriver{dataDir: dataDir}
+}
+
+// nativeNetworkConfig 只解析ipam需要的字段
+type nativeNetworkConfig struct {
+	CNIVersion string     `json:"cniVersion,omitempty"`
+	IPAM       IPAMConfig `json:"ipam,omitempty"`
+}
+
+func (d *NativeIPAMDriver) Add(args *invoke.Args, networkConfig []byte) (*current.Result, error) {
+	_, subnet, gateway, err := parseNativeNetworkConfig(networkConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if err := d.loadStore(subnet); err != nil {
+		return nil, err
+	}
+
+	if ipStr, ok := d.store.Allocations[args.ContainerID]; ok {
+		klog.Infof("[NativeIPAMDriver]-[Add]-container %s 已经分配了ip %s", args.ContainerID, ipStr)
+		return buildNativeResult(net.ParseIP(ipStr), subnet, gateway), nil
+	}
+
+	allocated, err := d.nextFreeIP(subnet, gateway)
+	if err != nil {
+		return nil, err
+	}
+	d.store.Allocations[args.ContainerID] = allocated.String()
+	d.store.LastReserved = allocated.String()
+	if err := d.saveStore(); err != nil {
+		delete(d.store.Allocations, args.ContainerID)
+		return nil, err
+	}
+	klog.Infof("[NativeIPAMDriver]-[Add]-为container %s 分配ip %s", args.ContainerID, allocated)
+	return buildNativeResult(allocated, subnet, gateway), nil
+}
+
+func (d *NativeIPAMDriver) Del(args *invoke.Args, networkConfig []byte) error {
+	_, subnet, _, err := parseNativeNetworkConfig(networkConfig)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if err := d.loadStore(subnet); err != nil {
+		return err
+	}
+	ipStr, ok := d.store.Allocations[args.ContainerID]
+	if !ok {
+		return nil
+	}
+	delete(d.store.Allocations, args.ContainerID)
+	if err := d.saveStore(); err != nil {
+		d.store.Allocations[args.ContainerID] = ipStr
+		return err
+	}
+	klog.Infof("[NativeIPAMDriver]-[Del]-释放container %s 的ip %s", args.ContainerID, ipStr)
+	return nil
+}
+
+func (d *NativeIPAMDriver) Check(args *invoke.Args, networkConfig []byte) error {
+	_, subnet, _, err := parseNativeNetworkConfig(networkConfig)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if err := d.loadStore(subnet); err != nil {
+		return err
+	}
+	if _, ok := d.store.Allocations[args.ContainerID]; !ok {
+		return fmt.Errorf("no IP allocated for container %s in subnet %s", args.ContainerID, subnet)
+	}
+	return nil
+}
+
+func (d *NativeIPAMDriver) Capabilities() IPAMCapabilities {
+	return IPAMCapabilities{InProcess: true, Persistent: true, Check: true}
+}
+
+// nextFreeIP 从LastReserved之后开始查找第一个未分配的地址，网络地址、广播地址以及网关地址不会被分配
+func (d *NativeIPAMDriver) nextFreeIP(subnet *net.IPNet, gateway net.IP) (net.IP, error) {
+	used := make(map[string]bool, len(d.store.Allocations)+1)
+	for _, ipStr := range d.store.Allocations {
+		used[ipStr] = true
+	}
+	used[gateway.String()] = true
+
+	first := ip.NextIP(subnet.IP.Mask(subnet.Mask))
+	last := lastIP(subnet)
+	start := first
+	if lastReserved := net.ParseIP(d.store.LastReserved); lastReserved != nil && subnet.Contains(lastReserved) {
+		start = lastReserved
+	}
+
+	candidate := start
+	for {
+		candidate = ip.NextIP(candidate)
+		if ip.Cmp(candidate, last) >= 0 {
+			candidate = first
+		}
+		if !used[candidate.String()] {
+			return candidate, nil
+		}
+		if candidate.Equal(start) {
+			return nil, fmt.Errorf("no free IP left in subnet %s", subnet)
+		}
+	}
+}
+
+// loadStore 从本地文件加载分配记录。如果subnet发生了变化，旧的记录全部作废
+func (d *NativeIPAMDriver) loadStore(subnet *net.IPNet) error {
+	if d.store != nil && d.store.Subnet == subnet.String() {
+		return nil
+	}
+	store := &nativeIPAMStore{Subnet: subnet.String(), Allocations: map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(d.dataDir, nativeIPAMDataFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read IPAM data file: %v", err)
+	}
+	if err == nil {
+		persisted := &nativeIPAMStore{}
+		if err := json.Unmarshal(data, persisted); err != nil {
+			return fmt.Errorf("failed to decode IPAM data file: %v", err)
+		}
+		if persisted.Subnet == subnet.String() && persisted.Allocations != nil {
+			store = persisted
+		} else {
+			klog.Warningf("[NativeIPAMDriver]-subnet由%s变为%s, 丢弃旧的分配记录", persisted.Subnet, subnet)
+		}
+	}
+	d.store = store
+	return nil
+}
+
+// saveStore 先写临时文件再rename，保证数据文件不会只写了一半
+func (d *NativeIPAMDriver) saveStore() error {
+	if err := os.MkdirAll(d.dataDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create IPAM data dir: %v", err)
+	}
+	data, err := json.Marshal(d.store)
+	if err != nil {
+		return err
+	}
+	dataFile := filepath.Join(d.dataDir, nativeIPAMDataFile)
+	tmpFile := dataFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write IPAM data file: %v", err)
+	}
+	return os.Rename(tmpFile, dataFile)
+}
+
+// parseNativeNetworkConfig 解析ipam配置中的subnet以及gateway，gateway为空时使用subnet中的第一个地址，
+// 与agent在setupGatewayInterface中为网关配置的地址相同
+func parseNativeNetworkConfig(networkConfig []byte) (*nativeNetworkConfig, *net.IPNet, net.IP, error) {
+	conf := &nativeNetworkConfig{}
+	if err := json.Unmarshal(networkConfig, conf); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode network config: %v", err)
+	}
+	_, subnet, err := net.ParseCIDR(conf.IPAM.Subnet)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid IPAM subnet %q: %v", conf.IPAM.Subnet, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, nil, nil, fmt.Errorf("IPAM subnet %s is not IPv4", subnet)
+	}
+	gateway := ip.NextIP(subnet.IP.Mask(subnet.Mask))
+	if conf.IPAM.Gateway != "" {
+		if gateway = net.ParseIP(conf.IPAM.Gateway); gateway == nil || !subnet.Contains(gateway) {
+			return nil, nil, nil, fmt.Errorf("invalid IPAM gateway %q for subnet %s", conf.IPAM.Gateway, subnet)
+		}
+	}
+	return conf, subnet, gateway.To4(), nil
+}
+
+// buildNativeResult 返回当前版本的result，由cniserver根据配置中的cniVersion进行转换
+func buildNativeResult(allocated net.IP, subnet *net.IPNet, gateway net.IP) *current.Result {
+	return &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs: []*current.IPConfig{{
+			Address: net.IPNet{IP: allocated, Mask: subnet.Mask},
+			Gateway: gateway,
+		}},
+		Routes: []*types.Route{},
+	}
+}
+
+// lastIP 返回subnet的广播地址
+func lastIP(subnet *net.IPNet) net.IP {
+	base := subnet.IP.Mask(subnet.Mask).To4()
+	ones, bits := subnet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last := new(big.Int).Add(new(big.Int).SetBytes(base), size)
+	last.Sub(last, big.NewInt(1))
+	return net.IP(last.FillBytes(make([]byte, 4)))
+}
+
+func init() {
+	if err := RegisterIPAMDriver(IPAM_NATIVE, NewNativeIPAMDriver(defaultNativeIPAMDataDir)); err != nil {
+		klog.Errorf("Failed to register IPAM plugin on type %s", IPAM_NATIVE)
+	}
+}
@@ -0,0 +1,69 @@
+package ipam_test
+
+import (
+	"ciccni/pkg/cniserver/ipam"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/stretchr/testify/require"
+)
+
+func nativeNetworkConfig(t *testing.T, subnet string) []byte {
+	config, err := json.Marshal(map[string]interface{}{
+		"cniVersion": "0.3.0",
+		"name":       "ciccni",
+		"ipam":       ipam.IPAMConfig{Type: ipam.IPAM_NATIVE, Subnet: subnet},
+	})
+	require.NoError(t, err)
+	return config
+}
+
+func TestNativeIPAMDriver(t *testing.T) {
+	dataDir := t.TempDir()
+	config := nativeNetworkConfig(t, "10.244.1.0/29")
+	driver := ipam.NewNativeIPAMDriver(dataDir)
+
+	// 10.244.1.1为网关，10.244.1.7为广播地址，可分配的地址为.2 ~ .6
+	allocated := map[string]string{}
+	for _, id := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		result, err := driver.Add(&invoke.Args{ContainerID: id}, config)
+		require.NoError(t, err)
+		require.Len(t, result.IPs, 1)
+		require.Equal(t, "10.244.1.1", result.IPs[0].Gateway.String())
+		require.NotContains(t, allocated, result.IPs[0].Address.String())
+		allocated[result.IPs[0].Address.String()] = id
+	}
+	require.Contains(t, allocated, "10.244.1.2/29")
+	require.Contains(t, allocated, "10.244.1.6/29")
+
+	_, err := driver.Add(&invoke.Args{ContainerID: "c6"}, config)
+	require.Error(t, err)
+
+	// 同一个containerID重复ADD返回相同的地址
+	result, err := driver.Add(&invoke.Args{ContainerID: "c3"}, config)
+	require.NoError(t, err)
+	require.Equal(t, "c3", allocated[result.IPs[0].Address.String()])
+	require.NoError(t, driver.Check(&invoke.Args{ContainerID: "c3"}, config))
+
+	// 重复DEL不报错，释放后的地址可以再次分配
+	require.NoError(t, driver.Del(&invoke.Args{ContainerID: "c3"}, config))
+	require.NoError(t, driver.Del(&invoke.Args{ContainerID: "c3"}, config))
+	require.Error(t, driver.Check(&invoke.Args{ContainerID: "c3"}, config))
+	result, err = driver.Add(&invoke.Args{ContainerID: "c6"}, config)
+	require.NoError(t, err)
+	require.Equal(t, "c3", allocated[result.IPs[0].Address.String()])
+
+	// 重启后从本地文件恢复分配记录
+	restarted := ipam.NewNativeIPAMDriver(dataDir)
+	result, err = restarted.Add(&invoke.Args{ContainerID: "c1"}, config)
+	require.NoError(t, err)
+	require.Equal(t, "c1", allocated[result.IPs[0].Address.String()])
+	require.NoError(t, restarted.Check(&invoke.Args{ContainerID: "c6"}, config))
+
+	// subnet变化后旧的分配记录作废
+	result, err = restarted.Add(&invoke.Args{ContainerID: "c1"}, nativeNetworkConfig(t, "10.244.2.0/24"))
+	require.NoError(t, err)
+	require.True(t, net.ParseIP("10.244.2.2").Equal(result.IPs[0].Address.IP))
+}
@@ -17,6 +17,8 @@ package ipam
 import (
 	"ciccni/pkg/apis/cni/pb"
 	"fmt"
+	"path/filepath"
+	"sort"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 
@@ -37,6 +39,24 @@ type IPAMDriver interface {
 	Add(args *invoke.Args, networkConfig []byte) (*current.Result, error)
 	Del(args *invoke.Args, networkConfig []byte) error
 	Check(args *invoke.Args, networkConfig []byte) error
+	Capabilities() IPAMCapabilities
+}
+
+// IPAMCapabilities describes what an IPAM driver supports and what it depends on.
+type IPAMCapabilities struct {
+	// InProcess is true if the driver allocates addresses inside the agent. Otherwise the driver
+	// delegates to an IPAM plugin binary with the same name, which must be present in the CNI path.
+	InProcess bool
+	// Persistent is true if allocations survive an agent restart.
+	Persistent bool
+	// Check is true if the driver implements CNI CHECK.
+	Check bool
+}
+
+// IPAMDriverInfo is the type and capabilities of a registered IPAM driver.
+type IPAMDriverInfo struct {
+	Type         string
+	Capabilities IPAMCapabilities
 }
 
 func RegisterIPAMDriver(ipamType string, ipamDriver IPAMDriver) error {
@@ -59,21 +79,41 @@ func argsFromEnv(cniArgs *pb.CniCmdArgs) *invoke.Args {
 	}
 }
 
+func getIPAMDriver(ipamType string) (IPAMDriver, error) {
+	driver, ok := ipamDrivers[ipamType]
+	if !ok {
+		return nil, fmt.Errorf("unknown IPAM type %q, registered types: %v", ipamType, registeredIPAMTypes())
+	}
+	return driver, nil
+}
+
 func ExecIPAMAdd(cniArgs *pb.CniCmdArgs, ipamType string) (*current.Result, error) {
+	driver, err := getIPAMDriver(ipamType)
+	if err != nil {
+		return nil, err
+	}
 	args := argsFromEnv(cniArgs)
-	driver := ipamDrivers[ipamType]
 	return driver.Add(args, cniArgs.NetworkConfiguration)
 }
 
 func ExecIPAMDelete(cniArgs *pb.CniCmdArgs, ipamType string) error {
+	driver, err := getIPAMDriver(ipamType)
+	if err != nil {
+		return err
+	}
 	args := argsFromEnv(cniArgs)
-	driver := ipamDrivers[ipamType]
 	return driver.Del(args, cniArgs.NetworkConfiguration)
 }
 
 func ExecIPAMCheck(cniArgs *pb.CniCmdArgs, ipamType string) error {
+	driver, err := getIPAMDriver(ipamType)
+	if err != nil {
+		return err
+	}
+	if !driver.Capabilities().Check {
+		return nil
+	}
 	args := argsFromEnv(cniArgs)
-	driver := ipamDrivers[ipamType]
 	return driver.Check(args, cniArgs.NetworkConfiguration)
 }
 
@@ -81,3 +121,37 @@ func IsIPAMTypeValid(ipamType string) bool {
 	_, valid := ipamDrivers[ipamType]
 	return valid
 }
+
+// ListIPAMDrivers returns all registered IPAM drivers sorted by type.
+func ListIPAMDrivers() []IPAMDriverInfo {
+	infos := make([]IPAMDriverInfo, 0, len(ipamDrivers))
+	for _, ipamType := range registeredIPAMTypes() {
+		infos = append(infos, IPAMDriverInfo{Type: ipamType, Capabilities: ipamDrivers[ipamType].Capabilities()})
+	}
+	return infos
+}
+
+// ValidateIPAMType checks that ipamType is registered and, for drivers delegating to an IPAM
+// plugin binary, that the binary can be found in cniPath.
+func ValidateIPAMType(ipamType string, cniPath string) error {
+	driver, err := getIPAMDriver(ipamType)
+	if err != nil {
+		return err
+	}
+	if driver.Capabilities().InProcess {
+		return nil
+	}
+	if _, err := invoke.FindInPath(ipamType, filepath.SplitList(cniPath)); err != nil {
+		return fmt.Errorf("IPAM type %q requires plugin binary in %s: %v", ipamType, cniPath, err)
+	}
+	return nil
+}
+
+func registeredIPAMTypes() []string {
+	types := make([]string, 0, len(ipamDrivers))
+	for ipamType := range ipamDrivers {
+		types = append(types, ipamType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,37 @@
+package ipam_test
+
+import (
+	"ciccni/pkg/apis/cni/pb"
+	"ciccni/pkg/cniserver/ipam"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListIPAMDrivers(t *testing.T) {
+	drivers := ipam.ListIPAMDrivers()
+	require.Equal(t, []ipam.IPAMDriverInfo{
+		{Type: ipam.IPAM_NATIVE, Capabilities: ipam.IPAMCapabilities{InProcess: true, Persistent: true, Check: true}},
+		{Type: ipam.IPAM_HOST_LOCAL, Capabilities: ipam.IPAMCapabilities{InProcess: false, Persistent: true, Check: true}},
+	}, drivers)
+}
+
+func TestValidateIPAMType(t *testing.T) {
+	cniPath := t.TempDir()
+	require.NoError(t, ipam.ValidateIPAMType(ipam.IPAM_NATIVE, cniPath))
+	require.Error(t, ipam.ValidateIPAMType("host-locl", cniPath))
+	// host-local需要cniPath中存在对应的二进制
+	require.Error(t, ipam.ValidateIPAMType(ipam.IPAM_HOST_LOCAL, cniPath))
+	require.NoError(t, os.WriteFile(filepath.Join(cniPath, ipam.IPAM_HOST_LOCAL), []byte{}, 0o755))
+	require.NoError(t, ipam.ValidateIPAMType(ipam.IPAM_HOST_LOCAL, cniPath))
+}
+
+func TestExecIPAMUnknownType(t *testing.T) {
+	args := &pb.CniCmdArgs{ContainerId: "c1", NetworkConfiguration: []byte("{}")}
+	_, err := ipam.ExecIPAMAdd(args, "host-locl")
+	require.Error(t, err)
+	require.Error(t, ipam.ExecIPAMDelete(args, "host-locl"))
+	require.Error(t, ipam.ExecIPAMCheck(args, "host-locl"))
+}
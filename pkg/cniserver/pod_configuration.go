@@ -6,17 +6,17 @@ import (
 	"ciccni/pkg/ovs"
 	"ciccni/pkg/tctools"
 	"encoding/json"
+	"fmt"
 	"net"
 
 	"github.com/containernetworking/cni/pkg/types"
-	types040 "github.com/containernetworking/cni/pkg/types/040"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 
-	"github.com/florianl/go-tc/core"
 	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 )
 
@@ -33,9 +33,10 @@ type k8sArgs struct {
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
 }
 
-// setipVethPair 创建veth pair，一端放入容器中，另一端放入host中。tcArgs为限速配置，如果为nil则不进行限速配置
+// setipVethPair 创建veth pair，一端放入容器中，另一端放入host中。tcArgs为限速配置，如果为nil则不进行限速配置。
+// clusterCIDR为集群的pod网段，用于区分出方向限速的范围
 // 此处的netns应该为容器中的命名空间
-func setupVethPair(podName string, podNamespace string, ifname string, netns ns.NetNS, MTU int, tcArgs *tctools.TCArgs) (hostIface *types100.Interface, containerIface *types100.Interface, err error) {
+func setupVethPair(podName string, podNamespace string, ifname string, netns ns.NetNS, MTU int, tcArgs *tctools.TCArgs, clusterCIDR *net.IPNet) (hostIface *types100.Interface, containerIface *types100.Interface, err error) {
 	hostVethName := util.GenerateContainerInterfaceName(podName, podNamespace)
 	hostIface, containerIface = &types100.Interface{}, &types100.Interface{}
 
@@ -48,12 +49,21 @@ func setupVethPair(podName string, podNamespace string, ifname string, netns ns.
 		// todo: 为容器中的网络接口配置限速，配速大小应该由pod的资源需求来决定，将这个值作为参数传入
 		// 限速配置错误不影响正常执行CNI的流程，仅打印日志
 		// 可以配置tc的网络接口有两个，其中一个是在容器中的网络接口，另一个是在host中的网络接口。
-		// 但是经过测试，发现在host段配置tc后会产生大量的丢包，因此选择在容器中进行配置。在容器中进行tc配置后如果需要进行动态修改会有些麻烦
-		if tcArgs != nil {
+		// 但是经过测试，发现在host段配置tc后会产生大量的丢包，因此选择在容器中进行配置。创建之后限速annotation的变化由agent中的bandwidth controller进入容器的netns进行修改
+		// 入方向的限速只能在host端配置：从host端veth发出的流量即为进入pod的流量。host端只配置一个default class，不使用过滤器
+		if tcArgs != nil && tcArgs.Rate > 0 {
 			// rate := uint32(100000000)
-			err = configureTC(containerVeth.Name, tcArgs.Rate, tcArgs.Burst)
+			err = tctools.ApplyEgressRate(containerVeth.Name, tcArgs, clusterCIDR)
 			if err != nil {
-				klog.Warningf("[setupVethPair]-[configureTC]-配置容器中的网络接口限速失败, err=%s", err)
+				klog.Warningf("[setupVethPair]-[ApplyEgressRate]-配置容器中的网络接口限速失败, err=%s", err)
+			}
+		}
+		if tcArgs != nil && tcArgs.IngressRate > 0 {
+			err = hostNS.Do(func(_ ns.NetNS) error {
+				return tctools.ApplyIngressRate(hostVeth.Name, tcArgs.IngressRate, tcArgs.IngressBurst)
+			})
+			if err != nil {
+				klog.Warningf("[setupVethPair]-[ApplyIngressRate]-配置host端的网络接口限速失败, err=%s", err)
 			}
 		}
 
@@ -100,6 +110,107 @@ func removeContainerLink(containerID string, containerNetns string, ifname strin
 	return nil
 }
 
+// checkContainerInterface 检查容器netns中的veth是否存在，且mac、mtu以及ip与缓存中一致。返回值为veth对端（host端）的ifindex
+func checkContainerInterface(containerNetns string, ifname string, containerConfig *agent.InterfaceConfig, MTU int) (int, error) {
+	var peerIndex int
+	if err := ns.WithNetNSPath(containerNetns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s in netns %s: %v", ifname, containerNetns, err)
+		}
+		veth, ok := link.(*netlink.Veth)
+		if !ok {
+			return fmt.Errorf("interface %s in netns %s has type %s, expected veth", ifname, containerNetns, link.Type())
+		}
+		if mac := veth.Attrs().HardwareAddr.String(); mac != containerConfig.MAC.String() {
+			return fmt.Errorf("interface %s has MAC %s, expected %s", ifname, mac, containerConfig.MAC)
+		}
+		if mtu := veth.Attrs().MTU; mtu != MTU {
+			return fmt.Errorf("interface %s has MTU %d, expected %d", ifname, mtu, MTU)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of interface %s: %v", ifname, err)
+		}
+		foundIP := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(containerConfig.IP) {
+				foundIP = true
+				break
+			}
+		}
+		if !foundIP {
+			return fmt.Errorf("IP %s not configured on interface %s", containerConfig.IP, ifname)
+		}
+		peerIndex, err = netlink.VethPeerIndex(veth)
+		if err != nil {
+			return fmt.Errorf("failed to get peer index of interface %s: %v", ifname, err)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return peerIndex, nil
+}
+
+// checkHostInterface 检查host端veth是否为容器veth的对端，并且已经以正确的external_ids接入ovs网桥
+func checkHostInterface(ovsBridge ovs.OVSBridgeClient, containerConfig *agent.InterfaceConfig, peerIndex int) error {
+	if containerConfig.OVSPortConfig == nil {
+		return fmt.Errorf("no OVS port cached for container %s", containerConfig.ID)
+	}
+	hostIfaceName := containerConfig.IfaceName
+	hostLink, err := netlink.LinkByName(hostIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find host interface %s: %v", hostIfaceName, err)
+	}
+	if hostLink.Attrs().Index != peerIndex {
+		return fmt.Errorf("host interface %s (index %d) is not the peer of the container interface (peer index %d)",
+			hostIfaceName, hostLink.Attrs().Index, peerIndex)
+	}
+
+	portData, err := ovsBridge.GetPortData(containerConfig.PortUUID, hostIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to get OVS port %s: %v", hostIfaceName, err)
+	}
+	if portData == nil {
+		return fmt.Errorf("OVS port %s (uuid %s) not found on bridge", hostIfaceName, containerConfig.PortUUID)
+	}
+	if portData.OFPort != containerConfig.OFPort {
+		return fmt.Errorf("OVS port %s has ofport %d, expected %d", hostIfaceName, portData.OFPort, containerConfig.OFPort)
+	}
+	return checkOVSPortExternalIDs(hostIfaceName, containerConfig, portData.ExternalIDs)
+}
+
+// checkOVSPortExternalIDs 检查OVS port的external_ids是否与缓存一致
+func checkOVSPortExternalIDs(portName string, containerConfig *agent.InterfaceConfig, externalIDs map[string]string) error {
+	for key, expected := range agent.BuildOVSPortExternalIDs(containerConfig) {
+		actual, found := externalIDs[key]
+		// 旧版本创建的port没有记录容器的netns以及容器内的接口名
+		if !found && (key == agent.OVSExternalIDNetNS || key == agent.OVSExternalIDIfName) {
+			continue
+		}
+		if actual != fmt.Sprint(expected) {
+			return fmt.Errorf("OVS port %s has external_ids %s=%q, expected %q", portName, key, actual, expected)
+		}
+	}
+	return nil
+}
+
+// checkPrevResult 检查runtime传入的prevResult中的容器接口以及ip是否与缓存一致
+func checkPrevResult(containerConfig *agent.InterfaceConfig, ifname string, prevResult *types100.Result) error {
+	for _, iface := range prevResult.Interfaces {
+		if iface.Name == ifname && iface.Sandbox != "" && iface.Mac != containerConfig.MAC.String() {
+			return fmt.Errorf("prevResult has MAC %s for interface %s, expected %s", iface.Mac, ifname, containerConfig.MAC)
+		}
+	}
+	for _, ipc := range prevResult.IPs {
+		if ipc.Address.IP.Equal(containerConfig.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s of container %s not found in prevResult", containerConfig.IP, containerConfig.ID)
+}
+
 func configureContainerAddr(netns ns.NetNS, containerInterface *types100.Interface, result *types100.Result) error {
 	if err := netns.Do(func(_ ns.NetNS) error {
 		klog.Infof("[configureContainerAddr]-配置容器地址, containerInterface.Name=%s", containerInterface.Name)
@@ -114,11 +225,13 @@ func configureContainerAddr(netns ns.NetNS, containerInterface *types100.Interfa
 			klog.Errorf("[pod_configuration.go]-[configureContainerAddr]-ipam.ConfigureIface失败, err=%s", err)
 			return err
 		}
-		result040Interface, _ := result.GetAsVersion("0.4.0")
-		result040, _ := types040.GetResult(result040Interface)
-		for _, ipc := range result040.IPs {
-			if ipc.Version == "4" {
-				arping.GratuitousArpOverIface(ipc.Address.IP, *containerVeth)
+		// 通告容器的ipv4地址，失败只影响对端arp缓存的更新，不影响CNI流程
+		for _, ipc := range result.IPs {
+			if ipc.Address.IP.To4() == nil {
+				continue
+			}
+			if err := arping.GratuitousArpOverIface(ipc.Address.IP, *containerVeth); err != nil {
+				klog.Warningf("[configureContainerAddr]-发送免费arp失败, ip=%s, err=%s", ipc.Address.IP, err)
 			}
 		}
 		return nil
@@ -127,29 +240,3 @@ func configureContainerAddr(netns ns.NetNS, containerInterface *types100.Interfa
 	}
 	return nil
 }
-
-func configureTC(ifName string, rate uint32, burst uint32) error {
-	err := tctools.CreateRootHTB(ifName)
-	if err != nil {
-		klog.Errorf("[configureTC]-创建root htb失败, err = %s", err)
-		return err
-	}
-
-	classHandle := core.BuildHandle(0x1, 0x1)
-	qdiscRootHandle := core.BuildHandle(0x1, 0x0)
-
-	err = tctools.CreateHTBClass(ifName, qdiscRootHandle, classHandle, rate, burst)
-	if err != nil {
-		klog.Errorf("[configureTC]-创建htb class失败, err = %s", err)
-		return err
-	}
-
-	// todo: 高级TC配置需要增加过滤器等方式，目前仅仅是配置了class，然后查看在容器内这些配置是否生效
-	err = tctools.AddTCFilterWithDstCidr(ifName, qdiscRootHandle, "10.244.0.0/16", classHandle, uint16(1))
-	if err != nil {
-		klog.Errorf("[configureTC]-添加过滤器失败, err = %s", err)
-		return err
-	}
-	return nil
-
-}
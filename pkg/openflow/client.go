@@ -17,8 +17,10 @@ package openflow
 import (
 	"fmt"
 	"net"
+	"sort"
 
 	"ciccni/pkg/agent/types"
+	"ciccni/pkg/openflow/cookie"
 	binding "ciccni/pkg/ovs/openflow"
 )
 
@@ -27,10 +29,15 @@ const maxRetryForOFSwitch = 5
 //go:generate mockgen -copyright_file ../../../hack/boilerplate/license_header.raw.txt -destination testing/mock_client.go -package=testing github.com/vmware-tanzu/antrea/pkg/agent/openflow Client
 
 // Client is the interface to program OVS flows for entity connectivity of Antrea.
-// TODO: flow sync (e.g. at agent restart), retry at failure, garbage collection mechanisms
 type Client interface {
-	// Initialize sets up all basic flows on the specific OVS bridge.
-	Initialize() error
+	// Initialize sets up all basic flows on the specific OVS bridge. All the flows installed by the client carry the
+	// round number of roundInfo in their cookies.
+	Initialize(roundInfo types.RoundInfo) error
+
+	// DeleteStaleFlows deletes the flows installed in the previous round, i.e. by the agent before it restarted. It
+	// should be called after all the flows still needed have been installed again in the current round. The previous
+	// round is always set by Initialize, it is 0 for the flows installed before cookies were introduced.
+	DeleteStaleFlows() error
 
 	// InstallGatewayFlows sets up flows related to an OVS gateway port, the gateway must exist.
 	InstallGatewayFlows(gatewayAddr net.IP, gatewayMAC net.HardwareAddr, gatewayOFPort uint32) error
@@ -66,17 +73,31 @@ type Client interface {
 	// GetFlowTableStatus should return an array of flow table status, all existing flow tables should be included in the list.
 	GetFlowTableStatus() []binding.TableStatus
 
+	// QueryFlowTableStatus is like GetFlowTableStatus, but queries the flow, packet and byte counts of the tables from
+	// the switch instead of using the local counters, which may drift from the switch.
+	QueryFlowTableStatus() ([]binding.TableStatus, error)
+
 	// InstallPolicyRuleFlows installs flows for a new NetworkPolicy rule. Rule should include all fields in the
 	// NetworkPolicy rule. Each ingress/egress policy rule installs Openflow entries on two tables, one for
 	// ruleTable and the other for dropTable. If a packet does not pass the ruleTable, it will be dropped by the
 	// dropTable.
 	InstallPolicyRuleFlows(rule *types.PolicyRule) error
 
-	// InstallTunFlow 加入一条构建vxlan隧道的flow。dstIPNet指定了
-	InstallTunFlow(dstIPNet string, inPort uint32, tunnelDstIP net.IP) error
+	// InstallTunFlow 为hostname对应的对端node加入一条构建vxlan隧道的flow。dstIPNet指定了发往该node的目的地址
+	// （一般为对端node的PodCIDR），tunnelDstIP为对端node的IP。flow按hostname缓存在nodeFlowCache中，
+	// 与InstallNodeFlows安装的flow分开缓存，对同一个hostname重复调用是幂等的
+	InstallTunFlow(hostname string, dstIPNet string, inPort uint32, tunnelDstIP net.IP) error
 
+	// InstallARPFlow 使用tunDsts整体替换arp请求/响应flow中的隧道目的地址集合
 	InstallARPFlow(tunDsts []string) error
 
+	// AddARPTunnelDst 向arp请求/响应flow中加入一个隧道目的地址（对端node IP），并通过Modify重新下发flow。
+	// 重复加入同一个地址是幂等的
+	AddARPTunnelDst(tunDst net.IP) error
+
+	// RemoveARPTunnelDst 从arp请求/响应flow中移除一个隧道目的地址。移除最后一个地址时会删除这两条flow
+	RemoveARPTunnelDst(tunDst net.IP) error
+
 	// InstallLocalIPFlow 安装本地的ip流表规则
 	InstallLocalIPFlow(nodename string, localIP string) error
 
@@ -86,7 +107,9 @@ type Client interface {
 	// UninstallCorednsFlow 删除coreDNS流表
 	UninstallCorednsFlow(containerID string) error
 
-	UninstallTunFlow() error
+	// UninstallTunFlow 删除hostname对应node的隧道flow，不会影响其他node的flow。
+	// 如果没有为该hostname安装过flow，则什么也不做
+	UninstallTunFlow(hostname string) error
 
 	// UninstallPolicyRuleFlows removes the Openflow entry relevant to the specified NetworkPolicy rule.
 	// UninstallPolicyRuleFlows will do nothing if no Openflow entry for the rule is installed.
@@ -100,6 +123,10 @@ type Client interface {
 	// are removed from PolicyRule.From, else from PolicyRule.To.
 	DeletePolicyRuleAddress(ruleID uint32, addrType types.AddressType, addresses []types.Address) error
 
+	// ReconcileFlows compares the flows of the current round on the switch with the flows in the caches of the
+	// client. The missing flows are installed again and the flows not in the caches are deleted.
+	ReconcileFlows() (binding.FlowSyncResult, error)
+
 	// Disconnect disconnects the connection between client and OFSwitch.
 	Disconnect() error
 }
@@ -109,6 +136,11 @@ func (c *client) GetFlowTableStatus() []binding.TableStatus {
 	return c.bridge.DumpTableStatus()
 }
 
+// QueryFlowTableStatus returns an array of flow table status queried from the switch.
+func (c *client) QueryFlowTableStatus() ([]binding.TableStatus, error) {
+	return c.bridge.QueryTableStatus()
+}
+
 // addMissingFlows adds any flow from flows which is not currently in the flow cache. The function
 // returns immediately in case of error when adding a flow. If a flow is added succesfully, it is
 // added to the flow cache. If the flow cache has not been initialized yet (i.e. there is no
@@ -131,6 +163,24 @@ func (c *client) addMissingFlows(cache *flowCategoryCache, flowCacheKey string,
 	return nil
 }
 
+// addOrModifyFlow adds flow if no flow with the same match is in the flow cache indexed by flowCacheKey,
+// otherwise it modifies the actions of the existing flow. The flow cache is updated with the new flow.
+func (c *client) addOrModifyFlow(cache *flowCategoryCache, flowCacheKey string, flow binding.Flow) error {
+	fCacheI, _ := cache.LoadOrStore(flowCacheKey, flowCache{})
+	fCache := fCacheI.(flowCache)
+
+	flowKey := flow.MatchString()
+	if _, ok := fCache[flowKey]; ok {
+		if err := c.flowOperations.Modify(flow); err != nil {
+			return err
+		}
+	} else if err := c.flowOperations.Add(flow); err != nil {
+		return err
+	}
+	fCache[flowKey] = flow
+	return nil
+}
+
 // deleteFlows deletes all the flows in the flow cache indexed by the provided flowCacheKey.
 func (c *client) deleteFlows(cache *flowCategoryCache, flowCacheKey string) error {
 	fCacheI, ok := cache.Load(flowCacheKey)
@@ -157,6 +207,8 @@ func (c *client) deleteFlows(cache *flowCategoryCache, flowCacheKey string) erro
 }
 
 func (c *client) InstallNodeFlows(hostname string, localGatewayMAC net.HardwareAddr, peerGatewayIP net.IP, peerPodCIDR net.IPNet, tunnelPeerAddr net.IP) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	flows := []binding.Flow{
 		c.arpResponderFlow(peerGatewayIP),
 		c.l3FwdFlowToRemote(localGatewayMAC, peerPodCIDR, tunnelPeerAddr),
@@ -166,10 +218,14 @@ func (c *client) InstallNodeFlows(hostname string, localGatewayMAC net.HardwareA
 }
 
 func (c *client) UninstallNodeFlows(hostname string) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	return c.deleteFlows(c.nodeFlowCache, hostname)
 }
 
-func (c *client) InstallTunFlow(dstIPNetString string, inPort uint32, tunnelDstIP net.IP) error {
+func (c *client) InstallTunFlow(hostname string, dstIPNetString string, inPort uint32, tunnelDstIP net.IP) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	dstIP, dstIPNet, t, err := parseDstIP(dstIPNetString)
 	if err != nil { // 无法解析传入的ip地址
 		return err
@@ -185,39 +241,112 @@ func (c *client) InstallTunFlow(dstIPNetString string, inPort uint32, tunnelDstI
 		}
 	}
 	
-	return c.addMissingFlows(c.generalCache, IPConnectionVxlan, flows)
+	return c.addMissingFlows(c.nodeFlowCache, tunnelFlowCacheKey(hostname), flows)
 }
 
-func (c *client) UninstallTunFlow() error {
-	return c.deleteFlows(c.generalCache, IPConnectionVxlan)
+// tunnelFlowCacheKey 隧道流表与InstallNodeFlows安装的流表分开缓存，两者可以分别删除
+func tunnelFlowCacheKey(hostname string) string {
+	return hostname + "-tunnel"
 }
 
-func (c *client) InstallARPFlow(dstIPNets []string) error {
-	var ipNets []*net.IP
+func (c *client) UninstallTunFlow(hostname string) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	return c.deleteFlows(c.nodeFlowCache, tunnelFlowCacheKey(hostname))
+}
 
+func (c *client) InstallARPFlow(dstIPNets []string) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	tunDsts := make(map[string]net.IP, len(dstIPNets))
 	for _, ipStr := range dstIPNets {
 		ip := net.ParseIP(ipStr)
-		ipNets = append(ipNets, &ip)
+		if ip == nil {
+			return fmt.Errorf("invalid tunnel destination %s", ipStr)
+		}
+		tunDsts[ip.String()] = ip
 	}
-	arpReq, arpResp := c.arpFlow(ipNets)
-	ReqFlows := []binding.Flow{
-		arpReq,
+
+	c.arpFlowLock.Lock()
+	defer c.arpFlowLock.Unlock()
+	oldTunDsts := c.arpTunDsts
+	c.arpTunDsts = tunDsts
+	if err := c.syncARPFlows(); err != nil {
+		c.arpTunDsts = oldTunDsts
+		return err
 	}
-	RespFlows := []binding.Flow{
-		arpResp,
+	return nil
+}
+
+func (c *client) AddARPTunnelDst(tunDst net.IP) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	c.arpFlowLock.Lock()
+	defer c.arpFlowLock.Unlock()
+	key := tunDst.String()
+	if _, ok := c.arpTunDsts[key]; ok {
+		return nil
 	}
-	err := c.addMissingFlows(c.generalCache, ArpRequest, ReqFlows)
-	if err != nil {
+	c.arpTunDsts[key] = tunDst
+	if err := c.syncARPFlows(); err != nil {
+		delete(c.arpTunDsts, key)
 		return err
 	}
-	err = c.addMissingFlows(c.generalCache, ArpResponse, RespFlows)
-	if err != nil {
+	return nil
+}
+
+func (c *client) RemoveARPTunnelDst(tunDst net.IP) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	c.arpFlowLock.Lock()
+	defer c.arpFlowLock.Unlock()
+	key := tunDst.String()
+	if _, ok := c.arpTunDsts[key]; !ok {
+		return nil
+	}
+	delete(c.arpTunDsts, key)
+	if err := c.syncARPFlows(); err != nil {
+		c.arpTunDsts[key] = tunDst
+		return err
+	}
+	return nil
+}
+
+// syncARPFlows 根据c.arpTunDsts重新生成arp请求/响应flow。已经存在的flow通过Modify覆盖其action，
+// 集合为空时删除这两条flow。调用者需要持有arpFlowLock
+func (c *client) syncARPFlows() error {
+	if len(c.arpTunDsts) == 0 {
+		if err := c.deleteFlows(c.generalCache, ArpRequest); err != nil {
+			return err
+		}
+		return c.deleteFlows(c.generalCache, ArpResponse)
+	}
+
+	// 对地址排序，保证相同的集合生成的action顺序一致
+	keys := make([]string, 0, len(c.arpTunDsts))
+	for key := range c.arpTunDsts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ipNets []*net.IP
+	for _, key := range keys {
+		ip := c.arpTunDsts[key]
+		ipNets = append(ipNets, &ip)
+	}
+
+	arpReq, arpResp := c.arpFlow(ipNets)
+	if err := c.addOrModifyFlow(c.generalCache, ArpRequest, arpReq); err != nil {
+		return err
+	}
+	if err := c.addOrModifyFlow(c.generalCache, ArpResponse, arpResp); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (c *client) InstallLocalIPFlow(nodeName string, localIP string) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	ip, ipnet, isIPNet, err := parseDstIP(localIP)
 	var flows []binding.Flow
 	if err != nil {
@@ -239,78 +368,105 @@ func (c *client) InstallLocalIPFlow(nodeName string, localIP string) error {
 	return nil
 }
 
+// corednsFlowCacheKey coreDNS的流表与pod流表分开缓存，两者可以分别删除
+func corednsFlowCacheKey(containerID string) string {
+	return containerID + "-coredns"
+}
+
 func (c *client) InstallCorednsFlow(ofPortNum uint32, containerID string, serviceIP net.IP) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	flows := []binding.Flow {
 		c.classifierTableFlowWithInPort(ofPortNum),
 		c.coreDnsSNATTFlowWithInPort(ofPortNum, serviceIP),
 	}
-	return c.addMissingFlows(c.podFlowCache, containerID, flows)
+	return c.addMissingFlows(c.podFlowCache, corednsFlowCacheKey(containerID), flows)
 }
 
 func (c *client) UninstallCorednsFlow(containerID string) error {
-	return c.deleteFlows(c.podFlowCache, containerID)
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	return c.deleteFlows(c.podFlowCache, corednsFlowCacheKey(containerID))
 }
 
 func (c *client) InstallPodFlows(containerID string, podInterfaceIP net.IP, podInterfaceMAC, gatewayMAC net.HardwareAddr, ofPort uint32) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	flows := []binding.Flow{
 		c.podClassifierFlow(ofPort),
 		c.podIPSpoofGuardFlow(podInterfaceIP, podInterfaceMAC, ofPort),
 		c.arpSpoofGuardFlow(podInterfaceIP, podInterfaceMAC, ofPort),
-		c.l2ForwardCalcFlow(podInterfaceMAC, ofPort),
+		c.localPodForwardFlow(podInterfaceIP),
 		c.l3FlowsToPod(gatewayMAC, podInterfaceIP, podInterfaceMAC),
+		c.l2ForwardCalcFlow(podInterfaceMAC, ofPort, cookie.Pod),
 	}
 
 	return c.addMissingFlows(c.podFlowCache, containerID, flows)
 }
 
 func (c *client) UninstallPodFlows(containerID string) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	return c.deleteFlows(c.podFlowCache, containerID)
 }
 
 func (c *client) InstallClusterServiceCIDRFlows(serviceNet *net.IPNet, gatewayOFPort uint32) error {
-	return c.flowOperations.Add(c.serviceCIDRDNATFlow(serviceNet, gatewayOFPort))
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	flows := []binding.Flow{c.serviceCIDRDNATFlow(serviceNet, gatewayOFPort)}
+	return c.addMissingFlows(c.serviceCache, serviceCIDRFlowsKey, flows)
 }
 
 func (c *client) InstallGatewayFlows(gatewayAddr net.IP, gatewayMAC net.HardwareAddr, gatewayOFPort uint32) error {
-	if err := c.flowOperations.Add(c.gatewayClassifierFlow(gatewayOFPort)); err != nil {
-		return err
-	} else if err := c.flowOperations.Add(c.gatewayIPSpoofGuardFlow(gatewayOFPort)); err != nil {
-		return err
-	} else if err := c.flowOperations.Add(c.gatewayARPSpoofGuardFlow(gatewayOFPort)); err != nil {
-		return err
-	} else if err := c.flowOperations.Add(c.l3ToGatewayFlow(gatewayAddr, gatewayMAC)); err != nil {
-		return err
-	} else if err := c.flowOperations.Add(c.l2ForwardCalcFlow(gatewayMAC, gatewayOFPort)); err != nil {
-		return err
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	flows := []binding.Flow{
+		c.gatewayClassifierFlow(gatewayOFPort),
+		c.gatewayIPSpoofGuardFlow(gatewayOFPort),
+		c.gatewayARPSpoofGuardFlow(gatewayOFPort),
+		c.l3ToGatewayFlow(gatewayAddr, gatewayMAC),
+		c.l2ForwardCalcFlow(gatewayMAC, gatewayOFPort, cookie.General),
 	}
-	return nil
+	return c.addMissingFlows(c.generalCache, gatewayFlowsKey, flows)
 }
 
 func (c *client) InstallTunnelFlows(tunnelOFPort uint32) error {
-	if err := c.flowOperations.Add(c.tunnelClassifierFlow(tunnelOFPort)); err != nil {
-		return err
-	} else if err := c.flowOperations.Add(c.l2ForwardCalcFlow(globalVirtualMAC, tunnelOFPort)); err != nil {
-		return err
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
+	flows := []binding.Flow{
+		c.tunnelClassifierFlow(tunnelOFPort),
+		c.l2ForwardCalcFlow(globalVirtualMAC, tunnelOFPort, cookie.General),
 	}
-	return nil
+	return c.addMissingFlows(c.generalCache, tunnelFlowsKey, flows)
 }
 
-func (c *client) Initialize() error {
+func (c *client) Initialize(roundInfo types.RoundInfo) error {
+	c.roundInfo = roundInfo
+	c.cookieAllocator = cookie.NewAllocator(roundInfo.RoundNum)
 	// Initiate connections to target OFswitch, and create tables on the switch.
 	if err := c.bridge.Connect(maxRetryForOFSwitch); err != nil {
 		return err
 	}
-	if err := c.flowOperations.Add(c.arpNormalFlow()); err != nil {
-		return fmt.Errorf("failed to install arp normal flow, err = %v", err)
-	}
-	if err := c.flowOperations.Add(c.classifierDefaultFlow()); err != nil {
-		return fmt.Errorf("failed to install classifier default resubmit flow, err = %s", err)
-	}
-	if err := c.flowOperations.Add(c.coreDNSSNATDefaultFlow()); err != nil {
-		return fmt.Errorf("failed to install coreDNSSNAT default resubmit flow, err = %s", err)
+	// Install all the pipeline flows in one bundle, so that a failure leaves the tables untouched instead of a
+	// partially working pipeline.
+	var flows []binding.Flow
+	flows = append(flows, c.defaultFlows()...)
+	flows = append(flows, c.arpNormalFlow())
+	flows = append(flows, c.connectionTrackFlows()...)
+	flows = append(flows, c.establishedConnectionFlows()...)
+	flows = append(flows, c.l2ForwardOutputFlow())
+	if err := c.flowOperations.AddAll(flows); err != nil {
+		return fmt.Errorf("failed to install pipeline flows, err = %v", err)
 	}
-	if err := c.flowOperations.Add(c.clusterForwardDefaultFlow()); err != nil {
-		return fmt.Errorf("failed to install clusterForward default normal flow, err = %s", err)
+	fCache := flowCache{}
+	for _, flow := range flows {
+		fCache[flow.MatchString()] = flow
 	}
+	c.generalCache.Store(pipelineFlowsKey, fCache)
 	return nil
 }
+
+func (c *client) DeleteStaleFlows() error {
+	cookieID, cookieMask := cookie.RoundCookie(*c.roundInfo.PrevRoundNum)
+	return c.bridge.DeleteFlowsByCookie(cookieID, cookieMask)
+}
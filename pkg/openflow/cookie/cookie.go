@@ -0,0 +1,107 @@
+package cookie
+
+import (
+	"fmt"
+)
+
+// flow cookie的布局:
+// |63 ... 48|47 ... 40|39 ... 0|
+// |  round  | category| 保留   |
+// round在agent每次启动时加一，用于区分本次安装的流表以及之前的agent遗留的流表；category标识流表的来源
+const (
+	BitwidthRound    = 16
+	BitwidthCategory = 8
+
+	offsetRound    = 64 - BitwidthRound
+	offsetCategory = offsetRound - BitwidthCategory
+
+	RoundMask    uint64 = (1<<BitwidthRound - 1) << offsetRound
+	CategoryMask uint64 = (1<<BitwidthCategory - 1) << offsetCategory
+)
+
+// Category 流表的类别，0保留给没有设置cookie的流表
+type Category uint8
+
+const (
+	// Pod pod的转发、spoofGuard等流表，随CNI ADD/DEL安装和删除
+	Pod Category = iota + 1
+	// Node 对端node的隧道、arp流表
+	Node
+	// Policy NetworkPolicy规则的流表
+	Policy
+	// Service service以及coreDNS相关的流表
+	Service
+	// General 流水线的默认流表，以及gateway、tunnel等本node的流表
+	General
+)
+
+var categoryNames = map[Category]string{
+	Pod:     "Pod",
+	Node:    "Node",
+	Policy:  "Policy",
+	Service: "Service",
+	General: "General",
+}
+
+func (c Category) String() string {
+	if name, ok := categoryNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", uint8(c))
+}
+
+// ID flow cookie
+type ID uint64
+
+func newID(round uint64, category Category) ID {
+	return ID(round<<offsetRound | uint64(category)<<offsetCategory)
+}
+
+// Raw 返回FlowBuilder.Cookie使用的cookie值
+func (i ID) Raw() uint64 {
+	return uint64(i)
+}
+
+func (i ID) Round() uint64 {
+	return uint64(i) >> offsetRound
+}
+
+func (i ID) Category() Category {
+	return Category((uint64(i) & CategoryMask) >> offsetCategory)
+}
+
+func (i ID) String() string {
+	return fmt.Sprintf("<round:%d,category:%s>", i.Round(), i.Category())
+}
+
+// RoundCookie 返回匹配某一round所有流表的cookie以及mask
+func RoundCookie(round uint64) (uint64, uint64) {
+	return newID(round, 0).Raw(), RoundMask
+}
+
+// NextRound 返回prevRound之后的round。round为0的cookie与未设置cookie的流表相同，因此跳过0
+func NextRound(prevRound uint64) uint64 {
+	next := (prevRound + 1) & (1<<BitwidthRound - 1)
+	if next == 0 {
+		next = 1
+	}
+	return next
+}
+
+// Allocator 为流表分配cookie
+type Allocator interface {
+	Request(category Category) ID
+}
+
+type allocator struct {
+	round uint64
+}
+
+func (a *allocator) Request(category Category) ID {
+	return newID(a.round, category)
+}
+
+// NewAllocator 创建使用指定round的Allocator，round超出BitwidthRound的部分会被截断
+func NewAllocator(round uint64) Allocator {
+	return &allocator{round: round & (1<<BitwidthRound - 1)}
+}
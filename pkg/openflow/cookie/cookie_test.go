@@ -0,0 +1,32 @@
+package cookie
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocator(t *testing.T) {
+	id := NewAllocator(3).Request(Policy)
+	require.Equal(t, uint64(0x0003030000000000), id.Raw())
+	require.Equal(t, uint64(3), id.Round())
+	require.Equal(t, Policy, id.Category())
+	require.Equal(t, "<round:3,category:Policy>", id.String())
+
+	// round超出BitwidthRound的部分被截断
+	require.Equal(t, uint64(1), NewAllocator(1<<BitwidthRound+1).Request(Pod).Round())
+}
+
+func TestRoundCookie(t *testing.T) {
+	roundCookie, mask := RoundCookie(3)
+	for _, category := range []Category{Pod, Node, Policy, Service, General} {
+		require.Equal(t, roundCookie, NewAllocator(3).Request(category).Raw()&mask)
+		require.NotEqual(t, roundCookie, NewAllocator(4).Request(category).Raw()&mask)
+	}
+}
+
+func TestNextRound(t *testing.T) {
+	require.Equal(t, uint64(1), NextRound(0))
+	require.Equal(t, uint64(2), NextRound(1))
+	require.Equal(t, uint64(1), NextRound(1<<BitwidthRound-1))
+}
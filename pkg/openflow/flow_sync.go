@@ -0,0 +1,45 @@
+package openflow
+
+import (
+	"ciccni/pkg/openflow/cookie"
+	binding "ciccni/pkg/ovs/openflow"
+)
+
+// ReconcileFlows 以缓存中的流表为准，修正交换机上本次round的流表：补装缺失或被修改的流表，删除缓存中没有的流表。
+// 其他round以及没有cookie的流表不受影响
+func (c *client) ReconcileFlows() (binding.FlowSyncResult, error) {
+	c.reconcileLock.Lock()
+	defer c.reconcileLock.Unlock()
+
+	cookieID, cookieMask := cookie.RoundCookie(c.roundInfo.RoundNum)
+	return c.bridge.SyncFlows(c.expectedFlows(), cookieID, cookieMask)
+}
+
+// expectedFlows 返回所有缓存中的流表，调用者需要持有reconcileLock的写锁
+func (c *client) expectedFlows() []binding.Flow {
+	var flows []binding.Flow
+	for _, cache := range []*flowCategoryCache{c.nodeFlowCache, c.podFlowCache, c.serviceCache, c.generalCache} {
+		cache.Range(func(_, value interface{}) bool {
+			for _, flow := range value.(flowCache) {
+				flows = append(flows, flow)
+			}
+			return true
+		})
+	}
+
+	c.policyCache.Range(func(_, value interface{}) bool {
+		flows = append(flows, value.(*policyRuleConjunction).actionFlows...)
+		return true
+	})
+	c.conjMatchFlowLock.Lock()
+	defer c.conjMatchFlowLock.Unlock()
+	for _, ctx := range c.globalConjMatchFlowCache {
+		if ctx.flow != nil {
+			flows = append(flows, ctx.flow)
+		}
+		if ctx.dropFlow != nil {
+			flows = append(flows, ctx.dropFlow)
+		}
+	}
+	return flows
+}
@@ -20,6 +20,7 @@ import (
 
 	coreV1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/klog"
 
 	"ciccni/pkg/agent/types"
@@ -246,38 +247,70 @@ func (ctx *conjMatchFlowContext) deleteAction(conjID uint32) error {
 	return nil
 }
 
-// addAction adds the specified conjunction into conjunctiveMatchFlow's actions, and then updates the conjunctive
-// match flow on the switch. It also installs default drop flow if dropTable is not nil, and the dropFlow is not
-// installed before.
-func (ctx *conjMatchFlowContext) addAction(action *conjunctiveAction) error {
-	// Check if the conjunction exists in conjMatchFlowContext actions or not. If yes, return nil directly.
-	// Otherwise, add the new action, and update the Openflow entry.
-	_, found := ctx.actions[action.conjID]
-	if found {
-		return nil
-	}
-
-	// Install or update Openflow entry for the new conjunctiveAction.
+// flowWithAction builds the conjunctive match flow with the existing conjunctive actions and the new one. The returned
+// bool is true if the flow is already installed on the switch and needs to be modified.
+func (ctx *conjMatchFlowContext) flowWithAction(action *conjunctiveAction) (binding.Flow, bool) {
 	actions := make([]*conjunctiveAction, 0, len(ctx.actions)+1)
 	for _, act := range ctx.actions {
 		actions = append(actions, act)
 	}
 	actions = append(actions, action)
-	err := ctx.installOrUpdateFlow(actions)
-	if err != nil {
-		return err
+	if ctx.flow == nil {
+		return ctx.client.conjunctiveMatchFlow(ctx.tableID, ctx.matchKey, ctx.matchValue, actions...), false
 	}
-	ctx.actions[action.conjID] = action
-
-	return nil
+	flowBuilder := ctx.flow.CopyToBuilder()
+	for _, act := range actions {
+		flowBuilder.Action().Conjunction(act.conjID, act.clauseID, act.nClause)
+	}
+	return flowBuilder.Done(), true
 }
 
-func (ctx *conjMatchFlowContext) addDenyAllRule(ruleID uint32) error {
+func (ctx *conjMatchFlowContext) addDenyAllRule(ruleID uint32) {
 	if ctx.denyAllRules == nil {
 		ctx.denyAllRules = make(map[uint32]bool)
 	}
 	ctx.denyAllRules[ruleID] = true
-	return nil
+}
+
+// conjMatchFlowContextChange is the change of a conjMatchFlowContext when a clause adds a new match. The change is
+// calculated without modifying the context. Its flows are installed together with the other changes in one bundle, and
+// it is applied to the caches only after the bundle succeeds, so a failure leaves both the switch and the caches
+// untouched.
+type conjMatchFlowContextChange struct {
+	context    *conjMatchFlowContext
+	matcherKey string
+	clause     *clause
+	// isNew is true if the context is not in globalConjMatchFlowCache yet.
+	isNew bool
+	// matchFlow is the conjunctive match flow including the new conjunctive action. It is nil if the clause belongs to a
+	// DENY-ALL rule.
+	matchFlow binding.Flow
+	// modifyMatchFlow is true if matchFlow replaces the flow already installed on the switch.
+	modifyMatchFlow bool
+	// dropFlow is the default drop flow to install. It is nil if the clause has no dropTable, or the context has
+	// installed the drop flow already.
+	dropFlow binding.Flow
+}
+
+// apply updates the context, globalConjMatchFlowCache and clause matches after the flows are installed.
+func (ch *conjMatchFlowContextChange) apply() {
+	ctx := ch.context
+	action := ch.clause.action
+	if ch.dropFlow != nil {
+		ctx.dropFlow = ch.dropFlow
+	}
+	if action.nClause > 1 {
+		if ch.matchFlow != nil {
+			ctx.flow = ch.matchFlow
+		}
+		ctx.actions[action.conjID] = action
+	} else {
+		ctx.addDenyAllRule(action.conjID)
+	}
+	if ch.isNew {
+		ctx.client.globalConjMatchFlowCache[ch.matcherKey] = ctx
+	}
+	ch.clause.matches[ch.matcherKey] = ctx
 }
 
 // policyRuleConjunction is responsible to build Openflow entries for Pods that are in a NetworkPolicy rule's AppliedToGroup.
@@ -323,7 +356,9 @@ type clause struct {
 	dropTable binding.Table
 }
 
-func (c *clause) addConjunctiveMatchFlow(client *client, match *conjunctiveMatch) error {
+// calculateChange calculates the change to add the match into the clause, it returns nil if the clause has the match
+// already. The caller must hold client.conjMatchFlowLock.
+func (c *clause) calculateChange(client *client, match *conjunctiveMatch) *conjMatchFlowContextChange {
 	matcherKey := match.generateGlobalMapKey()
 	_, found := c.matches[matcherKey]
 	if found {
@@ -331,10 +366,12 @@ func (c *clause) addConjunctiveMatchFlow(client *client, match *conjunctiveMatch
 		return nil
 	}
 
-	client.conjMatchFlowLock.Lock()
-	defer client.conjMatchFlowLock.Unlock()
-
-	// Get conjMatchFlowContext from globalConjMatchFlowCache. If it doesn't exist, create a new one and add into the cache.
+	change := &conjMatchFlowContextChange{
+		matcherKey: matcherKey,
+		clause:     c,
+	}
+	// Get conjMatchFlowContext from globalConjMatchFlowCache. If it doesn't exist, create a new one which is added into
+	// the cache when the change is applied.
 	context, found := client.globalConjMatchFlowCache[matcherKey]
 	if !found {
 		context = &conjMatchFlowContext{
@@ -342,33 +379,65 @@ func (c *clause) addConjunctiveMatchFlow(client *client, match *conjunctiveMatch
 			actions:          make(map[uint32]*conjunctiveAction),
 			client:           client,
 		}
+		change.isNew = true
+	}
+	change.context = context
 
-		// Install the default drop flow entry if dropTable is not nil.
-		if c.dropTable != nil && context.dropFlow == nil {
-			dropFlow := context.client.defaultDropFlow(c.dropTable.GetID(), match.matchKey, match.matchValue)
-			if err := dropFlow.Add(); err != nil {
-				return err
-			}
-			context.dropFlow = dropFlow
-		}
-		client.globalConjMatchFlowCache[matcherKey] = context
+	// Install the default drop flow entry if dropTable is not nil.
+	if c.dropTable != nil && context.dropFlow == nil {
+		change.dropFlow = client.defaultDropFlow(c.dropTable.GetID(), match.matchKey, match.matchValue)
 	}
+	// Add the conjunction into the conjunctive match flow. A DENY-ALL rule only needs the default drop flow.
 	if c.action.nClause > 1 {
-		// Add the conjunction into conjunctiveFlowContext's actions, and update the flow entry on the switch.
-		err := context.addAction(c.action)
-		if err != nil {
-			return err
-		}
-	} else {
-		// Add the DENY-ALL rule into conjunctiveFlowContext's denyAllRules.
-		err := context.addDenyAllRule(c.action.conjID)
-		if err != nil {
-			return err
+		if _, found := context.actions[c.action.conjID]; !found {
+			change.matchFlow, change.modifyMatchFlow = context.flowWithAction(c.action)
 		}
 	}
+	return change
+}
 
-	c.matches[matcherKey] = context
+// calculateChanges calculates the changes to add the matches into the clause. The caller must hold
+// client.conjMatchFlowLock.
+func (c *clause) calculateChanges(client *client, matches []*conjunctiveMatch) []*conjMatchFlowContextChange {
+	var changes []*conjMatchFlowContextChange
+	pending := make(map[string]bool, len(matches))
+	for _, match := range matches {
+		matcherKey := match.generateGlobalMapKey()
+		if pending[matcherKey] {
+			continue
+		}
+		if change := c.calculateChange(client, match); change != nil {
+			pending[matcherKey] = true
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
 
+// installConjMatchFlowChanges installs the action flows and the flows of the changes in one bundle, then applies the
+// changes to the caches. Nothing is changed if the bundle fails. The caller must hold conjMatchFlowLock.
+func (c *client) installConjMatchFlowChanges(actionFlows []binding.Flow, changes []*conjMatchFlowContextChange) error {
+	addFlows := append([]binding.Flow{}, actionFlows...)
+	var modFlows []binding.Flow
+	for _, change := range changes {
+		if change.dropFlow != nil {
+			addFlows = append(addFlows, change.dropFlow)
+		}
+		if change.matchFlow == nil {
+			continue
+		}
+		if change.modifyMatchFlow {
+			modFlows = append(modFlows, change.matchFlow)
+		} else {
+			addFlows = append(addFlows, change.matchFlow)
+		}
+	}
+	if err := c.flowOperations.AddFlowsInBundle(addFlows, modFlows, nil); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		change.apply()
+	}
 	return nil
 }
 
@@ -384,6 +453,9 @@ func (c *clause) generateAddressConjMatch(addr types.Address, addrType types.Add
 }
 
 func getServiceMatchType(protocol *coreV1.Protocol) int {
+	if protocol == nil {
+		return MatchTCPDstPort
+	}
 	switch *protocol {
 	case coreV1.ProtocolTCP:
 		return MatchTCPDstPort
@@ -396,39 +468,85 @@ func getServiceMatchType(protocol *coreV1.Protocol) int {
 	}
 }
 
-func (c *clause) generateServicePortConjMatch(port *v1.NetworkPolicyPort) *conjunctiveMatch {
+// portMatch is a transport port matched with a bitmask. A mask of 0xffff matches the exact port, and a mask of 0
+// matches any port of the protocol.
+type portMatch struct {
+	port uint16
+	mask uint16
+}
+
+func (m portMatch) String() string {
+	return fmt.Sprintf("0x%04x/0x%04x", m.port, m.mask)
+}
+
+// portRangeToMasks splits the port range [start, end] into the minimal set of bitmask matches. Each match covers an
+// aligned block of 2^n ports, so a range like 1000-1999 needs a handful of flows instead of one flow per port.
+func portRangeToMasks(start, end uint16) []portMatch {
+	var matches []portMatch
+	for s, e := uint32(start), uint32(end); s <= e; {
+		size := uint32(1)
+		for size < 1<<16 && s%(size*2) == 0 && s+size*2-1 <= e {
+			size *= 2
+		}
+		matches = append(matches, portMatch{port: uint16(s), mask: uint16(^(size - 1))})
+		s += size
+	}
+	return matches
+}
+
+// generateServicePortConjMatches translates a NetworkPolicyPort to conjunctive matches. A port without Port matches
+// all ports of the protocol, and a port with EndPort matches the range [Port, EndPort]. Named ports should have been
+// resolved to numbers by the caller, they are ignored here.
+func (c *clause) generateServicePortConjMatches(port *v1.NetworkPolicyPort) []*conjunctiveMatch {
 	matchKey := getServiceMatchType(port.Protocol)
-	matchValue := uint16(port.Port.IntVal)
-	match := &conjunctiveMatch{
-		tableID:    c.ruleTable.GetID(),
-		matchKey:   matchKey,
-		matchValue: matchValue,
+	var matchValues []portMatch
+	switch {
+	case port.Port == nil:
+		matchValues = []portMatch{{port: 0, mask: 0}}
+	case port.Port.Type == intstr.String:
+		klog.Warningf("Named port %s is not resolved, ignore it", port.Port.StrVal)
+		return nil
+	case port.EndPort != nil && *port.EndPort > port.Port.IntVal:
+		matchValues = portRangeToMasks(uint16(port.Port.IntVal), uint16(*port.EndPort))
+	default:
+		matchValues = []portMatch{{port: uint16(port.Port.IntVal), mask: 0xffff}}
 	}
-	return match
+	matches := make([]*conjunctiveMatch, 0, len(matchValues))
+	for _, value := range matchValues {
+		matches = append(matches, &conjunctiveMatch{
+			tableID:    c.ruleTable.GetID(),
+			matchKey:   matchKey,
+			matchValue: value,
+		})
+	}
+	return matches
 }
 
-// addAddrFlows translates the specified addresses to conjunctiveMatchFlow, and installs corresponding Openflow entry.
-func (c *clause) addAddrFlows(client *client, addrType types.AddressType, addresses []types.Address) error {
+// addrMatches translates the specified addresses to conjunctive matches.
+func (c *clause) addrMatches(addrType types.AddressType, addresses []types.Address) []*conjunctiveMatch {
+	matches := make([]*conjunctiveMatch, 0, len(addresses))
 	for _, addr := range addresses {
-		match := c.generateAddressConjMatch(addr, addrType)
-		err := c.addConjunctiveMatchFlow(client, match)
-		if err != nil {
-			return err
-		}
+		matches = append(matches, c.generateAddressConjMatch(addr, addrType))
 	}
-	return nil
+	return matches
 }
 
-// addServiceFlows translates the specified NetworkPolicyPorts to conjunctiveMatchFlow, and installs corresponding Openflow entry.
-func (c *clause) addServiceFlows(client *client, ports []*v1.NetworkPolicyPort) error {
+// serviceMatches translates the specified NetworkPolicyPorts to conjunctive matches.
+func (c *clause) serviceMatches(ports []*v1.NetworkPolicyPort) []*conjunctiveMatch {
+	var matches []*conjunctiveMatch
 	for _, port := range ports {
-		match := c.generateServicePortConjMatch(port)
-		err := c.addConjunctiveMatchFlow(client, match)
-		if err != nil {
-			return err
-		}
+		matches = append(matches, c.generateServicePortConjMatches(port)...)
 	}
-	return nil
+	return matches
+}
+
+// addAddrFlows translates the specified addresses to conjunctiveMatchFlow, and installs corresponding Openflow entries
+// in one bundle.
+func (c *clause) addAddrFlows(client *client, addrType types.AddressType, addresses []types.Address) error {
+	client.conjMatchFlowLock.Lock()
+	defer client.conjMatchFlowLock.Unlock()
+	changes := c.calculateChanges(client, c.addrMatches(addrType, addresses))
+	return client.installConjMatchFlowChanges(nil, changes)
 }
 
 // deleteConjunctiveMatchFlow deletes the specific conjunctiveAction from existing flow.
@@ -531,10 +649,11 @@ func (c *policyRuleConjunction) getAddressClause(addrType types.AddressType) *cl
 // addresses in rule.To for ingress rule. No conjunctive match flow or conjunction action except flows are installed.
 // A DENY-ALL rule is configured with rule.ID, rule.Direction, and either rule.From(egress rule) or rule.To(ingress rule).
 // Other fields in the rule should be nil.
-// If there is an error in any clause's addAddrFlows or addServiceFlows, the conjunction action flow will never be hit.
-// If the default drop flow is already installed before this error, all packets will be dropped by the default drop flow,
-// Otherwise all packets will be allowed.
+// All the flows of the rule are installed in one bundle. If any flow fails, no flow of the rule is installed and the
+// caches are not changed, so the rule can be installed again later.
 func (c *client) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	// Check if the policyRuleConjunction is added into cache or not. If yes, return nil.
 	conj := c.getPolicyRuleConjunction(rule.ID)
 	if conj != nil {
@@ -575,11 +694,10 @@ func (c *client) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
 	// Conjunction action flows are installed only if the number of clauses in the conjunction is > 1. It should be a rule
 	// to drop all packets.  If the number is 1, no conjunctive match flows or conjunction action flows are installed,
 	// but the default drop flow is installed.
+	var actionFlows []binding.Flow
 	if nClause > 1 {
-		// Install action flows.
-		var actionFlows = []binding.Flow{
-			c.conjunctionActionFlow(rule.ID, ruleTable.GetID(), dropTable.GetNext()),
-		}
+		// Build action flows.
+		actionFlows = append(actionFlows, c.conjunctionActionFlow(rule.ID, ruleTable.GetID(), dropTable.GetNext()))
 		if rule.ExceptFrom != nil {
 			for _, addr := range rule.ExceptFrom {
 				flow := c.conjunctionExceptionFlow(rule.ID, ruleTable.GetID(), dropTable.GetID(), addr.GetMatchKey(types.SrcAddress), addr.GetValue())
@@ -592,16 +710,13 @@ func (c *client) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
 				actionFlows = append(actionFlows, flow)
 			}
 		}
-		for _, flow := range actionFlows {
-			err := flow.Add()
-			if err != nil {
-				return err
-			}
-		}
-		conj.actionFlows = actionFlows
 	}
 
-	// Install conjunctive match flows if exists in rule.Form/To/Service
+	c.conjMatchFlowLock.Lock()
+	defer c.conjMatchFlowLock.Unlock()
+
+	// Calculate conjunctive match flows if exists in rule.Form/To/Service
+	var changes []*conjMatchFlowContextChange
 	var defaultTable binding.Table
 	if rule.From != nil {
 		if isEgressRule {
@@ -610,9 +725,7 @@ func (c *client) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
 			defaultTable = nil
 		}
 		conj.fromClause = conj.newClause(fromID, nClause, ruleTable, defaultTable)
-		if err := conj.fromClause.addAddrFlows(c, types.SrcAddress, rule.From); err != nil {
-			return err
-		}
+		changes = append(changes, conj.fromClause.calculateChanges(c, conj.fromClause.addrMatches(types.SrcAddress, rule.From))...)
 	}
 	if rule.To != nil {
 		if !isEgressRule {
@@ -621,16 +734,18 @@ func (c *client) InstallPolicyRuleFlows(rule *types.PolicyRule) error {
 			defaultTable = nil
 		}
 		conj.toClause = conj.newClause(toID, nClause, ruleTable, defaultTable)
-		if err := conj.toClause.addAddrFlows(c, types.DstAddress, rule.To); err != nil {
-			return err
-		}
+		changes = append(changes, conj.toClause.calculateChanges(c, conj.toClause.addrMatches(types.DstAddress, rule.To))...)
 	}
 	if rule.Service != nil {
 		conj.serviceClause = conj.newClause(serviceID, nClause, ruleTable, nil)
-		if err := conj.serviceClause.addServiceFlows(c, rule.Service); err != nil {
-			return err
-		}
+		changes = append(changes, conj.serviceClause.calculateChanges(c, conj.serviceClause.serviceMatches(rule.Service))...)
+	}
+
+	// Install all the flows of the rule in one bundle.
+	if err := c.installConjMatchFlowChanges(actionFlows, changes); err != nil {
+		return err
 	}
+	conj.actionFlows = actionFlows
 	c.policyCache.Store(rule.ID, conj)
 	return nil
 }
@@ -659,6 +774,8 @@ func (c *client) getPolicyRuleConjunction(ruleID uint32) *policyRuleConjunction
 // UninstallPolicyRuleFlows removes the Openflow entry relevant to the specified NetworkPolicy rule.
 // UninstallPolicyRuleFlows will do nothing if no Openflow entry for the rule is installed.
 func (c *client) UninstallPolicyRuleFlows(ruleID uint32) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	conj := c.getPolicyRuleConjunction(ruleID)
 	if conj == nil {
 		klog.V(2).Infof("policyRuleConjunction with ID %d not found", ruleID)
@@ -701,6 +818,8 @@ func (c *client) UninstallPolicyRuleFlows(ruleID uint32) error {
 // AddPolicyRuleAddress adds one or multiple addresses to the specified NetworkPolicy rule. If addrType is srcAddress, the
 // addresses are added to PolicyRule.From, else to PolicyRule.To.
 func (c *client) AddPolicyRuleAddress(ruleID uint32, addrType types.AddressType, addresses []types.Address) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	conj := c.getPolicyRuleConjunction(ruleID)
 	// If policyRuleConjunction doesn't exist in client's policyCache return not found error. It should not happen, since
 	// NetworkPolicyController will guarantee the policyRuleConjunction is created before this method is called. The check
@@ -719,6 +838,8 @@ func (c *client) AddPolicyRuleAddress(ruleID uint32, addrType types.AddressType,
 // DeletePolicyRuleAddress removes addresses from the specified NetworkPolicy rule. If addrType is srcAddress, the addresses
 // are removed from PolicyRule.From, else from PolicyRule.To.
 func (c *client) DeletePolicyRuleAddress(ruleID uint32, addrType types.AddressType, addresses []types.Address) error {
+	c.reconcileLock.RLock()
+	defer c.reconcileLock.RUnlock()
 	conj := c.getPolicyRuleConjunction(ruleID)
 	// If policyRuleConjunction doesn't exist in client's policyCache return not found error. It should not happen, since
 	// NetworkPolicyController will guarantee the policyRuleConjunction is created before this method is called. The check
@@ -0,0 +1,132 @@
+package openflow
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"ciccni/pkg/agent/types"
+	binding "ciccni/pkg/ovs/openflow"
+)
+
+func TestPortRangeToMasks(t *testing.T) {
+	for _, tc := range []struct {
+		start, end uint16
+		expected   []string
+	}{
+		{80, 80, []string{"0x0050/0xffff"}},
+		{0, 65535, []string{"0x0000/0x0000"}},
+		{1024, 2047, []string{"0x0400/0xfc00"}},
+		{1000, 1010, []string{"0x03e8/0xfff8", "0x03f0/0xfffe", "0x03f2/0xffff"}},
+		{65534, 65535, []string{"0xfffe/0xfffe"}},
+		{1, 6, []string{"0x0001/0xffff", "0x0002/0xfffe", "0x0004/0xfffe", "0x0006/0xffff"}},
+	} {
+		var actual []string
+		covered := 0
+		for _, m := range portRangeToMasks(tc.start, tc.end) {
+			actual = append(actual, m.String())
+			covered += int(^m.mask) + 1
+		}
+		require.Equal(t, tc.expected, actual, "range %d-%d", tc.start, tc.end)
+		require.Equal(t, int(tc.end)-int(tc.start)+1, covered)
+	}
+}
+
+// bundleRecorder records the flows of each bundle instead of sending them to the switch.
+type bundleRecorder struct {
+	FlowOperations
+	err                          error
+	addFlows, modFlows, delFlows []binding.Flow
+}
+
+func (r *bundleRecorder) AddFlowsInBundle(addFlows, modFlows, delFlows []binding.Flow) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.addFlows = append(r.addFlows, addFlows...)
+	r.modFlows = append(r.modFlows, modFlows...)
+	r.delFlows = append(r.delFlows, delFlows...)
+	return nil
+}
+
+func TestInstallPolicyRuleFlowsInBundle(t *testing.T) {
+	c := NewClient("br0", false).(*client)
+	recorder := &bundleRecorder{err: errors.New("bundle failed")}
+	c.flowOperations = recorder
+
+	tcp := coreV1.ProtocolTCP
+	port := intstr.FromInt(80)
+	rule := &types.PolicyRule{
+		ID:        1,
+		Direction: v1.PolicyTypeIngress,
+		From:      []types.Address{NewIPAddress(net.ParseIP("10.0.1.2")), NewIPAddress(net.ParseIP("10.0.1.3"))},
+		To:        []types.Address{NewOFPortAddress(3)},
+		Service:   []*v1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+	}
+
+	// A failed bundle leaves the caches untouched, so the rule can be installed again.
+	require.Error(t, c.InstallPolicyRuleFlows(rule))
+	require.Nil(t, c.getPolicyRuleConjunction(rule.ID))
+	require.Empty(t, c.globalConjMatchFlowCache)
+
+	recorder.err = nil
+	require.NoError(t, c.InstallPolicyRuleFlows(rule))
+	require.NotNil(t, c.getPolicyRuleConjunction(rule.ID))
+	// 1 conjunction action flow, 4 conjunctive match flows and 1 default drop flow for the ofport.
+	require.Len(t, recorder.addFlows, 6)
+	require.Empty(t, recorder.modFlows)
+	require.Len(t, c.globalConjMatchFlowCache, 4)
+
+	// A second rule sharing the ofport modifies its conjunctive match flow, the drop flow is already installed.
+	recorder.addFlows = nil
+	rule2 := &types.PolicyRule{
+		ID:        2,
+		Direction: v1.PolicyTypeIngress,
+		From:      []types.Address{NewIPAddress(net.ParseIP("10.0.1.4"))},
+		To:        []types.Address{NewOFPortAddress(3)},
+	}
+	require.NoError(t, c.InstallPolicyRuleFlows(rule2))
+	require.Len(t, recorder.addFlows, 2)
+	require.Len(t, recorder.modFlows, 1)
+	require.Len(t, c.globalConjMatchFlowCache, 5)
+}
+
+// flowRecorder records the flows added and deleted one by one.
+type flowRecorder struct {
+	FlowOperations
+	added, deleted []binding.Flow
+}
+
+func (r *flowRecorder) Add(flow binding.Flow) error {
+	r.added = append(r.added, flow)
+	return nil
+}
+
+func (r *flowRecorder) Delete(flow binding.Flow) error {
+	r.deleted = append(r.deleted, flow)
+	return nil
+}
+
+func TestUninstallTunFlowKeepsNodeFlows(t *testing.T) {
+	c := NewClient("br0", false).(*client)
+	recorder := &flowRecorder{}
+	c.flowOperations = recorder
+
+	gatewayMAC, _ := net.ParseMAC("aa:bb:cc:00:00:01")
+	_, peerPodCIDR, _ := net.ParseCIDR("10.244.2.0/24")
+	require.NoError(t, c.InstallNodeFlows("node2", gatewayMAC, net.ParseIP("10.244.2.1"), *peerPodCIDR, net.ParseIP("192.168.0.2")))
+	require.NoError(t, c.InstallTunFlow("node2", "10.244.2.0/24", 0, net.ParseIP("192.168.0.2")))
+	require.Len(t, recorder.added, 3)
+
+	// The tunnel flow and the node flows of the same host are cached separately.
+	require.NoError(t, c.UninstallTunFlow("node2"))
+	require.Len(t, recorder.deleted, 1)
+	require.Equal(t, recorder.added[2].MatchString(), recorder.deleted[0].MatchString())
+	require.NoError(t, c.UninstallNodeFlows("node2"))
+	require.Len(t, recorder.deleted, 3)
+}
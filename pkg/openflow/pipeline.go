@@ -19,6 +19,8 @@ import (
 	"net"
 	"sync"
 
+	"ciccni/pkg/agent/types"
+	"ciccni/pkg/openflow/cookie"
 	binding "ciccni/pkg/ovs/openflow"
 )
 
@@ -38,10 +40,10 @@ const (
 	ingressDefaultTable   binding.TableIDType = 100
 	l2ForwardingOutTable  binding.TableIDType = 110
 
-	// ciccni的新index，大小在200之上
-	allFlowTable binding.TableIDType = 0 
+	// ciccni的新index。clusterFowardTable位于egressDefaultTable与l3ForwardingTable之间，负责选择转发路径：
+	// 对端node的pod走隧道，本地pod进入l3ForwardingTable，其余流量交给NORMAL
 	clusterFowardTable binding.TableIDType = 1
-	coreDnsSNATTTable binding.TableIDType = 2
+	coreDnsSNATTTable  binding.TableIDType = 2
 
 	// Flow priority level
 	priorityHigh   = 210
@@ -54,12 +56,18 @@ const (
 	markTrafficFromGateway = 1
 	markTrafficFromLocal   = 2
 
-	// IPConnectionVxlan generalCache key: ip隧道所对应的cache key，每个节点应该有多个
-	IPConnectionVxlan string = "ipConnectionVxlan"
 	// ArpRequest generalCache key: arp请求所对应的流表项，这个流表项有多个转发动作
 	ArpRequest string = "arpOP1"
 	// ArpResponse generalCache key: arp请求所对应的流表项，这个流表项有多个转发动作
 	ArpResponse string = "arpOP2"
+	// pipelineFlowsKey generalCache key: Initialize安装的各个表的默认流表
+	pipelineFlowsKey = "pipeline"
+	// gatewayFlowsKey generalCache key: gateway port相关的流表
+	gatewayFlowsKey = "gateway"
+	// tunnelFlowsKey generalCache key: tunnel port相关的流表
+	tunnelFlowsKey = "tunnel"
+	// serviceCIDRFlowsKey serviceCache key: service网段的dnat流表
+	serviceCIDRFlowsKey = "serviceCIDR"
 )
 
 var (
@@ -111,6 +119,10 @@ type FlowOperations interface {
 	Add(flow binding.Flow) error
 	Modify(flow binding.Flow) error
 	Delete(flow binding.Flow) error
+	// AddAll adds the flows in one bundle, none of them is added if any one fails.
+	AddAll(flows []binding.Flow) error
+	// AddFlowsInBundle adds, modifies and deletes the flows in one bundle.
+	AddFlowsInBundle(addFlows, modFlows, delFlows []binding.Flow) error
 }
 
 type flowCache map[string]binding.Flow
@@ -131,6 +143,16 @@ type client struct {
 	// globalConjMatchFlowCache is a global map for conjMatchFlowContext. The key is a string generated from the
 	// conjMatchFlowContext.
 	globalConjMatchFlowCache map[string]*conjMatchFlowContext
+	// arpFlowLock 保护arpTunDsts以及对应的arp请求/响应flow
+	arpFlowLock sync.Mutex
+	// arpTunDsts 为arp请求/响应flow中的隧道目的地址集合，key为ip的字符串形式
+	arpTunDsts map[string]net.IP
+	// roundInfo 本次启动的round，cookieAllocator据此为流表分配cookie
+	roundInfo       types.RoundInfo
+	cookieAllocator cookie.Allocator
+	// reconcileLock 流表对账时需要读取全部缓存，并以缓存为准修正交换机上的流表。安装、删除流表并更新缓存的方法持有读锁，
+	// ReconcileFlows持有写锁，避免把已经安装但尚未写入缓存的流表当作未知流表删除
+	reconcileLock sync.RWMutex
 }
 
 func (c *client) Add(flow binding.Flow) error {
@@ -145,28 +167,25 @@ func (c *client) Delete(flow binding.Flow) error {
 	return flow.Delete()
 }
 
+func (c *client) AddAll(flows []binding.Flow) error {
+	return c.bridge.AddFlowsInBundle(flows, nil, nil)
+}
+
+func (c *client) AddFlowsInBundle(addFlows, modFlows, delFlows []binding.Flow) error {
+	return c.bridge.AddFlowsInBundle(addFlows, modFlows, delFlows)
+}
+
 // defaultFlows generates the default flows of all tables.
 func (c *client) defaultFlows() (flows []binding.Flow) {
-	for _, table := range c.pipeline {
-		flowBuilder := table.BuildFlow().Priority(priorityMiss).MatchProtocol(binding.ProtocolIP)
-		switch table.GetMissAction() {
-		case binding.TableMissActionNext:
-			flowBuilder = flowBuilder.Action().Resubmit(emptyPlaceholderStr, table.GetNext())
-		case binding.TableMissActionNormal:
-			flowBuilder = flowBuilder.Action().Normal()
-		case binding.TableMissActionDrop:
-			fallthrough
-		default:
-			flowBuilder = flowBuilder.Action().Drop()
-		}
-		flows = append(flows, flowBuilder.Done())
+	for tableID := range c.pipeline {
+		flows = append(flows, c.tableMissFlow(tableID))
 	}
 	return flows
 }
 
 // tunnelClassifierFlow generates the flow to mark traffic comes from the tunnelOFPort.
 func (c *client) tunnelClassifierFlow(tunnelOFPort uint32) binding.Flow {
-	return c.pipeline[classifierTable].BuildFlow().Priority(priorityNormal).
+	return c.pipeline[classifierTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).Priority(priorityNormal).
 		MatchInPort(tunnelOFPort).
 		Action().LoadRegRange(int(marksReg), markTrafficFromTunnel, binding.Range{0, 15}).
 		Action().Resubmit(emptyPlaceholderStr, conntrackTable).
@@ -176,7 +195,7 @@ func (c *client) tunnelClassifierFlow(tunnelOFPort uint32) binding.Flow {
 // gatewayClassifierFlow generates the flow to mark traffic comes from the gatewayOFPort.
 func (c *client) gatewayClassifierFlow(gatewayOFPort uint32) binding.Flow {
 	classifierTable := c.pipeline[classifierTable]
-	return classifierTable.BuildFlow().Priority(priorityNormal).
+	return classifierTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).Priority(priorityNormal).
 		MatchInPort(gatewayOFPort).
 		Action().LoadRegRange(int(marksReg), markTrafficFromGateway, binding.Range{0, 15}).
 		Action().Resubmit(emptyPlaceholderStr, classifierTable.GetNext()).
@@ -186,13 +205,40 @@ func (c *client) gatewayClassifierFlow(gatewayOFPort uint32) binding.Flow {
 // podClassifierFlow generates the flow to mark traffic comes from the podOFPort.
 func (c *client) podClassifierFlow(podOFPort uint32) binding.Flow {
 	classifierTable := c.pipeline[classifierTable]
-	return classifierTable.BuildFlow().Priority(priorityLow).
+	return classifierTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Pod).Raw()).Priority(priorityLow).
 		MatchInPort(podOFPort).
 		Action().LoadRegRange(int(marksReg), markTrafficFromLocal, binding.Range{0, 15}).
 		Action().Resubmit(emptyPlaceholderStr, classifierTable.GetNext()).
 		Done()
 }
 
+// localPodForwardFlow 将目的地址为本地pod的ip流量交给l3ForwardingTable，之后经过l2转发计算以及ingress规则，
+// 直接输出到pod的端口，不再依赖NORMAL的mac学习
+func (c *client) localPodForwardFlow(podInterfaceIP net.IP) binding.Flow {
+	clusterForwardTable := c.pipeline[clusterFowardTable]
+	return clusterForwardTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Pod).Raw()).
+		Priority(priorityHigh).
+		MatchProtocol(binding.ProtocolIP).
+		MatchDstIP(podInterfaceIP).
+		Action().Resubmit(emptyPlaceholderStr, clusterForwardTable.GetNext()).
+		Done()
+}
+
+// tableMissFlow 根据table的miss action生成默认flow，不区分协议
+func (c *client) tableMissFlow(tableID binding.TableIDType) binding.Flow {
+	table := c.pipeline[tableID]
+	flowBuilder := table.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).Priority(priorityMiss)
+	switch table.GetMissAction() {
+	case binding.TableMissActionNext:
+		flowBuilder = flowBuilder.Action().Resubmit(emptyPlaceholderStr, table.GetNext())
+	case binding.TableMissActionNormal:
+		flowBuilder = flowBuilder.Action().Normal()
+	default:
+		flowBuilder = flowBuilder.Action().Drop()
+	}
+	return flowBuilder.Done()
+}
+
 // connectionTrackFlows generates flows that redirect traffic to ct_zone and handle traffic according to ct_state:
 // 1) commit new connections to ct that sent from non-gateway.
 // 2) Add ct_mark on traffic replied from the host gateway.
@@ -201,13 +247,13 @@ func (c *client) podClassifierFlow(podOFPort uint32) binding.Flow {
 // 4) Drop all invalid traffic.
 func (c *client) connectionTrackFlows() (flows []binding.Flow) {
 	connectionTrackTable := c.pipeline[conntrackTable]
-	baseConnectionTrackFlow := connectionTrackTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	baseConnectionTrackFlow := connectionTrackTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		Action().CT(false, connectionTrackTable.GetNext(), ctZone).CTDone().
 		Done()
 	flows = append(flows, baseConnectionTrackFlow)
 
 	connectionTrackStateTable := c.pipeline[conntrackStateTable]
-	gatewayReplyFlow := connectionTrackStateTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
+	gatewayReplyFlow := connectionTrackStateTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
 		MatchRegRange(int(marksReg), markTrafficFromGateway, binding.Range{0, 15}).
 		MatchCTMark(i2h(gatewayCTMark)).
 		MatchCTState("-new+trk").
@@ -215,14 +261,14 @@ func (c *client) connectionTrackFlows() (flows []binding.Flow) {
 		Done()
 	flows = append(flows, gatewayReplyFlow)
 
-	gatewaySendFlow := connectionTrackStateTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	gatewaySendFlow := connectionTrackStateTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchRegRange(int(marksReg), markTrafficFromGateway, binding.Range{0, 15}).
 		MatchCTState("+new+trk").
 		Action().CT(true, connectionTrackStateTable.GetNext(), ctZone).LoadToMark(gatewayCTMark).MoveToLabel(binding.NxmFieldSrcMAC, &binding.Range{0, 47}, &binding.Range{0, 47}).CTDone().
 		Done()
 	flows = append(flows, gatewaySendFlow)
 
-	podReplyGatewayFlow := connectionTrackStateTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	podReplyGatewayFlow := connectionTrackStateTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchCTMark(i2h(gatewayCTMark)).
 		MatchCTState("-new+trk").
 		Action().MoveRange(binding.NxmFieldCtLabel, binding.NxmFieldDstMAC, binding.Range{0, 47}, binding.Range{0, 47}).
@@ -230,13 +276,13 @@ func (c *client) connectionTrackFlows() (flows []binding.Flow) {
 		Done()
 	flows = append(flows, podReplyGatewayFlow)
 
-	nonGatewaySendFlow := connectionTrackStateTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityLow).
+	nonGatewaySendFlow := connectionTrackStateTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityLow).
 		MatchCTState("+new+trk").
 		Action().CT(true, connectionTrackStateTable.GetNext(), ctZone).CTDone().
 		Done()
 	flows = append(flows, nonGatewaySendFlow)
 
-	invCTFlow := connectionTrackStateTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	invCTFlow := connectionTrackStateTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchCTState("+new+inv").
 		Action().Drop().
 		Done()
@@ -246,9 +292,9 @@ func (c *client) connectionTrackFlows() (flows []binding.Flow) {
 }
 
 // l2ForwardCalcFlow generates the flow that matches dst MAC and loads ofPort to reg.
-func (c *client) l2ForwardCalcFlow(dstMAC net.HardwareAddr, ofPort uint32) binding.Flow {
+func (c *client) l2ForwardCalcFlow(dstMAC net.HardwareAddr, ofPort uint32, category cookie.Category) binding.Flow {
 	l2FwdCalcTable := c.pipeline[l2ForwardingCalcTable]
-	return l2FwdCalcTable.BuildFlow().Priority(priorityNormal).
+	return l2FwdCalcTable.BuildFlow().Cookie(c.cookieAllocator.Request(category).Raw()).Priority(priorityNormal).
 		MatchDstMAC(dstMAC).
 		Action().LoadRegRange(int(portCacheReg), ofPort, ofPortRegRange).
 		Action().LoadRegRange(int(marksReg), portFoundMark, ofPortMarkRange).
@@ -258,7 +304,7 @@ func (c *client) l2ForwardCalcFlow(dstMAC net.HardwareAddr, ofPort uint32) bindi
 
 // l2ForwardOutputFlow generates the flow that outputs packets to OVS port after L2 forwarding calculation.
 func (c *client) l2ForwardOutputFlow() binding.Flow {
-	return c.pipeline[l2ForwardingOutTable].BuildFlow().
+	return c.pipeline[l2ForwardingOutTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).
 		Priority(priorityNormal).
 		MatchProtocol(binding.ProtocolIP).
 		MatchRegRange(int(marksReg), portFoundMark, ofPortMarkRange).
@@ -266,21 +312,9 @@ func (c *client) l2ForwardOutputFlow() binding.Flow {
 		Done()
 }
 
-// ipTunFlow 生成对端隧道的flow表项
-func (c *client) ipTunFlow(dstIPNet net.IPNet, inPort uint32, tunnelDstIP net.IP) binding.Flow {
-	return c.pipeline[allFlowTable].BuildFlow().
-		Priority(priorityNormal).
-		MatchProtocol(binding.ProtocolIP).
-		MatchDstIPNet(dstIPNet).
-		MatchInPort(inPort).
-		Action().SetTunnelDst(tunnelDstIP).
-		Action().Normal().
-		Done()
-}
-
 // ipTunFlowWithoutInPort 生成对端隧道的dlow表项，match字段中不包含in_port字段
 func (c *client) ipTunFlowWithoutInPort(dstIPNet net.IPNet, tunnelDstIP net.IP) binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
+	return c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).
 		Priority(priorityNormal).
 		MatchProtocol(binding.ProtocolIP).
 		MatchDstIPNet(dstIPNet).
@@ -289,49 +323,29 @@ func (c *client) ipTunFlowWithoutInPort(dstIPNet net.IPNet, tunnelDstIP net.IP)
 		Done()
 }
 
-func (c *client) classifierDefaultFlow() binding.Flow {
-	return c.pipeline[classifierTable].BuildFlow().
-		Priority(priorityMiss).
-		Action().Resubmit(emptyPlaceholderStr, clusterFowardTable).
-		Done()
-}
-
 func (c *client) classifierTableFlowWithInPort(coreDNSPort uint32) binding.Flow {
-	return c.pipeline[classifierTable].BuildFlow().
+	return c.pipeline[classifierTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Service).Raw()).
 	Priority(priorityNormal).
 	MatchInPort(coreDNSPort).
 	Action().Resubmit(emptyPlaceholderStr, coreDnsSNATTTable).
 	Done()
 }
 
-func (c *client) coreDNSSNATDefaultFlow() binding.Flow {
-	return c.pipeline[coreDnsSNATTTable].BuildFlow().
-	Priority(priorityMiss).
-	Action().Resubmit(emptyPlaceholderStr, clusterFowardTable).
-	Done()
-}
-
+// coreDnsSNATTFlowWithInPort 将coreDNS的响应的源地址改写为kube-dns的service ip，之后进入conntrackTable
 func (c *client) coreDnsSNATTFlowWithInPort(coreDNSPort uint32, serviceIP net.IP) binding.Flow {
-	return c.pipeline[coreDnsSNATTTable].BuildFlow().
+	coreDnsSNATTable := c.pipeline[coreDnsSNATTTable]
+	return coreDnsSNATTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Service).Raw()).
 	Priority(priorityNormal).
 	MatchInPort(coreDNSPort).
 	MatchTPSrc(53).
 	MatchProtocol(binding.ProtocolUDP).
 	Action().SetSrcIP(serviceIP).
-	Action().Resubmit(emptyPlaceholderStr, clusterFowardTable).
+	Action().Resubmit(emptyPlaceholderStr, coreDnsSNATTable.GetNext()).
 	Done()
 }
 
-func (c *client) clusterForwardDefaultFlow() binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
-	Priority(priorityMiss).
-	Action().Normal().
-	Done()
-
-}
-
 func (c *client) localIPFlowWithIPnet(ipnet net.IPNet) binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
+	return c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).
 	Priority(priorityNormal).
 	MatchProtocol(binding.ProtocolIP).
 	MatchDstIPNet(ipnet).
@@ -339,7 +353,7 @@ func (c *client) localIPFlowWithIPnet(ipnet net.IPNet) binding.Flow {
 	Done()
 }
 func (c *client) localIPFlowWithIP(ip net.IP) binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
+	return c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).
 	Priority(priorityNormal).
 	MatchProtocol(binding.ProtocolIP).
 	MatchDstIP(ip).
@@ -348,7 +362,7 @@ func (c *client) localIPFlowWithIP(ip net.IP) binding.Flow {
 }
 
 func (c *client) ipTunFlowMatchIP(dstIPNet net.IP, inPort uint32, tunnelDstIP net.IP) binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
+	return c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).
 		Priority(priorityNormal).
 		MatchProtocol(binding.ProtocolIP).
 		MatchDstIP(dstIPNet).
@@ -360,8 +374,8 @@ func (c *client) ipTunFlowMatchIP(dstIPNet net.IP, inPort uint32, tunnelDstIP ne
 
 // arpFlow 分别构建了arp请求和arp响应两个flow
 func (c *client) arpFlow(dstIPNets []*net.IP) (arpReqFlow binding.Flow, arpRespFlow binding.Flow) {
-	buildForReq := c.pipeline[clusterFowardTable].BuildFlow().Priority(priorityNormal).MatchProtocol(binding.ProtocolARP).MatchARPOp(1)
-	buildForResp := c.pipeline[clusterFowardTable].BuildFlow().Priority(priorityNormal).MatchProtocol(binding.ProtocolARP).MatchARPOp(2)
+	buildForReq := c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).Priority(priorityNormal).MatchProtocol(binding.ProtocolARP).MatchARPOp(1)
+	buildForResp := c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).Priority(priorityNormal).MatchProtocol(binding.ProtocolARP).MatchARPOp(2)
 	for _ , dstIPNet := range dstIPNets {
 		buildForReq.Action().SetTunnelDst(*dstIPNet).Action().Normal()
 		buildForResp.Action().SetTunnelDst(*dstIPNet).Action().Normal()
@@ -375,7 +389,7 @@ func (c *client) arpFlow(dstIPNets []*net.IP) (arpReqFlow binding.Flow, arpRespF
 func (c *client) l3FlowsToPod(localGatewayMAC net.HardwareAddr, podInterfaceIP net.IP, podInterfaceMAC net.HardwareAddr) binding.Flow {
 	l3FwdTable := c.pipeline[l3ForwardingTable]
 	// Rewrite src MAC to local gateway MAC, and rewrite dst MAC to pod MAC
-	return l3FwdTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	return l3FwdTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Pod).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchDstMAC(globalVirtualMAC).
 		MatchDstIP(podInterfaceIP).
 		Action().SetSrcMAC(localGatewayMAC).
@@ -388,7 +402,7 @@ func (c *client) l3FlowsToPod(localGatewayMAC net.HardwareAddr, podInterfaceIP n
 // l3ToGatewayFlow generates flow that rewrites MAC of the packet received from tunnel port and destined to local gateway.
 func (c *client) l3ToGatewayFlow(localGatewayIP net.IP, localGatewayMAC net.HardwareAddr) binding.Flow {
 	l3FwdTable := c.pipeline[l3ForwardingTable]
-	return l3FwdTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	return l3FwdTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchDstIP(localGatewayIP).
 		Action().SetDstMAC(localGatewayMAC).
 		Action().Resubmit(emptyPlaceholderStr, l3FwdTable.GetNext()).
@@ -399,7 +413,7 @@ func (c *client) l3ToGatewayFlow(localGatewayIP net.IP, localGatewayMAC net.Hard
 func (c *client) l3FwdFlowToRemote(localGatewayMAC net.HardwareAddr, peerSubnet net.IPNet, tunnelPeer net.IP) binding.Flow {
 	l3FwdTable := c.pipeline[l3ForwardingTable]
 	// Rewrite src MAC to local gateway MAC and rewrite dst MAC to virtual MAC
-	return l3FwdTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	return l3FwdTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchDstIPNet(peerSubnet).
 		Action().DecTTL().
 		Action().SetSrcMAC(localGatewayMAC).
@@ -412,7 +426,7 @@ func (c *client) l3FwdFlowToRemote(localGatewayMAC net.HardwareAddr, peerSubnet
 // arpResponderFlow generates the ARP responder flow entry that replies request comes from local gateway for peer
 // gateway MAC.
 func (c *client) arpResponderFlow(peerGatewayIP net.IP) binding.Flow {
-	return c.pipeline[arpResponderTable].BuildFlow().
+	return c.pipeline[arpResponderTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Node).Raw()).
 		MatchProtocol(binding.ProtocolARP).Priority(priorityNormal).
 		MatchARPOp(1).
 		MatchARPTpa(peerGatewayIP).
@@ -432,7 +446,7 @@ func (c *client) arpResponderFlow(peerGatewayIP net.IP) binding.Flow {
 func (c *client) podIPSpoofGuardFlow(ifIP net.IP, ifMAC net.HardwareAddr, ifOFPort uint32) binding.Flow {
 	ipPipeline := c.pipeline
 	ipSpoofGuardTable := ipPipeline[spoofGuardTable]
-	return ipSpoofGuardTable.BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	return ipSpoofGuardTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Pod).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchInPort(ifOFPort).
 		MatchSrcMAC(ifMAC).
 		MatchSrcIP(ifIP).
@@ -442,7 +456,7 @@ func (c *client) podIPSpoofGuardFlow(ifIP net.IP, ifMAC net.HardwareAddr, ifOFPo
 
 // gatewayARPSpoofGuardFlow generates the flow to skip ARP UP check on packets sent out from the local gateway interface.
 func (c *client) gatewayARPSpoofGuardFlow(gatewayOFPort uint32) binding.Flow {
-	return c.pipeline[spoofGuardTable].BuildFlow().MatchProtocol(binding.ProtocolARP).Priority(priorityNormal).
+	return c.pipeline[spoofGuardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolARP).Priority(priorityNormal).
 		MatchInPort(gatewayOFPort).
 		Action().Resubmit(emptyPlaceholderStr, arpResponderTable).
 		Done()
@@ -450,7 +464,7 @@ func (c *client) gatewayARPSpoofGuardFlow(gatewayOFPort uint32) binding.Flow {
 
 // arpSpoofGuardFlow generates the flow to check ARP traffic sent out from local pods interfaces.
 func (c *client) arpSpoofGuardFlow(ifIP net.IP, ifMAC net.HardwareAddr, ifOFPort uint32) binding.Flow {
-	return c.pipeline[spoofGuardTable].BuildFlow().MatchProtocol(binding.ProtocolARP).Priority(priorityNormal).
+	return c.pipeline[spoofGuardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Pod).Raw()).MatchProtocol(binding.ProtocolARP).Priority(priorityNormal).
 		MatchInPort(ifOFPort).
 		MatchARPSha(ifMAC).
 		MatchARPSpa(ifIP).
@@ -462,7 +476,7 @@ func (c *client) arpSpoofGuardFlow(ifIP net.IP, ifMAC net.HardwareAddr, ifOFPort
 func (c *client) gatewayIPSpoofGuardFlow(gatewayOFPort uint32) binding.Flow {
 	ipPipeline := c.pipeline
 	ipSpoofGuardTable := ipPipeline[spoofGuardTable]
-	return ipSpoofGuardTable.BuildFlow().Priority(priorityNormal).
+	return ipSpoofGuardTable.BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).Priority(priorityNormal).
 		MatchProtocol(binding.ProtocolIP).
 		MatchInPort(gatewayOFPort).
 		Action().Resubmit(emptyPlaceholderStr, ipSpoofGuardTable.GetNext()).
@@ -471,7 +485,7 @@ func (c *client) gatewayIPSpoofGuardFlow(gatewayOFPort uint32) binding.Flow {
 
 // serviceCIDRDNATFlow generates flows to match dst IP in service CIDR and output to host gateway interface directly.
 func (c *client) serviceCIDRDNATFlow(serviceCIDR *net.IPNet, gatewayOFPort uint32) binding.Flow {
-	return c.pipeline[dnatTable].BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
+	return c.pipeline[dnatTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Service).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityNormal).
 		MatchDstIPNet(*serviceCIDR).
 		Action().Output(int(gatewayOFPort)).
 		Done()
@@ -479,7 +493,7 @@ func (c *client) serviceCIDRDNATFlow(serviceCIDR *net.IPNet, gatewayOFPort uint3
 
 // arpNormalFlow generates the flow to response arp in normal way if no flow in arpResponderTable is matched.
 func (c *client) arpNormalFlow() binding.Flow {
-	return c.pipeline[clusterFowardTable].BuildFlow().
+	return c.pipeline[clusterFowardTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).
 		MatchProtocol(binding.ProtocolARP).Priority(priorityLow).
 		Action().Normal().Done()
 }
@@ -487,7 +501,7 @@ func (c *client) arpNormalFlow() binding.Flow {
 // conjunctionActionFlow generates the flow to resubmit to a specific table if policyRuleConjunction ID is matched. Priority of
 // conjunctionActionFlow is priorityLow.
 func (c *client) conjunctionActionFlow(conjunctionID uint32, tableID binding.TableIDType, nextTable binding.TableIDType) binding.Flow {
-	return c.pipeline[tableID].BuildFlow().
+	return c.pipeline[tableID].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Policy).Raw()).
 		MatchProtocol(binding.ProtocolIP).Priority(priorityLow).
 		MatchConjID(conjunctionID).
 		Action().Resubmit(emptyPlaceholderStr, nextTable).Done()
@@ -507,14 +521,14 @@ func (c *client) establishedConnectionFlows() (flows []binding.Flow) {
 	// matching the NetworkPolicy rules. Packets in the established connections need not to be checked with the
 	// egressRuleTable or the egressDropTable.
 	egressDropTable := c.pipeline[egressDefaultTable]
-	egressEstFlow := c.pipeline[egressRuleTable].BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
+	egressEstFlow := c.pipeline[egressRuleTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
 		MatchCTState("-new+est").
 		Action().Resubmit(emptyPlaceholderStr, egressDropTable.GetNext()).Done()
 	// ingressDropTable checks the destination address of packets, and drops packets sent to the AppliedToGroup but not
 	// matching the NetworkPolicy rules. Packets in the established connections need not to be checked with the
 	// ingressRuleTable or ingressDropTable.
 	ingressDropTable := c.pipeline[ingressDefaultTable]
-	ingressEstFlow := c.pipeline[ingressRuleTable].BuildFlow().MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
+	ingressEstFlow := c.pipeline[ingressRuleTable].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.General).Raw()).MatchProtocol(binding.ProtocolIP).Priority(priorityHigh).
 		MatchCTState("-new+est").
 		Action().Resubmit(emptyPlaceholderStr, ingressDropTable.GetNext()).Done()
 	return []binding.Flow{egressEstFlow, ingressEstFlow}
@@ -536,25 +550,40 @@ func (c *client) addFlowMatch(fb binding.FlowBuilder, matchType int, matchValue
 	case MatchSrcOFPort:
 		fb = fb.MatchProtocol(binding.ProtocolIP).MatchInPort(uint32(matchValue.(int32)))
 	case MatchTCPDstPort:
-		fb = fb.MatchProtocol(binding.ProtocolTCP).MatchTCPDstPort(matchValue.(uint16))
+		fb = fb.MatchProtocol(binding.ProtocolTCP)
+		if m := matchValue.(portMatch); m.mask == 0xffff {
+			fb = fb.MatchTCPDstPort(m.port)
+		} else if m.mask != 0 {
+			fb = fb.MatchTCPDstPortMask(m.port, m.mask)
+		}
 	case MatchUDPDstPort:
-		fb = fb.MatchProtocol(binding.ProtocolUDP).MatchUDPDstPort(matchValue.(uint16))
+		fb = fb.MatchProtocol(binding.ProtocolUDP)
+		if m := matchValue.(portMatch); m.mask == 0xffff {
+			fb = fb.MatchUDPDstPort(m.port)
+		} else if m.mask != 0 {
+			fb = fb.MatchUDPDstPortMask(m.port, m.mask)
+		}
 	case MatchSCTPDstPort:
-		fb = fb.MatchProtocol(binding.ProtocolSCTP).MatchSCTPDstPort(matchValue.(uint16))
+		fb = fb.MatchProtocol(binding.ProtocolSCTP)
+		if m := matchValue.(portMatch); m.mask == 0xffff {
+			fb = fb.MatchSCTPDstPort(m.port)
+		} else if m.mask != 0 {
+			fb = fb.MatchSCTPDstPortMask(m.port, m.mask)
+		}
 	}
 	return fb
 }
 
 // conjunctionExceptionFlow generates the flow to resubmit to a specific table if both policyRuleConjunction ID and except address are matched.
 func (c *client) conjunctionExceptionFlow(conjunctionID uint32, tableID binding.TableIDType, nextTable binding.TableIDType, matchKey int, matchValue interface{}) binding.Flow {
-	fb := c.pipeline[tableID].BuildFlow().Priority(priorityNormal).MatchConjID(conjunctionID)
+	fb := c.pipeline[tableID].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Policy).Raw()).Priority(priorityNormal).MatchConjID(conjunctionID)
 	return c.addFlowMatch(fb, matchKey, matchValue).
 		Action().Resubmit(emptyPlaceholderStr, nextTable).Done()
 }
 
 // conjunctiveMatchFlow generates the flow to set conjunctive actions if the match condition is matched.
 func (c *client) conjunctiveMatchFlow(tableID binding.TableIDType, matchKey int, matchValue interface{}, actions ...*conjunctiveAction) binding.Flow {
-	fb := c.pipeline[tableID].BuildFlow().Priority(priorityNormal)
+	fb := c.pipeline[tableID].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Policy).Raw()).Priority(priorityNormal)
 	fb = c.addFlowMatch(fb, matchKey, matchValue)
 	for _, act := range actions {
 		fb.Action().Conjunction(act.conjID, act.clauseID, act.nClause)
@@ -564,22 +593,39 @@ func (c *client) conjunctiveMatchFlow(tableID binding.TableIDType, matchKey int,
 
 // defaultDropFlow generates the flow to drop packets if the match condition is matched.
 func (c *client) defaultDropFlow(tableID binding.TableIDType, matchKey int, matchValue interface{}) binding.Flow {
-	fb := c.pipeline[tableID].BuildFlow().Priority(priorityNormal)
+	fb := c.pipeline[tableID].BuildFlow().Cookie(c.cookieAllocator.Request(cookie.Policy).Raw()).Priority(priorityNormal)
 	return c.addFlowMatch(fb, matchKey, matchValue).
 		Action().Drop().Done()
 }
 
-// NewClient is the constructor of the Client interface.
-func NewClient(bridgeName string) Client {
+// NewClient is the constructor of the Client interface. nativeOpenFlow为true时通过OpenFlow连接下发流表，否则使用ovs-ofctl命令。
+func NewClient(bridgeName string, nativeOpenFlow bool) Client {
 	bridge := binding.NewBridge(bridgeName)
+	if nativeOpenFlow {
+		bridge = binding.NewOFBridge(bridgeName, binding.DefaultOVSRunDir)
+	}
 	c := &client{
 		bridge: bridge,
+		// ip流量: classifier -> spoofGuard -> conntrack -> conntrackState -> dnat -> egressRule -> egressDefault ->
+		// clusterForward -> l3Forwarding -> l2ForwardingCalc -> ingressRule -> ingressDefault -> l2ForwardingOut
+		// arp流量: classifier -> spoofGuard -> arpResponder -> clusterForward
+		// 来自隧道的流量跳过spoofGuard，coreDNS的流量经过coreDnsSNATT后直接进入conntrack
 		pipeline: map[binding.TableIDType]binding.Table{
-			// l2ForwardingOutTable:  bridge.CreateTable(l2ForwardingOutTable, binding.LastTableID, binding.TableMissActionDrop),
-			// allFlowTable : bridge.CreateTable(allFlowTable, binding.LastTableID, binding.TableMissActionDrop),
-			classifierTable:       bridge.CreateTable(classifierTable, clusterFowardTable, binding.TableMissActionNext),
-			clusterFowardTable:   bridge.CreateTable(clusterFowardTable, binding.LastTableID, binding.TableMissActionNormal),
-			coreDnsSNATTTable:     bridge.CreateTable(coreDnsSNATTTable, clusterFowardTable, binding.TableMissActionNext),
+			classifierTable:       bridge.CreateTable(classifierTable, spoofGuardTable, binding.TableMissActionDrop),
+			clusterFowardTable:    bridge.CreateTable(clusterFowardTable, l3ForwardingTable, binding.TableMissActionNormal),
+			coreDnsSNATTTable:     bridge.CreateTable(coreDnsSNATTTable, conntrackTable, binding.TableMissActionNext),
+			spoofGuardTable:       bridge.CreateTable(spoofGuardTable, conntrackTable, binding.TableMissActionDrop),
+			arpResponderTable:     bridge.CreateTable(arpResponderTable, clusterFowardTable, binding.TableMissActionNext),
+			conntrackTable:        bridge.CreateTable(conntrackTable, conntrackStateTable, binding.TableMissActionNext),
+			conntrackStateTable:   bridge.CreateTable(conntrackStateTable, dnatTable, binding.TableMissActionNext),
+			dnatTable:             bridge.CreateTable(dnatTable, egressRuleTable, binding.TableMissActionNext),
+			egressRuleTable:       bridge.CreateTable(egressRuleTable, egressDefaultTable, binding.TableMissActionNext),
+			egressDefaultTable:    bridge.CreateTable(egressDefaultTable, clusterFowardTable, binding.TableMissActionNext),
+			l3ForwardingTable:     bridge.CreateTable(l3ForwardingTable, l2ForwardingCalcTable, binding.TableMissActionNext),
+			l2ForwardingCalcTable: bridge.CreateTable(l2ForwardingCalcTable, ingressRuleTable, binding.TableMissActionNext),
+			ingressRuleTable:      bridge.CreateTable(ingressRuleTable, ingressDefaultTable, binding.TableMissActionNext),
+			ingressDefaultTable:   bridge.CreateTable(ingressDefaultTable, l2ForwardingOutTable, binding.TableMissActionNext),
+			l2ForwardingOutTable:  bridge.CreateTable(l2ForwardingOutTable, binding.LastTableID, binding.TableMissActionNormal),
 		},
 		nodeFlowCache:            newFlowCategoryCache(),
 		podFlowCache:             newFlowCategoryCache(),
@@ -587,6 +633,8 @@ func NewClient(bridgeName string) Client {
 		generalCache: 			  newFlowCategoryCache(), // cache，为了进行modify和delete用的
 		policyCache:              sync.Map{},
 		globalConjMatchFlowCache: map[string]*conjMatchFlowContext{},
+		arpTunDsts:               map[string]net.IP{},
+		cookieAllocator:          cookie.NewAllocator(0),
 	}
 	c.flowOperations = c
 	return c
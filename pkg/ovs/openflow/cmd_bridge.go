@@ -15,8 +15,14 @@
 package openflow
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -55,12 +61,47 @@ func (b *commandBridge) DeleteTable(id TableIDType) bool {
 
 func (b *commandBridge) DumpTableStatus() []TableStatus {
 	var r []TableStatus
-	for _, t := range b.tableCache {
+	for _, t := range sortedTables(&b.Mutex, b.tableCache) {
 		r = append(r, t.Status())
 	}
 	return r
 }
 
+// QueryTableStatus runs "ovs-ofctl dump-tables" for the lookup and matched counts of all tables, and
+// "ovs-ofctl dump-aggregate" for the flow, packet and byte counts of each table.
+func (b *commandBridge) QueryTableStatus() ([]TableStatus, error) {
+	output, err := executor("ovs-ofctl", "dump-tables", b.name, "-O"+Version13).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump tables of bridge %s: %v", b.name, err)
+	}
+	tableStats, err := parseDumpTables(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	var r []TableStatus
+	for _, table := range sortedTables(&b.Mutex, b.tableCache) {
+		status := table.Status()
+		status.FromSwitch = true
+		if stats, ok := tableStats[table.GetID()]; ok {
+			status.LookupCount, status.MatchedCount = stats.lookup, stats.matched
+		}
+		match := fmt.Sprintf("table=%d", table.GetID())
+		output, err := executor("ovs-ofctl", "dump-aggregate", b.name, "-O"+Version13, match).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump aggregate of %s of bridge %s: %v", match, b.name, err)
+		}
+		aggregate, err := parseDumpAggregate(string(output))
+		if err != nil {
+			return nil, err
+		}
+		status.FlowCount = uint(aggregate.flows)
+		status.PacketCount, status.ByteCount = aggregate.packets, aggregate.bytes
+		r = append(r, status)
+	}
+	return r, nil
+}
+
 // Connect initiates connection to the OFSwitch. commandBridge executes command "ovs-ofctl show" to check if target
 // switch is connected or not.
 func (b *commandBridge) Connect(maxRetry int) error {
@@ -80,3 +121,278 @@ func (b *commandBridge) Connect(maxRetry int) error {
 func (b *commandBridge) Disconnect() error {
 	return nil
 }
+
+// AddFlowsInBundle writes the flows to a flow file and installs them with "ovs-ofctl --bundle add-flows", which applies
+// all the lines of the file in one OpenFlow 1.4 bundle. Modified and deleted flows use the strict flow-mods, so that
+// only the flow with the same match and priority is affected, as with the native bridge.
+func (b *commandBridge) AddFlowsInBundle(addFlows, modFlows, delFlows []Flow) error {
+	if len(addFlows)+len(modFlows)+len(delFlows) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, flow := range addFlows {
+		lines = append(lines, "add "+flow.String())
+	}
+	for _, flow := range modFlows {
+		lines = append(lines, "modify_strict "+flow.String())
+	}
+	for _, flow := range delFlows {
+		cmdFlow, ok := flow.(*commandFlow)
+		if !ok {
+			return fmt.Errorf("flow %s is not built by bridge %s", flow.MatchString(), b.name)
+		}
+		lines = append(lines, "delete_strict "+cmdFlow.strictMatchString())
+	}
+	if err := b.installFlowFile(lines); err != nil {
+		return err
+	}
+
+	updateTableStatus(addFlows, 1)
+	updateTableStatus(modFlows, 0)
+	updateTableStatus(delFlows, -1)
+	return nil
+}
+
+// installFlowFile writes the lines to a flow file and applies it with "ovs-ofctl --bundle add-flows".
+func (b *commandBridge) installFlowFile(lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	file, err := os.CreateTemp("", b.name+"-flows-")
+	if err != nil {
+		return fmt.Errorf("failed to create flow file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(buf.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write flow file: %v", err)
+	}
+	if output, err := executor("ovs-ofctl", "--bundle", "add-flows", b.name, "-O"+Version14, file.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to install %d flows in bundle: %v (%q)", len(lines), err, output)
+	}
+	return nil
+}
+
+// DeleteFlowsByCookie executes "ovs-ofctl del-flows" with a masked cookie match.
+func (b *commandBridge) DeleteFlowsByCookie(cookieID, cookieMask uint64) error {
+	match := fmt.Sprintf("cookie=0x%x/0x%x", cookieID, cookieMask)
+	if output, err := executor("ovs-ofctl", "del-flows", b.name, "-O"+Version13, match).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete flows %q: %v (%q)", match, err, output)
+	}
+	return nil
+}
+
+// SyncFlows compares the switch with the flows using "ovs-ofctl diff-flows", then adds the flows that are missing or
+// differ, and deletes the unexpected flows whose cookie matches, in one bundle. The table status is not changed, as the
+// repaired flows were already counted when they were installed.
+func (b *commandBridge) SyncFlows(flows []Flow, cookieID, cookieMask uint64) (FlowSyncResult, error) {
+	var result FlowSyncResult
+	file, err := os.CreateTemp("", b.name+"-expected-flows-")
+	if err != nil {
+		return result, fmt.Errorf("failed to create flow file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	for _, flow := range flows {
+		fmt.Fprintln(file, flow.String())
+	}
+	if err := file.Close(); err != nil {
+		return result, fmt.Errorf("failed to write flow file: %v", err)
+	}
+	// diff-flows exits with status 2 if it finds any difference.
+	output, err := executor("ovs-ofctl", "diff-flows", "-O"+Version13, b.name, file.Name()).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		err = nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to diff flows of bridge %s: %v", b.name, err)
+	}
+
+	// The lines starting with "-" are only on the switch, the lines starting with "+" are only in the file. A flow
+	// with different cookies or actions on both sides is printed once with each sign.
+	var removed, added []*diffFlowLine
+	addedKeys := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+		flow, err := parseDiffFlowLine(line)
+		if err != nil {
+			return result, err
+		}
+		switch line[0] {
+		case '-':
+			removed = append(removed, flow)
+		case '+':
+			added = append(added, flow)
+			addedKeys[flow.key] = true
+		}
+	}
+	removedKeys := map[string]bool{}
+	var lines []string
+	for _, flow := range removed {
+		removedKeys[flow.key] = true
+		if addedKeys[flow.key] || flow.cookie&cookieMask != cookieID&cookieMask {
+			continue
+		}
+		result.Unknown++
+		lines = append(lines, fmt.Sprintf("delete_strict %s,cookie=0x%x/-1", flow.key, flow.cookie))
+	}
+	for _, flow := range added {
+		if removedKeys[flow.key] {
+			result.Mismatched++
+		} else {
+			result.Missing++
+		}
+		lines = append(lines, "add "+flow.flow)
+	}
+	if len(lines) == 0 {
+		return result, nil
+	}
+	return result, b.installFlowFile(lines)
+}
+
+// diffFlowLine is a flow printed by "ovs-ofctl diff-flows", for example
+// "+table=10 priority=200,ip,nw_dst=10.0.0.0/24 cookie=0x1 actions=resubmit(,20)".
+type diffFlowLine struct {
+	// key is the table, priority and match of the flow, which identify the flow on the switch.
+	key    string
+	cookie uint64
+	// flow is the line without the sign, in a syntax accepted by ovs-ofctl.
+	flow string
+}
+
+func parseDiffFlowLine(line string) (*diffFlowLine, error) {
+	flow := &diffFlowLine{flow: line[1:]}
+	spec := flow.flow
+	if idx := strings.Index(spec, " actions="); idx >= 0 {
+		spec = spec[:idx]
+	}
+	// The table is omitted when it is 0.
+	keyParts := []string{"table=0"}
+	for _, field := range strings.FieldsFunc(spec, func(r rune) bool { return r == ' ' || r == ',' }) {
+		switch {
+		case strings.HasPrefix(field, "cookie="):
+			cookie, err := strconv.ParseUint(strings.TrimPrefix(field, "cookie="), 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cookie in flow %q: %v", line, err)
+			}
+			flow.cookie = cookie
+		case strings.HasPrefix(field, "table="):
+			keyParts[0] = field
+		default:
+			keyParts = append(keyParts, field)
+		}
+	}
+	flow.key = strings.Join(keyParts, ",")
+	return flow, nil
+}
+
+// tableStats is the status of a table reported by the switch.
+type tableStats struct {
+	active, lookup, matched uint64
+}
+
+// aggregateStats is the sum of the counters of a group of flows reported by the switch.
+type aggregateStats struct {
+	packets, bytes, flows uint64
+}
+
+var (
+	// dumpTablesHeaderPattern matches the header of a table in the output of "ovs-ofctl dump-tables", like "table 0:",
+	// `table 0 ("classifier"):` or "tables 1...253: ditto" which means the tables have the same status as the previous
+	// one. Old versions print "0: active=1, ..." instead.
+	dumpTablesHeaderPattern = regexp.MustCompile(`^\s*(?:tables? )?(\d+)(?:\.\.\.(\d+))?(?: \("[^"]*"\))?:\s*(ditto)?`)
+	counterPattern          = regexp.MustCompile(`(\w+)=(\d+)`)
+)
+
+func parseDumpTables(output string) (map[TableIDType]*tableStats, error) {
+	r := map[TableIDType]*tableStats{}
+	var current, previous *tableStats
+	for _, line := range strings.Split(output, "\n") {
+		if m := dumpTablesHeaderPattern.FindStringSubmatch(line); m != nil {
+			first, _ := strconv.ParseUint(m[1], 10, 8)
+			last := first
+			if m[2] != "" {
+				last, _ = strconv.ParseUint(m[2], 10, 8)
+			}
+			if m[3] != "" {
+				if previous == nil {
+					return nil, fmt.Errorf("invalid dump-tables output: %q", line)
+				}
+				for id := first; id <= last; id++ {
+					stats := *previous
+					r[TableIDType(id)] = &stats
+				}
+				current = nil
+				continue
+			}
+			current = &tableStats{}
+			r[TableIDType(first)] = current
+			previous = current
+		}
+		if current == nil {
+			continue
+		}
+		for _, m := range counterPattern.FindAllStringSubmatch(line, -1) {
+			value, _ := strconv.ParseUint(m[2], 10, 64)
+			switch m[1] {
+			case "active":
+				current.active = value
+			case "lookup":
+				current.lookup = value
+			case "matched":
+				current.matched = value
+			}
+		}
+	}
+	return r, nil
+}
+
+// parseDumpAggregate parses the output of "ovs-ofctl dump-aggregate", like
+// "OFPST_AGGREGATE reply (OF1.3) (xid=0x2): packet_count=10 byte_count=840 flow_count=3".
+func parseDumpAggregate(output string) (*aggregateStats, error) {
+	r := &aggregateStats{}
+	found := false
+	for _, m := range counterPattern.FindAllStringSubmatch(output, -1) {
+		value, _ := strconv.ParseUint(m[2], 10, 64)
+		switch m[1] {
+		case "packet_count":
+			r.packets = value
+		case "byte_count":
+			r.bytes = value
+		case "flow_count":
+			r.flows = value
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("invalid dump-aggregate output: %q", output)
+	}
+	return r, nil
+}
+
+// sortedTables returns the tables of a bridge sorted by ID.
+func sortedTables(lock sync.Locker, tableCache map[TableIDType]Table) []Table {
+	lock.Lock()
+	defer lock.Unlock()
+	tables := make([]Table, 0, len(tableCache))
+	for _, t := range tableCache {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].GetID() < tables[j].GetID() })
+	return tables
+}
+
+// updateTableStatus updates the status of the tables of the flows after they are changed in a bundle.
+func updateTableStatus(flows []Flow, delta int) {
+	for _, flow := range flows {
+		if updater, ok := flow.GetTable().(updater); ok {
+			updater.UpdateStatus(delta)
+		}
+	}
+}
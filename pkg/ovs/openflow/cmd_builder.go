@@ -122,7 +122,39 @@ func (b *commandBuilder) MatchUDPDstPort(port uint16) FlowBuilder {
 }
 
 func (b *commandBuilder) MatchSCTPDstPort(port uint16) FlowBuilder {
-	return b.MatchField("sct_dst", fmt.Sprintf("%d", port))
+	return b.MatchField("sctp_dst", fmt.Sprintf("%d", port))
+}
+
+func (b *commandBuilder) MatchTCPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	return b.MatchField("tcp_dst", fmt.Sprintf("0x%04x/0x%04x", port, mask))
+}
+
+func (b *commandBuilder) MatchUDPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	return b.MatchField("udp_dst", fmt.Sprintf("0x%04x/0x%04x", port, mask))
+}
+
+func (b *commandBuilder) MatchSCTPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	return b.MatchField("sctp_dst", fmt.Sprintf("0x%04x/0x%04x", port, mask))
+}
+
+func (b *commandBuilder) MatchTCPSrcPort(port uint16) FlowBuilder {
+	return b.MatchField("tcp_src", fmt.Sprintf("%d", port))
+}
+
+func (b *commandBuilder) MatchUDPSrcPort(port uint16) FlowBuilder {
+	return b.MatchField("udp_src", fmt.Sprintf("%d", port))
+}
+
+func (b *commandBuilder) MatchTCPFlags(flags uint16, mask uint16) FlowBuilder {
+	return b.MatchField("tcp_flags", fmt.Sprintf("0x%03x/0x%03x", flags, mask))
+}
+
+func (b *commandBuilder) MatchICMPType(icmpType uint8) FlowBuilder {
+	return b.MatchField("icmp_type", fmt.Sprintf("%d", icmpType))
+}
+
+func (b *commandBuilder) MatchICMPCode(icmpCode uint8) FlowBuilder {
+	return b.MatchField("icmp_code", fmt.Sprintf("%d", icmpCode))
 }
 
 func (b *commandBuilder) MatchTPSrc(port uint16) FlowBuilder {
@@ -134,8 +166,11 @@ func (b *commandBuilder) MatchProtocol(protocol protocol) FlowBuilder {
 	return b
 }
 
+// Cookie sets the cookie of the flow. Modify and Delete only apply to the flow with the same cookie.
 func (b *commandBuilder) Cookie(cookieID uint64) FlowBuilder {
-	return b.MatchField("cookie", fmt.Sprintf("%d", cookieID))
+	b.cookieID = cookieID
+	b.cookieSet = true
+	return b
 }
 
 func (b *commandBuilder) Action() Action {
@@ -15,6 +15,8 @@
 package openflow
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 	"testing"
@@ -51,3 +53,236 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("Expected running <%s>, got <%s>", expectedCommand, executedCommand)
 	}
 }
+
+func TestTransportMatches(t *testing.T) {
+	dummyBridge := NewBridge("ut0")
+	dummyTable := dummyBridge.CreateTable(TableIDType(50), TableIDType(60), TableMissActionNext)
+
+	for _, tc := range []struct {
+		name     string
+		build    func(fb FlowBuilder) FlowBuilder
+		expected string
+	}{
+		{
+			name:     "tcp dst port",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolTCP).MatchTCPDstPort(80) },
+			expected: "tcp,tcp_dst=80",
+		},
+		{
+			name: "tcp dst port mask",
+			build: func(fb FlowBuilder) FlowBuilder {
+				return fb.MatchProtocol(ProtocolTCP).MatchTCPDstPortMask(1024, 0xfc00)
+			},
+			expected: "tcp,tcp_dst=0x0400/0xfc00",
+		},
+		{
+			name:     "tcp src port",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolTCP).MatchTCPSrcPort(8080) },
+			expected: "tcp,tcp_src=8080",
+		},
+		{
+			name: "tcp syn",
+			build: func(fb FlowBuilder) FlowBuilder {
+				return fb.MatchProtocol(ProtocolTCP).MatchTCPFlags(TCPFlagSYN, TCPFlagSYN|TCPFlagACK)
+			},
+			expected: "tcp,tcp_flags=0x002/0x012",
+		},
+		{
+			name:     "udp dst port",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolUDP).MatchUDPDstPort(53) },
+			expected: "udp,udp_dst=53",
+		},
+		{
+			name: "udp dst port mask",
+			build: func(fb FlowBuilder) FlowBuilder {
+				return fb.MatchProtocol(ProtocolUDP).MatchUDPDstPortMask(1000, 0xfff8)
+			},
+			expected: "udp,udp_dst=0x03e8/0xfff8",
+		},
+		{
+			name:     "udp src port",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolUDP).MatchUDPSrcPort(53) },
+			expected: "udp,udp_src=53",
+		},
+		{
+			name:     "sctp dst port",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolSCTP).MatchSCTPDstPort(132) },
+			expected: "sctp,sctp_dst=132",
+		},
+		{
+			name:     "sctp dst port mask",
+			build:    func(fb FlowBuilder) FlowBuilder { return fb.MatchProtocol(ProtocolSCTP).MatchSCTPDstPortMask(0, 0) },
+			expected: "sctp,sctp_dst=0x0000/0x0000",
+		},
+		{
+			name: "icmp echo request",
+			build: func(fb FlowBuilder) FlowBuilder {
+				return fb.MatchProtocol(ProtocolICMP).MatchICMPType(8).MatchICMPCode(0)
+			},
+			expected: "icmp,icmp_type=8,icmp_code=0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flow := tc.build(dummyTable.BuildFlow().Priority(200)).Action().Drop().Done()
+			executedCommand := withUnitTestExecutor(func() {
+				if err := flow.Add(); err != nil {
+					t.Fatalf("Flow <%s> adding failed, err: %s", flow.String(), err)
+				}
+			})
+			expectedCommand := "ovs-ofctl add-flow ut0 -OOpenflow13 table=50,priority=200," + tc.expected + ",actions=drop"
+			if executedCommand != expectedCommand {
+				t.Fatalf("Expected running <%s>, got <%s>", expectedCommand, executedCommand)
+			}
+		})
+	}
+}
+
+func TestAddFlowsInBundle(t *testing.T) {
+	dummyBridge := NewBridge("ut0")
+	dummyTable := dummyBridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	addFlow := dummyTable.BuildFlow().Priority(200).MatchProtocol(ProtocolARP).Action().Normal().Done()
+	modFlow := dummyTable.BuildFlow().Priority(100).MatchProtocol(ProtocolIP).Action().Resubmit("", TableIDType(10)).Done()
+	delFlow := dummyTable.BuildFlow().Priority(100).MatchProtocol(ProtocolTCP).Action().Drop().Done()
+
+	var executedCommand, flowFile string
+	executor = func(name string, args ...string) *exec.Cmd {
+		executedCommand = name + " " + strings.Join(args[:len(args)-1], " ")
+		content, err := os.ReadFile(args[len(args)-1])
+		if err != nil {
+			t.Fatalf("Failed to read flow file: %v", err)
+		}
+		flowFile = string(content)
+		return exec.Command("true")
+	}
+	defer func() { executor = exec.Command }()
+
+	if err := dummyBridge.AddFlowsInBundle([]Flow{addFlow}, []Flow{modFlow}, []Flow{delFlow}); err != nil {
+		t.Fatalf("Adding flows in bundle failed, err: %s", err)
+	}
+	if expected := "ovs-ofctl --bundle add-flows ut0 -OOpenflow14"; executedCommand != expected {
+		t.Fatalf("Expected running <%s>, got <%s>", expected, executedCommand)
+	}
+	expectedFile := "add table=0,priority=200,arp,actions=Normal\n" +
+		"modify_strict table=0,priority=100,ip,actions=resubmit(,10)\n" +
+		"delete_strict table=0,priority=100,tcp\n"
+	if flowFile != expectedFile {
+		t.Fatalf("Expected flow file <%s>, got <%s>", expectedFile, flowFile)
+	}
+	if count := dummyTable.Status().FlowCount; count != 0 {
+		t.Fatalf("Expected flow count 0, got %d", count)
+	}
+}
+
+func TestCookie(t *testing.T) {
+	dummyBridge := NewBridge("ut0")
+	dummyTable := dummyBridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	flow := dummyTable.BuildFlow().Priority(200).Cookie(0x1000000000000).MatchProtocol(ProtocolARP).Action().Normal().Done()
+
+	// The cookie is set on the added flow, and deleting only matches the flow with the same cookie.
+	if expected := "table=0,priority=200,cookie=0x1000000000000,arp,actions=Normal"; flow.String() != expected {
+		t.Fatalf("Expected flow <%s>, got <%s>", expected, flow.String())
+	}
+	if expected := "table=0,cookie=0x1000000000000/-1,arp"; flow.MatchString() != expected {
+		t.Fatalf("Expected match <%s>, got <%s>", expected, flow.MatchString())
+	}
+
+	executedCommand := withUnitTestExecutor(func() {
+		if err := dummyBridge.DeleteFlowsByCookie(0x1000000000000, 0xffff000000000000); err != nil {
+			t.Fatalf("Deleting flows by cookie failed, err: %s", err)
+		}
+	})
+	expectedCommand := "ovs-ofctl del-flows ut0 -OOpenflow13 cookie=0x1000000000000/0xffff000000000000"
+	if executedCommand != expectedCommand {
+		t.Fatalf("Expected running <%s>, got <%s>", expectedCommand, executedCommand)
+	}
+}
+
+func TestSyncFlows(t *testing.T) {
+	dummyBridge := NewBridge("ut0")
+	dummyTable := dummyBridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	flows := []Flow{
+		dummyTable.BuildFlow().Priority(200).Cookie(0x1).MatchProtocol(ProtocolARP).Action().Normal().Done(),
+		dummyTable.BuildFlow().Priority(210).Cookie(0x1).MatchProtocol(ProtocolIP).Action().Normal().Done(),
+	}
+	// The ip flow has different actions on the switch, the tcp flow is unknown and the udp flow has a cookie that is
+	// not owned.
+	diffOutput := "-priority=210,ip cookie=0x1 actions=drop\n" +
+		"-table=10 priority=300,tcp cookie=0x1 actions=NORMAL\n" +
+		"-table=10 priority=300,udp cookie=0x2 actions=NORMAL\n" +
+		"+priority=200,arp cookie=0x1 actions=NORMAL\n" +
+		"+priority=210,ip cookie=0x1 actions=NORMAL\n"
+
+	var executedCommands []string
+	var flowFile string
+	executor = func(name string, args ...string) *exec.Cmd {
+		executedCommands = append(executedCommands, name+" "+strings.Join(args[:len(args)-1], " "))
+		if args[0] == "diff-flows" {
+			return exec.Command("sh", "-c", `printf "%s" "$0"; exit 2`, diffOutput)
+		}
+		content, err := os.ReadFile(args[len(args)-1])
+		if err != nil {
+			t.Fatalf("Failed to read flow file: %v", err)
+		}
+		flowFile = string(content)
+		return exec.Command("true")
+	}
+	defer func() { executor = exec.Command }()
+
+	result, err := dummyBridge.SyncFlows(flows, 0x1, 0xff)
+	if err != nil {
+		t.Fatalf("Syncing flows failed, err: %s", err)
+	}
+	if expected := (FlowSyncResult{Missing: 1, Mismatched: 1, Unknown: 1}); result != expected {
+		t.Fatalf("Expected result %+v, got %+v", expected, result)
+	}
+	expectedCommands := []string{"ovs-ofctl diff-flows -OOpenflow13 ut0", "ovs-ofctl --bundle add-flows ut0 -OOpenflow14"}
+	if strings.Join(executedCommands, ";") != strings.Join(expectedCommands, ";") {
+		t.Fatalf("Expected running <%v>, got <%v>", expectedCommands, executedCommands)
+	}
+	expectedFile := "delete_strict table=10,priority=300,tcp,cookie=0x1/-1\n" +
+		"add priority=200,arp cookie=0x1 actions=NORMAL\n" +
+		"add priority=210,ip cookie=0x1 actions=NORMAL\n"
+	if flowFile != expectedFile {
+		t.Fatalf("Expected flow file <%s>, got <%s>", expectedFile, flowFile)
+	}
+}
+
+func TestQueryTableStatus(t *testing.T) {
+	dummyBridge := NewBridge("ut0")
+	dummyBridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	dummyBridge.CreateTable(TableIDType(10), TableIDType(20), TableMissActionNext)
+	dummyBridge.CreateTable(TableIDType(20), LastTableID, TableMissActionNormal)
+
+	dumpTables := "OFPST_TABLE reply (OF1.3) (xid=0x2):\n" +
+		"  table 0:\n" +
+		"    active=3, lookup=120, matched=100\n" +
+		"\n" +
+		"  table 1:\n" +
+		"    active=0, lookup=7, matched=7\n" +
+		"\n" +
+		"  tables 2...253: ditto\n"
+	executor = func(name string, args ...string) *exec.Cmd {
+		output := dumpTables
+		if args[0] == "dump-aggregate" {
+			output = "OFPST_AGGREGATE reply (OF1.3) (xid=0x2): packet_count=10 byte_count=840 flow_count=" + strings.TrimPrefix(args[len(args)-1], "table=")
+		}
+		return exec.Command("printf", "%s", output)
+	}
+	defer func() { executor = exec.Command }()
+
+	status, err := dummyBridge.QueryTableStatus()
+	if err != nil {
+		t.Fatalf("Querying table status failed, err: %s", err)
+	}
+	var got []string
+	for _, s := range status {
+		if !s.FromSwitch {
+			t.Fatalf("Expected status of table %d from switch", s.ID)
+		}
+		got = append(got, fmt.Sprintf("%d:%d/%d/%d/%d/%d", s.ID, s.FlowCount, s.LookupCount, s.MatchedCount, s.PacketCount, s.ByteCount))
+	}
+	expected := []string{"0:0/120/100/10/840", "10:10/7/7/10/840", "20:20/7/7/10/840"}
+	if strings.Join(got, ";") != strings.Join(expected, ";") {
+		t.Fatalf("Expected status <%v>, got <%v>", expected, got)
+	}
+}
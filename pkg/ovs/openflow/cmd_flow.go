@@ -20,11 +20,13 @@ import (
 )
 
 type commandFlow struct {
-	table    Table
-	bridge   string
-	priority uint32
-	matchers []string
-	actions  []string
+	table     Table
+	bridge    string
+	priority  uint32
+	cookieID  uint64
+	cookieSet bool
+	matchers  []string
+	actions   []string
 }
 
 func (f *commandFlow) GetTable() Table {
@@ -32,11 +34,29 @@ func (f *commandFlow) GetTable() Table {
 }
 
 func (f *commandFlow) format(withActions bool) string {
+	return f.formatWith(withActions, withActions)
+}
+
+// strictMatchString returns the match of the flow including its priority, which is what the strict flow-mods
+// (modify_strict/delete_strict) use to identify exactly one flow.
+func (f *commandFlow) strictMatchString() string {
+	return f.formatWith(false, true)
+}
+
+func (f *commandFlow) formatWith(withActions, withPriority bool) string {
 	repr := fmt.Sprintf("table=%d", f.table.GetID())
 
-	if withActions {
+	if withPriority {
 		repr += fmt.Sprintf(",priority=%d", f.priority)
 	}
+	if withActions {
+		if f.cookieSet {
+			repr += fmt.Sprintf(",cookie=0x%x", f.cookieID)
+		}
+	} else if f.cookieSet {
+		// Match the exact cookie, so that a flow with the same match but another cookie is not affected.
+		repr += fmt.Sprintf(",cookie=0x%x/-1", f.cookieID)
+	}
 	if len(f.matchers) > 0 {
 		repr += fmt.Sprintf(",%s", strings.Join(f.matchers, ","))
 	}
@@ -92,10 +112,12 @@ func (f *commandFlow) MatchString() string {
 
 func (f *commandFlow) CopyToBuilder() FlowBuilder {
 	var newFlow = commandFlow{
-		table:    f.table,
-		bridge:   f.bridge,
-		priority: f.priority,
-		matchers: f.matchers,
+		table:     f.table,
+		bridge:    f.bridge,
+		priority:  f.priority,
+		cookieID:  f.cookieID,
+		cookieSet: f.cookieSet,
+		matchers:  f.matchers,
 	}
 	return &commandBuilder{newFlow}
 }
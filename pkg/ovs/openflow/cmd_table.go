@@ -42,6 +42,8 @@ func (t *commandTable) BuildFlow() FlowBuilder {
 }
 
 func (t *commandTable) Status() TableStatus {
+	t.Lock()
+	defer t.Unlock()
 	return TableStatus{
 		ID:         uint(t.id),
 		FlowCount:  t.flowCount,
@@ -62,7 +64,12 @@ func (t *commandTable) UpdateStatus(flowCountDelta int) {
 	defer t.Unlock()
 
 	if flowCountDelta < 0 {
-		t.flowCount -= uint(-flowCountDelta)
+		// Deleting a flow that is not on the switch does not make the count negative.
+		if uint(-flowCountDelta) > t.flowCount {
+			t.flowCount = 0
+		} else {
+			t.flowCount -= uint(-flowCountDelta)
+		}
 	} else {
 		t.flowCount += uint(flowCountDelta)
 	}
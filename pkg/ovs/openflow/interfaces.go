@@ -33,6 +33,8 @@ type Range [2]uint32
 
 const (
 	Version13 versionType = "Openflow13"
+	// Version14 is required by ovs-ofctl --bundle.
+	Version14 versionType = "Openflow14"
 
 	ProtocolIP   protocol = "ip"
 	ProtocolARP  protocol = "arp"
@@ -42,6 +44,16 @@ const (
 	ProtocolICMP protocol = "icmp"
 )
 
+// TCP flag bits used by MatchTCPFlags.
+const (
+	TCPFlagFIN uint16 = 0x01
+	TCPFlagSYN uint16 = 0x02
+	TCPFlagRST uint16 = 0x04
+	TCPFlagPSH uint16 = 0x08
+	TCPFlagACK uint16 = 0x10
+	TCPFlagURG uint16 = 0x20
+)
+
 const (
 	TableMissActionDrop MissActionType = iota
 	TableMissActionNormal
@@ -67,12 +79,26 @@ type Bridge interface {
 	CreateTable(id, next TableIDType, missAction MissActionType) Table
 	GetName() string
 	DeleteTable(id TableIDType) bool
+	// DumpTableStatus returns the status of the tables from the local counters, which are updated when flows are
+	// added or deleted through the Bridge.
 	DumpTableStatus() []TableStatus
+	// QueryTableStatus queries the flow, lookup, matched, packet and byte counts of the tables from the switch. The
+	// status is sorted by table ID.
+	QueryTableStatus() ([]TableStatus, error)
 	// Connect initiates connection to the OFSwitch. It will block until the connection is established.
 	// If Bridge is not connected in maxRetry times, it will return error.
 	Connect(maxRetry int) error
 	// Disconnect stops connection to the OFSwitch.
 	Disconnect() error
+	// AddFlowsInBundle adds, modifies and deletes the flows in one atomic transaction. Either all the changes are
+	// applied, or none of them is applied if any flow fails.
+	AddFlowsInBundle(addFlows, modFlows, delFlows []Flow) error
+	// DeleteFlowsByCookie deletes the flows in all tables whose cookie matches cookieID under cookieMask.
+	DeleteFlowsByCookie(cookieID, cookieMask uint64) error
+	// SyncFlows makes the flows on the switch whose cookie matches cookieID under cookieMask the same as flows. The
+	// expected flows missing from the switch are added again and the unexpected flows with a matching cookie are
+	// deleted in one bundle. Flows with other cookies are left untouched.
+	SyncFlows(flows []Flow, cookieID, cookieMask uint64) (FlowSyncResult, error)
 }
 
 func NewBridge(name string) Bridge {
@@ -87,6 +113,26 @@ type TableStatus struct {
 	ID         uint      `json:"id"`
 	FlowCount  uint      `json:"flowCount"`
 	UpdateTime time.Time `json:"updateTime"`
+	// FromSwitch is true if FlowCount and the counters below were queried from the switch, otherwise FlowCount is
+	// the local counter and the counters below are not set.
+	FromSwitch bool `json:"fromSwitch"`
+	// LookupCount is the number of packets looked up in the table, MatchedCount the number of them that hit a flow.
+	LookupCount  uint64 `json:"lookupCount,omitempty"`
+	MatchedCount uint64 `json:"matchedCount,omitempty"`
+	// PacketCount and ByteCount are the sums of the counters of the flows in the table.
+	PacketCount uint64 `json:"packetCount,omitempty"`
+	ByteCount   uint64 `json:"byteCount,omitempty"`
+}
+
+// FlowSyncResult counts the differences found by Bridge.SyncFlows between the expected flows and the switch.
+type FlowSyncResult struct {
+	// Missing is the number of expected flows that were not on the switch.
+	Missing int `json:"missing"`
+	// Mismatched is the number of expected flows that were on the switch with a different cookie or different
+	// actions. The native bridge only compares the cookie, as the switch may encode the actions differently.
+	Mismatched int `json:"mismatched"`
+	// Unknown is the number of flows on the switch with a matching cookie that were not expected.
+	Unknown int `json:"unknown"`
 }
 
 type Table interface {
@@ -162,6 +208,16 @@ type FlowBuilder interface {
 	MatchTCPDstPort(port uint16) FlowBuilder
 	MatchUDPDstPort(port uint16) FlowBuilder
 	MatchSCTPDstPort(port uint16) FlowBuilder
+	// MatchTCPDstPortMask 等方法按掩码匹配目的端口，用于以少量流表项表示一个端口范围
+	MatchTCPDstPortMask(port uint16, mask uint16) FlowBuilder
+	MatchUDPDstPortMask(port uint16, mask uint16) FlowBuilder
+	MatchSCTPDstPortMask(port uint16, mask uint16) FlowBuilder
+	MatchTCPSrcPort(port uint16) FlowBuilder
+	MatchUDPSrcPort(port uint16) FlowBuilder
+	// MatchTCPFlags 匹配flags中被mask选中的TCP标志位，例如flags=TCPFlagSYN、mask=TCPFlagSYN|TCPFlagACK只匹配SYN包
+	MatchTCPFlags(flags uint16, mask uint16) FlowBuilder
+	MatchICMPType(icmpType uint8) FlowBuilder
+	MatchICMPCode(icmpCode uint8) FlowBuilder
 	MatchTPSrc(port uint16) FlowBuilder
 	Cookie(cookieID uint64) FlowBuilder
 	Action() Action
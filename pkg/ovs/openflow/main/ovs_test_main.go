@@ -24,9 +24,9 @@ func main() {
 		return
 	}
 
-	ofClient := openflow.NewClient("br0")
+	ofClient := openflow.NewClient("br0", false)
 	dstTunIP := net.ParseIP("172.16.0.119")
-	err2 := ofClient.InstallTunFlow("172.16.0.1", uint32(portNum), dstTunIP)
+	err2 := ofClient.InstallTunFlow("test-node", "172.16.0.1", uint32(portNum), dstTunIP)
 	if err2 != nil {
 		logrus.Errorf("IntallTunFlow err, err = %s", err2)
 	}
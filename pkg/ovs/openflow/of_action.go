@@ -0,0 +1,361 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	ofpatOutput       uint16 = 0
+	ofpatDecNwTTL     uint16 = 24
+	ofpatSetField     uint16 = 25
+	ofpatExperimenter uint16 = 0xffff
+
+	// nxVendorID is the experimenter ID of the Nicira extension actions.
+	nxVendorID uint32 = 0x00002320
+
+	nxastRegMove       uint16 = 6
+	nxastRegLoad       uint16 = 7
+	nxastResubmitTable uint16 = 14
+	nxastOutputReg     uint16 = 15
+	nxastConjunction   uint16 = 34
+	nxastCT            uint16 = 35
+
+	nxCtFlagCommit uint16 = 1
+	nxCtRecircNone uint8  = 0xff
+	ofppInPort16   uint16 = 0xfff8
+)
+
+func encodeOutput(port uint32) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint16(buf[0:], ofpatOutput)
+	binary.BigEndian.PutUint16(buf[2:], 16)
+	binary.BigEndian.PutUint32(buf[4:], port)
+	binary.BigEndian.PutUint16(buf[8:], ofpcmlNoBuffer)
+	return buf
+}
+
+func encodeDecTTL() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:], ofpatDecNwTTL)
+	binary.BigEndian.PutUint16(buf[2:], 8)
+	return buf
+}
+
+func encodeSetField(field oxmField, value []byte) []byte {
+	buf := make([]byte, 4, 16)
+	binary.BigEndian.PutUint16(buf[0:], ofpatSetField)
+	entry := &oxmEntry{field: field, value: value}
+	buf = pad8(append(buf, entry.encode()...))
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+// encodeNXAction wraps the body of a Nicira extension action, the body starts right after the subtype.
+func encodeNXAction(subtype uint16, body []byte) []byte {
+	buf := make([]byte, 10, 10+len(body))
+	binary.BigEndian.PutUint16(buf[0:], ofpatExperimenter)
+	binary.BigEndian.PutUint32(buf[4:], nxVendorID)
+	binary.BigEndian.PutUint16(buf[8:], subtype)
+	buf = pad8(append(buf, body...))
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+func ofsNbits(rng Range) uint16 {
+	return uint16(rng[0])<<6 | uint16(rng[1]-rng[0])
+}
+
+func encodeRegLoad(field oxmField, value uint64, rng Range) []byte {
+	body := make([]byte, 14)
+	binary.BigEndian.PutUint16(body[0:], ofsNbits(rng))
+	binary.BigEndian.PutUint32(body[2:], field.header(false))
+	binary.BigEndian.PutUint64(body[6:], value)
+	return encodeNXAction(nxastRegLoad, body)
+}
+
+func encodeRegMove(src, dst oxmField, srcRng, dstRng Range) []byte {
+	body := make([]byte, 14)
+	binary.BigEndian.PutUint16(body[0:], uint16(srcRng[1]-srcRng[0]+1))
+	binary.BigEndian.PutUint16(body[2:], uint16(srcRng[0]))
+	binary.BigEndian.PutUint16(body[4:], uint16(dstRng[0]))
+	binary.BigEndian.PutUint32(body[6:], src.header(false))
+	binary.BigEndian.PutUint32(body[10:], dst.header(false))
+	return encodeNXAction(nxastRegMove, body)
+}
+
+func encodeOutputReg(field oxmField, rng Range) []byte {
+	body := make([]byte, 14)
+	binary.BigEndian.PutUint16(body[0:], ofsNbits(rng))
+	binary.BigEndian.PutUint32(body[2:], field.header(false))
+	binary.BigEndian.PutUint16(body[6:], ofpcmlNoBuffer)
+	return encodeNXAction(nxastOutputReg, body)
+}
+
+func encodeResubmitTable(inPort uint16, table TableIDType) []byte {
+	body := make([]byte, 6)
+	binary.BigEndian.PutUint16(body[0:], inPort)
+	body[2] = uint8(table)
+	return encodeNXAction(nxastResubmitTable, body)
+}
+
+// encodeConjunction encodes conjunction(id,clause/nClause). The clause is 1-based in ovs-ofctl syntax but 0-based on
+// the wire.
+func encodeConjunction(conjID uint32, clauseID uint8, nClause uint8) []byte {
+	body := make([]byte, 6)
+	body[0] = clauseID - 1
+	body[1] = nClause
+	binary.BigEndian.PutUint32(body[2:], conjID)
+	return encodeNXAction(nxastConjunction, body)
+}
+
+func encodeCT(base ctBase, actions [][]byte) []byte {
+	body := make([]byte, 14)
+	var flags uint16
+	if base.commit {
+		flags |= nxCtFlagCommit
+	}
+	binary.BigEndian.PutUint16(body[0:], flags)
+	// zone_src is 0, so the zone is an immediate value.
+	binary.BigEndian.PutUint16(body[6:], base.ctZone)
+	body[8] = nxCtRecircNone
+	if base.ctTable > 0 {
+		body[8] = base.ctTable
+	}
+	for _, action := range actions {
+		body = append(body, action...)
+	}
+	return encodeNXAction(nxastCT, body)
+}
+
+// encodeInstructions wraps the actions in an OFPIT_APPLY_ACTIONS instruction. No instruction means drop.
+func encodeInstructions(actions [][]byte) []byte {
+	if len(actions) == 0 {
+		return nil
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:], ofpitApplyActions)
+	for _, action := range actions {
+		buf = append(buf, action...)
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+type ofAction struct {
+	builder *ofBuilder
+}
+
+func (a *ofAction) add(action []byte) FlowBuilder {
+	a.builder.actions = append(a.builder.actions, action)
+	return a.builder
+}
+
+func (a *ofAction) fieldByName(name string) (oxmField, bool) {
+	field, err := nxmFieldByName(name)
+	if err != nil {
+		a.builder.setError(err)
+		return oxmField{}, false
+	}
+	return field, true
+}
+
+func (a *ofAction) Drop() FlowBuilder {
+	a.builder.text.Action().Drop()
+	return a.builder
+}
+
+func (a *ofAction) Output(port int) FlowBuilder {
+	a.builder.text.Action().Output(port)
+	return a.add(encodeOutput(uint32(port)))
+}
+
+func (a *ofAction) OutputFieldRange(name string, rng Range) FlowBuilder {
+	a.builder.text.Action().OutputFieldRange(name, rng)
+	field, ok := a.fieldByName(name)
+	if !ok {
+		return a.builder
+	}
+	return a.add(encodeOutputReg(field, rng))
+}
+
+func (a *ofAction) OutputRegRange(regID int, rng Range) FlowBuilder {
+	return a.OutputFieldRange(fmt.Sprintf("%s%d", NxmFieldReg, regID), rng)
+}
+
+func (a *ofAction) OutputInPort() FlowBuilder {
+	a.builder.text.Action().OutputInPort()
+	return a.add(encodeOutput(ofppInPort))
+}
+
+func (a *ofAction) CT(commit bool, tableID TableIDType, zone int) CTAction {
+	return &ofCT{
+		ctBase: ctBase{
+			commit:  commit,
+			ctTable: uint8(tableID),
+			ctZone:  uint16(zone),
+		},
+		text:    a.builder.text.Action().CT(commit, tableID, zone),
+		builder: a.builder,
+	}
+}
+
+func (a *ofAction) Load(name string, value uint64) FlowBuilder {
+	a.builder.text.Action().(*commandAction).Load(name, value)
+	field, ok := a.fieldByName(name)
+	if !ok {
+		return a.builder
+	}
+	return a.add(encodeRegLoad(field, value, Range{0, uint32(field.bits() - 1)}))
+}
+
+func (a *ofAction) LoadARPOperation(value uint16) FlowBuilder {
+	return a.Load(NxmFieldARPOp, uint64(value))
+}
+
+func (a *ofAction) LoadRange(name string, addr uint32, to Range) FlowBuilder {
+	a.builder.text.Action().LoadRange(name, addr, to)
+	field, ok := a.fieldByName(name)
+	if !ok {
+		return a.builder
+	}
+	return a.add(encodeRegLoad(field, uint64(addr), to))
+}
+
+func (a *ofAction) LoadRegRange(regID int, value uint32, to Range) FlowBuilder {
+	return a.LoadRange(fmt.Sprintf("reg%d", regID), value, to)
+}
+
+func (a *ofAction) Move(from, to string) FlowBuilder {
+	a.builder.text.Action().Move(from, to)
+	src, ok1 := a.fieldByName(from)
+	dst, ok2 := a.fieldByName(to)
+	if !ok1 || !ok2 {
+		return a.builder
+	}
+	rng := Range{0, uint32(src.bits() - 1)}
+	return a.add(encodeRegMove(src, dst, rng, rng))
+}
+
+func (a *ofAction) MoveRange(fromName, toName string, from, to Range) FlowBuilder {
+	a.builder.text.Action().MoveRange(fromName, toName, from, to)
+	src, ok1 := a.fieldByName(fromName)
+	dst, ok2 := a.fieldByName(toName)
+	if !ok1 || !ok2 {
+		return a.builder
+	}
+	return a.add(encodeRegMove(src, dst, from, to))
+}
+
+func (a *ofAction) Resubmit(port string, table TableIDType) FlowBuilder {
+	a.builder.text.Action().Resubmit(port, table)
+	inPort := ofppInPort16
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			a.builder.setError(fmt.Errorf("invalid resubmit port %q", port))
+			return a.builder
+		}
+		inPort = uint16(p)
+	}
+	return a.add(encodeResubmitTable(inPort, table))
+}
+
+func (a *ofAction) DecTTL() FlowBuilder {
+	a.builder.text.Action().DecTTL()
+	return a.add(encodeDecTTL())
+}
+
+func (a *ofAction) Normal() FlowBuilder {
+	a.builder.text.Action().Normal()
+	return a.add(encodeOutput(ofppNormal))
+}
+
+func (a *ofAction) Conjunction(conjID uint32, clauseID uint8, nClause uint8) FlowBuilder {
+	a.builder.text.Action().Conjunction(conjID, clauseID, nClause)
+	return a.add(encodeConjunction(conjID, clauseID, nClause))
+}
+
+func (a *ofAction) SetDstMAC(addr net.HardwareAddr) FlowBuilder {
+	a.builder.text.Action().SetDstMAC(addr)
+	return a.add(encodeSetField(oxmEthDst, addr))
+}
+
+func (a *ofAction) SetSrcMAC(addr net.HardwareAddr) FlowBuilder {
+	a.builder.text.Action().SetSrcMAC(addr)
+	return a.add(encodeSetField(oxmEthSrc, addr))
+}
+
+func (a *ofAction) SetARPSha(addr net.HardwareAddr) FlowBuilder {
+	a.builder.text.Action().SetARPSha(addr)
+	return a.add(encodeSetField(oxmARPSha, addr))
+}
+
+func (a *ofAction) SetARPTha(addr net.HardwareAddr) FlowBuilder {
+	a.builder.text.Action().SetARPTha(addr)
+	return a.add(encodeSetField(oxmARPTha, addr))
+}
+
+func (a *ofAction) SetARPSpa(addr net.IP) FlowBuilder {
+	a.builder.text.Action().SetARPSpa(addr)
+	return a.add(encodeSetField(oxmARPSpa, addr.To4()))
+}
+
+func (a *ofAction) SetARPTpa(addr net.IP) FlowBuilder {
+	a.builder.text.Action().SetARPTpa(addr)
+	return a.add(encodeSetField(oxmARPTpa, addr.To4()))
+}
+
+func (a *ofAction) SetSrcIP(addr net.IP) FlowBuilder {
+	a.builder.text.Action().SetSrcIP(addr)
+	return a.add(encodeSetField(oxmIPv4Src, addr.To4()))
+}
+
+func (a *ofAction) SetDstIP(addr net.IP) FlowBuilder {
+	a.builder.text.Action().SetDstIP(addr)
+	return a.add(encodeSetField(oxmIPv4Dst, addr.To4()))
+}
+
+func (a *ofAction) SetTunnelDst(addr net.IP) FlowBuilder {
+	a.builder.text.Action().SetTunnelDst(addr)
+	return a.add(encodeSetField(nxmNxTunIPv4Dst, addr.To4()))
+}
+
+// ofCT collects the nested actions of a ct action, which are encoded when CTDone is called.
+type ofCT struct {
+	ctBase
+	actions [][]byte
+	text    CTAction
+	builder *ofBuilder
+}
+
+func (a *ofCT) LoadToMark(value uint32) CTAction {
+	a.text.LoadToMark(value)
+	a.actions = append(a.actions, encodeRegLoad(nxmNxCtMark, uint64(value), Range{0, 31}))
+	return a
+}
+
+func (a *ofCT) LoadToLabelRange(value uint64, rng *Range) CTAction {
+	a.text.LoadToLabelRange(value, rng)
+	a.actions = append(a.actions, encodeRegLoad(nxmNxCtLabel, value, *rng))
+	return a
+}
+
+func (a *ofCT) MoveToLabel(fromName string, fromRng, labelRng *Range) CTAction {
+	a.text.MoveToLabel(fromName, fromRng, labelRng)
+	src, err := nxmFieldByName(fromName)
+	if err != nil {
+		a.builder.setError(err)
+		return a
+	}
+	a.actions = append(a.actions, encodeRegMove(src, nxmNxCtLabel, *fromRng, *labelRng))
+	return a
+}
+
+func (a *ofCT) CTDone() FlowBuilder {
+	a.text.CTDone()
+	a.builder.actions = append(a.builder.actions, encodeCT(a.ctBase, a.actions))
+	return a.builder
+}
@@ -0,0 +1,524 @@
+package openflow
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultOVSRunDir is where ovs-vswitchd creates the management socket <bridge>.mgmt of each bridge.
+	DefaultOVSRunDir = "/var/run/openvswitch"
+
+	ofHandshakeTimeout = 5 * time.Second
+	// ofRequestTimeout bounds the wait for the barrier reply of a request.
+	ofRequestTimeout = 10 * time.Second
+)
+
+var errOFConnClosed = errors.New("OpenFlow connection closed")
+
+// ofBridge programs flows through a persistent OpenFlow 1.3 connection to the management socket of the bridge,
+// instead of running ovs-ofctl for every flow. Each request is followed by a barrier, and the error replies received
+// before the barrier reply are returned to the caller.
+type ofBridge struct {
+	sync.Mutex
+
+	name       string
+	mgmtAddr   string
+	tableCache map[TableIDType]Table
+
+	// connLock serializes connecting, conn is replaced when the connection is re-established.
+	connLock sync.Mutex
+	conn     *ofConn
+
+	lastBundleID uint32
+}
+
+// NewOFBridge creates a Bridge that talks OpenFlow 1.3 to the management socket under ovsRunDir.
+func NewOFBridge(name string, ovsRunDir string) Bridge {
+	return &ofBridge{
+		name:       name,
+		mgmtAddr:   filepath.Join(ovsRunDir, name+".mgmt"),
+		tableCache: map[TableIDType]Table{},
+	}
+}
+
+func (b *ofBridge) CreateTable(id, next TableIDType, missAction MissActionType) Table {
+	t := &ofTable{
+		commandTable: &commandTable{
+			bridge:     b.name,
+			id:         id,
+			next:       next,
+			missAction: missAction,
+		},
+		bridge: b,
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.tableCache[t.id] = t
+	return t
+}
+
+func (b *ofBridge) GetName() string {
+	return b.name
+}
+
+func (b *ofBridge) DeleteTable(id TableIDType) bool {
+	return true
+}
+
+func (b *ofBridge) DumpTableStatus() []TableStatus {
+	var r []TableStatus
+	for _, t := range sortedTables(&b.Mutex, b.tableCache) {
+		r = append(r, t.Status())
+	}
+	return r
+}
+
+// QueryTableStatus sends an OFPMP_TABLE request for the lookup and matched counts of all tables, and an OFPMP_AGGREGATE
+// request for the flow, packet and byte counts of each table, all in one round trip.
+func (b *ofBridge) QueryTableStatus() ([]TableStatus, error) {
+	tables := sortedTables(&b.Mutex, b.tableCache)
+	msgs := []ofMessage{&tableStatsRequest{}}
+	for _, table := range tables {
+		msgs = append(msgs, &flowStatsRequest{aggregate: true, tableID: uint8(table.GetID())})
+	}
+	replies, err := b.queryMessages(msgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table status of bridge %s: %v", b.name, err)
+	}
+
+	tableStats := map[TableIDType]*tableStats{}
+	// The switch replies to the requests in order, so the aggregate replies are in the order of tables.
+	var aggregates []*aggregateStats
+	for _, reply := range replies {
+		switch multipartType(reply) {
+		case ofpmpTable:
+			stats, err := decodeTableStats(reply)
+			if err != nil {
+				return nil, err
+			}
+			for id, s := range stats {
+				tableStats[id] = s
+			}
+		case ofpmpAggregate:
+			aggregate, err := decodeAggregateStats(reply)
+			if err != nil {
+				return nil, err
+			}
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	if len(aggregates) != len(tables) {
+		return nil, fmt.Errorf("expected %d aggregate replies, got %d", len(tables), len(aggregates))
+	}
+
+	var r []TableStatus
+	for i, table := range tables {
+		status := table.Status()
+		status.FromSwitch = true
+		if stats, ok := tableStats[table.GetID()]; ok {
+			status.LookupCount, status.MatchedCount = stats.lookup, stats.matched
+		}
+		status.FlowCount = uint(aggregates[i].flows)
+		status.PacketCount, status.ByteCount = aggregates[i].packets, aggregates[i].bytes
+		r = append(r, status)
+	}
+	return r, nil
+}
+
+// AddFlowsInBundle sends the flow-mods in an atomic bundle, the switch discards all of them if any one fails.
+func (b *ofBridge) AddFlowsInBundle(addFlows, modFlows, delFlows []Flow) error {
+	if len(addFlows)+len(modFlows)+len(delFlows) == 0 {
+		return nil
+	}
+	bundleID := atomic.AddUint32(&b.lastBundleID, 1)
+	msgs := []ofMessage{&bundleControl{bundleID: bundleID, controlType: ofpbctOpenRequest}}
+	for _, change := range []struct {
+		flows   []Flow
+		command uint8
+	}{
+		{addFlows, ofpfcAdd},
+		{modFlows, ofpfcModifyStrict},
+		{delFlows, ofpfcDeleteStrict},
+	} {
+		for _, flow := range change.flows {
+			f, ok := flow.(*ofFlow)
+			if !ok {
+				return fmt.Errorf("flow %q is not built by bridge %s", flow.String(), b.name)
+			}
+			msg, err := f.flowMod(change.command)
+			if err != nil {
+				return fmt.Errorf("invalid flow %q: %v", flow.String(), err)
+			}
+			msgs = append(msgs, &bundleAdd{bundleID: bundleID, msg: msg})
+		}
+	}
+	msgs = append(msgs, &bundleControl{bundleID: bundleID, controlType: ofpbctCommitRequest})
+	if err := b.sendMessages(msgs); err != nil {
+		return fmt.Errorf("failed to install %d flows in bundle: %v", len(msgs)-2, err)
+	}
+
+	updateTableStatus(addFlows, 1)
+	updateTableStatus(modFlows, 0)
+	updateTableStatus(delFlows, -1)
+	return nil
+}
+
+// DeleteFlowsByCookie sends a non-strict delete of all tables with only the cookie matched.
+func (b *ofBridge) DeleteFlowsByCookie(cookieID, cookieMask uint64) error {
+	msg := &flowMod{
+		command:    ofpfcDelete,
+		tableID:    ofpttAll,
+		cookie:     cookieID,
+		cookieMask: cookieMask,
+		match:      encodeMatch(nil),
+	}
+	if err := b.sendMessages([]ofMessage{msg}); err != nil {
+		return fmt.Errorf("failed to delete flows with cookie 0x%x/0x%x: %v", cookieID, cookieMask, err)
+	}
+	return nil
+}
+
+// SyncFlows dumps the flows with a matching cookie from the switch, and compares them with flows by table, priority
+// and match. The flows missing from the switch or installed with another cookie are added again and the unexpected
+// flows are deleted in one bundle. The actions are not compared, since the switch may encode them differently.
+func (b *ofBridge) SyncFlows(flows []Flow, cookieID, cookieMask uint64) (FlowSyncResult, error) {
+	var result FlowSyncResult
+	replies, err := b.queryMessages([]ofMessage{&flowStatsRequest{tableID: ofpttAll, cookie: cookieID, cookieMask: cookieMask}})
+	if err != nil {
+		return result, fmt.Errorf("failed to dump flows of bridge %s: %v", b.name, err)
+	}
+	installed := map[string]*flowStats{}
+	for _, reply := range replies {
+		stats, err := decodeFlowStats(reply)
+		if err != nil {
+			return result, err
+		}
+		for _, s := range stats {
+			key, err := flowStatsKey(s.tableID, s.priority, s.match)
+			if err != nil {
+				return result, err
+			}
+			installed[key] = s
+		}
+	}
+
+	bundleID := atomic.AddUint32(&b.lastBundleID, 1)
+	msgs := []ofMessage{&bundleControl{bundleID: bundleID, controlType: ofpbctOpenRequest}}
+	expected := map[string]bool{}
+	for _, flow := range flows {
+		f, ok := flow.(*ofFlow)
+		if !ok {
+			return result, fmt.Errorf("flow %q is not built by bridge %s", flow.String(), b.name)
+		}
+		msg, err := f.flowMod(ofpfcAdd)
+		if err != nil {
+			return result, fmt.Errorf("invalid flow %q: %v", flow.String(), err)
+		}
+		key, err := flowStatsKey(msg.tableID, msg.priority, msg.match)
+		if err != nil {
+			return result, err
+		}
+		if expected[key] {
+			continue
+		}
+		expected[key] = true
+		s, ok := installed[key]
+		if ok && s.cookie == msg.cookie {
+			continue
+		}
+		if ok {
+			result.Mismatched++
+		} else {
+			result.Missing++
+		}
+		msgs = append(msgs, &bundleAdd{bundleID: bundleID, msg: msg})
+	}
+	for key, s := range installed {
+		if expected[key] {
+			continue
+		}
+		result.Unknown++
+		msgs = append(msgs, &bundleAdd{bundleID: bundleID, msg: &flowMod{
+			command:    ofpfcDeleteStrict,
+			tableID:    s.tableID,
+			priority:   s.priority,
+			cookie:     s.cookie,
+			cookieMask: ^uint64(0),
+			match:      s.match,
+		}})
+	}
+	if len(msgs) == 1 {
+		return result, nil
+	}
+	msgs = append(msgs, &bundleControl{bundleID: bundleID, controlType: ofpbctCommitRequest})
+	if err := b.sendMessages(msgs); err != nil {
+		return result, fmt.Errorf("failed to sync %d flows in bundle: %v", len(msgs)-2, err)
+	}
+	return result, nil
+}
+
+// flowStatsKey identifies a flow on the switch by its table, priority and match.
+func flowStatsKey(tableID uint8, priority uint16, match []byte) (string, error) {
+	key, err := matchKey(match)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("table=%d,priority=%d,%s", tableID, priority, key), nil
+}
+
+// Connect establishes the OpenFlow connection, retrying every second up to maxRetry times.
+func (b *ofBridge) Connect(maxRetry int) error {
+	for retry := 0; retry < maxRetry; retry++ {
+		klog.V(2).Infof("Trying to connect to OpenFlow switch %s...", b.mgmtAddr)
+		if _, err := b.getConn(); err != nil {
+			klog.V(2).Infof("Failed to connect to OpenFlow switch %s: %v", b.mgmtAddr, err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to connect to OpenFlow switch after %d tries", maxRetry)
+}
+
+func (b *ofBridge) Disconnect() error {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.close()
+	b.conn = nil
+	return err
+}
+
+// getConn returns the current connection, and reconnects if it has been closed, e.g. after ovs-vswitchd restarted.
+func (b *ofBridge) getConn() (*ofConn, error) {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	if b.conn != nil && !b.conn.isClosed() {
+		return b.conn, nil
+	}
+	conn, err := dialOFConn(b.mgmtAddr)
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+// sendMessages sends the messages followed by a barrier, and waits until the switch has processed all of them.
+func (b *ofBridge) sendMessages(msgs []ofMessage) error {
+	_, err := b.queryMessages(msgs)
+	return err
+}
+
+// queryMessages is like sendMessages, and also returns the bodies of the multipart replies to the messages.
+func (b *ofBridge) queryMessages(msgs []ofMessage) ([][]byte, error) {
+	conn, err := b.getConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.request(msgs)
+}
+
+// ofConn is an OpenFlow connection after the version negotiation.
+type ofConn struct {
+	conn    net.Conn
+	lastXid uint32
+
+	writeLock sync.Mutex
+	// pendingLock protects pending and errTargets.
+	pendingLock sync.Mutex
+	// pending maps the xid of a barrier request to the request waiting for it.
+	pending map[uint32]*ofRequest
+	// errTargets maps the xid of a sent message to the request it belongs to, for its error and multipart replies.
+	errTargets map[uint32]*ofRequest
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ofRequest is a group of messages followed by a barrier.
+type ofRequest struct {
+	xids    []uint32
+	errs    []error
+	replies [][]byte
+	done    chan struct{}
+}
+
+func dialOFConn(addr string) (*ofConn, error) {
+	netConn, err := net.DialTimeout("unix", addr, ofHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ofConn{
+		conn:       netConn,
+		pending:    map[uint32]*ofRequest{},
+		errTargets: map[uint32]*ofRequest{},
+		closed:     make(chan struct{}),
+	}
+	if err := c.handshake(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// handshake exchanges hello messages and checks that the switch supports OpenFlow 1.3.
+func (c *ofConn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(ofHandshakeTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(encodeMessage(&helloMessage{}, c.nextXid())); err != nil {
+		return err
+	}
+	for {
+		header, body, err := readMessage(c.conn)
+		if err != nil {
+			return err
+		}
+		switch header.Type {
+		case ofptHello:
+			if !helloSupports13(header, body) {
+				return fmt.Errorf("OpenFlow switch does not support OpenFlow 1.3")
+			}
+			return nil
+		case ofptError:
+			return fmt.Errorf("OpenFlow handshake failed: %v", decodeError(body))
+		}
+	}
+}
+
+func (c *ofConn) nextXid() uint32 {
+	return atomic.AddUint32(&c.lastXid, 1)
+}
+
+func (c *ofConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ofConn) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *ofConn) write(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// request sends msgs and a barrier in one write, then waits for the barrier reply. The errors the switch replied for
+// any of the messages are returned, otherwise the bodies of the multipart replies are returned in order.
+func (c *ofConn) request(msgs []ofMessage) ([][]byte, error) {
+	req := &ofRequest{done: make(chan struct{})}
+	var data []byte
+	for _, msg := range msgs {
+		xid := c.nextXid()
+		req.xids = append(req.xids, xid)
+		data = append(data, encodeMessage(msg, xid)...)
+	}
+	barrierXid := c.nextXid()
+	data = append(data, encodeMessage(&barrierRequest{}, barrierXid)...)
+
+	c.pendingLock.Lock()
+	c.pending[barrierXid] = req
+	for _, xid := range req.xids {
+		c.errTargets[xid] = req
+	}
+	c.pendingLock.Unlock()
+	defer c.forget(barrierXid, req)
+
+	if err := c.write(data); err != nil {
+		c.close()
+		return nil, err
+	}
+	select {
+	case <-req.done:
+	case <-c.closed:
+		return nil, errOFConnClosed
+	case <-time.After(ofRequestTimeout):
+		return nil, fmt.Errorf("timed out waiting for OpenFlow barrier reply")
+	}
+
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if len(req.errs) == 0 {
+		return req.replies, nil
+	}
+	if len(req.errs) == 1 {
+		return nil, req.errs[0]
+	}
+	return nil, fmt.Errorf("%d OpenFlow errors, first: %v", len(req.errs), req.errs[0])
+}
+
+func (c *ofConn) forget(barrierXid uint32, req *ofRequest) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	delete(c.pending, barrierXid)
+	for _, xid := range req.xids {
+		delete(c.errTargets, xid)
+	}
+}
+
+// readLoop dispatches the messages from the switch until the connection is closed.
+func (c *ofConn) readLoop() {
+	defer c.close()
+	for {
+		header, body, err := readMessage(c.conn)
+		if err != nil {
+			if !c.isClosed() {
+				klog.Warningf("OpenFlow connection closed: %v", err)
+			}
+			return
+		}
+		switch header.Type {
+		case ofptEchoRequest:
+			if err := c.write(encodeMessage(&echoMessage{reply: true, data: body}, header.Xid)); err != nil {
+				klog.Warningf("Failed to send OpenFlow echo reply: %v", err)
+				return
+			}
+		case ofptError:
+			ofErr := decodeError(body)
+			c.pendingLock.Lock()
+			if req, ok := c.errTargets[header.Xid]; ok {
+				req.errs = append(req.errs, ofErr)
+			} else {
+				klog.Warningf("Received OpenFlow error for unknown request %d: %v", header.Xid, ofErr)
+			}
+			c.pendingLock.Unlock()
+		case ofptMultipartReply:
+			c.pendingLock.Lock()
+			if req, ok := c.errTargets[header.Xid]; ok {
+				req.replies = append(req.replies, body)
+			}
+			c.pendingLock.Unlock()
+		case ofptBarrierReply:
+			c.pendingLock.Lock()
+			if req, ok := c.pending[header.Xid]; ok {
+				close(req.done)
+				delete(c.pending, header.Xid)
+			}
+			c.pendingLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func hexBytes(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestEncodeHello(t *testing.T) {
+	msg := encodeMessage(&helloMessage{}, 1)
+	require.Equal(t, hexBytes(t, "04000010 00000001 00010008 00000010"), msg)
+
+	header, body, err := readMessage(strings.NewReader(string(msg)))
+	require.NoError(t, err)
+	require.True(t, helloSupports13(header, body))
+}
+
+func TestEncodeFlowMod(t *testing.T) {
+	bridge := NewOFBridge("br0", t.TempDir()).(*ofBridge)
+	table := bridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	_, ipNet, _ := net.ParseCIDR("10.0.1.0/24")
+	build := func(table Table) Flow {
+		return table.BuildFlow().Priority(200).Cookie(0x1234).
+			MatchProtocol(ProtocolIP).
+			MatchDstIPNet(*ipNet).
+			Action().Resubmit("", TableIDType(10)).
+			Done()
+	}
+	flow := build(table).(*ofFlow)
+	// The flow is rendered the same way as by the command based bridge.
+	cmdFlow := build(NewBridge("br0").CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext))
+	require.Equal(t, cmdFlow.String(), flow.String())
+	require.Equal(t, cmdFlow.MatchString(), flow.MatchString())
+
+	msg, err := flow.flowMod(ofpfcAdd)
+	require.NoError(t, err)
+	expected := "0000000000001234 0000000000000000 00 00 0000 0000 00c8 ffffffff ffffffff ffffffff 0000 0000" +
+		// match: eth_type=0x0800, ipv4_dst=10.0.1.0/255.255.255.0
+		"0001 0016 80000a02 0800 80001908 0a000100 ffffff00 0000" +
+		// apply-actions: resubmit(,10)
+		"0004 0018 00000000 ffff0010 00002320 000e fff8 0a000000"
+	require.Equal(t, hexBytes(t, expected), msg.body())
+
+	// Delete and modify only match the flow with the same cookie, and delete carries no instruction.
+	msg, err = flow.flowMod(ofpfcDeleteStrict)
+	require.NoError(t, err)
+	require.Equal(t, ^uint64(0), msg.cookieMask)
+	require.Nil(t, msg.instructions)
+}
+
+func TestEncodeActions(t *testing.T) {
+	require.Equal(t, hexBytes(t, "ffff0010 00002320 0022 0102 00000005"), encodeConjunction(5, 2, 2))
+	require.Equal(t, hexBytes(t, "0000 0010 00000003 ffff 000000000000"), encodeOutput(3))
+	ct := encodeCT(ctBase{commit: true, ctTable: 40, ctZone: 65520}, nil)
+	require.Equal(t, hexBytes(t, "ffff0018 00002320 0023 0001 00000000 fff0 28 000000 0000"), ct)
+}
+
+func TestInvalidField(t *testing.T) {
+	bridge := NewOFBridge("br0", t.TempDir()).(*ofBridge)
+	table := bridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	flow := table.BuildFlow().Action().LoadRange("NXM_NX_UNKNOWN", 1, Range{0, 15}).Done().(*ofFlow)
+	_, err := flow.flowMod(ofpfcAdd)
+	require.Error(t, err)
+}
+
+// fakeSwitch accepts one connection on the management socket, completes the handshake, sends an echo request and
+// replies to barriers. Flow-mods with a priority of failPriority are answered with a FLOW_MOD_FAILED error, flow stats
+// requests with the flows in dumped, and table and aggregate stats requests with fixed counters. The data of the echo reply is sent to the first returned channel, the
+// flow-mods added to bundles to the second one.
+func fakeSwitch(t *testing.T, dir string, failPriority uint16, dumped ...[]byte) (<-chan string, <-chan []byte) {
+	echoCh := make(chan string, 1)
+	bundledCh := make(chan []byte, 16)
+	l, err := net.Listen("unix", filepath.Join(dir, "br0.mgmt"))
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(encodeMessage(&helloMessage{}, 100))
+		if header, _, err := readMessage(conn); err != nil || header.Type != ofptHello {
+			return
+		}
+		conn.Write(encodeMessage(&echoMessage{data: []byte("ping")}, 101))
+		for {
+			header, body, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			switch header.Type {
+			case ofptEchoReply:
+				echoCh <- string(body)
+			case ofptExperimenter:
+				// The inner message of a bundle add must carry the xid of the bundle add.
+				if binary.BigEndian.Uint32(body[4:]) != onftBundleAddMessage {
+					continue
+				}
+				inner := body[16:]
+				if binary.BigEndian.Uint32(inner[4:]) != header.Xid || binary.BigEndian.Uint16(inner[30:]) == failPriority {
+					errMsg := encodeMessage(&echoMessage{data: []byte{0, 17, 0, 14}}, header.Xid)
+					errMsg[1] = ofptError
+					conn.Write(errMsg)
+					continue
+				}
+				bundledCh <- inner[8:]
+			case ofptMultipartRequest:
+				reply := append([]byte{}, body[:8]...)
+				switch binary.BigEndian.Uint16(body) {
+				case ofpmpFlow:
+					for _, flow := range dumped {
+						reply = append(reply, flow...)
+					}
+				case ofpmpTable:
+					// Table 0 with 3 flows, 120 lookups and 100 matches.
+					reply = append(reply, hexBytes(t, "00000000 00000003 0000000000000078 0000000000000064")...)
+				case ofpmpAggregate:
+					// The table ID as the flow count, 10 packets and 840 bytes.
+					reply = append(reply, hexBytes(t, "000000000000000a 0000000000000348 000000")...)
+					reply = append(reply, body[8], 0, 0, 0, 0)
+				}
+				msg := encodeMessage(&echoMessage{data: reply}, header.Xid)
+				msg[1] = ofptMultipartReply
+				conn.Write(msg)
+			case ofptFlowMod:
+				if binary.BigEndian.Uint16(body[22:]) == failPriority {
+					errBody := []byte{0, 5, 0, 2}
+					errMsg := encodeMessage(&echoMessage{data: errBody}, header.Xid)
+					errMsg[1] = ofptError
+					conn.Write(errMsg)
+				}
+			case ofptBarrierRequest:
+				reply := encodeMessage(&barrierRequest{}, header.Xid)
+				reply[1] = ofptBarrierReply
+				conn.Write(reply)
+			}
+		}
+	}()
+	return echoCh, bundledCh
+}
+
+func TestOFBridgeRequest(t *testing.T) {
+	dir := t.TempDir()
+	echoCh, _ := fakeSwitch(t, dir, 300)
+	bridge := NewOFBridge("br0", dir)
+	require.NoError(t, bridge.Connect(1))
+	defer bridge.Disconnect()
+	select {
+	case data := <-echoCh:
+		require.Equal(t, "ping", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo reply received")
+	}
+
+	table := bridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	flow := table.BuildFlow().Priority(200).MatchProtocol(ProtocolARP).Action().Normal().Done()
+	require.NoError(t, flow.Add())
+	require.Equal(t, uint(1), table.Status().FlowCount)
+
+	failed := table.BuildFlow().Priority(300).MatchProtocol(ProtocolARP).Action().Normal().Done()
+	err := failed.Add()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "FLOW_MOD_FAILED")
+	require.Equal(t, uint(1), table.Status().FlowCount)
+
+	require.NoError(t, flow.Delete())
+	require.Equal(t, uint(0), table.Status().FlowCount)
+
+	require.NoError(t, bridge.AddFlowsInBundle([]Flow{flow}, nil, nil))
+	require.Equal(t, uint(1), table.Status().FlowCount)
+	require.Error(t, bridge.AddFlowsInBundle([]Flow{flow, failed}, nil, nil))
+	require.Equal(t, uint(1), table.Status().FlowCount)
+}
+
+func TestMatchKey(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	sent := encodeMatch([]*oxmEntry{
+		{field: oxmEthType, value: uint16Bytes(0x0806)},
+		{field: oxmEthDst, value: mac},
+		{field: nxmNxReg(0), value: uint32Bytes(0x10003), mask: uint32Bytes(0xffff)},
+	})
+	// The switch replies the fields in another order, with the NXM alias of eth_dst, a full mask on eth_type and the
+	// bits outside of the register mask cleared.
+	replied := encodeMatch([]*oxmEntry{
+		{field: nxmNxReg(0), value: uint32Bytes(0x3), mask: uint32Bytes(0xffff)},
+		{field: nxmOfEthDst, value: mac},
+		{field: oxmEthType, value: uint16Bytes(0x0806), mask: uint16Bytes(0xffff)},
+	})
+	sentKey, err := matchKey(sent)
+	require.NoError(t, err)
+	repliedKey, err := matchKey(replied)
+	require.NoError(t, err)
+	require.Equal(t, sentKey, repliedKey)
+
+	other, err := matchKey(encodeMatch([]*oxmEntry{{field: oxmEthType, value: uint16Bytes(0x0806)}}))
+	require.NoError(t, err)
+	require.NotEqual(t, sentKey, other)
+}
+
+// encodeFlowStats encodes a flow of an OFPMP_FLOW multipart reply without instructions.
+func encodeFlowStats(tableID uint8, priority uint16, cookie uint64, match []byte) []byte {
+	buf := make([]byte, 48, 48+len(match))
+	binary.BigEndian.PutUint16(buf[0:], uint16(48+len(match)))
+	buf[2] = tableID
+	binary.BigEndian.PutUint16(buf[12:], priority)
+	binary.BigEndian.PutUint64(buf[24:], cookie)
+	return append(buf, match...)
+}
+
+func TestOFBridgeSyncFlows(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	arpMatch := encodeMatch([]*oxmEntry{{field: oxmEthType, value: uint16Bytes(0x0806)}})
+	macMatch := encodeMatch([]*oxmEntry{{field: nxmOfEthDst, value: mac}})
+	dir := t.TempDir()
+	_, bundledCh := fakeSwitch(t, dir, 0xffff,
+		// The expected ARP flow.
+		encodeFlowStats(0, 200, 0x1, arpMatch),
+		// The expected MAC flow with another cookie.
+		encodeFlowStats(0, 210, 0x2, macMatch),
+		// A flow that is not expected.
+		encodeFlowStats(10, 300, 0x1, arpMatch),
+	)
+	bridge := NewOFBridge("br0", dir)
+	require.NoError(t, bridge.Connect(1))
+	defer bridge.Disconnect()
+
+	table := bridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	flows := []Flow{
+		table.BuildFlow().Priority(200).Cookie(0x1).MatchProtocol(ProtocolARP).Action().Normal().Done(),
+		table.BuildFlow().Priority(210).Cookie(0x1).MatchDstMAC(mac).Action().Normal().Done(),
+		table.BuildFlow().Priority(220).Cookie(0x1).MatchProtocol(ProtocolIP).Action().Normal().Done(),
+	}
+	result, err := bridge.SyncFlows(flows, 0x1, 0xff)
+	require.NoError(t, err)
+	require.Equal(t, FlowSyncResult{Missing: 1, Mismatched: 1, Unknown: 1}, result)
+
+	// command/table/priority of the bundled flow-mods: the MAC and IP flows are added, the unknown flow is deleted.
+	var commands []string
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-bundledCh:
+			commands = append(commands, fmt.Sprintf("%d/%d/%d", msg[17], msg[16], binary.BigEndian.Uint16(msg[22:])))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no bundled flow-mod received")
+		}
+	}
+	require.Equal(t, []string{"0/0/210", "0/0/220", "4/10/300"}, commands)
+}
+
+func TestOFBridgeQueryTableStatus(t *testing.T) {
+	dir := t.TempDir()
+	fakeSwitch(t, dir, 0xffff)
+	bridge := NewOFBridge("br0", dir)
+	require.NoError(t, bridge.Connect(1))
+	defer bridge.Disconnect()
+
+	bridge.CreateTable(TableIDType(10), LastTableID, TableMissActionNormal)
+	bridge.CreateTable(TableIDType(0), TableIDType(10), TableMissActionNext)
+	status, err := bridge.QueryTableStatus()
+	require.NoError(t, err)
+	require.Len(t, status, 2)
+	require.Equal(t, TableStatus{ID: 0, FromSwitch: true, LookupCount: 120, MatchedCount: 100, PacketCount: 10, ByteCount: 840}, status[0])
+	require.Equal(t, TableStatus{ID: 10, FlowCount: 10, FromSwitch: true, PacketCount: 10, ByteCount: 840}, status[1])
+}
@@ -0,0 +1,395 @@
+package openflow
+
+import (
+	"fmt"
+	"net"
+)
+
+// ofTable is the Table of ofBridge. It reuses the status bookkeeping of commandTable and builds native flows.
+type ofTable struct {
+	*commandTable
+	bridge *ofBridge
+}
+
+func (t *ofTable) BuildFlow() FlowBuilder {
+	fb := &ofBuilder{}
+	fb.table = t
+	fb.bridge = t.bridge
+	fb.text.table = t
+	fb.text.bridge = t.bridge.name
+	return fb
+}
+
+// ofFlow is a flow encoded as OpenFlow 1.3 flow-mod messages. It keeps the equivalent ovs-ofctl representation so that
+// String and MatchString return the same value as commandFlow.
+type ofFlow struct {
+	table  *ofTable
+	bridge *ofBridge
+	text   commandBuilder
+
+	priority  uint16
+	cookie    uint64
+	cookieSet bool
+	matches   []*oxmEntry
+	// tpSrc is resolved to tcp_src, udp_src or sctp_src by the protocol when the flow is encoded.
+	tpSrc   *uint16
+	actions [][]byte
+	// err records the first invalid field used by the builder, it is returned when the flow is sent.
+	err error
+}
+
+func (f *ofFlow) setError(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *ofFlow) GetTable() Table {
+	return f.table
+}
+
+func (f *ofFlow) String() string {
+	return f.text.String()
+}
+
+func (f *ofFlow) MatchString() string {
+	return f.text.MatchString()
+}
+
+func (f *ofFlow) Add() error {
+	if err := f.send(ofpfcAdd); err != nil {
+		return fmt.Errorf("failed to add flow %q: %v", f.String(), err)
+	}
+	f.table.UpdateStatus(1)
+	return nil
+}
+
+func (f *ofFlow) Modify() error {
+	if err := f.send(ofpfcModifyStrict); err != nil {
+		return fmt.Errorf("failed to modify flow %q: %v", f.String(), err)
+	}
+	f.table.UpdateStatus(0)
+	return nil
+}
+
+// Delete removes the flow with exactly the same match and priority.
+func (f *ofFlow) Delete() error {
+	if err := f.send(ofpfcDeleteStrict); err != nil {
+		return fmt.Errorf("failed to delete flow %q: %v", f.MatchString(), err)
+	}
+	f.table.UpdateStatus(-1)
+	return nil
+}
+
+func (f *ofFlow) send(command uint8) error {
+	msg, err := f.flowMod(command)
+	if err != nil {
+		return err
+	}
+	return f.bridge.sendMessages([]ofMessage{msg})
+}
+
+func (f *ofFlow) flowMod(command uint8) (*flowMod, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	matches, err := f.resolvedMatches()
+	if err != nil {
+		return nil, err
+	}
+	msg := &flowMod{
+		command:  command,
+		tableID:  uint8(f.table.GetID()),
+		priority: f.priority,
+		match:    encodeMatch(matches),
+	}
+	if f.cookieSet {
+		msg.cookie = f.cookie
+		if command != ofpfcAdd {
+			msg.cookieMask = ^uint64(0)
+		}
+	}
+	if command != ofpfcDeleteStrict {
+		msg.instructions = encodeInstructions(f.actions)
+	}
+	return msg, nil
+}
+
+// resolvedMatches returns the match fields with tp_src replaced by the field of the matched protocol.
+func (f *ofFlow) resolvedMatches() ([]*oxmEntry, error) {
+	if f.tpSrc == nil {
+		return f.matches, nil
+	}
+	var field oxmField
+	for _, e := range f.matches {
+		if e.field != oxmIPProto {
+			continue
+		}
+		switch e.value[0] {
+		case 6:
+			field = oxmTCPSrc
+		case 17:
+			field = oxmUDPSrc
+		case 132:
+			field = oxmSCTPSrc
+		}
+	}
+	if field.length == 0 {
+		return nil, fmt.Errorf("tp_src requires a tcp, udp or sctp protocol match")
+	}
+	return append(append([]*oxmEntry{}, f.matches...), &oxmEntry{field: field, value: uint16Bytes(*f.tpSrc)}), nil
+}
+
+func (f *ofFlow) CopyToBuilder() FlowBuilder {
+	fb := &ofBuilder{ofFlow{
+		table:     f.table,
+		bridge:    f.bridge,
+		priority:  f.priority,
+		cookie:    f.cookie,
+		cookieSet: f.cookieSet,
+		matches:   append([]*oxmEntry{}, f.matches...),
+		tpSrc:     f.tpSrc,
+		err:       f.err,
+	}}
+	fb.text = *(f.text.CopyToBuilder().(*commandBuilder))
+	fb.text.matchers = append([]string{}, f.text.matchers...)
+	return fb
+}
+
+type ofBuilder struct {
+	ofFlow
+}
+
+func (b *ofBuilder) Done() Flow {
+	return &b.ofFlow
+}
+
+// setMatch adds a match field, a later match on the same field replaces the earlier one.
+func (b *ofBuilder) setMatch(field oxmField, value, mask []byte) FlowBuilder {
+	entry := &oxmEntry{field: field, value: value, mask: mask}
+	for i, e := range b.matches {
+		if e.field == field {
+			b.matches[i] = entry
+			return b
+		}
+	}
+	b.matches = append(b.matches, entry)
+	return b
+}
+
+func (b *ofBuilder) Priority(value uint32) FlowBuilder {
+	b.text.Priority(value)
+	b.priority = uint16(value)
+	return b
+}
+
+func (b *ofBuilder) MatchProtocol(protocol protocol) FlowBuilder {
+	b.text.MatchProtocol(protocol)
+	switch protocol {
+	case ProtocolIP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0800), nil)
+	case ProtocolARP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0806), nil)
+	case ProtocolTCP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0800), nil)
+		b.setMatch(oxmIPProto, uint8Bytes(6), nil)
+	case ProtocolUDP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0800), nil)
+		b.setMatch(oxmIPProto, uint8Bytes(17), nil)
+	case ProtocolSCTP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0800), nil)
+		b.setMatch(oxmIPProto, uint8Bytes(132), nil)
+	case ProtocolICMP:
+		b.setMatch(oxmEthType, uint16Bytes(0x0800), nil)
+		b.setMatch(oxmIPProto, uint8Bytes(1), nil)
+	default:
+		b.setError(fmt.Errorf("unsupported protocol %s", protocol))
+	}
+	return b
+}
+
+func (b *ofBuilder) MatchReg(regID int, data uint32) FlowBuilder {
+	b.text.MatchReg(regID, data)
+	return b.setMatch(nxmNxReg(regID), uint32Bytes(data), nil)
+}
+
+func (b *ofBuilder) MatchRegRange(regID int, data uint32, rng Range) FlowBuilder {
+	b.text.MatchRegRange(regID, data, rng)
+	field := nxmNxReg(regID)
+	value, mask := bitRangeBytes(field, uint64(data), rng)
+	return b.setMatch(field, value, mask)
+}
+
+func (b *ofBuilder) MatchInPort(inPort uint32) FlowBuilder {
+	b.text.MatchInPort(inPort)
+	return b.setMatch(oxmInPort, uint32Bytes(inPort), nil)
+}
+
+func (b *ofBuilder) matchIPNet(field oxmField, ipNet net.IPNet) FlowBuilder {
+	ones, bits := ipNet.Mask.Size()
+	switch {
+	case ones == 0:
+		// A /0 prefix matches any address, the field is omitted.
+		return b
+	case ones == bits:
+		return b.setMatch(field, ipNet.IP.To4(), nil)
+	default:
+		return b.setMatch(field, ipNet.IP.Mask(ipNet.Mask).To4(), net.IP(ipNet.Mask).To4())
+	}
+}
+
+func (b *ofBuilder) MatchDstIP(ip net.IP) FlowBuilder {
+	b.text.MatchDstIP(ip)
+	return b.setMatch(oxmIPv4Dst, ip.To4(), nil)
+}
+
+func (b *ofBuilder) MatchDstIPNet(ipNet net.IPNet) FlowBuilder {
+	b.text.MatchDstIPNet(ipNet)
+	return b.matchIPNet(oxmIPv4Dst, ipNet)
+}
+
+func (b *ofBuilder) MatchSrcIP(ip net.IP) FlowBuilder {
+	b.text.MatchSrcIP(ip)
+	return b.setMatch(oxmIPv4Src, ip.To4(), nil)
+}
+
+func (b *ofBuilder) MatchSrcIPNet(ipNet net.IPNet) FlowBuilder {
+	b.text.MatchSrcIPNet(ipNet)
+	return b.matchIPNet(oxmIPv4Src, ipNet)
+}
+
+func (b *ofBuilder) MatchDstMAC(mac net.HardwareAddr) FlowBuilder {
+	b.text.MatchDstMAC(mac)
+	return b.setMatch(oxmEthDst, mac, nil)
+}
+
+func (b *ofBuilder) MatchSrcMAC(mac net.HardwareAddr) FlowBuilder {
+	b.text.MatchSrcMAC(mac)
+	return b.setMatch(oxmEthSrc, mac, nil)
+}
+
+func (b *ofBuilder) MatchARPSha(mac net.HardwareAddr) FlowBuilder {
+	b.text.MatchARPSha(mac)
+	return b.setMatch(oxmARPSha, mac, nil)
+}
+
+func (b *ofBuilder) MatchARPTha(mac net.HardwareAddr) FlowBuilder {
+	b.text.MatchARPTha(mac)
+	return b.setMatch(oxmARPTha, mac, nil)
+}
+
+func (b *ofBuilder) MatchARPSpa(ip net.IP) FlowBuilder {
+	b.text.MatchARPSpa(ip)
+	return b.setMatch(oxmARPSpa, ip.To4(), nil)
+}
+
+func (b *ofBuilder) MatchARPTpa(ip net.IP) FlowBuilder {
+	b.text.MatchARPTpa(ip)
+	return b.setMatch(oxmARPTpa, ip.To4(), nil)
+}
+
+func (b *ofBuilder) MatchARPOp(op uint16) FlowBuilder {
+	b.text.MatchARPOp(op)
+	return b.setMatch(oxmARPOp, uint16Bytes(op), nil)
+}
+
+func (b *ofBuilder) MatchCTState(value string) FlowBuilder {
+	b.text.MatchCTState(value)
+	state, mask, err := parseCTState(value)
+	if err != nil {
+		b.setError(err)
+		return b
+	}
+	return b.setMatch(nxmNxCtState, uint32Bytes(state), uint32Bytes(mask))
+}
+
+func (b *ofBuilder) MatchCTMark(value string) FlowBuilder {
+	b.text.MatchCTMark(value)
+	mark, mask, err := parseValueMask(value)
+	if err != nil {
+		b.setError(fmt.Errorf("invalid ct_mark %q: %v", value, err))
+		return b
+	}
+	if mask == nil {
+		return b.setMatch(nxmNxCtMark, uint32Bytes(mark), nil)
+	}
+	return b.setMatch(nxmNxCtMark, uint32Bytes(mark), uint32Bytes(*mask))
+}
+
+func (b *ofBuilder) MatchConjID(value uint32) FlowBuilder {
+	b.text.MatchConjID(value)
+	return b.setMatch(nxmNxConjID, uint32Bytes(value), nil)
+}
+
+func (b *ofBuilder) MatchTCPDstPort(port uint16) FlowBuilder {
+	b.text.MatchTCPDstPort(port)
+	return b.setMatch(oxmTCPDst, uint16Bytes(port), nil)
+}
+
+func (b *ofBuilder) MatchUDPDstPort(port uint16) FlowBuilder {
+	b.text.MatchUDPDstPort(port)
+	return b.setMatch(oxmUDPDst, uint16Bytes(port), nil)
+}
+
+func (b *ofBuilder) MatchSCTPDstPort(port uint16) FlowBuilder {
+	b.text.MatchSCTPDstPort(port)
+	return b.setMatch(oxmSCTPDst, uint16Bytes(port), nil)
+}
+
+func (b *ofBuilder) MatchTCPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	b.text.MatchTCPDstPortMask(port, mask)
+	return b.setMatch(oxmTCPDst, uint16Bytes(port&mask), uint16Bytes(mask))
+}
+
+func (b *ofBuilder) MatchUDPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	b.text.MatchUDPDstPortMask(port, mask)
+	return b.setMatch(oxmUDPDst, uint16Bytes(port&mask), uint16Bytes(mask))
+}
+
+func (b *ofBuilder) MatchSCTPDstPortMask(port uint16, mask uint16) FlowBuilder {
+	b.text.MatchSCTPDstPortMask(port, mask)
+	return b.setMatch(oxmSCTPDst, uint16Bytes(port&mask), uint16Bytes(mask))
+}
+
+func (b *ofBuilder) MatchTCPSrcPort(port uint16) FlowBuilder {
+	b.text.MatchTCPSrcPort(port)
+	return b.setMatch(oxmTCPSrc, uint16Bytes(port), nil)
+}
+
+func (b *ofBuilder) MatchUDPSrcPort(port uint16) FlowBuilder {
+	b.text.MatchUDPSrcPort(port)
+	return b.setMatch(oxmUDPSrc, uint16Bytes(port), nil)
+}
+
+func (b *ofBuilder) MatchTCPFlags(flags uint16, mask uint16) FlowBuilder {
+	b.text.MatchTCPFlags(flags, mask)
+	return b.setMatch(nxmNxTCPFlags, uint16Bytes(flags&mask), uint16Bytes(mask))
+}
+
+func (b *ofBuilder) MatchICMPType(icmpType uint8) FlowBuilder {
+	b.text.MatchICMPType(icmpType)
+	return b.setMatch(oxmICMPv4Type, uint8Bytes(icmpType), nil)
+}
+
+func (b *ofBuilder) MatchICMPCode(icmpCode uint8) FlowBuilder {
+	b.text.MatchICMPCode(icmpCode)
+	return b.setMatch(oxmICMPv4Code, uint8Bytes(icmpCode), nil)
+}
+
+func (b *ofBuilder) MatchTPSrc(port uint16) FlowBuilder {
+	b.text.MatchTPSrc(port)
+	b.tpSrc = &port
+	return b
+}
+
+// Cookie sets the cookie of the flow. Modify and Delete only apply to the flow with the same cookie.
+func (b *ofBuilder) Cookie(cookieID uint64) FlowBuilder {
+	b.text.Cookie(cookieID)
+	b.cookie = cookieID
+	b.cookieSet = true
+	return b
+}
+
+func (b *ofBuilder) Action() Action {
+	return &ofAction{b}
+}
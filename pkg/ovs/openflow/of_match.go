@@ -0,0 +1,309 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OXM/NXM classes. NXM fields are accepted by Open vSwitch in OpenFlow 1.3 matches and actions.
+const (
+	oxmClassNXM0         uint16 = 0x0000
+	oxmClassNXM1         uint16 = 0x0001
+	oxmClassOpenflowBasc uint16 = 0x8000
+)
+
+// oxmField identifies a match field by its class, field number and length in bytes.
+type oxmField struct {
+	class  uint16
+	field  uint8
+	length uint8
+}
+
+func (f oxmField) header(masked bool) uint32 {
+	length := uint32(f.length)
+	hasMask := uint32(0)
+	if masked {
+		length *= 2
+		hasMask = 1
+	}
+	return uint32(f.class)<<16 | uint32(f.field)<<9 | hasMask<<8 | length
+}
+
+func (f oxmField) bits() int {
+	return int(f.length) * 8
+}
+
+var (
+	oxmInPort     = oxmField{oxmClassOpenflowBasc, 0, 4}
+	oxmEthDst     = oxmField{oxmClassOpenflowBasc, 3, 6}
+	oxmEthSrc     = oxmField{oxmClassOpenflowBasc, 4, 6}
+	oxmEthType    = oxmField{oxmClassOpenflowBasc, 5, 2}
+	oxmIPProto    = oxmField{oxmClassOpenflowBasc, 10, 1}
+	oxmIPv4Src    = oxmField{oxmClassOpenflowBasc, 11, 4}
+	oxmIPv4Dst    = oxmField{oxmClassOpenflowBasc, 12, 4}
+	oxmTCPSrc     = oxmField{oxmClassOpenflowBasc, 13, 2}
+	oxmTCPDst     = oxmField{oxmClassOpenflowBasc, 14, 2}
+	oxmUDPSrc     = oxmField{oxmClassOpenflowBasc, 15, 2}
+	oxmUDPDst     = oxmField{oxmClassOpenflowBasc, 16, 2}
+	oxmSCTPSrc    = oxmField{oxmClassOpenflowBasc, 17, 2}
+	oxmSCTPDst    = oxmField{oxmClassOpenflowBasc, 18, 2}
+	oxmICMPv4Type = oxmField{oxmClassOpenflowBasc, 19, 1}
+	oxmICMPv4Code = oxmField{oxmClassOpenflowBasc, 20, 1}
+	oxmARPOp      = oxmField{oxmClassOpenflowBasc, 21, 2}
+	oxmARPSpa     = oxmField{oxmClassOpenflowBasc, 22, 4}
+	oxmARPTpa     = oxmField{oxmClassOpenflowBasc, 23, 4}
+	oxmARPSha     = oxmField{oxmClassOpenflowBasc, 24, 6}
+	oxmARPTha     = oxmField{oxmClassOpenflowBasc, 25, 6}
+
+	nxmOfEthDst     = oxmField{oxmClassNXM0, 1, 6}
+	nxmOfEthSrc     = oxmField{oxmClassNXM0, 2, 6}
+	nxmOfARPOp      = oxmField{oxmClassNXM0, 15, 2}
+	nxmOfARPSpa     = oxmField{oxmClassNXM0, 16, 4}
+	nxmOfARPTpa     = oxmField{oxmClassNXM0, 17, 4}
+	nxmNxARPSha     = oxmField{oxmClassNXM1, 17, 6}
+	nxmNxARPTha     = oxmField{oxmClassNXM1, 18, 6}
+	nxmNxTunIPv4Dst = oxmField{oxmClassNXM1, 32, 4}
+	nxmNxTCPFlags   = oxmField{oxmClassNXM1, 34, 2}
+	nxmNxConjID     = oxmField{oxmClassNXM1, 37, 4}
+	nxmNxCtState    = oxmField{oxmClassNXM1, 105, 4}
+	nxmNxCtMark     = oxmField{oxmClassNXM1, 107, 4}
+	nxmNxCtLabel    = oxmField{oxmClassNXM1, 108, 16}
+)
+
+func nxmNxReg(regID int) oxmField {
+	return oxmField{oxmClassNXM1, uint8(regID), 4}
+}
+
+var regFieldPattern = regexp.MustCompile(`^(?:reg|` + NxmFieldReg + `)(\d+)$`)
+
+// nxmFieldByName resolves the field names accepted by Load, Move and OutputFieldRange, i.e. the Nxm* constants and
+// register names like "reg1" or "NXM_NX_REG1".
+func nxmFieldByName(name string) (oxmField, error) {
+	switch name {
+	case NxmFieldSrcMAC:
+		return nxmOfEthSrc, nil
+	case NxmFieldDstMAC:
+		return nxmOfEthDst, nil
+	case NxmFieldARPSha:
+		return nxmNxARPSha, nil
+	case NxmFieldARPTha:
+		return nxmNxARPTha, nil
+	case NxmFieldARPSpa:
+		return nxmOfARPSpa, nil
+	case NxmFieldARPTpa:
+		return nxmOfARPTpa, nil
+	case NxmFieldCtLabel:
+		return nxmNxCtLabel, nil
+	case NxmFieldCtMark:
+		return nxmNxCtMark, nil
+	case NxmFieldARPOp:
+		return nxmOfARPOp, nil
+	}
+	if m := regFieldPattern.FindStringSubmatch(name); m != nil {
+		regID, _ := strconv.Atoi(m[1])
+		if regID < 16 {
+			return nxmNxReg(regID), nil
+		}
+	}
+	return oxmField{}, fmt.Errorf("unsupported field %s", name)
+}
+
+// oxmEntry is a match field with its value and optional mask.
+type oxmEntry struct {
+	field oxmField
+	value []byte
+	mask  []byte
+}
+
+func (e *oxmEntry) encode() []byte {
+	buf := make([]byte, 4, 4+len(e.value)+len(e.mask))
+	binary.BigEndian.PutUint32(buf, e.field.header(e.mask != nil))
+	buf = append(buf, e.value...)
+	return append(buf, e.mask...)
+}
+
+// encodeMatch builds an OXM ofp_match. Prerequisite fields (eth_type and ip_proto) are placed before the fields that
+// depend on them.
+func encodeMatch(entries []*oxmEntry) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf[0:], ofpmtOXM)
+	for _, prereq := range []oxmField{oxmEthType, oxmIPProto} {
+		for _, e := range entries {
+			if e.field == prereq {
+				buf = append(buf, e.encode()...)
+			}
+		}
+	}
+	for _, e := range entries {
+		if e.field != oxmEthType && e.field != oxmIPProto {
+			buf = append(buf, e.encode()...)
+		}
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return pad8(buf)
+}
+
+func uint8Bytes(v uint8) []byte {
+	return []byte{v}
+}
+
+func uint16Bytes(v uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, v)
+	return buf
+}
+
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return buf
+}
+
+// bitRangeBytes returns the value shifted into the bit range rng of a field with the given length, and the mask of
+// the range. A range covering the whole field returns a nil mask.
+func bitRangeBytes(field oxmField, value uint64, rng Range) ([]byte, []byte) {
+	n := int(field.length)
+	valueBuf := make([]byte, n)
+	maskBuf := make([]byte, n)
+	full := true
+	for bit := 0; bit < n*8; bit++ {
+		byteIdx := n - 1 - bit/8
+		inRange := uint32(bit) >= rng[0] && uint32(bit) <= rng[1]
+		if !inRange {
+			full = false
+			continue
+		}
+		maskBuf[byteIdx] |= 1 << (bit % 8)
+		offset := uint32(bit) - rng[0]
+		if offset < 64 && value&(1<<offset) != 0 {
+			valueBuf[byteIdx] |= 1 << (bit % 8)
+		}
+	}
+	if full {
+		return valueBuf, nil
+	}
+	return valueBuf, maskBuf
+}
+
+// ctStateBits maps the flags of a ct_state match like "-new+trk" to their bits.
+var ctStateBits = map[string]uint32{
+	"new":  0x01,
+	"est":  0x02,
+	"rel":  0x04,
+	"rpl":  0x08,
+	"inv":  0x10,
+	"trk":  0x20,
+	"snat": 0x40,
+	"dnat": 0x80,
+}
+
+// parseCTState parses the ovs-ofctl ct_state syntax, for example "+new+trk" or "-new+est".
+func parseCTState(state string) (uint32, uint32, error) {
+	var value, mask uint32
+	rest := state
+	for rest != "" {
+		sign := rest[0]
+		if sign != '+' && sign != '-' {
+			return 0, 0, fmt.Errorf("invalid ct_state %q", state)
+		}
+		rest = rest[1:]
+		end := strings.IndexAny(rest, "+-")
+		if end < 0 {
+			end = len(rest)
+		}
+		bit, ok := ctStateBits[rest[:end]]
+		if !ok {
+			return 0, 0, fmt.Errorf("invalid ct_state flag %q in %q", rest[:end], state)
+		}
+		mask |= bit
+		if sign == '+' {
+			value |= bit
+		}
+		rest = rest[end:]
+	}
+	return value, mask, nil
+}
+
+// parseValueMask parses "value" or "value/mask" in decimal or 0x-prefixed hexadecimal.
+func parseValueMask(s string) (uint32, *uint32, error) {
+	parts := strings.SplitN(s, "/", 2)
+	value, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(parts) == 1 {
+		return uint32(value), nil, nil
+	}
+	mask, err := strconv.ParseUint(parts[1], 0, 32)
+	if err != nil {
+		return 0, nil, err
+	}
+	m := uint32(mask)
+	return uint32(value), &m, nil
+}
+
+// nxmAliases maps the NXM fields to the OXM fields Open vSwitch may use for them in replies.
+var nxmAliases = map[oxmField]oxmField{
+	nxmOfEthDst: oxmEthDst,
+	nxmOfEthSrc: oxmEthSrc,
+	nxmOfARPOp:  oxmARPOp,
+	nxmOfARPSpa: oxmARPSpa,
+	nxmOfARPTpa: oxmARPTpa,
+	nxmNxARPSha: oxmARPSha,
+	nxmNxARPTha: oxmARPTha,
+}
+
+// matchKey returns a canonical form of an encoded ofp_match, so that the match of a flow is comparable with the match
+// the switch returns for it. The fields are sorted, NXM fields are replaced by their OXM aliases, fully masked values
+// lose their mask and the bits outside of the mask are cleared.
+func matchKey(match []byte) (string, error) {
+	if len(match) < 4 || binary.BigEndian.Uint16(match[0:]) != ofpmtOXM {
+		return "", fmt.Errorf("unsupported match type")
+	}
+	length := int(binary.BigEndian.Uint16(match[2:]))
+	if length < 4 || length > len(match) {
+		return "", fmt.Errorf("invalid match length %d", length)
+	}
+	var fields []string
+	for rest := match[4:length]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return "", fmt.Errorf("truncated match field")
+		}
+		header := binary.BigEndian.Uint32(rest)
+		payloadLen := int(header & 0xff)
+		if 4+payloadLen > len(rest) {
+			return "", fmt.Errorf("truncated match field 0x%08x", header)
+		}
+		field := oxmField{class: uint16(header >> 16), field: uint8(header>>9) & 0x7f}
+		value := append([]byte{}, rest[4:4+payloadLen]...)
+		var mask []byte
+		if header&0x100 != 0 {
+			value, mask = value[:payloadLen/2], value[payloadLen/2:]
+		}
+		field.length = uint8(len(value))
+		if alias, ok := nxmAliases[field]; ok {
+			field = alias
+		}
+		rest = rest[4+payloadLen:]
+
+		fullMask, emptyMask := true, true
+		for i := range mask {
+			value[i] &= mask[i]
+			fullMask = fullMask && mask[i] == 0xff
+			emptyMask = emptyMask && mask[i] == 0
+		}
+		if mask != nil && emptyMask {
+			continue
+		}
+		if fullMask {
+			mask = nil
+		}
+		fields = append(fields, fmt.Sprintf("%04x:%d=%x/%x", field.class, field.field, value, mask))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ","), nil
+}
@@ -0,0 +1,384 @@
+package openflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// OpenFlow 1.3 wire protocol constants used by ofBridge. Only the messages needed to program flows are implemented.
+const (
+	ofVersion13 uint8 = 0x04
+
+	ofptHello            uint8 = 0
+	ofptError            uint8 = 1
+	ofptEchoRequest      uint8 = 2
+	ofptEchoReply        uint8 = 3
+	ofptFlowMod          uint8 = 14
+	ofptMultipartRequest uint8 = 18
+	ofptMultipartReply   uint8 = 19
+	ofptBarrierRequest   uint8 = 20
+	ofptBarrierReply     uint8 = 21
+	ofptExperimenter     uint8 = 4
+
+	ofpHelloElemVersionBitmap uint16 = 1
+
+	ofpfcAdd          uint8 = 0
+	ofpfcModifyStrict uint8 = 2
+	ofpfcDelete       uint8 = 3
+	ofpfcDeleteStrict uint8 = 4
+
+	ofpttAll    uint8  = 0xff
+	ofpNoBuffer uint32 = 0xffffffff
+	ofppAny     uint32 = 0xffffffff
+	ofpgAny     uint32 = 0xffffffff
+	ofppInPort  uint32 = 0xfffffff8
+	ofppNormal  uint32 = 0xfffffffa
+	// ofpcmlNoBuffer asks the switch to send the whole packet when outputting to the controller.
+	ofpcmlNoBuffer uint16 = 0xffff
+
+	ofpmtOXM          uint16 = 1
+	ofpitApplyActions uint16 = 4
+
+	ofpmpFlow       uint16 = 1
+	ofpmpAggregate  uint16 = 2
+	ofpmpTable      uint16 = 3
+	ofpmpfReplyMore uint16 = 1
+
+	ofpHeaderLen  = 8
+	ofpFlowModLen = 48
+
+	// The ONF extension (EXT-230) brings the OpenFlow 1.4 bundles to OpenFlow 1.3, Open vSwitch supports it.
+	onfExperimenterID    uint32 = 0x4f4e4600
+	onftBundleControl    uint32 = 2300
+	onftBundleAddMessage uint32 = 2301
+	ofpbctOpenRequest    uint16 = 0
+	ofpbctCommitRequest  uint16 = 4
+	ofpbfAtomic          uint16 = 1
+	ofpbfOrdered         uint16 = 2
+)
+
+// ofHeader is the common header of all OpenFlow messages.
+type ofHeader struct {
+	Version uint8
+	Type    uint8
+	Length  uint16
+	Xid     uint32
+}
+
+// ofMessage is an OpenFlow message whose xid is assigned when it is sent.
+type ofMessage interface {
+	msgType() uint8
+	// body returns the message without the common header.
+	body() []byte
+}
+
+// xidBinder is implemented by the messages whose body depends on their own xid.
+type xidBinder interface {
+	bindXid(xid uint32)
+}
+
+func encodeMessage(msg ofMessage, xid uint32) []byte {
+	if b, ok := msg.(xidBinder); ok {
+		b.bindXid(xid)
+	}
+	body := msg.body()
+	buf := make([]byte, ofpHeaderLen, ofpHeaderLen+len(body))
+	buf[0] = ofVersion13
+	buf[1] = msg.msgType()
+	binary.BigEndian.PutUint16(buf[2:], uint16(ofpHeaderLen+len(body)))
+	binary.BigEndian.PutUint32(buf[4:], xid)
+	return append(buf, body...)
+}
+
+// readMessage reads one message from r and returns its header and body.
+func readMessage(r io.Reader) (*ofHeader, []byte, error) {
+	raw := make([]byte, ofpHeaderLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+	header := &ofHeader{}
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, header); err != nil {
+		return nil, nil, err
+	}
+	if header.Length < ofpHeaderLen {
+		return nil, nil, fmt.Errorf("invalid OpenFlow message length %d", header.Length)
+	}
+	body := make([]byte, int(header.Length)-ofpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	return header, body, nil
+}
+
+type helloMessage struct{}
+
+func (m *helloMessage) msgType() uint8 { return ofptHello }
+
+// body advertises OpenFlow 1.3 as the only supported version with a version bitmap element.
+func (m *helloMessage) body() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:], ofpHelloElemVersionBitmap)
+	binary.BigEndian.PutUint16(buf[2:], 8)
+	binary.BigEndian.PutUint32(buf[4:], 1<<ofVersion13)
+	return buf
+}
+
+// helloSupports13 checks whether the peer's hello message allows negotiating OpenFlow 1.3.
+func helloSupports13(header *ofHeader, body []byte) bool {
+	for len(body) >= 4 {
+		elemType := binary.BigEndian.Uint16(body[0:])
+		elemLen := int(binary.BigEndian.Uint16(body[2:]))
+		if elemLen < 4 || elemLen > len(body) {
+			break
+		}
+		if elemType == ofpHelloElemVersionBitmap && elemLen >= 8 {
+			return binary.BigEndian.Uint32(body[4:])&(1<<ofVersion13) != 0
+		}
+		body = body[(elemLen+7)/8*8:]
+	}
+	// Without a version bitmap the peer supports every version up to the one in the header.
+	return header.Version >= ofVersion13
+}
+
+type echoMessage struct {
+	reply bool
+	data  []byte
+}
+
+func (m *echoMessage) msgType() uint8 {
+	if m.reply {
+		return ofptEchoReply
+	}
+	return ofptEchoRequest
+}
+
+func (m *echoMessage) body() []byte { return m.data }
+
+type barrierRequest struct{}
+
+func (m *barrierRequest) msgType() uint8 { return ofptBarrierRequest }
+
+func (m *barrierRequest) body() []byte { return nil }
+
+// flowMod is an OFPT_FLOW_MOD message. An empty instruction list drops the matched packets.
+type flowMod struct {
+	command      uint8
+	tableID      uint8
+	priority     uint16
+	cookie       uint64
+	cookieMask   uint64
+	match        []byte
+	instructions []byte
+}
+
+func (m *flowMod) msgType() uint8 { return ofptFlowMod }
+
+func (m *flowMod) body() []byte {
+	buf := make([]byte, ofpFlowModLen-ofpHeaderLen, ofpFlowModLen-ofpHeaderLen+len(m.match)+len(m.instructions))
+	binary.BigEndian.PutUint64(buf[0:], m.cookie)
+	binary.BigEndian.PutUint64(buf[8:], m.cookieMask)
+	buf[16] = m.tableID
+	buf[17] = m.command
+	// idle_timeout and hard_timeout are left as 0, flows never expire.
+	binary.BigEndian.PutUint16(buf[22:], m.priority)
+	binary.BigEndian.PutUint32(buf[24:], ofpNoBuffer)
+	binary.BigEndian.PutUint32(buf[28:], ofppAny)
+	binary.BigEndian.PutUint32(buf[32:], ofpgAny)
+	// flags and pad are left as 0.
+	buf = append(buf, m.match...)
+	return append(buf, m.instructions...)
+}
+
+// flowStatsRequest is an OFPMP_FLOW multipart request for the flows of a table whose cookie matches, or an
+// OFPMP_AGGREGATE request for the sum of their counters if aggregate is set. The table ofpttAll selects all tables.
+type flowStatsRequest struct {
+	aggregate  bool
+	tableID    uint8
+	cookie     uint64
+	cookieMask uint64
+}
+
+func (m *flowStatsRequest) msgType() uint8 { return ofptMultipartRequest }
+
+func (m *flowStatsRequest) body() []byte {
+	buf := make([]byte, 40)
+	binary.BigEndian.PutUint16(buf[0:], ofpmpFlow)
+	if m.aggregate {
+		binary.BigEndian.PutUint16(buf[0:], ofpmpAggregate)
+	}
+	buf[8] = m.tableID
+	binary.BigEndian.PutUint32(buf[12:], ofppAny)
+	binary.BigEndian.PutUint32(buf[16:], ofpgAny)
+	binary.BigEndian.PutUint64(buf[24:], m.cookie)
+	binary.BigEndian.PutUint64(buf[32:], m.cookieMask)
+	return append(buf, encodeMatch(nil)...)
+}
+
+// flowStats is a flow in an OFPMP_FLOW multipart reply. The instructions are ignored.
+type flowStats struct {
+	tableID  uint8
+	priority uint16
+	cookie   uint64
+	match    []byte
+}
+
+// decodeFlowStats decodes the flows in the body of an OFPMP_FLOW multipart reply.
+func decodeFlowStats(body []byte) ([]*flowStats, error) {
+	if len(body) < 8 || binary.BigEndian.Uint16(body[0:]) != ofpmpFlow {
+		return nil, fmt.Errorf("invalid flow stats reply")
+	}
+	var stats []*flowStats
+	for rest := body[8:]; len(rest) > 0; {
+		if len(rest) < 56 {
+			return nil, fmt.Errorf("truncated flow stats")
+		}
+		length := int(binary.BigEndian.Uint16(rest[0:]))
+		matchLen := int(binary.BigEndian.Uint16(rest[50:]))
+		if length < 56 || length > len(rest) || 48+(matchLen+7)/8*8 > length {
+			return nil, fmt.Errorf("invalid flow stats length %d", length)
+		}
+		stats = append(stats, &flowStats{
+			tableID:  rest[2],
+			priority: binary.BigEndian.Uint16(rest[12:]),
+			cookie:   binary.BigEndian.Uint64(rest[24:]),
+			match:    rest[48 : 48+(matchLen+7)/8*8],
+		})
+		rest = rest[length:]
+	}
+	return stats, nil
+}
+
+// tableStatsRequest is an OFPMP_TABLE multipart request for the status of all tables.
+type tableStatsRequest struct{}
+
+func (m *tableStatsRequest) msgType() uint8 { return ofptMultipartRequest }
+
+func (m *tableStatsRequest) body() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:], ofpmpTable)
+	return buf
+}
+
+// multipartType returns the type of a multipart reply.
+func multipartType(body []byte) uint16 {
+	if len(body) < 8 {
+		return 0xffff
+	}
+	return binary.BigEndian.Uint16(body[0:])
+}
+
+// decodeTableStats decodes the body of an OFPMP_TABLE multipart reply.
+func decodeTableStats(body []byte) (map[TableIDType]*tableStats, error) {
+	r := map[TableIDType]*tableStats{}
+	rest := body[8:]
+	if len(rest)%24 != 0 {
+		return nil, fmt.Errorf("invalid table stats length %d", len(rest))
+	}
+	for ; len(rest) > 0; rest = rest[24:] {
+		r[TableIDType(rest[0])] = &tableStats{
+			active:  uint64(binary.BigEndian.Uint32(rest[4:])),
+			lookup:  binary.BigEndian.Uint64(rest[8:]),
+			matched: binary.BigEndian.Uint64(rest[16:]),
+		}
+	}
+	return r, nil
+}
+
+// decodeAggregateStats decodes the body of an OFPMP_AGGREGATE multipart reply.
+func decodeAggregateStats(body []byte) (*aggregateStats, error) {
+	if len(body) < 8+24 {
+		return nil, fmt.Errorf("invalid aggregate stats length %d", len(body))
+	}
+	return &aggregateStats{
+		packets: binary.BigEndian.Uint64(body[8:]),
+		bytes:   binary.BigEndian.Uint64(body[16:]),
+		flows:   uint64(binary.BigEndian.Uint32(body[24:])),
+	}, nil
+}
+
+// bundleControl opens or commits a bundle. The flags request an atomic and ordered bundle.
+type bundleControl struct {
+	bundleID    uint32
+	controlType uint16
+}
+
+func (m *bundleControl) msgType() uint8 { return ofptExperimenter }
+
+func (m *bundleControl) body() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:], onfExperimenterID)
+	binary.BigEndian.PutUint32(buf[4:], onftBundleControl)
+	binary.BigEndian.PutUint32(buf[8:], m.bundleID)
+	binary.BigEndian.PutUint16(buf[12:], m.controlType)
+	binary.BigEndian.PutUint16(buf[14:], ofpbfAtomic|ofpbfOrdered)
+	return buf
+}
+
+// bundleAdd adds a message to an open bundle. The xid of the inner message must be the xid of bundleAdd itself.
+type bundleAdd struct {
+	bundleID uint32
+	msg      ofMessage
+	xid      uint32
+}
+
+func (m *bundleAdd) msgType() uint8 { return ofptExperimenter }
+
+func (m *bundleAdd) bindXid(xid uint32) { m.xid = xid }
+
+func (m *bundleAdd) body() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:], onfExperimenterID)
+	binary.BigEndian.PutUint32(buf[4:], onftBundleAddMessage)
+	binary.BigEndian.PutUint32(buf[8:], m.bundleID)
+	binary.BigEndian.PutUint16(buf[14:], ofpbfAtomic|ofpbfOrdered)
+	return append(buf, encodeMessage(m.msg, m.xid)...)
+}
+
+// ofError is the error reply of the switch to a request.
+type ofError struct {
+	errType uint16
+	code    uint16
+}
+
+var ofErrorTypeNames = map[uint16]string{
+	0:  "HELLO_FAILED",
+	1:  "BAD_REQUEST",
+	2:  "BAD_ACTION",
+	3:  "BAD_INSTRUCTION",
+	4:  "BAD_MATCH",
+	5:  "FLOW_MOD_FAILED",
+	6:  "GROUP_MOD_FAILED",
+	7:  "PORT_MOD_FAILED",
+	8:  "TABLE_MOD_FAILED",
+	9:  "QUEUE_OP_FAILED",
+	10: "SWITCH_CONFIG_FAILED",
+	11: "ROLE_REQUEST_FAILED",
+	12: "METER_MOD_FAILED",
+	13: "TABLE_FEATURES_FAILED",
+	17: "BUNDLE_FAILED",
+}
+
+func (e *ofError) Error() string {
+	name, ok := ofErrorTypeNames[e.errType]
+	if !ok {
+		name = fmt.Sprintf("type %d", e.errType)
+	}
+	return fmt.Sprintf("OpenFlow error %s, code %d", name, e.code)
+}
+
+func decodeError(body []byte) *ofError {
+	if len(body) < 4 {
+		return &ofError{errType: 0xffff}
+	}
+	return &ofError{errType: binary.BigEndian.Uint16(body[0:]), code: binary.BigEndian.Uint16(body[2:])}
+}
+
+// pad8 pads buf with zeros to a multiple of 8 bytes.
+func pad8(buf []byte) []byte {
+	if rem := len(buf) % 8; rem != 0 {
+		buf = append(buf, make([]byte, 8-rem)...)
+	}
+	return buf
+}
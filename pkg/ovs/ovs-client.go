@@ -33,6 +33,8 @@ const (
 	openflowProtoVersion10 = "OpenFlow10"
 	// Openflow protocol version 1.3.
 	openflowProtoVersion13 = "OpenFlow13"
+	// Openflow protocol version 1.4, ovs-ofctl --bundle下发流表需要
+	openflowProtoVersion14 = "OpenFlow14"
 )
 
 var (
@@ -127,13 +129,13 @@ func (br *OVSBridge) lookupByName() (bool, Error) {
 
 func (br *OVSBridge) updateProtocols() Error {
 	tx := br.ovsdb.Transaction(openvSwitchSchema)
-	// Use Openflow protocol version 1.0 and 1.3.
+	// Use Openflow protocol version 1.0, 1.3 and 1.4.
 	tx.Update(dbtransaction.Update{
 		Table: "Bridge",
 		Where: [][]interface{}{{"name", "==", br.name}},
 		Row: map[string]interface{}{
 			"protocols": makeOVSDBSetFromList([]string{openflowProtoVersion10,
-				openflowProtoVersion13}),
+				openflowProtoVersion13, openflowProtoVersion14}),
 		},
 	})
 	_, err, temporary := tx.Commit()
@@ -148,9 +150,9 @@ func (br *OVSBridge) create() Error {
 	tx := br.ovsdb.Transaction(openvSwitchSchema)
 	bridge := Bridge{
 		Name: br.name,
-		// Use Openflow protocol version 1.0 and 1.3.
+		// Use Openflow protocol version 1.0, 1.3 and 1.4.
 		Protocols: makeOVSDBSetFromList([]string{openflowProtoVersion10,
-			openflowProtoVersion13}),
+			openflowProtoVersion13, openflowProtoVersion14}),
 		DatapathType: br.datapathType,
 	}
 	namedUUID := tx.Insert(dbtransaction.Insert{
@@ -17,10 +17,10 @@ func TestConnection(t *testing.T) {
 
 	ovsBridgeClient.CreatePort("b-ns1", "b-ns1", nil)
 	ovsBridgeClient.CreatePort("b-ns2", "b-ns2", nil)
-	ofClient := openflow.NewClient("test-ovs")
+	ofClient := openflow.NewClient("test-ovs", false)
 	portNum, _ := ovsBridgeClient.GetOFPort("b-ns1")
 	dstTunIP := net.ParseIP("172.16.0.119")
-	ofClient.InstallTunFlow("172.16.0.0/24", uint32(portNum), dstTunIP)
+	ofClient.InstallTunFlow("test-node", "172.16.0.0/24", uint32(portNum), dstTunIP)
 
 }
 
@@ -33,11 +33,11 @@ func TestOpenflow(t *testing.T) {
 	require.NoError(t, err)
 	// portNum, _ := ovsBridgeClient.GetOFPort("b-v")
 
-	// ofClient := openflow.NewClient("br0")
+	// ofClient := openflow.NewClient("br0", false)
 	// dstTunIP := net.ParseIP("172.16.0.119")
-	// err := ofClient.InstallTunFlow("172.16.0.1", uint32(portNum), dstTunIP)
+	// err := ofClient.InstallTunFlow("test-node", "172.16.0.1", uint32(portNum), dstTunIP)
 	// require.NoError(t, err)
-	// ofClient.UninstallTunFlow()
+	// ofClient.UninstallTunFlow("test-node")
 }
 
 // func TestDeleteOpenflow(t *testing.T) {
@@ -45,7 +45,7 @@ func TestOpenflow(t *testing.T) {
 // 	ovsBridgeClient := ovs.NewOVSBridge("br0", "", conn)
 // 	// portNum, _ := ovsBridgeClient.GetOFPort("b-v")
 
-// 	ofClient := openflow.NewClient("br0")
-// 	ofClient.UninstallTunFlow(openflow.IPConnectionVxlan)
+// 	ofClient := openflow.NewClient("br0", false)
+// 	ofClient.UninstallTunFlow("test-node")
 	
 // }
\ No newline at end of file
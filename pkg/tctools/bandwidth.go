@@ -0,0 +1,79 @@
+package tctools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// bandwidthUnits 带宽的单位，按后缀长度从长到短排列，值为true表示单位为byte。
+// 不带单位时按bit计算，与kubernetes.io/ingress-bandwidth等annotation的含义一致
+var bandwidthUnits = []struct {
+	suffix string
+	bytes  bool
+}{
+	{"bit", false},
+	{"bps", false},
+	{"Bps", true},
+	{"B", true},
+}
+
+// legacyBandwidthRe 之前的ciccni/egress-rate支持的格式，数字后面的单位只表示倍数，速率的单位为byte/s
+var legacyBandwidthRe = regexp.MustCompile(`^([1-9][0-9]*)(k|K|m|M|kbps|mbps|Kbps|Mbps)?$`)
+
+// ParseLegacyBandwidth 按照之前的ciccni/egress-rate的含义解析带宽，例如10m表示10,000,000 byte/s。
+// bandwidth不是之前支持的格式时返回false，由调用方按照ParseBandwidth解析
+func ParseLegacyBandwidth(bandwidth string) (uint64, bool) {
+	match := legacyBandwidthRe.FindStringSubmatch(bandwidth)
+	if match == nil {
+		return 0, false
+	}
+	rate, err := strconv.ParseUint(match[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	switch match[2] {
+	case "k", "K", "kbps", "Kbps":
+		rate *= 1000
+	case "m", "M", "mbps", "Mbps":
+		rate *= 1000 * 1000
+	}
+	return rate, true
+}
+
+// ParseBandwidth 解析Kubernetes风格的带宽，返回值的单位为byte/s，与tc的RateSpec一致。支持的格式例如
+// 100k, 10M, 1G, 1Gi, 10Mbit, 10Mbps（bit/s）以及10MB, 10MBps（byte/s）。
+// bandwidth中不会出现milli的含义，因此小写的m按照M处理，大写的K按照k处理
+func ParseBandwidth(bandwidth string) (uint64, error) {
+	value, isBytes := strings.TrimSpace(bandwidth), false
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, isBytes = strings.TrimSuffix(value, unit.suffix), unit.bytes
+			break
+		}
+	}
+	if strings.HasSuffix(value, "m") {
+		value = strings.TrimSuffix(value, "m") + "M"
+	} else if strings.HasSuffix(value, "K") {
+		value = strings.TrimSuffix(value, "K") + "k"
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %v", bandwidth, err)
+	}
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q: must be positive", bandwidth)
+	}
+	rate := uint64(quantity.Value())
+	if !isBytes {
+		rate = rate / 8
+	}
+	if rate == 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q: less than 1 byte/s", bandwidth)
+	}
+	return rate, nil
+}
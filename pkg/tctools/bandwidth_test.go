@@ -0,0 +1,86 @@
+package tctools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		bandwidth string
+		expected  uint64
+		wantErr   bool
+	}{
+		// 不带单位时按bit/s计算
+		{bandwidth: "8000", expected: 1000},
+		{bandwidth: "100k", expected: 12500},
+		{bandwidth: "10M", expected: 1250000},
+		{bandwidth: "1G", expected: 125000000},
+		{bandwidth: "40G", expected: 5000000000},
+		{bandwidth: "1Gi", expected: 1 << 30 / 8},
+		{bandwidth: "8Ki", expected: 1024},
+		// 小写m表示M，大写K表示k
+		{bandwidth: "10m", expected: 1250000},
+		{bandwidth: "800K", expected: 100000},
+		{bandwidth: "10Mbit", expected: 1250000},
+		{bandwidth: "10mbps", expected: 1250000},
+		{bandwidth: "800Kbps", expected: 100000},
+		{bandwidth: "1Gbps", expected: 125000000},
+		// B、Bps表示byte/s
+		{bandwidth: "10MB", expected: 10000000},
+		{bandwidth: "10MBps", expected: 10000000},
+		{bandwidth: "1GiB", expected: 1 << 30},
+		{bandwidth: "100B", expected: 100},
+		{bandwidth: " 10M ", expected: 1250000},
+		{bandwidth: "", wantErr: true},
+		{bandwidth: "fast", wantErr: true},
+		{bandwidth: "10Mb", wantErr: true},
+		{bandwidth: "10Xbps", wantErr: true},
+		{bandwidth: "0", wantErr: true},
+		{bandwidth: "-10M", wantErr: true},
+		// 不足1 byte/s
+		{bandwidth: "7", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bandwidth, func(t *testing.T) {
+			rate, err := ParseBandwidth(tt.bandwidth)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, rate)
+		})
+	}
+}
+
+func TestParseLegacyBandwidth(t *testing.T) {
+	tests := []struct {
+		bandwidth string
+		expected  uint64
+		legacy    bool
+	}{
+		// 之前的格式中单位只表示倍数，速率的单位为byte/s
+		{bandwidth: "1000", expected: 1000, legacy: true},
+		{bandwidth: "10m", expected: 10000000, legacy: true},
+		{bandwidth: "10M", expected: 10000000, legacy: true},
+		{bandwidth: "800K", expected: 800000, legacy: true},
+		{bandwidth: "800kbps", expected: 800000, legacy: true},
+		{bandwidth: "10Mbps", expected: 10000000, legacy: true},
+		// 之前不支持的格式按照ParseBandwidth解析
+		{bandwidth: "1G"},
+		{bandwidth: "10Mbit"},
+		{bandwidth: "10MB"},
+		{bandwidth: "1Mi"},
+		{bandwidth: "010M"},
+		{bandwidth: "99999999999M"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bandwidth, func(t *testing.T) {
+			rate, legacy := ParseLegacyBandwidth(tt.bandwidth)
+			require.Equal(t, tt.legacy, legacy)
+			require.Equal(t, tt.expected, rate)
+		})
+	}
+}
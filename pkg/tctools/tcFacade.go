@@ -2,7 +2,10 @@ package tctools
 
 import (
 	"context"
+	"fmt"
+	"net"
 
+	"github.com/florianl/go-tc/core"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
@@ -12,30 +15,111 @@ func CreateRootHTB(ifName string) error {
 	return addHTBToInterface(ifName)
 }
 
-func CreateHTBClass(ifName string, parent uint32, classid uint32, rate uint32, burst uint32) error {
+func CreateHTBClass(ifName string, parent uint32, classid uint32, rate uint64, burst uint64) error {
 	return addHTBClass(ifName, parent, classid, rate, burst)
 }
 
+// ApplyEgressRate 在容器内的veth上为pod发出的流量配置限速，clusterCIDR为集群的pod网段，用于区分限速的范围。
+// 接口上已经有相同范围的root htb时原地修改速率，范围不同时重新创建
+func ApplyEgressRate(ifName string, tcArgs *TCArgs, clusterCIDR *net.IPNet) error {
+	return applyEgressHTB(ifName, tcArgs, clusterCIDR)
+}
+
+// ApplyIngressRate 在host端的veth上为进入pod的流量配置限速。
+// 接口上已经有root htb时只替换default class中的速率
+func ApplyIngressRate(ifName string, rate uint64, burst uint64) error {
+	exists, err := HasRootHTB(ifName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return replaceHTBClass(ifName, core.BuildHandle(0x1, 0x0), core.BuildHandle(0x1, 0x1), rate, burst)
+	}
+	return addIngressHTB(ifName, rate, burst)
+}
+
 func ConstructTcConfig(k8sClient kubernetes.Interface, podName string, namespace string) (*TCArgs, error) {
 	podInfo, err := k8sClient.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
 	if err != nil {
 		klog.Errorf("[ConstructTcConfig]-获取pod信息失败, err = %s", err)
 		return nil, err
 	}
-	annotaions := podInfo.ObjectMeta.Annotations
+	return ParseTcAnnotations(podInfo.ObjectMeta.Annotations)
+}
+
+// ParseTcAnnotations 根据pod的annotation构造限速配置，没有annotation时返回nil。
+// 同时兼容上游bandwidth插件的kubernetes.io/egress-bandwidth、kubernetes.io/ingress-bandwidth，
+// 同一方向上ciccni/*与kubernetes.io/*同时存在时使用ciccni/*的值。
+// ciccni/*按照parseCiccniBandwidth解析，kubernetes.io/*按照ParseBandwidth解析
+func ParseTcAnnotations(annotaions map[string]string) (*TCArgs, error) {
 	if annotaions == nil {
 		return nil, nil
 	}
-	res := &TCArgs{}
-	if egressRate, ok := annotaions["ciccni/egress-rate"]; ok {
-		klog.Infof("[ConstructTcConfig]-[ConstructTcConfig]-解析egress-rate, rate = %s", egressRate)
-		rate, err := validateBandwithFormat(egressRate)
+	res := &TCArgs{Scope: EgressScopeAll}
+	rate, found, err := parseRateAnnotation(annotaions, EgressRateAnnotation, KubernetesEgressBandwidthAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		res.Rate = rate
+		res.Burst = rate / 10
+	}
+	if egressBurst, ok := annotaions[EgressBurstAnnotation]; ok && res.Rate > 0 {
+		burst, err := parseCiccniBandwidth(egressBurst)
 		if err != nil {
-			klog.Errorf("[ConstructTcConfig]-[validateBandwithFormat]-解析egress-rate失败, err = %s", err)
+			klog.Errorf("[ConstructTcConfig]-[ParseBandwidth]-解析egress-burst失败, err = %s", err)
 			return nil, err
 		}
-		res.Rate = uint32(rate)
-		res.Burst = uint32(rate) / 10
+		res.Burst = burst
+	}
+	if scope, ok := annotaions[EgressScopeAnnotation]; ok {
+		switch EgressScope(scope) {
+		case EgressScopeAll, EgressScopeCluster, EgressScopeExternal:
+			res.Scope = EgressScope(scope)
+		default:
+			klog.Errorf("[ConstructTcConfig]-不支持的egress-scope: %s", scope)
+			return nil, fmt.Errorf("invalid %s %q, expected one of %s, %s, %s", EgressScopeAnnotation, scope, EgressScopeAll, EgressScopeCluster, EgressScopeExternal)
+		}
+	}
+	rate, found, err = parseRateAnnotation(annotaions, IngressRateAnnotation, KubernetesIngressBandwidthAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		res.IngressRate = rate
+		res.IngressBurst = rate / 10
 	}
 	return res, nil
 }
+
+// parseRateAnnotation 解析一个方向上的速率，ciccniKey优先于kubernetesKey
+func parseRateAnnotation(annotations map[string]string, ciccniKey string, kubernetesKey string) (uint64, bool, error) {
+	if value, ok := annotations[ciccniKey]; ok {
+		klog.Infof("[ConstructTcConfig]-解析%s, rate = %s", ciccniKey, value)
+		rate, err := parseCiccniBandwidth(value)
+		if err != nil {
+			klog.Errorf("[ConstructTcConfig]-[ParseBandwidth]-解析%s失败, err = %s", ciccniKey, err)
+			return 0, false, err
+		}
+		return rate, true, nil
+	}
+	if value, ok := annotations[kubernetesKey]; ok {
+		klog.Infof("[ConstructTcConfig]-解析%s, rate = %s", kubernetesKey, value)
+		rate, err := ParseBandwidth(value)
+		if err != nil {
+			klog.Errorf("[ConstructTcConfig]-[ParseBandwidth]-解析%s失败, err = %s", kubernetesKey, err)
+			return 0, false, err
+		}
+		return rate, true, nil
+	}
+	return 0, false, nil
+}
+
+// parseCiccniBandwidth 解析ciccni/*的带宽：之前的格式保持原来byte/s的含义，例如10m表示10,000,000 byte/s，
+// 其它格式按照ParseBandwidth解析
+func parseCiccniBandwidth(bandwidth string) (uint64, error) {
+	if rate, legacy := ParseLegacyBandwidth(bandwidth); legacy {
+		return rate, nil
+	}
+	return ParseBandwidth(bandwidth)
+}
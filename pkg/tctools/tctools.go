@@ -1,10 +1,9 @@
 package tctools
 
 import (
-	"errors"
+	"fmt"
+	"math"
 	"net"
-	"regexp"
-	"strconv"
 
 	"github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
@@ -36,6 +35,9 @@ const (
 	ProtocolIP Protocol = 8
 )
 
+// unlimitedRate 不限速class使用的速率，单位与RateSpec相同，为100Gbit/s，高于veth实际能达到的速率
+const unlimitedRate = uint64(100 * 1000 * 1000 * 1000 / 8)
+
 var tcnl *tc.Tc
 
 func init() {
@@ -54,8 +56,69 @@ func init() {
 	}
 }
 
+// DeleteRootFromInterface 删除接口上handle为1:0的root htb，相当于运行
+// $TC qdisc del dev {ifName} root handle 1:0
+// root htb下的class和filter会随之一起删除。接口上没有root htb时直接返回
 func DeleteRootFromInterface(ifName string) error {
-	return nil
+	ifByName, err := net.InterfaceByName(ifName)
+	if err != nil {
+		klog.Errorf("[DeleteRootFromInterface]-未找到名为%s的interface", ifName)
+		return err
+	}
+
+	// 这里只能在函数内部创建rtnetlink，因为这个函数可能会在{ns.Do()}中执行
+	tcnlInNs, err := createTcnl()
+	if err != nil {
+		klog.Errorf("[DeleteRootFromInterface]-err creating tcnl, err = %s", err)
+		return err
+	}
+	defer tcnlInNs.Close()
+
+	exists, err := hasRootHTB(tcnlInNs, uint32(ifByName.Index))
+	if err != nil || !exists {
+		return err
+	}
+	qdiscHTB := createHTBObject(uint32(ifByName.Index), core.BuildHandle(0x1, 0x0), tc.HandleRoot, nil, nil)
+	return tcnlInNs.Qdisc().Delete(qdiscHTB)
+}
+
+// HasRootHTB 判断接口上是否已经配置了handle为1:0的root htb
+func HasRootHTB(ifName string) (bool, error) {
+	ifByName, err := net.InterfaceByName(ifName)
+	if err != nil {
+		klog.Errorf("[HasRootHTB]-未找到名为%s的interface", ifName)
+		return false, err
+	}
+
+	tcnlInNs, err := createTcnl()
+	if err != nil {
+		klog.Errorf("[HasRootHTB]-err creating tcnl, err = %s", err)
+		return false, err
+	}
+	defer tcnlInNs.Close()
+
+	return hasRootHTB(tcnlInNs, uint32(ifByName.Index))
+}
+
+func hasRootHTB(tcnlInNs *tc.Tc, ifIndex uint32) (bool, error) {
+	root, err := getRootHTB(tcnlInNs, ifIndex)
+	return root != nil, err
+}
+
+// getRootHTB 返回接口上handle为1:0的root htb，不存在时返回nil
+func getRootHTB(tcnlInNs *tc.Tc, ifIndex uint32) (*tc.Object, error) {
+	qdiscs, err := tcnlInNs.Qdisc().Get()
+	if err != nil {
+		klog.Errorf("[getRootHTB]-获取qdisc信息失败, err=%s", err)
+		return nil, err
+	}
+	for i := range qdiscs {
+		qdisc := &qdiscs[i]
+		if qdisc.Ifindex == ifIndex && qdisc.Parent == tc.HandleRoot && qdisc.Handle == core.BuildHandle(0x1, 0x0) && qdisc.Kind == "htb" {
+			return qdisc, nil
+		}
+	}
+	return nil, nil
 }
 
 // AddHTBToInterface  相当于运行
@@ -90,7 +153,7 @@ func addHTBToInterface(ifName string) error {
 
 // addHTBClass something like
 // $TC class add dev {ifName} parent {parent} classid {classid} htb rate {limit} ceil {limit+burst}
-func addHTBClass(ifName string, parent uint32, classid uint32, limit uint32, burst uint32) error {
+func addHTBClass(ifName string, parent uint32, classid uint32, limit uint64, burst uint64) error {
 	ifByName, err := net.InterfaceByName(ifName)
 	if err != nil {
 		klog.Errorf("cannot find %s interface", ifName)
@@ -99,7 +162,7 @@ func addHTBClass(ifName string, parent uint32, classid uint32, limit uint32, bur
 	// create rate
 	rate := limit
 
-	htbObject := createClassObject(uint32(ifByName.Index), classid, parent, rate, rate+burst)
+	htbObject := createClassObject(uint32(ifByName.Index), classid, parent, rate, burst)
 	// 这里只能在函数内部创建rtnetlink，因为这个函数可能会在{ns.Do()}中执行
 	tcnlInNs, err := createTcnl()
 	if err != nil {
@@ -115,6 +178,213 @@ func addHTBClass(ifName string, parent uint32, classid uint32, limit uint32, bur
 	return nil
 }
 
+// replaceHTBClass 修改已有class的限速，class不存在时创建，相当于运行
+// $TC class replace dev {ifName} parent {parent} classid {classid} htb rate {limit} ceil {limit+burst}
+// class上挂载的filter保持不变
+func replaceHTBClass(ifName string, parent uint32, classid uint32, limit uint64, burst uint64) error {
+	ifByName, err := net.InterfaceByName(ifName)
+	if err != nil {
+		klog.Errorf("[replaceHTBClass]-未找到名为%s的interface", ifName)
+		return err
+	}
+
+	htbObject := createClassObject(uint32(ifByName.Index), classid, parent, limit, burst)
+	tcnlInNs, err := createTcnl()
+	if err != nil {
+		klog.Errorf("[replaceHTBClass]-err creating tcnl, err = %s", err)
+		return err
+	}
+	defer tcnlInNs.Close()
+
+	return tcnlInNs.Class().Replace(htbObject)
+}
+
+// addIngressHTB 在host端的veth上配置限速。从host端veth发出的流量即为进入pod的流量，相当于运行
+// $TC qdisc add dev {ifName} root handle 1:0 htb default 1
+// $TC class add dev {ifName} parent 1:0 classid 1:1 htb rate {rate} ceil {rate+burst}
+func addIngressHTB(ifName string, rate uint64, burst uint64) error {
+	ifByName, err := net.InterfaceByName(ifName)
+	if err != nil {
+		klog.Errorf("[addIngressHTB]-未找到名为%s的interface", ifName)
+		return err
+	}
+
+	qdiscHTB, classHTB := buildIngressHTBObjects(uint32(ifByName.Index), rate, burst)
+	// 这里只能在函数内部创建rtnetlink，因为这个函数可能会在{ns.Do()}中执行
+	tcnlInNs, err := createTcnl()
+	if err != nil {
+		klog.Errorf("[addIngressHTB]-err creating tcnl, err = %s", err)
+		return err
+	}
+	defer tcnlInNs.Close()
+
+	if err := tcnlInNs.Qdisc().Add(qdiscHTB); err != nil {
+		return err
+	}
+	if err := tcnlInNs.Class().Add(classHTB); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildIngressHTBObjects 构造入方向限速使用的root htb和class。root htb的default class为1:1，
+// 所有流量都会进入这个class，因此不需要再添加过滤器
+func buildIngressHTBObjects(ifIndex uint32, rate uint64, burst uint64) (*tc.Object, *tc.Object) {
+	qdiscHTB := createHTBObject(ifIndex,
+		core.BuildHandle(0x1, 0x0),
+		tc.HandleRoot,
+		nil, &tc.HtbGlob{Version: 3, Rate2Quantum: 10, Defcls: 0x1})
+	classHTB := createClassObject(ifIndex, core.BuildHandle(0x1, 0x1), core.BuildHandle(0x1, 0x0), rate, burst)
+	return qdiscHTB, classHTB
+}
+
+// applyEgressHTB 在容器内的veth上按照tcArgs配置root htb、class以及过滤器。
+// 接口上已有的root htb与期望的default class以及过滤器一致时，只原地替换class中的速率，
+// 因此agent重启后重复配置不会中断限速；只有scope发生变化时才删除root htb重新创建
+func applyEgressHTB(ifName string, tcArgs *TCArgs, clusterCIDR *net.IPNet) error {
+	ifByName, err := net.InterfaceByName(ifName)
+	if err != nil {
+		klog.Errorf("[applyEgressHTB]-未找到名为%s的interface", ifName)
+		return err
+	}
+	ifIndex := uint32(ifByName.Index)
+
+	qdiscHTB, classes, filters, err := buildEgressHTBObjects(ifIndex, tcArgs, clusterCIDR)
+	if err != nil {
+		return err
+	}
+	// 这里只能在函数内部创建rtnetlink，因为这个函数可能会在{ns.Do()}中执行
+	tcnlInNs, err := createTcnl()
+	if err != nil {
+		klog.Errorf("[applyEgressHTB]-err creating tcnl, err = %s", err)
+		return err
+	}
+	defer tcnlInNs.Close()
+
+	root, err := getRootHTB(tcnlInNs, ifIndex)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		currentFilters, err := tcnlInNs.Filter().Get(&tc.Msg{Ifindex: ifIndex, Parent: core.BuildHandle(0x1, 0x0)})
+		if err != nil {
+			klog.Errorf("[applyEgressHTB]-获取过滤器失败, err = %s", err)
+			return err
+		}
+		if egressHTBUnchanged(root, currentFilters, qdiscHTB, filters) {
+			for _, class := range classes {
+				if err := tcnlInNs.Class().Replace(class); err != nil {
+					klog.Errorf("[applyEgressHTB]-替换htb class失败, err = %s", err)
+					return err
+				}
+			}
+			return nil
+		}
+		klog.Infof("[applyEgressHTB]-%s 上的限速范围发生变化, 重新创建root htb", ifName)
+		if err := tcnlInNs.Qdisc().Delete(createHTBObject(ifIndex, core.BuildHandle(0x1, 0x0), tc.HandleRoot, nil, nil)); err != nil {
+			klog.Errorf("[applyEgressHTB]-删除root htb失败, err = %s", err)
+			return err
+		}
+	}
+
+	if err := tcnlInNs.Qdisc().Add(qdiscHTB); err != nil {
+		klog.Errorf("[applyEgressHTB]-创建root htb失败, err = %s", err)
+		return err
+	}
+	for _, class := range classes {
+		if err := tcnlInNs.Class().Add(class); err != nil {
+			klog.Errorf("[applyEgressHTB]-创建htb class失败, err = %s", err)
+			return err
+		}
+	}
+	for _, filter := range filters {
+		if err := tcnlInNs.Filter().Add(filter); err != nil {
+			klog.Errorf("[applyEgressHTB]-添加过滤器失败, err = %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// egressHTBUnchanged 比较已有的root htb与期望的root htb：default class相同，并且u32过滤器的目的class与匹配条件相同。
+// u32在dump时还会返回没有selector的hash table节点，这些节点不参与比较
+func egressHTBUnchanged(root *tc.Object, currentFilters []tc.Object, qdiscHTB *tc.Object, filters []*tc.Object) bool {
+	if root.Htb == nil || root.Htb.Init == nil || root.Htb.Init.Defcls != qdiscHTB.Htb.Init.Defcls {
+		return false
+	}
+	current := map[string]bool{}
+	for i := range currentFilters {
+		if key, ok := u32FilterKey(&currentFilters[i]); ok {
+			current[key] = true
+		}
+	}
+	if len(current) != len(filters) {
+		return false
+	}
+	for _, filter := range filters {
+		if key, ok := u32FilterKey(filter); !ok || !current[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// u32FilterKey 将u32过滤器的目的class以及匹配条件转换为字符串，用于比较两个过滤器是否相同
+func u32FilterKey(filter *tc.Object) (string, bool) {
+	if filter.Kind != "u32" || filter.U32 == nil || filter.U32.ClassID == nil || filter.U32.Sel == nil {
+		return "", false
+	}
+	key := fmt.Sprintf("%x", *filter.U32.ClassID)
+	for _, k := range filter.U32.Sel.Keys {
+		key += fmt.Sprintf(",%x/%x@%d", k.Val, k.Mask, k.Off)
+	}
+	return key, true
+}
+
+// buildEgressHTBObjects 构造出方向限速使用的root htb、class以及过滤器，相当于运行
+// $TC qdisc add dev {ifName} root handle 1:0 htb default {1|2}
+// $TC class add dev {ifName} parent 1:0 classid 1:1 htb rate {rate} ceil {rate+burst}
+// $TC class add dev {ifName} parent 1:0 classid 1:2 htb rate {unlimitedRate}
+// $TC filter add dev {ifName} protocol ip parent 1:0 prio 1 u32 match ip dst {clusterCIDR} flowid {1:1|1:2}
+// 其中1:1为限速class，1:2为不限速class。没有被过滤器匹配的流量进入default class，而不是绕过htb直接发送：
+// scope为all时default为1:1，不需要过滤器；scope为cluster时default为1:2，集群内的流量由过滤器送入1:1；
+// scope为external时default为1:1，集群内的流量由过滤器送入1:2
+func buildEgressHTBObjects(ifIndex uint32, tcArgs *TCArgs, clusterCIDR *net.IPNet) (*tc.Object, []*tc.Object, []*tc.Object, error) {
+	rootHandle := core.BuildHandle(0x1, 0x0)
+	limitedClass := core.BuildHandle(0x1, 0x1)
+	unlimitedClass := core.BuildHandle(0x1, 0x2)
+
+	defaultClass, filterClass := limitedClass, uint32(0)
+	switch tcArgs.Scope {
+	case EgressScopeAll, "":
+	case EgressScopeCluster:
+		defaultClass, filterClass = unlimitedClass, limitedClass
+	case EgressScopeExternal:
+		filterClass = unlimitedClass
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown egress scope %q", tcArgs.Scope)
+	}
+
+	_, defcls := core.SplitHandle(defaultClass)
+	qdiscHTB := createHTBObject(ifIndex, rootHandle, tc.HandleRoot, nil, &tc.HtbGlob{Version: 3, Rate2Quantum: 10, Defcls: defcls})
+	classes := []*tc.Object{
+		createClassObject(ifIndex, limitedClass, rootHandle, tcArgs.Rate, tcArgs.Burst),
+		createClassObject(ifIndex, unlimitedClass, rootHandle, unlimitedRate, 0),
+	}
+	var filters []*tc.Object
+	if filterClass != 0 {
+		if clusterCIDR == nil {
+			return nil, nil, nil, fmt.Errorf("cluster CIDR is required for egress scope %s", tcArgs.Scope)
+		}
+		filter, err := createDstCIDRFilterObject(ifIndex, rootHandle, clusterCIDR, filterClass, uint16(1))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return qdiscHTB, classes, filters, nil
+}
+
 // AddTCFilterWithDstCidr 相当于调用
 // $TC filter add dev $IF1 protocol ip parent {parent} prio {prio} u32 match ip dst {dstCidr} flowid {classId}
 func AddTCFilterWithDstCidr(ifName string, parent uint32, dstCidr string, classId uint32, prio uint16) error {
@@ -132,32 +402,43 @@ func AddTCFilterWithDstCidr(ifName string, parent uint32, dstCidr string, classI
 	}
 	defer tcnlInNs.Close()
 
-	ipAddr, cidr, err := net.ParseCIDR(dstCidr)
+	_, cidr, err := net.ParseCIDR(dstCidr)
 	if err != nil {
 		klog.Errorf("解析CIDR出错, err=%s", err)
 		return err
 	}
+	filterObj, err := createDstCIDRFilterObject(uint32(ifByName.Index), parent, cidr, classId, prio)
+	if err != nil {
+		klog.Errorf("[AddTCFilterWithDstCidr]-构造过滤器失败, err=%s", err)
+		return err
+	}
+	err = tcnlInNs.Filter().Add(filterObj)
+	return err
+}
+
+// createDstCIDRFilterObject 构造按照目的网段将流量送入classId的u32过滤器
+func createDstCIDRFilterObject(ifIndex uint32, parent uint32, cidr *net.IPNet, classId uint32, prio uint16) (*tc.Object, error) {
 	// 将这个ip转化为uint32
-	dstIP := ipAddr.To4()
+	dstIP := cidr.IP.To4()
 	if dstIP == nil {
-		klog.Errorf("无法将%s转化为IPv4", ipAddr)
-		return err
+		return nil, fmt.Errorf("无法将%s转化为IPv4", cidr.IP)
 	}
 	dstIPUint32 := uint32(dstIP[3])<<24 | uint32(dstIP[2])<<16 | uint32(dstIP[1])<<8 | uint32(dstIP[0])
 	// 获取Mask掩码表示
 	mask := cidr.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
 	// 将mask位数转化为, 例如 24 -> 0xffffff00
 	maskUint32 := uint32(mask[3])<<24 | uint32(mask[2])<<16 | uint32(mask[1])<<8 | uint32(mask[0])
 
 	tcU32Keys := make([]tc.U32Key, 0)
 	tcU32Keys = append(tcU32Keys, tc.U32Key{
 		Mask: maskUint32,
-		Val:  dstIPUint32,
+		Val:  dstIPUint32 & maskUint32,
 		Off:  16, // 匹配ip字段
 	})
-	filterObj := createFilterObject(uint32(ifByName.Index), core.BuildHandle(1, 0), core.BuildHandle(1, 1), prio, ProtocolIP, tcU32Keys...)
-	err = tcnlInNs.Filter().Add(filterObj)
-	return err
+	return createFilterObject(ifIndex, parent, classId, prio, ProtocolIP, tcU32Keys...), nil
 }
 
 func createFilterObject(ifIndex uint32, parent uint32, flowid uint32, prio uint16, protocol Protocol, keys ...tc.U32Key) *tc.Object {
@@ -209,7 +490,36 @@ func createHTBObject(ifIndex uint32, handle uint32, parent uint32, rate *uint64,
 	}
 }
 
-func createClassObject(ifIndex uint32, handle uint32, parent uint32, rate uint32, burst uint32) *tc.Object {
+// createClassObject 构造htb class，ceil为rate+burst。速率超过32位时同时设置Rate64/Ceil64，
+// 此时RateSpec中的32位速率设置为最大值，内核会以Rate64/Ceil64为准
+func createClassObject(ifIndex uint32, handle uint32, parent uint32, rate uint64, burst uint64) *tc.Object {
+	ceil := rate + burst
+	htb := &tc.Htb{
+		Parms: &tc.HtbOpt{
+			Rate: tc.RateSpec{
+				CellLog:   0x3,
+				Linklayer: 0x1,
+				Overhead:  0x0,
+				CellAlign: 0xffff,
+				Mpu:       0x0,
+				Rate:      clampRate(rate),
+			},
+			Ceil: tc.RateSpec{
+				CellLog:   0x3,
+				Linklayer: 0x1,
+				Overhead:  0x0,
+				CellAlign: 0xffff,
+				Mpu:       0x0,
+				Rate:      clampRate(ceil),
+			},
+		},
+	}
+	if rate > math.MaxUint32 {
+		htb.Rate64 = &rate
+	}
+	if ceil > math.MaxUint32 {
+		htb.Ceil64 = &ceil
+	}
 	return &tc.Object{
 		Msg: tc.Msg{
 			Family:  unix.AF_UNSPEC,
@@ -219,30 +529,18 @@ func createClassObject(ifIndex uint32, handle uint32, parent uint32, rate uint32
 		},
 		Attribute: tc.Attribute{
 			Kind: "htb",
-			Htb: &tc.Htb{
-				Parms: &tc.HtbOpt{
-					Rate: tc.RateSpec{
-						CellLog:   0x3,
-						Linklayer: 0x1,
-						Overhead:  0x0,
-						CellAlign: 0xffff,
-						Mpu:       0x0,
-						Rate:      rate,
-					},
-					Ceil: tc.RateSpec{
-						CellLog:   0x3,
-						Linklayer: 0x1,
-						Overhead:  0x0,
-						CellAlign: 0xffff,
-						Mpu:       0x0,
-						Rate:      rate + burst,
-					},
-				},
-			},
+			Htb:  htb,
 		},
 	}
 }
 
+func clampRate(rate uint64) uint32 {
+	if rate > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(rate)
+}
+
 func GetFilter(ifName string) ([]tc.Object, error) {
 	ifByName, err := net.InterfaceByName(ifName)
 	if err != nil {
@@ -280,39 +578,3 @@ func createTcnl() (*tc.Tc, error) {
 	}
 	return tcnl, nil
 }
-
-// validateBandwithFormat 使用正则表达式验证带宽格式。支持的单位有k, K, m, M, kbps, mbps, Kbps, Mbps
-func validateBandwithFormat(bandwidth string) (uint32, error) {
-
-	checkReStr := `^[1-9][0-9]*(k|K|m|M|kbps|mbps|Kbps|Mbps)?$`
-	checkRe, err := regexp.Compile(checkReStr)
-	if err != nil {
-		return 0, errors.New("正则表达式编译失败")
-	}
-	if matchresult := checkRe.MatchString(bandwidth); !matchresult {
-		return 0, errors.New("带宽格式不正确")
-	}
-	// 提取数字
-	numReStr := `^[1-9][0-9]*`
-	numRe, _ := regexp.Compile(numReStr)
-
-	numStr := numRe.FindString(bandwidth)
-	rateNum, err := strconv.ParseUint(numStr, 10, 32)
-
-	if err != nil {
-		return 0, errors.New("解析带宽数字失败")
-	}
-
-	// 提取单位
-	unitReStr := `(k|K|m|M|kbps|mbps|Kbps|Mbps)?$`
-	unitRe, _ := regexp.Compile(unitReStr)
-	unitStr := unitRe.FindString(bandwidth)
-	switch unitStr {
-	case "k", "K", "kbps", "Kbps":
-		rateNum = rateNum * 1000
-	case "m", "M", "mbps", "Mbps":
-		rateNum = rateNum * 1000 * 1000
-	}
-
-	return uint32(rateNum), nil
-}
@@ -0,0 +1,207 @@
+package tctools
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTcAnnotations(t *testing.T) {
+	tcArgs, err := ParseTcAnnotations(nil)
+	require.NoError(t, err)
+	require.Nil(t, tcArgs)
+
+	tcArgs, err = ParseTcAnnotations(map[string]string{
+		EgressRateAnnotation:  "80m",
+		IngressRateAnnotation: "4000k",
+	})
+	require.NoError(t, err)
+	// ciccni/*之前的格式仍然以byte/s为单位
+	require.Equal(t, &TCArgs{Rate: 80000000, Burst: 8000000, Scope: EgressScopeAll, IngressRate: 4000000, IngressBurst: 400000}, tcArgs)
+
+	// egress-burst覆盖默认的rate/10
+	tcArgs, err = ParseTcAnnotations(map[string]string{EgressRateAnnotation: "10G", EgressBurstAnnotation: "1MB"})
+	require.NoError(t, err)
+	require.Equal(t, &TCArgs{Rate: 1250000000, Burst: 1000000, Scope: EgressScopeAll}, tcArgs)
+
+	// 只配置入方向限速时不应配置出方向
+	tcArgs, err = ParseTcAnnotations(map[string]string{IngressRateAnnotation: "2MB"})
+	require.NoError(t, err)
+	require.Equal(t, &TCArgs{Scope: EgressScopeAll, IngressRate: 2000000, IngressBurst: 200000}, tcArgs)
+
+	tcArgs, err = ParseTcAnnotations(map[string]string{EgressRateAnnotation: "1m", EgressScopeAnnotation: "cluster"})
+	require.NoError(t, err)
+	require.Equal(t, EgressScopeCluster, tcArgs.Scope)
+
+	// 兼容上游bandwidth插件的annotation
+	tcArgs, err = ParseTcAnnotations(map[string]string{
+		KubernetesEgressBandwidthAnnotation:  "10M",
+		KubernetesIngressBandwidthAnnotation: "1G",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &TCArgs{Rate: 1250000, Burst: 125000, Scope: EgressScopeAll, IngressRate: 125000000, IngressBurst: 12500000}, tcArgs)
+
+	// 同一方向上ciccni/*优先于kubernetes.io/*
+	tcArgs, err = ParseTcAnnotations(map[string]string{
+		EgressRateAnnotation:                 "20M",
+		KubernetesEgressBandwidthAnnotation:  "10M",
+		KubernetesIngressBandwidthAnnotation: "1G",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20000000), tcArgs.Rate)
+	require.Equal(t, uint64(125000000), tcArgs.IngressRate)
+
+	_, err = ParseTcAnnotations(map[string]string{IngressRateAnnotation: "fast"})
+	require.Error(t, err)
+	_, err = ParseTcAnnotations(map[string]string{EgressRateAnnotation: "10M", EgressBurstAnnotation: "-1"})
+	require.Error(t, err)
+	_, err = ParseTcAnnotations(map[string]string{EgressScopeAnnotation: "internet"})
+	require.Error(t, err)
+}
+
+func TestParseTcAnnotationUnits(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		rate        uint64
+		burst       uint64
+		ingressRate uint64
+	}{
+		// ciccni/egress-rate、ciccni/egress-burst、ciccni/ingress-rate的单位相同
+		{"legacy egress", map[string]string{EgressRateAnnotation: "10m"}, 10000000, 1000000, 0},
+		{"legacy egress and burst", map[string]string{EgressRateAnnotation: "10m", EgressBurstAnnotation: "1m"}, 10000000, 1000000, 0},
+		{"legacy burst with explicit rate", map[string]string{EgressRateAnnotation: "80Mbit", EgressBurstAnnotation: "2000k"}, 10000000, 2000000, 0},
+		{"explicit burst", map[string]string{EgressRateAnnotation: "10m", EgressBurstAnnotation: "8Mbit"}, 10000000, 1000000, 0},
+		{"legacy ingress", map[string]string{IngressRateAnnotation: "10m"}, 0, 0, 10000000},
+		{"explicit ingress", map[string]string{IngressRateAnnotation: "10MB"}, 0, 0, 10000000},
+		// kubernetes.io/*按照bit/s计算
+		{"kubernetes egress", map[string]string{KubernetesEgressBandwidthAnnotation: "10M"}, 1250000, 125000, 0},
+		{"kubernetes ingress", map[string]string{KubernetesIngressBandwidthAnnotation: "10M"}, 0, 0, 1250000},
+		{"ciccni ingress preferred", map[string]string{IngressRateAnnotation: "10m", KubernetesIngressBandwidthAnnotation: "10M"}, 0, 0, 10000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcArgs, err := ParseTcAnnotations(tt.annotations)
+			require.NoError(t, err)
+			require.Equal(t, tt.rate, tcArgs.Rate)
+			require.Equal(t, tt.burst, tcArgs.Burst)
+			require.Equal(t, tt.ingressRate, tcArgs.IngressRate)
+		})
+	}
+}
+
+func TestBuildIngressHTBObjects(t *testing.T) {
+	tcArgs, err := ParseTcAnnotations(map[string]string{IngressRateAnnotation: "80Mbit"})
+	require.NoError(t, err)
+
+	qdisc, class := buildIngressHTBObjects(7, tcArgs.IngressRate, tcArgs.IngressBurst)
+
+	require.Equal(t, uint32(7), qdisc.Ifindex)
+	require.Equal(t, core.BuildHandle(0x1, 0x0), qdisc.Handle)
+	require.Equal(t, uint32(tc.HandleRoot), qdisc.Parent)
+	require.Equal(t, "htb", qdisc.Kind)
+	require.Equal(t, uint32(0x1), qdisc.Htb.Init.Defcls)
+
+	require.Equal(t, uint32(7), class.Ifindex)
+	require.Equal(t, core.BuildHandle(0x1, 0x1), class.Handle)
+	require.Equal(t, core.BuildHandle(0x1, 0x0), class.Parent)
+	require.Equal(t, "htb", class.Kind)
+	require.Equal(t, uint32(10000000), class.Htb.Parms.Rate.Rate)
+	require.Equal(t, uint32(11000000), class.Htb.Parms.Ceil.Rate)
+	require.Nil(t, class.Htb.Rate64)
+	require.Nil(t, class.Htb.Ceil64)
+}
+
+func TestCreateClassObject64(t *testing.T) {
+	// 40Gbit/s超出了32位能表示的byte/s
+	rate, burst := uint64(5000000000), uint64(500000000)
+	class := createClassObject(3, core.BuildHandle(0x1, 0x1), core.BuildHandle(0x1, 0x0), rate, burst)
+	require.Equal(t, uint32(math.MaxUint32), class.Htb.Parms.Rate.Rate)
+	require.Equal(t, uint32(math.MaxUint32), class.Htb.Parms.Ceil.Rate)
+	require.Equal(t, rate, *class.Htb.Rate64)
+	require.Equal(t, rate+burst, *class.Htb.Ceil64)
+
+	// ceil超出32位而rate没有超出时只设置Ceil64
+	class = createClassObject(3, core.BuildHandle(0x1, 0x1), core.BuildHandle(0x1, 0x0), math.MaxUint32, 1)
+	require.Equal(t, uint32(math.MaxUint32), class.Htb.Parms.Rate.Rate)
+	require.Nil(t, class.Htb.Rate64)
+	require.Equal(t, uint64(math.MaxUint32+1), *class.Htb.Ceil64)
+}
+
+func TestBuildEgressHTBObjects(t *testing.T) {
+	_, clusterCIDR, _ := net.ParseCIDR("10.10.0.0/16")
+	limitedClass, unlimitedClass := core.BuildHandle(0x1, 0x1), core.BuildHandle(0x1, 0x2)
+	tests := []struct {
+		scope        EgressScope
+		defaultClass uint32
+		filterClass  uint32
+	}{
+		{EgressScopeAll, 0x1, 0},
+		{EgressScopeCluster, 0x2, limitedClass},
+		{EgressScopeExternal, 0x1, unlimitedClass},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			tcArgs := &TCArgs{Rate: 1000000, Burst: 100000, Scope: tt.scope}
+			qdisc, classes, filters, err := buildEgressHTBObjects(3, tcArgs, clusterCIDR)
+			require.NoError(t, err)
+
+			require.Equal(t, core.BuildHandle(0x1, 0x0), qdisc.Handle)
+			require.Equal(t, tt.defaultClass, qdisc.Htb.Init.Defcls)
+
+			require.Len(t, classes, 2)
+			require.Equal(t, limitedClass, classes[0].Handle)
+			require.Equal(t, uint32(1000000), classes[0].Htb.Parms.Rate.Rate)
+			require.Equal(t, uint32(1100000), classes[0].Htb.Parms.Ceil.Rate)
+			require.Equal(t, unlimitedClass, classes[1].Handle)
+			require.Equal(t, unlimitedRate, *classes[1].Htb.Rate64)
+
+			if tt.filterClass == 0 {
+				require.Empty(t, filters)
+				return
+			}
+			require.Len(t, filters, 1)
+			require.Equal(t, core.BuildHandle(0x1, 0x0), filters[0].Parent)
+			require.Equal(t, tt.filterClass, *filters[0].U32.ClassID)
+			// 10.10.0.0/16按网络字节序存放
+			require.Equal(t, []tc.U32Key{{Mask: 0x0000ffff, Val: 0x00000a0a, Off: 16}}, filters[0].U32.Sel.Keys)
+		})
+	}
+
+	_, _, _, err := buildEgressHTBObjects(3, &TCArgs{Rate: 1000000, Scope: EgressScopeCluster}, nil)
+	require.Error(t, err)
+}
+
+func TestEgressHTBUnchanged(t *testing.T) {
+	_, clusterCIDR, _ := net.ParseCIDR("10.10.0.0/16")
+	build := func(scope EgressScope, rate uint64) (*tc.Object, []tc.Object, *tc.Object, []*tc.Object) {
+		qdisc, _, filters, err := buildEgressHTBObjects(3, &TCArgs{Rate: rate, Scope: scope}, clusterCIDR)
+		require.NoError(t, err)
+		// 内核dump u32过滤器时还会返回没有selector的hash table节点
+		dumped := []tc.Object{{Attribute: tc.Attribute{Kind: "u32", U32: &tc.U32{}}}}
+		for _, filter := range filters {
+			dumped = append(dumped, *filter)
+		}
+		return qdisc, dumped, qdisc, filters
+	}
+
+	// 只有速率变化时可以原地替换class
+	root, dumped, _, _ := build(EgressScopeCluster, 1000000)
+	_, _, qdisc, filters := build(EgressScopeCluster, 2000000)
+	require.True(t, egressHTBUnchanged(root, dumped, qdisc, filters))
+
+	// scope变化时default class或者过滤器不同，需要重新创建
+	for _, scope := range []EgressScope{EgressScopeAll, EgressScopeExternal} {
+		_, _, qdisc, filters = build(scope, 1000000)
+		require.False(t, egressHTBUnchanged(root, dumped, qdisc, filters), scope)
+	}
+
+	// 升级前创建的root htb没有default class
+	legacyRoot := createHTBObject(3, core.BuildHandle(0x1, 0x0), tc.HandleRoot, nil, &tc.HtbGlob{Version: 3, Rate2Quantum: 10})
+	_, _, qdisc, filters = build(EgressScopeAll, 1000000)
+	require.False(t, egressHTBUnchanged(legacyRoot, nil, qdisc, filters))
+}
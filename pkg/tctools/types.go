@@ -1,6 +1,54 @@
 package tctools
 
+const (
+	// EgressRateAnnotation 限制pod发出的流量，在容器内的veth上配置。
+	// ciccni/*的带宽为了兼容，之前支持的格式（不带单位，或者k、m、kbps、mbps等）仍然以byte/s为单位，
+	// 例如10m表示10,000,000 byte/s；其它格式与kubernetes.io/egress-bandwidth相同，建议使用10Mbit、10MB等明确的单位
+	EgressRateAnnotation = "ciccni/egress-rate"
+	// EgressBurstAnnotation 出方向允许短时间超出egress-rate的带宽，默认为egress-rate的1/10。
+	// 单位与egress-rate相同，例如egress-rate为10m、egress-burst为1m时，速率为10MB/s，burst为1MB/s
+	EgressBurstAnnotation = "ciccni/egress-burst"
+	// EgressScopeAnnotation 出方向限速作用的流量范围，取值见EgressScope，默认为all
+	EgressScopeAnnotation = "ciccni/egress-scope"
+	// IngressRateAnnotation 限制进入pod的流量，在host端的veth上配置，单位与egress-rate相同
+	IngressRateAnnotation = "ciccni/ingress-rate"
+)
+
+// 上游bandwidth插件使用的annotation，同样以bit/s为单位。
+// 与ciccni/egress-rate、ciccni/ingress-rate同时存在时，以ciccni/*的配置为准
+const (
+	KubernetesEgressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+	KubernetesIngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+)
+
+// BandwidthAnnotations 所有影响限速配置的annotation，agent根据它们判断是否需要更新限速
+var BandwidthAnnotations = []string{
+	EgressRateAnnotation,
+	EgressBurstAnnotation,
+	EgressScopeAnnotation,
+	IngressRateAnnotation,
+	KubernetesEgressBandwidthAnnotation,
+	KubernetesIngressBandwidthAnnotation,
+}
+
+// EgressScope 出方向限速作用的流量范围，以集群的pod网段区分集群内外的流量
+type EgressScope string
+
+const (
+	// EgressScopeAll 限制pod发出的所有流量
+	EgressScopeAll EgressScope = "all"
+	// EgressScopeCluster 只限制目的地址在集群pod网段内的流量
+	EgressScopeCluster EgressScope = "cluster"
+	// EgressScopeExternal 只限制目的地址在集群pod网段外的流量，包括访问service以及集群外部的流量
+	EgressScopeExternal EgressScope = "external"
+)
+
 type TCArgs struct {
-	Rate  uint32
-	Burst uint32
+	// Rate、Burst等速率的单位均为byte/s，ceil为Rate+Burst
+	Rate  uint64
+	Burst uint64
+	Scope EgressScope
+
+	IngressRate  uint64
+	IngressBurst uint64
 }